@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/jobs"
+	"rolflewis.com/spotify-status-sync/src/logging"
+	"rolflewis.com/spotify-status-sync/src/routes"
+	"rolflewis.com/spotify-status-sync/src/spotify"
+	"rolflewis.com/spotify-status-sync/src/tracing"
+)
+
+// Every command the binary runs, by name. Each gets the arguments after its name.
+var commands = map[string]func(args []string) error{
+	"serve":            serve,
+	"migrate":          migrateCommand,
+	"reencrypt-tokens": reencryptTokensCommand,
+	"sync-once":        syncOnceCommand,
+	"refresh-tokens":   refreshTokensCommand,
+	"list-users":       listUsersCommand,
+	"purge-user":       purgeUserCommand,
+	"purge-team":       purgeTeamCommand,
+	"export-user":      exportUserCommand,
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: spotify-status-sync [command] [flags]
+
+Commands:
+  serve                        run the web app, sync loops and job workers (the default)
+  migrate [-dry-run] [-down N] apply pending schema migrations, or undo those newer than version N
+  reencrypt-tokens             rewrite every stored token under the first key in TOKEN_ENCRYPTION_KEYS
+  sync-once [-user ID]         sync every connected user, or just one, and send the resulting status writes
+  refresh-tokens [-user ID]    refresh Spotify tokens expiring soon, or one user's token whenever it expires
+  list-users [-team ID]        list users, optionally only those in a team
+  purge-user ID                clear the status we set for a user and delete everything stored for them
+  purge-team ID                remove a team and everyone in it, like an uninstall
+  export-user ID               print everything stored for a user as JSON, with tokens redacted
+
+Every command reads the same configuration as serve.`)
+}
+
+// Sets up a one-off command and runs it in a span of its own. Unlike serve it doesn't migrate the database, so it refuses
+// to run against a schema this build doesn't match.
+func runCommand(name string, run func(ctx context.Context) error) error {
+	shutdownTracing := setup()
+	defer shutdownTracing(context.Background())
+	appDatabase := useDatabase()
+	defer appDatabase.DisconnectDatabase()
+
+	ctx, span := tracing.Start(context.Background(), "command "+name)
+	ctx = tracing.WithTraceID(logging.WithLogger(ctx, slog.Default().With("command", name)))
+	applied, known, versionError := appDatabase.SchemaVersion(ctx)
+	if versionError == nil && applied != known {
+		versionError = errors.New("Database schema is at version " + strconv.Itoa(applied) + " but this build expects " +
+			strconv.Itoa(known) + ", run migrate first.")
+	}
+	runError := versionError
+	if runError == nil {
+		runError = run(ctx)
+	}
+	tracing.End(span, runError)
+	return runError
+}
+
+// Reads a command's single id argument
+func idArgument(flags *flag.FlagSet, what string) (string, error) {
+	if flags.NArg() != 1 || flags.Arg(0) == "" {
+		return "", errors.New("Expected the " + what + " id as the only argument.")
+	}
+	return flags.Arg(0), nil
+}
+
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "log the migrations that would run without running them")
+	down := flags.Int("down", -1, "undo migrations newer than this version instead of applying pending ones")
+	flags.Parse(args)
+
+	shutdownTracing := setup()
+	defer shutdownTracing(context.Background())
+	appDatabase := useDatabase()
+	defer appDatabase.DisconnectDatabase()
+	if *down >= 0 {
+		return appDatabase.MigrateDown(*down, *dryRun)
+	}
+	return appDatabase.MigrateUp(*dryRun)
+}
+
+// Run after putting a new key at the front of TOKEN_ENCRYPTION_KEYS. Once it finishes, the keys after the first can be removed.
+func reencryptTokensCommand(args []string) error {
+	flags := flag.NewFlagSet("reencrypt-tokens", flag.ExitOnError)
+	flags.Parse(args)
+
+	shutdownTracing := setup()
+	defer shutdownTracing(context.Background())
+	appDatabase := useDatabase()
+	defer appDatabase.DisconnectDatabase()
+	rewritten, reencryptError := appDatabase.ReencryptTokens(false)
+	fmt.Println("Re-encrypted", rewritten, "tokens.")
+	return reencryptError
+}
+
+func syncOnceCommand(args []string) error {
+	flags := flag.NewFlagSet("sync-once", flag.ExitOnError)
+	user := flags.String("user", "", "only sync this slack user")
+	flags.Parse(args)
+
+	return runCommand("sync-once", func(ctx context.Context) error {
+		synced, failed, syncError := statusSyncHelper(ctx, *user)
+		if syncError != nil {
+			return syncError
+		}
+		if *user != "" && synced == 0 {
+			return errors.New("User " + *user + " doesn't have both Slack and Spotify connected.")
+		}
+		// There are no workers here, so send the writes the sync queued now. With a user, only their status is sent.
+		var ran int
+		var drainError error
+		if *user != "" {
+			ran, drainError = jobs.DrainStatus(ctx, *user, globalClient)
+		} else {
+			fmt.Fprintln(os.Stderr, "Warning: every job that is due is run, not only the status writes this sync queued.")
+			ran, drainError = jobs.Drain(ctx, globalClient)
+		}
+		if drainError != nil {
+			return drainError
+		}
+		fmt.Println("Synced", synced, "users,", failed, "of which failed, and ran", ran, "queued jobs.")
+		if *user == "" {
+			return nil
+		}
+		// Show what was saved for the user
+		users, usersError := store.ListUsers(ctx)
+		if usersError != nil {
+			return usersError
+		}
+		for _, summary := range users {
+			if summary.ID == *user {
+				fmt.Println("Sync:", describeResult(summary.LastSync()))
+				fmt.Println("Status write:", describeResult(summary.LastWrite()))
+			}
+		}
+		return nil
+	})
+}
+
+func refreshTokensCommand(args []string) error {
+	flags := flag.NewFlagSet("refresh-tokens", flag.ExitOnError)
+	user := flags.String("user", "", "refresh this slack user's spotify token, whenever it expires")
+	flags.Parse(args)
+
+	return runCommand("refresh-tokens", func(ctx context.Context) error {
+		if *user != "" {
+			if refreshError := spotify.RefreshTokenForUser(ctx, *user, globalClient); refreshError != nil {
+				return refreshError
+			}
+			fmt.Println("Refreshed the Spotify token for", *user+".")
+			return nil
+		}
+		refreshed, refreshError := spotify.RefreshExpiringTokens(ctx, globalClient)
+		fmt.Println("Refreshed", refreshed, "Spotify tokens.")
+		return refreshError
+	})
+}
+
+func listUsersCommand(args []string) error {
+	flags := flag.NewFlagSet("list-users", flag.ExitOnError)
+	team := flags.String("team", "", "only list users in this team")
+	flags.Parse(args)
+
+	return runCommand("list-users", func(ctx context.Context) error {
+		users, usersError := store.ListUsers(ctx)
+		if usersError != nil {
+			return usersError
+		}
+		table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "USER\tTEAM\tSLACK\tSPOTIFY\tTOKEN EXPIRES\tPAUSED\tSTATUS")
+		for _, user := range users {
+			if *team != "" && user.Team != *team {
+				continue
+			}
+			slackState := "no"
+			if user.SlackConnected {
+				slackState = "yes"
+			}
+			spotifyID, expires := "-", "-"
+			if user.SpotifyID != "" {
+				spotifyID = user.SpotifyID
+			}
+			if user.SpotifyExpiresAt.Valid {
+				expires = user.SpotifyExpiresAt.Time.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%t\t%s\n", user.ID, user.Team, slackState, spotifyID, expires, user.ManualOverride, user.Status)
+		}
+		return table.Flush()
+	})
+}
+
+func purgeUserCommand(args []string) error {
+	flags := flag.NewFlagSet("purge-user", flag.ExitOnError)
+	flags.Parse(args)
+	user, argumentError := idArgument(flags, "slack user")
+	if argumentError != nil {
+		return argumentError
+	}
+
+	return runCommand("purge-user", func(ctx context.Context) error {
+		if purgeError := routes.PurgeUser(ctx, user, globalClient); purgeError != nil {
+			return purgeError
+		}
+		fmt.Println("Deleted everything stored for", user+".")
+		return store.AddAuditRecord(ctx, "", user, "cli_purge", "from the command line")
+	})
+}
+
+func purgeTeamCommand(args []string) error {
+	flags := flag.NewFlagSet("purge-team", flag.ExitOnError)
+	flags.Parse(args)
+	team, argumentError := idArgument(flags, "slack team")
+	if argumentError != nil {
+		return argumentError
+	}
+
+	return runCommand("purge-team", func(ctx context.Context) error {
+		// Deleting the team audits it
+		if removeError := routes.RemoveTeam(ctx, team, "purged from the command line", globalClient); removeError != nil {
+			return removeError
+		}
+		fmt.Println("Deleted team", team+".")
+		return nil
+	})
+}
+
+func exportUserCommand(args []string) error {
+	flags := flag.NewFlagSet("export-user", flag.ExitOnError)
+	flags.Parse(args)
+	user, argumentError := idArgument(flags, "slack user")
+	if argumentError != nil {
+		return argumentError
+	}
+
+	return runCommand("export-user", func(ctx context.Context) error {
+		export, exportError := store.ExportUser(ctx, user)
+		if exportError != nil {
+			return exportError
+		}
+		if export.SlackAccount == nil {
+			return errors.New("Nothing is stored for user " + user + ".")
+		}
+		exportBytes, jsonError := json.MarshalIndent(export, "", "  ")
+		if jsonError != nil {
+			return jsonError
+		}
+		// Audit it first, so nothing is printed without a record of it
+		if auditError := store.AddAuditRecord(ctx, "", user, "data_exported", "from the command line"); auditError != nil {
+			return auditError
+		}
+		fmt.Println(string(exportBytes))
+		return nil
+	})
+}
+
+// Describes how a sync or status write went, for printing
+func describeResult(result database.LastResult) string {
+	if result.Outcome == "" {
+		return "nothing to do"
+	}
+	if result.Error != "" {
+		return result.Outcome + ": " + result.Error
+	}
+	return result.Outcome
+}
@@ -0,0 +1,87 @@
+// Runs a fake Spotify Web API for developing offline. Point the app at it by setting SPOTIFY_AUTH_URL and SPOTIFY_API_URL
+// to the urls it prints. Connecting Spotify from the App Home then signs in as the -user without asking.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"rolflewis.com/spotify-status-sync/src/spotify/spotifytest"
+)
+
+// A step as written in the timeline file, with its start as a duration string like "90s"
+type fileStep struct {
+	At     string            `json:"at"`
+	Item   *spotifytest.Item `json:"item"`
+	Paused bool              `json:"paused"`
+	Status int               `json:"status"`
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	address := flag.String("addr", ":8888", "address to listen on")
+	user := flag.String("user", "fake-spotify-user", "the spotify user id /authorize signs in as")
+	timelineFile := flag.String("timeline", "", "JSON file of playback timelines, keyed by spotify user id")
+	clientID := flag.String("client-id", "", "only accept this client id, if set")
+	clientSecret := flag.String("client-secret", "", "only accept this client secret from confidential clients, if set")
+	tokenLifetime := flag.Duration("token-lifetime", time.Hour, "how long access tokens last")
+	flag.Parse()
+
+	server, serverError := spotifytest.NewServerAt(*address)
+	if serverError != nil {
+		log.Fatal("Listen Error:", serverError)
+	}
+	defer server.Close()
+	server.ClientID = *clientID
+	server.ClientSecret = *clientSecret
+	server.TokenLifetime = *tokenLifetime
+	server.AuthorizeAs = *user
+
+	// Without a timeline file, the user is always playing the same song
+	server.SetTimeline(*user, spotifytest.Step{Item: &spotifytest.Item{ID: "fake-track", Name: "Fake Song", Artists: []string{"Fake Artist"}}})
+	if *timelineFile != "" {
+		loadError := loadTimelines(server, *timelineFile)
+		if loadError != nil {
+			log.Fatal("Timeline Error:", loadError)
+		}
+	}
+
+	log.Println("SPOTIFY_AUTH_URL=" + server.AuthURL)
+	log.Println("SPOTIFY_API_URL=" + server.APIURL)
+
+	// Run until interrupted
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+}
+
+func loadTimelines(server *spotifytest.Server, path string) error {
+	fileBytes, readError := ioutil.ReadFile(path)
+	if readError != nil {
+		return readError
+	}
+	var timelines map[string][]fileStep
+	if jsonError := json.Unmarshal(fileBytes, &timelines); jsonError != nil {
+		return jsonError
+	}
+	for user, fileSteps := range timelines {
+		var steps []spotifytest.Step
+		for _, step := range fileSteps {
+			var at time.Duration
+			if step.At != "" {
+				var parseError error
+				if at, parseError = time.ParseDuration(step.At); parseError != nil {
+					return parseError
+				}
+			}
+			steps = append(steps, spotifytest.Step{At: at, Item: step.Item, Paused: step.Paused, Status: step.Status})
+		}
+		server.SetTimeline(user, steps...)
+	}
+	return nil
+}
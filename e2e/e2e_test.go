@@ -0,0 +1,559 @@
+// Package e2e runs the whole app against the Slack and Spotify emulators and walks a user through install, connecting
+// Spotify, having their status synced, an admin resyncing them, the operational commands, exporting their data, and
+// disconnecting. Nothing leaves the machine, so it runs with the rest of the tests. It builds the app, which takes a
+// while, so it is skipped with -short:
+//
+//	go test -short ./...
+//
+// Set E2E_KEEP to keep the app's log and database afterwards.
+package e2e
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"rolflewis.com/spotify-status-sync/src/slack/slacktest"
+	"rolflewis.com/spotify-status-sync/src/spotify/spotifytest"
+	"rolflewis.com/spotify-status-sync/src/tracing/tracingtest"
+)
+
+const (
+	team = "T0000E2E"
+	user = "U0000E2E"
+	// Another member of the team, who isn't an admin
+	bystander = "U0000BYS"
+)
+
+// How long to wait for something the app does in the background, such as a job or a sync tick
+const patience = 30 * time.Second
+
+// Where the app is built and run from - the repository root, since it loads its pages from there
+const appDir = ".."
+
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the app and runs it against the emulators")
+	}
+	workDir := t.TempDir()
+	if os.Getenv("E2E_KEEP") != "" {
+		var dirError error
+		workDir, dirError = ioutil.TempDir("", "spotify-status-sync-e2e")
+		if dirError != nil {
+			t.Fatal(dirError)
+		}
+		t.Log("App log and database kept in", workDir)
+	}
+	// Show what the app logged if anything went wrong
+	t.Cleanup(func() {
+		if t.Failed() {
+			appLog, _ := ioutil.ReadFile(filepath.Join(workDir, "app.log"))
+			t.Log("App log:\n" + string(appLog))
+		}
+	})
+
+	// Stand up the emulators
+	slackServer := slacktest.NewServer()
+	defer slackServer.Close()
+	spotifyServer := spotifytest.NewServer()
+	defer spotifyServer.Close()
+	collector := tracingtest.NewCollector()
+	defer collector.Close()
+
+	slackServer.ClientID = "e2e-slack-client"
+	slackServer.ClientSecret = "e2e-slack-secret"
+	slackServer.SigningKey = "e2e-signing-key"
+	slackServer.InstallAs = user
+	slackServer.AddUser(team, user)
+	slackServer.AddUser(team, bystander)
+	spotifyServer.ClientID = "e2e-spotify-client"
+	spotifyServer.AuthorizeAs = "e2e-spotify-user"
+	spotifyServer.SetTimeline("e2e-spotify-user", spotifytest.Step{Item: &spotifytest.Item{ID: "e2e-track", Name: "Test Song", Artists: []string{"Test Artist"}}})
+
+	// Build and start the app, pointed at the emulators
+	port, portError := freePort()
+	if portError != nil {
+		t.Fatal("Could not find a free port:", portError)
+	}
+	appURL := "http://127.0.0.1:" + port + "/"
+	slackServer.AppURL = appURL
+	env := []string{
+		"PORT=" + port,
+		"APP_URL=" + appURL,
+		"DATABASE_URL=sqlite://" + filepath.Join(workDir, "e2e.db"),
+		"SLACK_TRANSPORT=http",
+		"SLACK_CLIENT_ID=" + slackServer.ClientID,
+		"SLACK_CLIENT_SECRET=" + slackServer.ClientSecret,
+		"SLACK_SIGNING_KEY=" + slackServer.SigningKey,
+		"SLACK_API_URL=" + slackServer.APIURL,
+		"SLACK_AUTH_URL=" + slackServer.AuthURL,
+		"SLACK_OPENID_URL=" + slackServer.OpenIDURL,
+		"ADMIN_USER_IDS=" + team + ":" + user,
+		"SPOTIFY_CLIENT_ID=" + spotifyServer.ClientID,
+		"SPOTIFY_API_URL=" + spotifyServer.APIURL,
+		"SPOTIFY_AUTH_URL=" + spotifyServer.AuthURL,
+		"OAUTH_STATE_SECRET=e2e-state-secret",
+		"LOG_HASH_KEY=e2e-log-hash-key",
+		"METRICS_TOKEN=e2e-metrics-token",
+		"TRACE_EXPORTER=otlp",
+		"OTLP_ENDPOINT=" + collector.URL,
+	}
+	app, startError := startApp(workDir, env)
+	if startError != nil {
+		t.Fatal("Could not start the app:", startError)
+	}
+	defer app.Process.Kill()
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"app starts", func() error {
+			return waitFor("the app to answer", func() bool {
+				response, getError := http.Get(appURL)
+				if getError != nil {
+					return false
+				}
+				response.Body.Close()
+				return response.StatusCode == http.StatusOK
+			})
+		}},
+		{"health probes answer", func() error {
+			if status, _, getError := get(appURL+"healthz", ""); getError != nil || status != http.StatusOK {
+				return errors.New("Liveness probe failed")
+			}
+			status, body, getError := get(appURL+"readyz", "")
+			if getError != nil {
+				return getError
+			}
+			if status != http.StatusOK || !strings.Contains(body, `"status":"ok"`) {
+				return errors.New("Readiness probe failed: " + body)
+			}
+			return nil
+		}},
+		{"install from the website", func() error {
+			if followError := follow(appURL + "slack/install"); followError != nil {
+				return followError
+			}
+			return waitFor("the App Home to offer Spotify", func() bool {
+				return homeButtonURL(slackServer.HomeView(user), "spotify_login_button") != ""
+			})
+		}},
+		{"connect spotify", func() error {
+			if followError := follow(homeButtonURL(slackServer.HomeView(user), "spotify_login_button")); followError != nil {
+				return followError
+			}
+			return waitFor("the App Home to offer disconnecting", func() bool {
+				return strings.Contains(slackServer.HomeView(user), "spotify_disconnect_button")
+			})
+		}},
+		{"status is synced", func() error {
+			return waitFor("the status to be set", func() bool {
+				profile := slackServer.Profile(user)
+				return profile.StatusText == `Listening to "Test Song" by Test Artist on Spotify` && profile.StatusEmoji == ":musical_note:"
+			})
+		}},
+		{"status follows playback", func() error {
+			spotifyServer.SetTimeline("e2e-spotify-user", spotifytest.Step{})
+			return waitFor("the status to be cleared", func() bool {
+				return slackServer.Profile(user).StatusText == ""
+			})
+		}},
+		{"metrics are served", func() error {
+			if status, _, getError := get(appURL+"metrics", ""); getError != nil || status != http.StatusUnauthorized {
+				return errors.New("Metrics were not refused without the token")
+			}
+			status, body, getError := get(appURL+"metrics", "e2e-metrics-token")
+			if getError != nil {
+				return getError
+			}
+			if status != http.StatusOK || !strings.Contains(body, `status_updates_total{reason="set",result="written"}`) ||
+				!strings.Contains(body, `connected_users{team="`+team+`"}`) {
+				return errors.New("Metrics are missing status writes or connected users:\n" + body)
+			}
+			return nil
+		}},
+		{"traces are exported", func() error {
+			// Spans are exported in batches every few seconds
+			return waitFor("route, sync, job, call and query spans", func() bool {
+				return len(collector.Named("GET /slack/callback")) > 0 &&
+					hasChain(collector, "sync.tick", "sync.user", "spotify me/player/currently-playing") &&
+					hasChain(collector, "job set_status", "slack users.profile.set") &&
+					hasChain(collector, "job set_status", "sql.conn.exec")
+			})
+		}},
+		{"admin dashboard", func() error {
+			// Play something, so there is a status to resync
+			spotifyServer.SetTimeline("e2e-spotify-user", spotifytest.Step{Item: &spotifytest.Item{ID: "e2e-track-2", Name: "Other Song", Artists: []string{"Test Artist"}}})
+			waitError := waitFor("the status to be set again", func() bool {
+				return strings.Contains(slackServer.Profile(user).StatusText, "Other Song")
+			})
+			if waitError != nil {
+				return waitError
+			}
+			// Only admins get in
+			if status, _, signInError := signInAsAdmin(newBrowser(), appURL, bystander); signInError != nil || status != http.StatusForbidden {
+				return errors.New("A non-admin was not refused: " + strconv.Itoa(status))
+			}
+			browser := newBrowser()
+			status, body, signInError := signInAsAdmin(browser, appURL, user)
+			if signInError != nil {
+				return signInError
+			}
+			if status != http.StatusOK || !strings.Contains(body, user) || !strings.Contains(body, "e2e-spotify-user") || !strings.Contains(body, "set <small") {
+				return errors.New("Dashboard is missing the user or their last status write:\n" + body)
+			}
+			csrf := csrfPattern.FindStringSubmatch(body)
+			if csrf == nil {
+				return errors.New("Dashboard has no CSRF token")
+			}
+			// Actions without the token are refused
+			response, postError := browser.PostForm(appURL+"admin/users/"+user+"/resync", url.Values{})
+			if postError != nil {
+				return postError
+			}
+			response.Body.Close()
+			if response.StatusCode != http.StatusForbidden {
+				return errors.New("Resync without a CSRF token was not refused: " + response.Status)
+			}
+			// A resync writes the last status again
+			before := len(slackServer.Calls())
+			response, postError = browser.PostForm(appURL+"admin/users/"+user+"/resync", url.Values{"csrf": {csrf[1]}})
+			if postError != nil {
+				return postError
+			}
+			resyncBody, _ := ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK || !strings.Contains(string(resyncBody), "Resync queued") {
+				return errors.New("Resync failed: " + response.Status + ": " + string(resyncBody))
+			}
+			return waitFor("the status to be written again", func() bool {
+				for _, call := range slackServer.Calls()[before:] {
+					if call.Method == "users.profile.set" && call.User == user {
+						return true
+					}
+				}
+				return false
+			})
+		}},
+		{"command line", func() error {
+			listing, listError := command(workDir, env, "list-users", "-team", team)
+			if listError != nil {
+				return listError
+			}
+			if !strings.Contains(listing, user) || !strings.Contains(listing, "e2e-spotify-user") || strings.Contains(listing, bystander) {
+				return errors.New("list-users printed:\n" + listing)
+			}
+			exported, exportError := command(workDir, env, "export-user", user)
+			if exportError != nil {
+				return exportError
+			}
+			var export struct {
+				SlackAccount struct {
+					SlackToken string `json:"slack_token"`
+				} `json:"slack_account"`
+				SpotifyAccount struct {
+					AccessToken string `json:"access_token"`
+				} `json:"spotify_account"`
+				AuditLog []struct{ Action string } `json:"audit_log"`
+			}
+			if jsonError := json.Unmarshal([]byte(exported), &export); jsonError != nil {
+				return errors.New("export-user printed something other than JSON: " + jsonError.Error())
+			}
+			if export.SlackAccount.SlackToken != "[redacted]" || export.SpotifyAccount.AccessToken != "[redacted]" || strings.Contains(exported, "xoxp-") {
+				return errors.New("export-user didn't redact tokens:\n" + exported)
+			}
+			if len(export.AuditLog) == 0 || export.AuditLog[len(export.AuditLog)-1].Action != "admin_resync" {
+				return errors.New("export-user is missing the admin's resync:\n" + exported)
+			}
+			if _, unknownError := command(workDir, env, "export-user", "U-nobody"); unknownError == nil {
+				return errors.New("export-user succeeded for a user nothing is stored for")
+			}
+			synced, syncError := command(workDir, env, "sync-once", "-user", user)
+			if syncError != nil {
+				return syncError
+			}
+			if !strings.Contains(synced, "Synced 1 users") {
+				return errors.New("sync-once printed:\n" + synced)
+			}
+			refreshed, refreshError := command(workDir, env, "refresh-tokens", "-user", user)
+			if refreshError != nil {
+				return refreshError
+			}
+			if !strings.Contains(refreshed, "Refreshed the Spotify token") {
+				return errors.New("refresh-tokens printed:\n" + refreshed)
+			}
+			return nil
+		}},
+		{"export my data", func() error {
+			if !strings.Contains(slackServer.HomeView(user), `"data_export_button"`) {
+				return errors.New("App Home doesn't offer an export")
+			}
+			if sendError := expectOK(slackServer.PressHomeButton(user, "data_export_button")); sendError != nil {
+				return sendError
+			}
+			waitError := waitFor("the export to be sent as a direct message", func() bool {
+				return len(slackServer.Files(user)) > 0
+			})
+			if waitError != nil {
+				return waitError
+			}
+			file := slackServer.Files(user)[0]
+			var export struct {
+				SlackAccount struct {
+					ID         string `json:"id"`
+					SlackToken string `json:"slack_token"`
+				} `json:"slack_account"`
+				SpotifyAccount struct {
+					RefreshToken string `json:"refresh_token"`
+				} `json:"spotify_account"`
+			}
+			if jsonError := json.Unmarshal(file.Content, &export); jsonError != nil {
+				return errors.New("The export sent isn't JSON: " + jsonError.Error())
+			}
+			if export.SlackAccount.ID != user || export.SlackAccount.SlackToken != "[redacted]" ||
+				export.SpotifyAccount.RefreshToken != "[redacted]" || strings.Contains(string(file.Content), "xoxp-") {
+				return errors.New("The export sent is wrong or has tokens in it:\n" + string(file.Content))
+			}
+			// The request is audited when the button is pressed, and the export once slack has shared it
+			var exported string
+			waitError = waitFor("the export to be audited as sent", func() bool {
+				exported, _ = command(workDir, env, "export-user", user)
+				return strings.Contains(exported, `"detail": "sent as a direct message by job `)
+			})
+			if waitError != nil {
+				return waitError
+			}
+			if !strings.Contains(exported, `"action": "data_export_requested"`) {
+				return errors.New("The export request wasn't audited:\n" + exported)
+			}
+			return nil
+		}},
+		{"disconnect spotify", func() error {
+			if sendError := expectOK(slackServer.PressHomeButton(user, "spotify_disconnect_button")); sendError != nil {
+				return sendError
+			}
+			return waitFor("the status to be cleared and Spotify offered again", func() bool {
+				return slackServer.Profile(user).StatusText == "" && homeButtonURL(slackServer.HomeView(user), "spotify_login_button") != ""
+			})
+		}},
+		{"uninstall", func() error {
+			if sendError := expectOK(slackServer.Uninstall(team)); sendError != nil {
+				return sendError
+			}
+			// Nothing visible changes in slack, so check the app has forgotten the team by reopening the home
+			before := len(slackServer.Calls())
+			if sendError := expectOK(slackServer.OpenHome(user)); sendError != nil {
+				return sendError
+			}
+			time.Sleep(3 * time.Second)
+			for _, call := range slackServer.Calls()[before:] {
+				if call.Method == "views.publish" {
+					return errors.New("App Home was published after the app was uninstalled")
+				}
+			}
+			return nil
+		}},
+	}
+
+	// Each step builds on the last, so the run stops at the first to fail
+	for _, step := range steps {
+		passed := t.Run(step.name, func(t *testing.T) {
+			if stepError := step.run(); stepError != nil {
+				t.Fatal(stepError)
+			}
+		})
+		if !passed {
+			t.FailNow()
+		}
+	}
+	t.Log("End to end run passed,", len(slackServer.Calls()), "slack calls made.")
+}
+
+// Builds the app into the work dir and starts it with only the given environment, logging to app.log
+func startApp(workDir string, env []string) (*exec.Cmd, error) {
+	binary := filepath.Join(workDir, "app")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Dir = appDir
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if buildError := build.Run(); buildError != nil {
+		return nil, buildError
+	}
+	logFile, logError := os.Create(filepath.Join(workDir, "app.log"))
+	if logError != nil {
+		return nil, logError
+	}
+	app := exec.Command(binary)
+	app.Dir = appDir
+	app.Env = append(env, "PATH="+os.Getenv("PATH"), "GIN_MODE=release")
+	app.Stdout, app.Stderr = logFile, logFile
+	return app, app.Start()
+}
+
+// Runs one of the app's commands against the same configuration, returning what it printed
+func command(workDir string, env []string, args ...string) (string, error) {
+	run := exec.Command(filepath.Join(workDir, "app"), args...)
+	run.Env = append(env, "PATH="+os.Getenv("PATH"))
+	var stderr strings.Builder
+	run.Stderr = &stderr
+	output, runError := run.Output()
+	if runError != nil {
+		return "", errors.New(strings.Join(args, " ") + " failed: " + runError.Error() + "\n" + stderr.String())
+	}
+	return string(output), nil
+}
+
+// Makes a browser-style request, following redirects through the emulators and back to the app
+func follow(link string) error {
+	if link == "" {
+		return errors.New("No link to follow")
+	}
+	response, getError := http.Get(link)
+	if getError != nil {
+		return getError
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return errors.New("Got " + response.Status + ": " + string(body))
+	}
+	return nil
+}
+
+// A client that keeps cookies, like a browser
+func newBrowser() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
+// Signs in to the dashboard as the slack user and follows through to it. Returns the status and body it ends on.
+func signInAsAdmin(browser *http.Client, appURL string, as string) (int, string, error) {
+	// Stop at slack's authorize page, so the emulator can be told who is signing in
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, getError := noFollow.Get(appURL + "admin/login")
+	if getError != nil {
+		return 0, "", getError
+	}
+	response.Body.Close()
+	authorize, parseError := url.Parse(response.Header.Get("Location"))
+	if parseError != nil {
+		return 0, "", parseError
+	}
+	query := authorize.Query()
+	query.Set("user", as)
+	authorize.RawQuery = query.Encode()
+
+	response, getError = browser.Get(authorize.String())
+	if getError != nil {
+		return 0, "", getError
+	}
+	defer response.Body.Close()
+	body, readError := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(body), readError
+}
+
+var csrfPattern = regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`)
+
+// Gets the url, with the token as a bearer token if given. Returns the status and body.
+func get(link string, token string) (int, string, error) {
+	request, requestError := http.NewRequest(http.MethodGet, link, nil)
+	if requestError != nil {
+		return 0, "", requestError
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, responseError := http.DefaultClient.Do(request)
+	if responseError != nil {
+		return 0, "", responseError
+	}
+	defer response.Body.Close()
+	body, readError := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(body), readError
+}
+
+// Reports whether a span with the first name has a child with the second, which has a child with the third, and so on
+func hasChain(collector *tracingtest.Collector, names ...string) bool {
+	var walk func(parents []tracingtest.Span, names []string) bool
+	walk = func(parents []tracingtest.Span, names []string) bool {
+		for _, parent := range parents {
+			if len(names) == 0 {
+				return true
+			}
+			var matching []tracingtest.Span
+			for _, child := range collector.Children(parent) {
+				if child.Name == names[0] {
+					matching = append(matching, child)
+				}
+			}
+			if walk(matching, names[1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(collector.Named(names[0]), names[1:])
+}
+
+// Finds the url of a button in a published App Home
+func homeButtonURL(view string, actionID string) string {
+	var parsed struct {
+		Blocks []struct {
+			Accessory struct {
+				ActionID string `json:"action_id"`
+				URL      string `json:"url"`
+			} `json:"accessory"`
+		} `json:"blocks"`
+	}
+	if json.Unmarshal([]byte(view), &parsed) != nil {
+		return ""
+	}
+	for _, block := range parsed.Blocks {
+		if block.Accessory.ActionID == actionID {
+			return block.Accessory.URL
+		}
+	}
+	return ""
+}
+
+func expectOK(status int, sendError error) error {
+	if sendError != nil {
+		return sendError
+	}
+	if status != http.StatusOK {
+		return errors.New("App answered with status " + strconv.Itoa(status))
+	}
+	return nil
+}
+
+func waitFor(what string, done func() bool) error {
+	deadline := time.Now().Add(patience)
+	for time.Now().Before(deadline) {
+		if done() {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return errors.New("Timed out waiting for " + what)
+}
+
+func freePort() (string, error) {
+	listener, listenError := net.Listen("tcp", "127.0.0.1:0")
+	if listenError != nil {
+		return "", listenError
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), nil
+}
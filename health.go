@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/logging"
+)
+
+// How long each background loop can go without finishing cleanly before the app is reported as not ready
+const (
+	syncStallAfter  = 2 * time.Minute
+	sweepStallAfter = 45 * time.Minute
+)
+
+// When the loops last finished a run without error, as unix nanoseconds. Both start at startup, so a fresh process is ready.
+var lastSyncAt = time.Now().UnixNano()
+var lastSweepAt = time.Now().UnixNano()
+
+// Records that a sync tick finished without error
+func markSynced() {
+	atomic.StoreInt64(&lastSyncAt, time.Now().UnixNano())
+}
+
+// Records that a token sweep finished without error
+func markSwept() {
+	atomic.StoreInt64(&lastSweepAt, time.Now().UnixNano())
+}
+
+// How long it has been since a sync tick finished without error
+func syncLag() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&lastSyncAt)))
+}
+
+// How long it has been since a token sweep finished without error
+func sweepLag() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&lastSweepAt)))
+}
+
+// The result of one readiness check
+type healthCheck struct {
+	OK      bool    `json:"ok"`
+	Error   string  `json:"error,omitempty"`
+	Version int     `json:"version,omitempty"`
+	Latest  int     `json:"latest,omitempty"`
+	Seconds float64 `json:"seconds_since_success,omitempty"`
+	Paused  bool    `json:"paused,omitempty"`
+}
+
+// Answers as long as the process is running
+func livenessHandler(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Checks the database and the background loops. Answers 503 if the database can't be used or a loop has stalled. An open
+// circuit breaker is reported but doesn't fail the check, since every instance shares the same upstreams - loops paused by
+// one aren't counted as stalled.
+func readinessHandler(appDatabase database.Database) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		checks := make(map[string]healthCheck)
+
+		// The database answers, and has every migration this version needs
+		ctx, cancel := contextWithTimeout(context, 2*time.Second)
+		defer cancel()
+		// The endpoint is public, so the real errors only go to the log, tagged with the request id
+		logger := logging.FromContext(context.Request.Context())
+		if pingError := appDatabase.Ping(ctx); pingError != nil {
+			logger.Error("Readiness check failed", "check", "database", "error", pingError)
+			checks["database"] = healthCheck{Error: "database unavailable"}
+		} else {
+			checks["database"] = healthCheck{OK: true}
+		}
+		version, latest, versionError := appDatabase.SchemaVersion(ctx)
+		if versionError != nil {
+			logger.Error("Readiness check failed", "check", "schema", "error", versionError)
+			checks["schema"] = healthCheck{Error: "schema version unavailable"}
+		} else {
+			checks["schema"] = healthCheck{OK: version >= latest, Version: version, Latest: latest}
+		}
+
+		// The loops have finished recently, unless a breaker has paused them
+		spotifyOpen, slackOpen := upstreams.IsOpen("spotify"), upstreams.IsOpen("slack")
+		syncPaused := spotifyOpen || slackOpen
+		checks["sync"] = healthCheck{OK: syncPaused || syncLag() < syncStallAfter, Seconds: syncLag().Seconds(), Paused: syncPaused}
+		checks["token_sweep"] = healthCheck{OK: spotifyOpen || sweepLag() < sweepStallAfter, Seconds: sweepLag().Seconds(), Paused: spotifyOpen}
+
+		status, summary := http.StatusOK, "ok"
+		for _, check := range checks {
+			if !check.OK {
+				status, summary = http.StatusServiceUnavailable, "unavailable"
+			}
+		}
+		context.JSON(status, gin.H{
+			"status": summary,
+			"checks": checks,
+			"circuit_breakers": gin.H{
+				"spotify": breakerState(spotifyOpen),
+				"slack":   breakerState(slackOpen),
+			},
+		})
+	}
+}
+
+func breakerState(open bool) string {
+	if open {
+		return "open"
+	}
+	return "closed"
+}
+
+// The handlers' gin.Context parameter hides the context package, so the timeout is made here
+func contextWithTimeout(ginContext *gin.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ginContext.Request.Context(), timeout)
+}
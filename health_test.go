@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/logging"
+)
+
+// A database that can't be reached, with an error that mustn't be shown to callers
+type unreachableDatabase struct {
+	database.Database
+}
+
+func (unreachableDatabase) Ping(ctx context.Context) error {
+	return errors.New("dial tcp 10.0.0.5:5432: password authentication failed for user \"admin\"")
+}
+
+func (unreachableDatabase) SchemaVersion(ctx context.Context) (int, int, error) {
+	return 0, 0, errors.New("pq: relation \"schema_migrations\" does not exist")
+}
+
+func TestReadinessHidesDatabaseErrors(t *testing.T) {
+	newTestApp(t)
+	var logged bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(logging.Middleware())
+	router.GET("/readyz", readinessHandler(unreachableDatabase{}))
+	request := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	request.Header.Set("X-Request-ID", "ready-1")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	body := recorder.Body.String()
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness answered %d with a broken database", recorder.Code)
+	}
+	if strings.Contains(body, "10.0.0.5") || strings.Contains(body, "schema_migrations") ||
+		!strings.Contains(body, "database unavailable") {
+		t.Errorf("readiness body gives away the database errors: %s", body)
+	}
+	// The real errors are logged against the request instead
+	if !strings.Contains(logged.String(), "request_id=ready-1") || !strings.Contains(logged.String(), "password authentication failed") ||
+		!strings.Contains(logged.String(), "schema_migrations") {
+		t.Errorf("readiness didn't log the errors with the request id: %s", logged.String())
+	}
+}
@@ -1,35 +1,137 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"rolflewis.com/spotify-status-sync/src/config"
 	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/jobs"
+	"rolflewis.com/spotify-status-sync/src/logging"
+	"rolflewis.com/spotify-status-sync/src/metrics"
+	"rolflewis.com/spotify-status-sync/src/oauthstate"
 	"rolflewis.com/spotify-status-sync/src/routes"
 	"rolflewis.com/spotify-status-sync/src/slack"
+	"rolflewis.com/spotify-status-sync/src/socketmode"
 	"rolflewis.com/spotify-status-sync/src/spotify"
+	"rolflewis.com/spotify-status-sync/src/tracing"
+	"rolflewis.com/spotify-status-sync/src/upstream"
 )
 
 var globalClient *http.Client
+var upstreams *upstream.Transport
+var store database.Store
+var settings *config.Config
 
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	port := os.Getenv("PORT")
+	// With no command the app serves, as it always has
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	run, known := commands[name]
+	if !known {
+		fmt.Fprintln(os.Stderr, "Unknown command:", name)
+		usage()
+		os.Exit(2)
+	}
+	if runError := run(args); runError != nil {
+		logging.Fatal("Command failed", "command", name, "error", runError)
+	}
+}
 
-	if port == "" {
-		log.Fatal("$PORT must be set")
+// Loads and checks the configuration and sets up logging, tracing and the outbound client. The returned function flushes
+// any spans still buffered.
+func setup() func(context.Context) error {
+	// Load and check the configuration - every problem is reported at once
+	appConfig, configError := config.Load()
+	if configError != nil {
+		logging.Fatal("Could not load configuration", "error", configError)
 	}
+	if validateError := appConfig.Validate(); validateError != nil {
+		var invalid *config.ValidationError
+		if errors.As(validateError, &invalid) {
+			logging.Fatal("Invalid configuration", "problems", invalid.Problems)
+		}
+		logging.Fatal("Invalid configuration", "error", validateError)
+	}
+	settings = appConfig
+	if setupError := logging.Setup(settings.LogLevel, settings.LogFormat); setupError != nil {
+		logging.Fatal("Could not set up logging", "error", setupError)
+	}
+	logging.UseHashKey(settings.LogHashKey)
+	shutdownTracing, tracingError := tracing.Setup(settings)
+	if tracingError != nil {
+		logging.Fatal("Could not set up tracing", "error", tracingError)
+	}
+	slack.UseConfig(settings)
+	spotify.UseConfig(settings)
+	oauthstate.UseSecret(settings.OAuthStateSecret)
+	useUpstreams()
+	return shutdownTracing
+}
 
-	// Create the global spotify client
-	globalClient = http.DefaultClient
+// Creates the global client - every outbound call goes through a per-upstream timeout, retry and breaker policy
+func useUpstreams() {
+	upstreams = upstream.New(
+		upstream.Policy{
+			Name:             "spotify",
+			Prefixes:         []string{settings.SpotifyAPIURL, settings.SpotifyAuthURL},
+			Timeout:          10 * time.Second,
+			MaxRetries:       2,
+			RetryBackoff:     250 * time.Millisecond,
+			FailureThreshold: 5,
+			OpenDuration:     30 * time.Second,
+		},
+		upstream.Policy{
+			Name:             "slack",
+			Prefixes:         []string{settings.SlackAPIURL},
+			Timeout:          10 * time.Second,
+			MaxRetries:       2,
+			RetryBackoff:     250 * time.Millisecond,
+			FailureThreshold: 5,
+			OpenDuration:     30 * time.Second,
+		},
+	)
+	globalClient = upstreams.Client()
+}
+
+// Connects to the database and hands it to everything that needs it
+func useDatabase() database.Database {
+	appDatabase := database.ConnectToDatabase(settings.DatabaseURL, settings.TokenEncryptionKeys)
+	store = appDatabase
+	slack.UseStore(store)
+	spotify.UseStore(store)
+	routes.UseStore(store)
+	jobs.UseStore(store)
+	oauthstate.UseStore(store)
+	return appDatabase
+}
+
+// Runs the web app along with the sync loops and job workers
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Parse(args)
+
+	// The app only ever stops by exiting, so there's no shutdown to flush the last spans on
+	setup()
 
 	// Create routes
 	router := gin.New()
-	router.Use(gin.Logger())
+	router.Use(logging.Middleware(), tracing.Middleware())
 	router.LoadHTMLGlob("pages/*.html")
 	router.Static("/static", "static")
 
@@ -39,13 +141,59 @@ func main() {
 
 	router.GET("/spotify/callback", spotifyCallbackClientInjector)
 	router.GET("/slack/callback", slackCallbackClientInjector)
+	router.GET("/slack/install", routes.SlackInstallFlow)
 
-	router.POST("/slack/events", eventsClientInjector)
-	router.POST("/slack/interactivity", interactionsClientInjector)
+	// Metrics are only served when there is a token to protect them with
+	if settings.MetricsToken != "" {
+		router.GET("/metrics", metrics.Handler(settings.MetricsToken))
+	} else {
+		slog.Warn("METRICS_TOKEN is not set, so /metrics is not served")
+	}
+
+	// The admin dashboard is only served when someone is allowed into it
+	if len(settings.Admins()) > 0 {
+		router.GET("/admin/login", routes.AdminSignIn)
+		router.GET("/admin/callback", adminCallbackClientInjector)
+		admin := router.Group("/admin", routes.AdminRequired(settings))
+		admin.GET("", adminDashboardConfigInjector)
+		admin.POST("/logout", adminSignOutConfigInjector)
+		admin.POST("/users/:user/:action", adminUserActionClientInjector)
+		admin.POST("/teams/:team/purge", adminPurgeTeamClientInjector)
+	} else {
+		slog.Warn("ADMIN_USER_IDS is not set, so /admin is not served")
+	}
+
+	// In socket mode these endpoints are not exposed at all
+	if settings.SlackTransport == "http" {
+		router.POST("/slack/events", eventsClientInjector)
+		router.POST("/slack/interactivity", interactionsClientInjector)
+	}
 
 	// Database setup
-	database.ConnectToDatabase()
-	database.ValidateSchema()
+	appDatabase := useDatabase()
+	if migrateError := appDatabase.MigrateUp(false); migrateError != nil {
+		logging.Fatal("Migration failed", "error", migrateError)
+	}
+	encrypted, encryptError := appDatabase.EncryptPlaintextTokens()
+	if encryptError != nil {
+		logging.Fatal("Token encryption failed", "error", encryptError)
+	}
+	if encrypted > 0 {
+		slog.Info("Encrypted plaintext tokens", "count", encrypted)
+	}
+	registerDatabaseMetrics(appDatabase)
+
+	// Health probes
+	router.GET("/healthz", livenessHandler)
+	router.GET("/readyz", readinessHandler(appDatabase))
+
+	// Start processing acknowledged slack events
+	routes.StartEventWorkers(4)
+	// Start working through queued slack writes
+	jobs.StartWorkers(4, globalClient)
+	if settings.SlackTransport == "socket" {
+		go slackSocketMode()
+	}
 
 	// Kick off the spotify token maintenance routine
 	go spotifyTokenMaintenance()
@@ -53,93 +201,259 @@ func main() {
 	go spotifyCurrentlyPlayingLoop()
 
 	// Stand up server
-	routerError := router.Run(":" + port)
-	if routerError != nil {
-		log.Fatal("Router Error:", routerError)
-	}
+	return router.Run(":" + settings.Port)
 }
 
-func statusSyncHelper() (int, error) {
-	// Get all users who have spotify connected
-	users, usersError := database.GetAllConnectedUsers()
-	if usersError != nil {
-		return 0, usersError
+// How many users are read from the database at a time during a sync
+const syncBatchSize = 200
+
+// Syncs every connected user, or only the given one. Returns how many users were synced and how many of those failed.
+// A user failing is logged and counted but doesn't stop the others - only reading the users, or running out of time, fails the run.
+func statusSyncHelper(ctx context.Context, only string) (int, int, error) {
+	// Status changes found this tick - queued in one statement at the end, even if the sync exits early
+	pending := make(map[string]string)
+	// How each user's sync went, for the admin dashboard - also saved at the end
+	var results []database.SyncResult
+	finish := func(synced int, failed int, syncError error) (int, int, error) {
+		// Still save what was found if the run timed out
+		saveError := store.EnqueueStatusJobs(context.WithoutCancel(ctx), pending)
+		if saveError != nil {
+			// Nothing was queued, so make the next poll find these changes again rather than skip them as unchanged
+			for user := range pending {
+				spotify.ForgetPlayback(user)
+			}
+		}
+		if recordError := store.RecordSyncResults(context.WithoutCancel(ctx), results); recordError != nil {
+			logging.FromContext(ctx).Warn("Could not record sync results", "error", recordError)
+		}
+		if syncError != nil {
+			return synced, failed, syncError
+		}
+		return synced, failed, saveError
 	}
-	// Get currently playing for each user
-	for index, user := range users {
-		current, currentError := spotify.GetCurrentlyPlayingForUser(user, globalClient)
-		if currentError != nil {
-			return index, currentError
+	// Walk all users who have spotify connected, a batch at a time
+	synced, failed := 0, 0
+	after := ""
+	for {
+		users, usersError := store.GetSyncBatch(ctx, after, syncBatchSize)
+		if usersError != nil {
+			return finish(synced, failed, usersError)
 		}
-		// Start building new status
-		var newStatus string
-		// Conditions where we should submit an empty status
-		if current != nil && current.IsPlaying {
-			if current.CurrentlyPlayingType == "track" {
-				// Build the new status
-				newStatus = "Listening to \"" + current.Item.Name + "\" by "
-				// To help in reducing character count, don't include artists in the artists lists
-				// who are also included in the song name such as "feat. artist name"
-				reducedArtistList := make([]string, 0)
-				for _, artist := range current.Item.Artists {
-					if !strings.Contains(artist.Name, current.Item.Name) {
-						reducedArtistList = append(reducedArtistList, artist.Name)
-					}
-				}
-				// Build the artists section of the status
-				for index, artist := range reducedArtistList {
-					// Comma separated list
-					if index > 0 {
-						newStatus += ", "
-					}
-					// add artists name
-					newStatus += artist
-				}
-				newStatus += " on Spotify"
-			} else if current.CurrentlyPlayingType == "episode" {
-				// Build the new status
-				newStatus = "Listening to \"" + current.Item.Name + "\" (" + current.Item.Show.Name + ") by " + current.Item.Show.Publisher + " on Spotify"
+		// Get currently playing for each user
+		for _, user := range users {
+			if only != "" && user.ID != only {
+				continue
 			}
+			// Every user left would fail the same way
+			if ctx.Err() != nil {
+				return finish(synced, failed, ctx.Err())
+			}
+			synced++
+			// syncUser logs what went wrong
+			outcome, syncError := syncUser(ctx, user, pending)
+			result := database.SyncResult{User: user.ID, Outcome: outcome}
+			if syncError != nil {
+				syncUserFailures.Inc()
+				failed++
+				result.Error = syncError.Error()
+			}
+			results = append(results, result)
 		}
-		// Safeguards against overly long status messages
-		if len(newStatus) > 100 {
-			// Fallback to just the name
-			newStatus = "Listening to \"" + current.Item.Name + "\" on Spotify "
-		}
-		// Update the new status
-		updateError := slack.UpdateUserStatus(user, newStatus, globalClient)
-		if updateError != nil {
-			return index, updateError
+		// A short batch means we've reached the end
+		if len(users) < syncBatchSize {
+			break
 		}
+		after = users[len(users)-1].ID
 	}
 	// return success
-	return len(users), nil
+	return finish(synced, failed, nil)
+}
+
+// Syncs a single user, adding their new status to pending if it should be written. Returns how the sync went: unchanged,
+// queued, skipped or error.
+func syncUser(ctx context.Context, user database.SyncUser, pending map[string]string) (result string, syncError error) {
+	ctx, span := tracing.Start(ctx, "sync.user", attribute.String("user", logging.Hash(user.ID)), attribute.String("team", logging.Hash(user.Team)))
+	result = "error"
+	defer func() {
+		span.SetAttributes(attribute.String("sync.result", result))
+		tracing.End(span, syncError)
+	}()
+	userLogger := logging.FromContext(ctx).With("user", logging.Hash(user.ID), "team", logging.Hash(user.Team))
+	current, changed, currentError := spotify.GetCurrentlyPlayingForUser(ctx, user.ID, user.SpotifyAccessToken, globalClient)
+	if currentError != nil {
+		userLogger.Warn("Could not read currently playing", "error", currentError)
+		return result, currentError
+	}
+	// Nothing changed since the last poll, so there is nothing to do
+	if !changed {
+		slack.StatusUpdates.WithLabelValues("skipped", "playback_unchanged").Inc()
+		result = "unchanged"
+		return result, nil
+	}
+	// Decide whether the new status should be written
+	newStatus := buildStatus(current)
+	shouldSet, checkError := slack.ShouldSetStatus(ctx, user, newStatus, globalClient)
+	if checkError != nil {
+		userLogger.Warn("Could not check slack status", "error", checkError)
+		// Make sure the next poll retries this change rather than skipping it as unchanged
+		spotify.ForgetPlayback(user.ID)
+		return result, checkError
+	}
+	// The job workers make the change in slack
+	if shouldSet {
+		userLogger.Debug("Queueing status change")
+		result = "queued"
+		pending[user.ID] = newStatus
+	} else {
+		result = "skipped"
+	}
+	return result, nil
+}
+
+// Builds the status text for what's playing. Returns a blank status if nothing is playing.
+func buildStatus(current *spotify.CurrentlyPlaying) string {
+	// Start building new status
+	var newStatus string
+	// Conditions where we should submit an empty status
+	if current != nil && current.IsPlaying {
+		if current.CurrentlyPlayingType == "track" {
+			// Build the new status
+			newStatus = "Listening to \"" + current.Item.Name + "\" by "
+			// To help in reducing character count, don't include artists in the artists lists
+			// who are also included in the song name such as "feat. artist name"
+			reducedArtistList := make([]string, 0)
+			for _, artist := range current.Item.Artists {
+				if !strings.Contains(artist.Name, current.Item.Name) {
+					reducedArtistList = append(reducedArtistList, artist.Name)
+				}
+			}
+			// Build the artists section of the status
+			for index, artist := range reducedArtistList {
+				// Comma separated list
+				if index > 0 {
+					newStatus += ", "
+				}
+				// add artists name
+				newStatus += artist
+			}
+			newStatus += " on Spotify"
+		} else if current.CurrentlyPlayingType == "episode" {
+			// Build the new status
+			newStatus = "Listening to \"" + current.Item.Name + "\" (" + current.Item.Show.Name + ") by " + current.Item.Show.Publisher + " on Spotify"
+		}
+	}
+	// Safeguards against overly long status messages
+	if len(newStatus) > 100 {
+		// Fallback to just the name
+		newStatus = "Listening to \"" + current.Item.Name + "\" on Spotify "
+	}
+	return newStatus
 }
 
 func spotifyCurrentlyPlayingLoop() {
 	ticker := time.NewTicker(5 * time.Second)
+	paused := false
 	for {
-		usersUpdated, updateError := statusSyncHelper()
-		log.Println("Spotify Currently Playing synced for", usersUpdated, "users.")
-		if updateError != nil {
-			log.Println("Spotify Currently Playing Sync exited early due to error:", updateError)
+		// Sync needs both upstreams, so sit the tick out while either breaker is open
+		if pausedFor("Spotify Currently Playing sync", &paused, "spotify", "slack") {
+			<-ticker.C
+			continue
 		}
+		syncTick()
 		<-ticker.C // Block until ticker kicks a tick off
 	}
 }
 
+// Runs one currently playing sync over every user, marking the app as synced unless the run itself failed
+func syncTick() {
+	// Bound the whole run so it can never overlap too far into later ticks. Everything logged during it carries the run id.
+	runID := logging.NewID()
+	ctx, span := tracing.Start(context.Background(), "sync.tick", attribute.String("sync_run", runID))
+	ctx = tracing.WithTraceID(logging.WithLogger(ctx, slog.Default().With("loop", "sync", "sync_run", runID)))
+	logger := logging.FromContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	started := time.Now()
+	usersUpdated, usersFailed, updateError := statusSyncHelper(ctx, "")
+	cancel()
+	span.SetAttributes(attribute.Int("sync.users", usersUpdated), attribute.Int("sync.failed", usersFailed))
+	tracing.End(span, updateError)
+	if updateError != nil {
+		syncDuration.WithLabelValues("error").Observe(time.Since(started).Seconds())
+	} else {
+		syncDuration.WithLabelValues("ok").Observe(time.Since(started).Seconds())
+		markSynced()
+	}
+	polls, unchanged := spotify.PollStats()
+	logger.Debug("Sync finished", "users", usersUpdated, "failed", usersFailed, "duration_ms", time.Since(started).Milliseconds(),
+		"polls_since_startup", polls, "unchanged_since_startup", unchanged)
+	if updateError != nil && !errors.Is(updateError, upstream.ErrCircuitOpen) {
+		logger.Error("Sync exited early", "users", usersUpdated, "error", updateError)
+	}
+}
+
 func spotifyTokenMaintenance() {
 	ticker := time.NewTicker(15 * time.Minute)
+	paused := false
 	for {
-		usersRefreshed, refreshError := spotify.RefreshExpiringTokens(globalClient)
-		log.Println("Spotify token refresh function refreshed", usersRefreshed, "tokens.")
-		if refreshError != nil {
-			log.Println("Spotify token refresh function exited early due to error:", refreshError)
+		if pausedFor("Spotify token refresh", &paused, "spotify") {
+			<-ticker.C
+			continue
+		}
+		runID := logging.NewID()
+		ctx, span := tracing.Start(context.Background(), "token_sweep", attribute.String("sweep_run", runID))
+		ctx = tracing.WithTraceID(logging.WithLogger(ctx, slog.Default().With("loop", "token_sweep", "sweep_run", runID)))
+		logger := logging.FromContext(ctx)
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		usersRefreshed, refreshError := spotify.RefreshExpiringTokens(ctx, globalClient)
+		cancel()
+		span.SetAttributes(attribute.Int("token_sweep.refreshed", usersRefreshed))
+		tracing.End(span, refreshError)
+		if refreshError == nil {
+			markSwept()
+		}
+		logger.Info("Token sweep finished", "refreshed", usersRefreshed)
+		if refreshError != nil && !errors.Is(refreshError, upstream.ErrCircuitOpen) {
+			logger.Error("Token sweep exited early", "refreshed", usersRefreshed, "error", refreshError)
 		}
 		<-ticker.C // Block until ticker kicks a tick off
 	}
 }
 
+// Reports whether any of the named upstreams has an open breaker. Only logs when the loop pauses or resumes, not on every tick.
+func pausedFor(loop string, paused *bool, names ...string) bool {
+	for _, name := range names {
+		if upstreams.IsOpen(name) {
+			if !*paused {
+				slog.Warn("Loop paused while a circuit breaker is open", "loop", loop, "upstream", name)
+			}
+			*paused = true
+			return true
+		}
+	}
+	if *paused {
+		slog.Info("Loop resumed", "loop", loop)
+	}
+	*paused = false
+	return false
+}
+
+func slackSocketMode() {
+	client := &socketmode.Client{
+		AppToken:   settings.SlackAppToken,
+		APIURL:     settings.SlackAPIURL,
+		HTTPClient: globalClient,
+		OnEvent: func(payload []byte) error {
+			return routes.DeliverEvent(payload, globalClient)
+		},
+		OnInteraction: func(ctx context.Context, payload []byte) error {
+			return routes.DeliverInteraction(ctx, payload, globalClient)
+		},
+	}
+	// Only returns once the context is cancelled, which never happens here
+	runError := client.Run(context.Background())
+	logging.Fatal("Socket Mode stopped", "error", runError)
+}
+
 func slackCallbackClientInjector(context *gin.Context) {
 	routes.SlackCallbackFlow(context, globalClient)
 }
@@ -148,10 +462,30 @@ func spotifyCallbackClientInjector(context *gin.Context) {
 	routes.SpotifyCallbackFlow(context, globalClient)
 }
 
+func adminCallbackClientInjector(context *gin.Context) {
+	routes.AdminCallbackFlow(context, settings, globalClient)
+}
+
+func adminDashboardConfigInjector(context *gin.Context) {
+	routes.AdminDashboard(context, settings)
+}
+
+func adminSignOutConfigInjector(context *gin.Context) {
+	routes.AdminSignOut(context, settings)
+}
+
+func adminUserActionClientInjector(context *gin.Context) {
+	routes.AdminUserAction(context, globalClient)
+}
+
+func adminPurgeTeamClientInjector(context *gin.Context) {
+	routes.AdminPurgeTeam(context, globalClient)
+}
+
 func eventsClientInjector(context *gin.Context) {
-	routes.EventsEndpoint(context, globalClient)
+	routes.EventsEndpoint(context, settings.SlackSigningKey, globalClient)
 }
 
 func interactionsClientInjector(context *gin.Context) {
-	routes.InteractivityEndpoint(context, globalClient)
+	routes.InteractivityEndpoint(context, settings.SlackSigningKey, globalClient)
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"rolflewis.com/spotify-status-sync/src/config"
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/jobs"
+	"rolflewis.com/spotify-status-sync/src/logging"
+	"rolflewis.com/spotify-status-sync/src/slack"
+	"rolflewis.com/spotify-status-sync/src/spotify"
+	"rolflewis.com/spotify-status-sync/src/tracing"
+)
+
+// Spans from every test. The tracer only ever follows the first provider installed, so there is one for the run.
+var exporter = tracetest.NewInMemoryExporter()
+
+func TestMain(m *testing.M) {
+	tracing.UseExporter(exporter)
+	m.Run()
+}
+
+// The access token the fake spotify refuses, as it would a revoked one
+const revokedToken = "revoked"
+
+// Points the app at a fake spotify, which is playing a song for every token but revokedToken, and a fresh memory store.
+// Slack is never called, since every user's cached profile is fresh.
+func newTestApp(t *testing.T) {
+	t.Helper()
+	spotifyServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ") == revokedToken {
+			http.Error(writer, `{"error":{"status":401,"message":"The access token expired"}}`, http.StatusUnauthorized)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(`{"is_playing":true,"currently_playing_type":"track","item":{"id":"track","name":"Test Song","artists":[{"name":"Test Artist"}]}}`))
+	}))
+	t.Cleanup(spotifyServer.Close)
+
+	settings = &config.Config{SpotifyAPIURL: spotifyServer.URL + "/v1/", SlackAPIURL: "http://127.0.0.1:1/api/"}
+	slack.UseConfig(settings)
+	spotify.UseConfig(settings)
+	useUpstreams()
+	store = database.NewMemoryStore()
+	slack.UseStore(store)
+	spotify.UseStore(store)
+	jobs.UseStore(store)
+}
+
+// Adds a user with slack and spotify connected, and a blank status cached so sync doesn't read it from slack
+func addSyncUser(t *testing.T, user string, spotifyToken string) {
+	t.Helper()
+	ctx := context.Background()
+	steps := []error{
+		store.EnsureTeamExists(ctx, "T1"),
+		store.SetTokenForTeam(ctx, "T1", "xoxb-T1"),
+		store.EnsureUserExists(ctx, user),
+		store.SetTeamForUser(ctx, user, "T1"),
+		store.SaveSlackTokenForUser(ctx, user, "xoxp-"+user),
+		store.AddSpotifyToUser(ctx, user, "spotify-"+user, spotifyToken, "refresh-"+user, 3600),
+		store.SetProfileForUser(ctx, user, "", "", 0, database.ProfileFromEvent),
+	}
+	for _, stepError := range steps {
+		if stepError != nil {
+			t.Fatalf("adding %s: %v", user, stepError)
+		}
+	}
+	spotify.ForgetPlayback(user)
+}
+
+func TestSyncCarriesOnPastFailingUsers(t *testing.T) {
+	newTestApp(t)
+	addSyncUser(t, "U1", revokedToken)
+	addSyncUser(t, "U2", "good")
+	atomic.StoreInt64(&lastSyncAt, 0)
+
+	synced, failed, syncError := statusSyncHelper(context.Background(), "")
+	if syncError != nil || synced != 2 || failed != 1 {
+		t.Fatalf("sync gave %d synced, %d failed, %v - want 2, 1 and no error", synced, failed, syncError)
+	}
+	claimed, claimError := store.ClaimJobs(context.Background(), 10, time.Minute)
+	if claimError != nil {
+		t.Fatal(claimError)
+	}
+	if len(claimed) != 1 || claimed[0].User != "U2" || claimed[0].Kind != database.JobSetStatus {
+		t.Fatalf("expected one status job for U2 after U1 failed, got %+v", claimed)
+	}
+
+	// A tick where only some users failed still counts as finishing
+	syncTick()
+	if syncLag() > time.Minute {
+		t.Errorf("a tick with a failing user didn't mark the app synced")
+	}
+}
+
+// A store whose status jobs can't be queued
+type unqueueableStore struct {
+	database.Store
+}
+
+func (unqueueableStore) EnqueueStatusJobs(ctx context.Context, statuses map[string]string) error {
+	return errors.New("Database is down")
+}
+
+func TestSyncRetriesChangesItCouldNotQueue(t *testing.T) {
+	newTestApp(t)
+	addSyncUser(t, "U1", "good")
+	working := store
+
+	// The change is found, but queueing it fails
+	store = unqueueableStore{working}
+	if _, _, syncError := statusSyncHelper(context.Background(), ""); syncError == nil {
+		t.Fatalf("sync didn't report the failure to queue")
+	}
+
+	// So the next sync finds it again
+	store = working
+	if _, _, syncError := statusSyncHelper(context.Background(), ""); syncError != nil {
+		t.Fatal(syncError)
+	}
+	claimed, claimError := store.ClaimJobs(context.Background(), 10, time.Minute)
+	if claimError != nil {
+		t.Fatal(claimError)
+	}
+	if len(claimed) != 1 || claimed[0].User != "U1" {
+		t.Fatalf("expected the change to be queued on the next sync, got %+v", claimed)
+	}
+}
+
+// The value of the attribute on the span, or an invalid value if it isn't set
+func attributeOf(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestSyncTickIsTraced(t *testing.T) {
+	newTestApp(t)
+	addSyncUser(t, "U1", revokedToken)
+	addSyncUser(t, "U2", "good")
+	exporter.Reset()
+
+	syncTick()
+
+	var tick tracetest.SpanStub
+	users := make(map[string]tracetest.SpanStub)
+	var polls []tracetest.SpanStub
+	for _, span := range exporter.GetSpans() {
+		switch span.Name {
+		case "sync.tick":
+			tick = span
+		case "sync.user":
+			users[attributeOf(span, "user").AsString()] = span
+		case "spotify me/player/currently-playing":
+			polls = append(polls, span)
+		}
+	}
+	if attributeOf(tick, "sync_run").AsString() == "" || attributeOf(tick, "sync.users").AsInt64() != 2 ||
+		attributeOf(tick, "sync.failed").AsInt64() != 1 || tick.Status.Code == codes.Error {
+		t.Errorf("tick span has status %v and attributes %v", tick.Status, tick.Attributes)
+	}
+
+	// Users are only identified by hash
+	failed, synced := users[logging.Hash("U1")], users[logging.Hash("U2")]
+	if len(users) != 2 || failed.Name == "" || synced.Name == "" {
+		t.Fatalf("expected a span for each user, got %v", users)
+	}
+	for _, span := range users {
+		if span.Parent.SpanID() != tick.SpanContext.SpanID() || attributeOf(span, "team").AsString() != logging.Hash("T1") {
+			t.Errorf("user span isn't under the tick or lacks its team: %v", span.Attributes)
+		}
+	}
+	if attributeOf(failed, "sync.result").AsString() != "error" || failed.Status.Code != codes.Error {
+		t.Errorf("failing user's span has status %v and attributes %v", failed.Status, failed.Attributes)
+	}
+	if attributeOf(synced, "sync.result").AsString() != "queued" || synced.Status.Code == codes.Error {
+		t.Errorf("synced user's span has status %v and attributes %v", synced.Status, synced.Attributes)
+	}
+
+	// Each user's poll is traced under their span
+	if len(polls) != 2 {
+		t.Fatalf("expected a spotify call for each user, got %d", len(polls))
+	}
+	for _, poll := range polls {
+		if poll.Parent.SpanID() != failed.SpanContext.SpanID() && poll.Parent.SpanID() != synced.SpanContext.SpanID() {
+			t.Errorf("spotify call isn't under a user's span")
+		}
+		if attributeOf(poll, "upstream").AsString() != "spotify" {
+			t.Errorf("spotify call span has attributes %v", poll.Attributes)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/metrics"
+)
+
+var syncDuration = metrics.Factory.NewHistogramVec(prometheus.HistogramOpts{Name: "sync_duration_seconds",
+	Help: "How long each currently playing sync tick took, by result.", Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}},
+	[]string{"result"})
+
+var syncUserFailures = metrics.Factory.NewCounter(prometheus.CounterOpts{Name: "sync_user_failures_total",
+	Help: "Users whose sync failed, such as from a revoked token. The rest of the tick carries on without them."})
+
+// Counts connected users by team when metrics are scraped
+type connectedUsersCollector struct {
+	appDatabase database.Database
+}
+
+var connectedUsersDesc = prometheus.NewDesc("connected_users", "Users with both Slack and Spotify connected, by team.",
+	[]string{"team"}, nil)
+
+func (collector connectedUsersCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- connectedUsersDesc
+}
+
+func (collector connectedUsersCollector) Collect(samples chan<- prometheus.Metric) {
+	counts, countError := collector.appDatabase.CountConnectedUsersByTeam(context.Background())
+	if countError != nil {
+		slog.Error("Could not count connected users for metrics", "error", countError)
+		samples <- prometheus.NewInvalidMetric(connectedUsersDesc, countError)
+		return
+	}
+	for _, count := range counts {
+		samples <- prometheus.MustNewConstMetric(connectedUsersDesc, prometheus.GaugeValue, float64(count.Count), count.Team)
+	}
+}
+
+// Registers the metrics that are read from the database when scraped
+func registerDatabaseMetrics(appDatabase database.Database) {
+	metrics.Factory.NewGaugeFunc(prometheus.GaugeOpts{Name: "sync_lag_seconds",
+		Help: "Time since a currently playing sync tick last finished without error."}, func() float64 {
+		return syncLag().Seconds()
+	})
+	metrics.Registry.MustRegister(connectedUsersCollector{appDatabase: appDatabase})
+
+	// Connection pool stats
+	poolGauge := func(name string, help string, read func() float64) {
+		metrics.Factory.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, read)
+	}
+	poolCounter := func(name string, help string, read func() float64) {
+		metrics.Factory.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, read)
+	}
+	poolGauge("db_max_open_connections", "Most connections the pool will open.", func() float64 {
+		return float64(appDatabase.Stats().MaxOpenConnections)
+	})
+	poolGauge("db_open_connections", "Connections open, in use or idle.", func() float64 {
+		return float64(appDatabase.Stats().OpenConnections)
+	})
+	poolGauge("db_in_use_connections", "Connections in use.", func() float64 {
+		return float64(appDatabase.Stats().InUse)
+	})
+	poolGauge("db_idle_connections", "Idle connections.", func() float64 {
+		return float64(appDatabase.Stats().Idle)
+	})
+	poolCounter("db_wait_count_total", "Times a query waited for a free connection.", func() float64 {
+		return float64(appDatabase.Stats().WaitCount)
+	})
+	poolCounter("db_wait_duration_seconds_total", "Total time spent waiting for a free connection.", func() float64 {
+		return appDatabase.Stats().WaitDuration.Seconds()
+	})
+	poolCounter("db_max_idle_closed_total", "Connections closed because the idle pool was full.", func() float64 {
+		return float64(appDatabase.Stats().MaxIdleClosed)
+	})
+	poolCounter("db_max_lifetime_closed_total", "Connections closed for reaching their maximum lifetime.", func() float64 {
+		return float64(appDatabase.Stats().MaxLifetimeClosed)
+	})
+}
@@ -0,0 +1,312 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Everything the app is configured with. Loaded once at startup and handed to the packages that need it.
+type Config struct {
+	Port           string
+	AppURL         string
+	DatabaseURL    string
+	SlackTransport string
+
+	SlackClientID     string
+	SlackClientSecret string
+	SlackSigningKey   string
+	SlackAppToken     string
+	SlackAPIURL       string
+	SlackAuthURL      string
+	// Sign in with Slack, used for the admin dashboard
+	SlackOpenIDURL string
+
+	SpotifyClientID     string
+	SpotifyClientSecret string
+	SpotifyAPIURL       string
+	SpotifyAuthURL      string
+
+	OAuthStateSecret    string
+	TokenEncryptionKeys string
+	// Keys the hashes ids are logged as, so they match across instances
+	LogHashKey string
+	// Bearer token for /metrics, which isn't served without one
+	MetricsToken string
+	// Slack users allowed into /admin, as TEAM:USER pairs of ids separated by commas, since a user id is only unique within
+	// its workspace. The dashboard isn't served without any.
+	AdminUserIDs string
+
+	// debug, info, warn or error, and text or json
+	LogLevel  string
+	LogFormat string
+
+	// none or otlp. With otlp, spans are sent to OTLPEndpoint, a full OTLP/HTTP traces url.
+	TraceExporter string
+	OTLPEndpoint  string
+	// Extra headers for the collector, as name=value pairs separated by commas
+	OTLPHeaders string
+	// Share of traces kept, from 0 to 1
+	TraceSampleRatio string
+}
+
+// The environment variable (and config file key) behind each setting
+func (config *Config) settings() map[string]*string {
+	return map[string]*string{
+		"PORT":                  &config.Port,
+		"APP_URL":               &config.AppURL,
+		"DATABASE_URL":          &config.DatabaseURL,
+		"SLACK_TRANSPORT":       &config.SlackTransport,
+		"SLACK_CLIENT_ID":       &config.SlackClientID,
+		"SLACK_CLIENT_SECRET":   &config.SlackClientSecret,
+		"SLACK_SIGNING_KEY":     &config.SlackSigningKey,
+		"SLACK_APP_TOKEN":       &config.SlackAppToken,
+		"SLACK_API_URL":         &config.SlackAPIURL,
+		"SLACK_AUTH_URL":        &config.SlackAuthURL,
+		"SLACK_OPENID_URL":      &config.SlackOpenIDURL,
+		"SPOTIFY_CLIENT_ID":     &config.SpotifyClientID,
+		"SPOTIFY_CLIENT_SECRET": &config.SpotifyClientSecret,
+		"SPOTIFY_API_URL":       &config.SpotifyAPIURL,
+		"SPOTIFY_AUTH_URL":      &config.SpotifyAuthURL,
+		"OAUTH_STATE_SECRET":    &config.OAuthStateSecret,
+		"TOKEN_ENCRYPTION_KEYS": &config.TokenEncryptionKeys,
+		"LOG_HASH_KEY":          &config.LogHashKey,
+		"METRICS_TOKEN":         &config.MetricsToken,
+		"ADMIN_USER_IDS":        &config.AdminUserIDs,
+		"LOG_LEVEL":             &config.LogLevel,
+		"LOG_FORMAT":            &config.LogFormat,
+		"TRACE_EXPORTER":        &config.TraceExporter,
+		"OTLP_ENDPOINT":         &config.OTLPEndpoint,
+		"OTLP_HEADERS":          &config.OTLPHeaders,
+		"TRACE_SAMPLE_RATIO":    &config.TraceSampleRatio,
+	}
+}
+
+// Reads the configuration. If CONFIG_FILE is set, it names a JSON file of settings keyed by their environment variable
+// names; any environment variable that is set overrides the file. Load doesn't check the values - call Validate for that.
+func Load() (*Config, error) {
+	config := &Config{}
+	settings := config.settings()
+
+	// Start from the file, if there is one
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		fileBytes, readError := ioutil.ReadFile(path)
+		if readError != nil {
+			return nil, readError
+		}
+		var fileSettings map[string]string
+		if jsonError := json.Unmarshal(fileBytes, &fileSettings); jsonError != nil {
+			return nil, errors.New("Could not parse config file " + path + ": " + jsonError.Error())
+		}
+		for name, value := range fileSettings {
+			setting, known := settings[name]
+			if !known {
+				return nil, errors.New("Unknown setting in config file " + path + ": " + name)
+			}
+			*setting = value
+		}
+	}
+
+	// The environment wins
+	for name, setting := range settings {
+		if value, set := os.LookupEnv(name); set && value != "" {
+			*setting = value
+		}
+	}
+
+	if config.SlackTransport == "" {
+		config.SlackTransport = "http"
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+	}
+	if config.LogFormat == "" {
+		config.LogFormat = "text"
+	}
+	if config.TraceExporter == "" {
+		config.TraceExporter = "none"
+	}
+	if config.TraceSampleRatio == "" {
+		config.TraceSampleRatio = "1"
+	}
+	return config, nil
+}
+
+// Every problem Validate found, reported together so a bad deploy can be fixed in one go
+type ValidationError struct {
+	Problems []string
+}
+
+func (validationError *ValidationError) Error() string {
+	return "Invalid configuration:\n  " + strings.Join(validationError.Problems, "\n  ")
+}
+
+// Checks everything the app needs to run is set and well formed. Returns a *ValidationError listing every problem, or nil.
+func (config *Config) Validate() error {
+	var problems []string
+	required := func(name string, value string) bool {
+		if value == "" {
+			problems = append(problems, name+" must be set")
+			return false
+		}
+		return true
+	}
+	// Paths are appended straight onto these, so they need the trailing slash
+	baseURL := func(name string, value string) {
+		if !required(name, value) {
+			return
+		}
+		parsed, parseError := url.Parse(value)
+		if parseError != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, name+" must be an absolute http or https url")
+			return
+		}
+		if !strings.HasSuffix(parsed.Path, "/") {
+			problems = append(problems, name+" must end with /")
+		}
+	}
+
+	required("PORT", config.Port)
+	baseURL("APP_URL", config.AppURL)
+	if required("DATABASE_URL", config.DatabaseURL) {
+		parsed, parseError := url.Parse(config.DatabaseURL)
+		if parseError != nil || (parsed.Scheme != "postgres" && parsed.Scheme != "postgresql" && parsed.Scheme != "sqlite") {
+			problems = append(problems, "DATABASE_URL must be a postgres:// or sqlite:// url")
+		}
+	}
+
+	// Slack
+	required("SLACK_CLIENT_ID", config.SlackClientID)
+	required("SLACK_CLIENT_SECRET", config.SlackClientSecret)
+	baseURL("SLACK_API_URL", config.SlackAPIURL)
+	baseURL("SLACK_AUTH_URL", config.SlackAuthURL)
+	switch config.SlackTransport {
+	case "http":
+		// Requests to the public endpoints are verified with this
+		required("SLACK_SIGNING_KEY", config.SlackSigningKey)
+	case "socket":
+		required("SLACK_APP_TOKEN", config.SlackAppToken)
+	default:
+		problems = append(problems, "SLACK_TRANSPORT must be http or socket")
+	}
+
+	// Spotify - the client secret is optional, since PKCE works without it
+	required("SPOTIFY_CLIENT_ID", config.SpotifyClientID)
+	baseURL("SPOTIFY_API_URL", config.SpotifyAPIURL)
+	baseURL("SPOTIFY_AUTH_URL", config.SpotifyAuthURL)
+
+	// Secrets
+	required("OAUTH_STATE_SECRET", config.OAuthStateSecret)
+	required("LOG_HASH_KEY", config.LogHashKey)
+	if _, keysError := ParseTokenKeys(config.TokenEncryptionKeys); keysError != nil {
+		problems = append(problems, keysError.Error())
+	}
+
+	// Admin dashboard - only checked when there are admins to sign in
+	if admins := config.Admins(); len(admins) > 0 {
+		for _, admin := range admins {
+			if parts := strings.Split(admin, ":"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				problems = append(problems, "ADMIN_USER_IDS must be TEAM:USER pairs of Slack ids separated by commas")
+				break
+			}
+		}
+		baseURL("SLACK_OPENID_URL", config.SlackOpenIDURL)
+	}
+
+	// Logging
+	switch strings.ToLower(config.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, "LOG_LEVEL must be debug, info, warn or error")
+	}
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		problems = append(problems, "LOG_FORMAT must be text or json")
+	}
+
+	// Tracing
+	switch config.TraceExporter {
+	case "none":
+	case "otlp":
+		if required("OTLP_ENDPOINT", config.OTLPEndpoint) {
+			parsed, parseError := url.Parse(config.OTLPEndpoint)
+			if parseError != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				problems = append(problems, "OTLP_ENDPOINT must be an absolute http or https url")
+			}
+		}
+		for _, header := range strings.Split(config.OTLPHeaders, ",") {
+			if strings.TrimSpace(header) != "" && !strings.Contains(header, "=") {
+				problems = append(problems, "OTLP_HEADERS must be name=value pairs separated by commas")
+				break
+			}
+		}
+	default:
+		problems = append(problems, "TRACE_EXPORTER must be none or otlp")
+	}
+	if ratio, parseError := strconv.ParseFloat(config.TraceSampleRatio, 64); parseError != nil || ratio < 0 || ratio > 1 {
+		problems = append(problems, "TRACE_SAMPLE_RATIO must be a number from 0 to 1")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// The TEAM:USER pairs in ADMIN_USER_IDS
+func (config *Config) Admins() []string {
+	var admins []string
+	for _, admin := range strings.Split(config.AdminUserIDs, ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			admins = append(admins, admin)
+		}
+	}
+	return admins
+}
+
+// Reports whether the Slack user, signed in to the team, is allowed into the admin dashboard
+func (config *Config) IsAdmin(team string, user string) bool {
+	for _, admin := range config.Admins() {
+		if admin == team+":"+user {
+			return true
+		}
+	}
+	return false
+}
+
+// A key from TOKEN_ENCRYPTION_KEYS
+type TokenKey struct {
+	ID  string
+	Key []byte
+}
+
+// Parses TOKEN_ENCRYPTION_KEYS, a comma separated list of id:base64key pairs with 32 byte keys, in the order they were
+// given. Blank gives no keys - tokens are then stored unencrypted.
+func ParseTokenKeys(keys string) ([]TokenKey, error) {
+	var parsed []TokenKey
+	if strings.TrimSpace(keys) == "" {
+		return parsed, nil
+	}
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(keys, ",") {
+		// Split the id from the key
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("TOKEN_ENCRYPTION_KEYS must be formatted as id:base64key")
+		}
+		if seen[parts[0]] {
+			return nil, errors.New("TOKEN_ENCRYPTION_KEYS has a duplicate key id: " + parts[0])
+		}
+		seen[parts[0]] = true
+		keyBytes, decodeError := base64.StdEncoding.DecodeString(parts[1])
+		if decodeError != nil || len(keyBytes) != 32 {
+			return nil, errors.New("TOKEN_ENCRYPTION_KEYS key " + parts[0] + " must be 32 bytes of base64")
+		}
+		parsed = append(parsed, TokenKey{ID: parts[0], Key: keyBytes})
+	}
+	return parsed, nil
+}
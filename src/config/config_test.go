@@ -0,0 +1,147 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Clears every setting from the environment for the test, so only what the case sets is read
+func clearEnvironment(t *testing.T) {
+	for name := range (&Config{}).settings() {
+		t.Setenv(name, "")
+	}
+	t.Setenv("CONFIG_FILE", "")
+}
+
+func TestLoadLetsTheEnvironmentOverrideTheFile(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     map[string]string
+		env      map[string]string
+		expected map[string]string
+	}{
+		{"defaults", nil, nil,
+			map[string]string{"SLACK_TRANSPORT": "http", "LOG_LEVEL": "info", "LOG_FORMAT": "text", "TRACE_EXPORTER": "none", "TRACE_SAMPLE_RATIO": "1"}},
+		{"file only", map[string]string{"PORT": "8080", "LOG_FORMAT": "json"}, nil,
+			map[string]string{"PORT": "8080", "LOG_FORMAT": "json", "LOG_LEVEL": "info"}},
+		{"environment wins", map[string]string{"PORT": "8080", "APP_URL": "https://file.example/"}, map[string]string{"PORT": "9090"},
+			map[string]string{"PORT": "9090", "APP_URL": "https://file.example/"}},
+		{"blank environment doesn't override", map[string]string{"PORT": "8080"}, map[string]string{"PORT": ""},
+			map[string]string{"PORT": "8080"}},
+	}
+	for _, current := range cases {
+		t.Run(current.name, func(t *testing.T) {
+			clearEnvironment(t)
+			if current.file != nil {
+				path := filepath.Join(t.TempDir(), "config.json")
+				fileBytes, _ := json.Marshal(current.file)
+				if writeError := os.WriteFile(path, fileBytes, 0600); writeError != nil {
+					t.Fatal(writeError)
+				}
+				t.Setenv("CONFIG_FILE", path)
+			}
+			for name, value := range current.env {
+				t.Setenv(name, value)
+			}
+			config, loadError := Load()
+			if loadError != nil {
+				t.Fatal(loadError)
+			}
+			settings := config.settings()
+			for name, expected := range current.expected {
+				if *settings[name] != expected {
+					t.Errorf("%s is %q, expected %q", name, *settings[name], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadRefusesUnknownFileSettings(t *testing.T) {
+	clearEnvironment(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	if writeError := os.WriteFile(path, []byte(`{"PORT": "8080", "PROT": "8080"}`), 0600); writeError != nil {
+		t.Fatal(writeError)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	if _, loadError := Load(); loadError == nil {
+		t.Errorf("a misspelt setting was accepted")
+	}
+}
+
+// A configuration that passes Validate
+func validConfig() *Config {
+	return &Config{
+		Port:              "8080",
+		AppURL:            "https://app.example/",
+		DatabaseURL:       "postgres://localhost/app",
+		SlackTransport:    "http",
+		SlackClientID:     "client",
+		SlackClientSecret: "secret",
+		SlackSigningKey:   "signing",
+		SlackAPIURL:       "https://slack.com/api/",
+		SlackAuthURL:      "https://slack.com/oauth/v2/",
+		SpotifyClientID:   "client",
+		SpotifyAPIURL:     "https://api.spotify.com/v1/",
+		SpotifyAuthURL:    "https://accounts.spotify.com/",
+		OAuthStateSecret:  "state",
+		LogHashKey:        "hash",
+		LogLevel:          "info",
+		LogFormat:         "text",
+		TraceExporter:     "none",
+		TraceSampleRatio:  "1",
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cases := []struct {
+		name     string
+		change   func(config *Config)
+		problems []string
+	}{
+		{"valid", func(config *Config) {}, nil},
+		{"missing and malformed together", func(config *Config) {
+			config.Port = ""
+			config.AppURL = "https://app.example"
+			config.LogFormat = "xml"
+		}, []string{"PORT must be set", "APP_URL must end with /", "LOG_FORMAT must be text or json"}},
+		{"socket mode needs an app token rather than a signing key", func(config *Config) {
+			config.SlackTransport = "socket"
+			config.SlackSigningKey = ""
+		}, []string{"SLACK_APP_TOKEN must be set"}},
+		{"log hashes need their own key", func(config *Config) {
+			config.LogHashKey = ""
+		}, []string{"LOG_HASH_KEY must be set"}},
+		{"admins need sign in with slack", func(config *Config) {
+			config.AdminUserIDs = "T1:U1,U2"
+		}, []string{"ADMIN_USER_IDS must be TEAM:USER pairs of Slack ids separated by commas", "SLACK_OPENID_URL must be set"}},
+		{"otlp needs an endpoint", func(config *Config) {
+			config.TraceExporter = "otlp"
+			config.TraceSampleRatio = "2"
+		}, []string{"OTLP_ENDPOINT must be set", "TRACE_SAMPLE_RATIO must be a number from 0 to 1"}},
+	}
+	for _, current := range cases {
+		t.Run(current.name, func(t *testing.T) {
+			config := validConfig()
+			current.change(config)
+			validateError := config.Validate()
+			if current.problems == nil {
+				if validateError != nil {
+					t.Fatalf("expected no problems, got %v", validateError)
+				}
+				return
+			}
+			var invalid *ValidationError
+			if !errors.As(validateError, &invalid) {
+				t.Fatalf("expected a *ValidationError, got %v", validateError)
+			}
+			if !reflect.DeepEqual(invalid.Problems, current.problems) {
+				t.Errorf("problems are %q, expected %q", invalid.Problems, current.problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// An entry in the audit log. Team and user are blank if they didn't apply.
+type AuditRecord struct {
+	At     time.Time `db:"at" json:"at"`
+	Team   string    `db:"team_id" json:"team_id"`
+	User   string    `db:"user_id" json:"user_id"`
+	Action string    `db:"action" json:"action"`
+	Detail string    `db:"detail" json:"detail"`
+}
+
+func (store *PostgresStore) addAuditRecord(ctx context.Context, transaction *sqlx.Tx, team string, user string, action string, detail string) error {
+	query := "INSERT INTO auditlog (at, team_id, user_id, action, detail) VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), $4, $5);"
+	// If transaction is given, use it. If not, use the DB pool
+	var insertError error
+	if transaction != nil {
+		_, insertError = transaction.ExecContext(ctx, query, time.Now(), team, user, action, detail)
+	} else {
+		_, insertError = store.db.ExecContext(ctx, query, time.Now(), team, user, action, detail)
+	}
+	return insertError
+}
+
+// Records an action in the audit log. Team and user may be blank if they don't apply.
+func (store *PostgresStore) AddAuditRecord(ctx context.Context, team string, user string, action string, detail string) error {
+	return store.addAuditRecord(ctx, nil, team, user, action, detail)
+}
+
+// Gets the most recent audit records, newest first
+func (store *PostgresStore) GetAuditRecords(ctx context.Context, limit int) ([]AuditRecord, error) {
+	var records []AuditRecord
+	selectError := store.db.SelectContext(ctx, &records, `SELECT at, COALESCE(team_id, '') AS team_id, COALESCE(user_id, '') AS user_id, action, COALESCE(detail, '') AS detail
+		FROM auditlog ORDER BY id DESC LIMIT $1;`, limit)
+	return records, selectError
+}
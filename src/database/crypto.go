@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"rolflewis.com/spotify-status-sync/src/config"
+)
+
+// Prefix that marks a stored token as encrypted. Anything without it is a plaintext token from before encryption was enabled.
+const encryptedTokenPrefix = "enc:"
+
+type tokenKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// The keys a store encrypts tokens with: the active one for new tokens, and every key that can still be used to decrypt, by
+// id. With no active key, tokens are stored as plaintext.
+type tokenKeyring struct {
+	active *tokenKey
+	keys   map[string]*tokenKey
+}
+
+// Builds the keyring for the TOKEN_ENCRYPTION_KEYS setting. The first key encrypts new tokens; the rest are kept so tokens
+// written under them can still be read.
+func newTokenKeyring(keys string) (*tokenKeyring, error) {
+	parsed, parseError := config.ParseTokenKeys(keys)
+	if parseError != nil {
+		return nil, parseError
+	}
+	keyring := &tokenKeyring{keys: make(map[string]*tokenKey)}
+	for _, parsedKey := range parsed {
+		// Build the cipher
+		block, blockError := aes.NewCipher(parsedKey.Key)
+		if blockError != nil {
+			return nil, blockError
+		}
+		aead, aeadError := cipher.NewGCM(block)
+		if aeadError != nil {
+			return nil, aeadError
+		}
+		key := &tokenKey{id: parsedKey.ID, aead: aead}
+		keyring.keys[key.id] = key
+		if keyring.active == nil {
+			keyring.active = key
+		}
+	}
+	return keyring, nil
+}
+
+// The additional data a token is sealed with. Along with the key id it names the table, column and row the token is stored
+// in, so a token copied into another row or column won't decrypt there.
+func tokenAAD(keyID string, table string, column string, row string) []byte {
+	return []byte(keyID + "\x00" + table + "\x00" + column + "\x00" + row)
+}
+
+// Encrypts a token for storage in the table's column, in the row with the given primary key, as
+// enc:<key id>:<base64 nonce and ciphertext>. Blank tokens and tokens written while encryption is off are left as they are.
+func (keyring *tokenKeyring) encryptToken(token string, table string, column string, row string) (string, error) {
+	if token == "" || keyring.active == nil {
+		return token, nil
+	}
+	nonce := make([]byte, keyring.active.aead.NonceSize())
+	if _, randError := rand.Read(nonce); randError != nil {
+		return "", randError
+	}
+	sealed := keyring.active.aead.Seal(nonce, nonce, []byte(token), tokenAAD(keyring.active.id, table, column, row))
+	return encryptedTokenPrefix + keyring.active.id + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a token read from the table's column, in the row with the given primary key, with whichever key it was written
+// under. Plaintext tokens are returned unchanged.
+func (keyring *tokenKeyring) decryptToken(stored string, table string, column string, row string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedTokenPrefix) {
+		return stored, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(stored, encryptedTokenPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Malformed encrypted token")
+	}
+	key, exists := keyring.keys[parts[0]]
+	if !exists {
+		return "", errors.New("No token encryption key with id " + parts[0])
+	}
+	sealed, decodeError := base64.RawStdEncoding.DecodeString(parts[1])
+	if decodeError != nil {
+		return "", decodeError
+	}
+	if len(sealed) < key.aead.NonceSize() {
+		return "", errors.New("Malformed encrypted token")
+	}
+	nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+	plaintext, openError := key.aead.Open(nil, nonce, ciphertext, tokenAAD(key.id, table, column, row))
+	if openError != nil {
+		return "", openError
+	}
+	return string(plaintext), nil
+}
+
+// Whether a stored token needs rewriting to be under the active key
+func (keyring *tokenKeyring) needsReencryption(stored string, plaintextOnly bool) bool {
+	if stored == "" || keyring.active == nil {
+		return false
+	}
+	if !strings.HasPrefix(stored, encryptedTokenPrefix) {
+		return true
+	}
+	return !plaintextOnly && !strings.HasPrefix(stored, encryptedTokenPrefix+keyring.active.id+":")
+}
+
+// The columns holding tokens, by table
+var tokenColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"teams", []string{"accesstoken"}},
+	{"slackaccounts", []string{"accesstoken"}},
+	{"spotifyaccounts", []string{"accesstoken", "refreshtoken"}},
+}
+
+// Encrypts any tokens saved before encryption was turned on, returning how many there were. Does nothing if encryption is off.
+func (store *PostgresStore) EncryptPlaintextTokens() (int, error) {
+	if store.keys.active == nil {
+		return 0, nil
+	}
+	return reencryptTokens(store.db, store.keys, true)
+}
+
+// Rewrites stored tokens under the active key and returns how many were rewritten. With plaintextOnly, only tokens stored
+// before encryption was enabled are touched; otherwise everything under an older key is too, so old keys can be retired.
+// Each row is only updated if it still holds the value that was read, so tokens refreshed in the meantime are left alone.
+func (store *PostgresStore) ReencryptTokens(plaintextOnly bool) (int, error) {
+	return reencryptTokens(store.db, store.keys, plaintextOnly)
+}
+
+func reencryptTokens(database *sqlx.DB, keyring *tokenKeyring, plaintextOnly bool) (int, error) {
+	if keyring.active == nil {
+		return 0, errors.New("No token encryption key is configured")
+	}
+	rewritten := 0
+	for _, table := range tokenColumns {
+		for _, column := range table.columns {
+			// Read every stored token in the column
+			var rows []struct {
+				ID    string `db:"id"`
+				Token string `db:"token"`
+			}
+			selectError := database.Select(&rows, "SELECT id, "+column+" AS token FROM "+table.table+" WHERE "+column+" IS NOT null AND "+column+" <> '';")
+			if selectError != nil {
+				return rewritten, selectError
+			}
+			for _, row := range rows {
+				if !keyring.needsReencryption(row.Token, plaintextOnly) {
+					continue
+				}
+				// Decrypt under the old key and encrypt under the new one
+				token, decryptError := keyring.decryptToken(row.Token, table.table, column, row.ID)
+				if decryptError != nil {
+					return rewritten, decryptError
+				}
+				encrypted, encryptError := keyring.encryptToken(token, table.table, column, row.ID)
+				if encryptError != nil {
+					return rewritten, encryptError
+				}
+				updateError := updateRowIn(context.Background(), database, nil, false, database.Rebind("UPDATE "+table.table+" SET "+column+"=? WHERE id=? AND "+column+"=?;"), encrypted, row.ID, row.Token)
+				if updateError != nil {
+					return rewritten, updateError
+				}
+				rewritten++
+			}
+		}
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A random 32 byte key, as it would be written in TOKEN_ENCRYPTION_KEYS
+func randomTokenKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func testKeyring(t *testing.T, keys string) *tokenKeyring {
+	t.Helper()
+	keyring, keyError := newTokenKeyring(keys)
+	if keyError != nil {
+		t.Fatal(keyError)
+	}
+	return keyring
+}
+
+func TestTokensOnlyDecryptWhereTheyWereStored(t *testing.T) {
+	keyring := testKeyring(t, "new:"+randomTokenKey())
+	stored, encryptError := keyring.encryptToken("xoxp-secret", "slackaccounts", "accesstoken", "U1")
+	if encryptError != nil {
+		t.Fatal(encryptError)
+	}
+	if !strings.HasPrefix(stored, "enc:new:") {
+		t.Fatalf("token was stored as %q", stored)
+	}
+	if token, decryptError := keyring.decryptToken(stored, "slackaccounts", "accesstoken", "U1"); decryptError != nil || token != "xoxp-secret" {
+		t.Errorf("token decrypted as %q, %v", token, decryptError)
+	}
+	elsewhere := [][3]string{{"slackaccounts", "accesstoken", "U2"}, {"teams", "accesstoken", "U1"}, {"spotifyaccounts", "refreshtoken", "U1"}}
+	for _, location := range elsewhere {
+		if _, decryptError := keyring.decryptToken(stored, location[0], location[1], location[2]); decryptError == nil {
+			t.Errorf("token moved to %v still decrypted", location)
+		}
+	}
+}
+
+func TestReencryptingMovesTokensToTheNewKey(t *testing.T) {
+	oldKey, newKey := randomTokenKey(), randomTokenKey()
+	path := filepath.Join(t.TempDir(), "crypto.db")
+	ctx := context.Background()
+
+	// Save a token under the old key
+	oldStore, openError := openSQLite(path, testKeyring(t, "old:"+oldKey))
+	if openError != nil {
+		t.Fatal(openError)
+	}
+	defer oldStore.DisconnectDatabase()
+	if migrateError := oldStore.MigrateUp(false); migrateError != nil {
+		t.Fatal(migrateError)
+	}
+	for _, user := range []string{"U1", "U2"} {
+		if ensureError := oldStore.EnsureUserExists(ctx, user); ensureError != nil {
+			t.Fatal(ensureError)
+		}
+	}
+	if saveError := oldStore.SaveSlackTokenForUser(ctx, "U1", "xoxp-rotated"); saveError != nil {
+		t.Fatal(saveError)
+	}
+
+	// Rotate: the new key goes first, and the old one is kept for reading. Each store keeps its own keys.
+	newStore, openError := openSQLite(path, testKeyring(t, "new:"+newKey+",old:"+oldKey))
+	if openError != nil {
+		t.Fatal(openError)
+	}
+	defer newStore.DisconnectDatabase()
+	if token, getError := newStore.GetSlackForUser(ctx, "U1"); getError != nil || token != "xoxp-rotated" {
+		t.Fatalf("token under the old key read as %q, %v", token, getError)
+	}
+	if encrypted, encryptError := newStore.EncryptPlaintextTokens(); encryptError != nil || encrypted != 0 {
+		t.Fatalf("startup pass rewrote %d tokens, %v", encrypted, encryptError)
+	}
+	rewritten, reencryptError := newStore.ReencryptTokens(false)
+	if reencryptError != nil || rewritten != 1 {
+		t.Fatalf("reencrypting rewrote %d tokens, %v", rewritten, reencryptError)
+	}
+	var stored string
+	if getError := newStore.db.Get(&stored, "SELECT accesstoken FROM slackaccounts WHERE id='U1';"); getError != nil {
+		t.Fatal(getError)
+	}
+	if !strings.HasPrefix(stored, "enc:new:") {
+		t.Errorf("token was rewritten as %q", stored)
+	}
+
+	// The old key can now be dropped
+	retiredStore, openError := openSQLite(path, testKeyring(t, "new:"+newKey))
+	if openError != nil {
+		t.Fatal(openError)
+	}
+	defer retiredStore.DisconnectDatabase()
+	if token, getError := retiredStore.GetSlackForUser(ctx, "U1"); getError != nil || token != "xoxp-rotated" {
+		t.Errorf("rewritten token read as %q, %v", token, getError)
+	}
+
+	// Copying it to U2 doesn't give U2 a working token
+	if _, updateError := retiredStore.db.Exec("UPDATE slackaccounts SET accesstoken=? WHERE id='U2';", stored); updateError != nil {
+		t.Fatal(updateError)
+	}
+	if _, getError := retiredStore.GetSlackForUser(ctx, "U2"); getError == nil {
+		t.Errorf("token copied to another user decrypted")
+	}
+}
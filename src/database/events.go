@@ -0,0 +1,25 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// Reports whether the slack event was recorded as processed and hasn't expired yet
+func (store *PostgresStore) EventProcessed(ctx context.Context, id string) (bool, error) {
+	var processed bool
+	getError := store.db.GetContext(ctx, &processed, "SELECT EXISTS (SELECT 1 FROM slackevents WHERE event_id=$1 AND expiresat >= $2);", id, time.Now())
+	return processed, getError
+}
+
+// Records that the slack event has been processed, until it expires. Recording it again is fine.
+func (store *PostgresStore) RecordProcessedEvent(ctx context.Context, id string, expiresAt time.Time) error {
+	// Clear out expired events while we're here
+	_, pruneError := store.db.ExecContext(ctx, "DELETE FROM slackevents WHERE expiresat < $1;", time.Now())
+	if pruneError != nil {
+		return pruneError
+	}
+	_, insertError := store.db.ExecContext(ctx, `INSERT INTO slackevents (event_id, expiresat) VALUES ($1, $2)
+		ON CONFLICT (event_id) DO UPDATE SET expiresat=EXCLUDED.expiresat;`, id, expiresAt)
+	return insertError
+}
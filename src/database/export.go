@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Stands in for a token in an export, so it shows a token is stored without giving it away
+const RedactedToken = "[redacted]"
+
+// Everything stored about a user, with tokens redacted. Accounts are nil if the user has none.
+type UserExport struct {
+	SlackAccount   *ExportedSlackAccount   `json:"slack_account"`
+	SpotifyAccount *ExportedSpotifyAccount `json:"spotify_account"`
+	AuditLog       []AuditRecord           `json:"audit_log"`
+	PendingJobs    []ExportedJob           `json:"pending_jobs"`
+	OAuthStates    []ExportedOAuthState    `json:"oauth_states"`
+}
+
+type ExportedSlackAccount struct {
+	ID         string `db:"id" json:"id"`
+	Team       string `db:"team_id" json:"team_id"`
+	SlackToken string `db:"slacktoken" json:"slack_token"`
+	// The last status the app set
+	Status    string `db:"status" json:"status"`
+	SpotifyID string `db:"spotify_id" json:"spotify_id"`
+	// The copy of the user's Slack status kept so sync doesn't have to read it every time
+	ProfileStatusText       string     `db:"profile_status_text" json:"profile_status_text"`
+	ProfileStatusEmoji      string     `db:"profile_status_emoji" json:"profile_status_emoji"`
+	ProfileStatusExpiration int        `db:"profile_status_expiration" json:"profile_status_expiration"`
+	ProfileUpdatedAt        *time.Time `db:"profile_updated_at" json:"profile_updated_at"`
+	ProfileSource           string     `db:"profile_source" json:"profile_source"`
+	ManualOverride          bool       `db:"manual_override" json:"manual_override"`
+	// How the last sync and last status write went
+	LastSyncAt       *time.Time `db:"lastsync_at" json:"last_sync_at"`
+	LastSyncOutcome  string     `db:"lastsync_outcome" json:"last_sync_outcome"`
+	LastSyncError    string     `db:"lastsync_error" json:"last_sync_error"`
+	LastWriteAt      *time.Time `db:"lastwrite_at" json:"last_write_at"`
+	LastWriteOutcome string     `db:"lastwrite_outcome" json:"last_write_outcome"`
+	LastWriteError   string     `db:"lastwrite_error" json:"last_write_error"`
+}
+
+type ExportedSpotifyAccount struct {
+	ID           string     `db:"id" json:"id"`
+	AccessToken  string     `db:"accesstoken" json:"access_token"`
+	RefreshToken string     `db:"refreshtoken" json:"refresh_token"`
+	ExpiresAt    *time.Time `db:"expirationat" json:"expires_at"`
+}
+
+// A queued write for the user that hasn't happened yet
+type ExportedJob struct {
+	Kind      string    `db:"kind" json:"kind"`
+	Payload   string    `db:"payload" json:"payload"`
+	Attempts  int       `db:"attempts" json:"attempts"`
+	LastError string    `db:"last_error" json:"last_error"`
+	RunAt     time.Time `db:"run_at" json:"run_at"`
+}
+
+// A sign in the user started that hasn't finished or expired yet. The nonce and verifier are secrets, so are left out.
+type ExportedOAuthState struct {
+	Provider  string    `db:"provider" json:"provider"`
+	ExpiresAt time.Time `db:"expiresat" json:"expires_at"`
+}
+
+// Shared by the Postgres and SQLite exports - tokens are swapped for RedactedToken in the query, so they are never decrypted
+const (
+	exportSlackColumns = `id, COALESCE(team_id, '') AS team_id, CASE WHEN accesstoken IS null THEN '' ELSE '` + RedactedToken + `' END AS slacktoken,
+		COALESCE(status, '') AS status, COALESCE(spotify_id, '') AS spotify_id, COALESCE(profile_status_text, '') AS profile_status_text,
+		COALESCE(profile_status_emoji, '') AS profile_status_emoji, COALESCE(profile_status_expiration, 0) AS profile_status_expiration,
+		profile_updated_at, COALESCE(profile_source, '') AS profile_source, manual_override, lastsync_at, COALESCE(lastsync_outcome, '') AS lastsync_outcome,
+		COALESCE(lastsync_error, '') AS lastsync_error, lastwrite_at, COALESCE(lastwrite_outcome, '') AS lastwrite_outcome,
+		COALESCE(lastwrite_error, '') AS lastwrite_error`
+	exportSpotifyColumns = `id, CASE WHEN accesstoken IS null THEN '' ELSE '` + RedactedToken + `' END AS accesstoken,
+		CASE WHEN refreshtoken IS null THEN '' ELSE '` + RedactedToken + `' END AS refreshtoken, expirationat`
+	exportAuditColumns = `at, COALESCE(team_id, '') AS team_id, COALESCE(user_id, '') AS user_id, action, COALESCE(detail, '') AS detail`
+	exportJobColumns   = `kind, payload, attempts, COALESCE(last_error, '') AS last_error, run_at`
+	exportOAuthColumns = `provider, expiresat`
+)
+
+// Collects everything stored about the user. An unknown user exports as empty.
+func (store *PostgresStore) ExportUser(ctx context.Context, user string) (*UserExport, error) {
+	export := &UserExport{AuditLog: make([]AuditRecord, 0), PendingJobs: make([]ExportedJob, 0), OAuthStates: make([]ExportedOAuthState, 0)}
+	var account ExportedSlackAccount
+	accountError := store.db.GetContext(ctx, &account, "SELECT "+exportSlackColumns+" FROM slackaccounts WHERE id=$1;", user)
+	if accountError != nil && accountError != sql.ErrNoRows {
+		return nil, accountError
+	}
+	if accountError == nil {
+		export.SlackAccount = &account
+		if account.SpotifyID != "" {
+			var spotifyAccount ExportedSpotifyAccount
+			spotifyError := store.db.GetContext(ctx, &spotifyAccount, "SELECT "+exportSpotifyColumns+" FROM spotifyaccounts WHERE id=$1;", account.SpotifyID)
+			if spotifyError != nil {
+				return nil, spotifyError
+			}
+			export.SpotifyAccount = &spotifyAccount
+		}
+	}
+	auditError := store.db.SelectContext(ctx, &export.AuditLog, "SELECT "+exportAuditColumns+" FROM auditlog WHERE user_id=$1 ORDER BY id;", user)
+	if auditError != nil {
+		return nil, auditError
+	}
+	jobsError := store.db.SelectContext(ctx, &export.PendingJobs, "SELECT "+exportJobColumns+" FROM jobs WHERE user_id=$1 ORDER BY id;", user)
+	if jobsError != nil {
+		return nil, jobsError
+	}
+	statesError := store.db.SelectContext(ctx, &export.OAuthStates, "SELECT "+exportOAuthColumns+" FROM oauthstates WHERE user_id=$1 ORDER BY expiresat;", user)
+	if statesError != nil {
+		return nil, statesError
+	}
+	return export, nil
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The kinds of job that can be queued
+const (
+	JobSetStatus       = "set_status"
+	JobClearStatus     = "clear_status"
+	JobPublishHome     = "publish_home"
+	JobDirectMessage   = "direct_message"
+	JobExportData      = "export_data"
+	statusDedupePrefix = "status:"
+)
+
+type Job struct {
+	ID       int64  `db:"id"`
+	Kind     string `db:"kind"`
+	User     string `db:"user_id"`
+	Payload  string `db:"payload"`
+	Version  int    `db:"version"`
+	Attempts int    `db:"attempts"`
+}
+
+// Shared upsert tail - a newer job replaces a waiting one with the same key, and resets its retries, but only if it actually differs
+const jobConflictClause = ` ON CONFLICT (dedupe_key) DO UPDATE SET kind=excluded.kind, payload=excluded.payload, version=jobs.version+1,
+	attempts=0, last_error=null, run_at=excluded.run_at
+	WHERE jobs.kind <> excluded.kind OR jobs.payload <> excluded.payload;`
+
+// Queues a job. If dedupe key is blank the job is always added, otherwise it replaces any waiting job with the same key.
+func (store *PostgresStore) EnqueueJob(ctx context.Context, kind string, user string, dedupeKey string, payload string) error {
+	now := time.Now()
+	_, insertError := store.db.ExecContext(ctx, "INSERT INTO jobs (kind, user_id, dedupe_key, payload, run_at, created_at) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $5)"+jobConflictClause,
+		kind, user, dedupeKey, payload, now)
+	return insertError
+}
+
+// Queues status changes for many users in a single statement. A blank status clears it. Only the latest status per user is kept.
+func (store *PostgresStore) EnqueueStatusJobs(ctx context.Context, statuses map[string]string) error {
+	// Nothing to write
+	if len(statuses) == 0 {
+		return nil
+	}
+	// Split the map into parallel arrays so they can be unnested into rows
+	users := make([]string, 0, len(statuses))
+	values := make([]string, 0, len(statuses))
+	for user, status := range statuses {
+		users = append(users, user)
+		values = append(values, status)
+	}
+	_, insertError := store.db.ExecContext(ctx, `INSERT INTO jobs (kind, user_id, dedupe_key, payload, run_at, created_at)
+		SELECT CASE WHEN updates.status = '' THEN $3 ELSE $4 END, updates.id, $5 || updates.id, updates.status, $6, $6
+		FROM unnest($1::text[], $2::text[]) AS updates(id, status)`+jobConflictClause,
+		pq.Array(users), pq.Array(values), JobClearStatus, JobSetStatus, statusDedupePrefix, time.Now())
+	return insertError
+}
+
+// Gets the dedupe key used for a user's status jobs
+func StatusJobKey(user string) string {
+	return statusDedupePrefix + user
+}
+
+// Leases up to limit due jobs. Jobs leased by another worker are skipped, and a job whose lease runs out becomes available again.
+func (store *PostgresStore) ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]Job, error) {
+	now := time.Now()
+	var jobs []Job
+	claimError := store.db.SelectContext(ctx, &jobs, `UPDATE jobs SET locked_until=$1, attempts=attempts+1
+		WHERE id IN (SELECT id FROM jobs WHERE run_at <= $2 AND (locked_until IS null OR locked_until < $2)
+			ORDER BY run_at LIMIT $3 FOR UPDATE SKIP LOCKED)
+		RETURNING id, kind, user_id, payload, version, attempts;`, now.Add(lease), now, limit)
+	return jobs, claimError
+}
+
+// Leases the job queued under the dedupe key, if it is due and nobody holds it. Returns at most one job.
+func (store *PostgresStore) ClaimJobByKey(ctx context.Context, dedupeKey string, lease time.Duration) ([]Job, error) {
+	now := time.Now()
+	var jobs []Job
+	claimError := store.db.SelectContext(ctx, &jobs, `UPDATE jobs SET locked_until=$1, attempts=attempts+1
+		WHERE dedupe_key=$3 AND run_at <= $2 AND (locked_until IS null OR locked_until < $2)
+		RETURNING id, kind, user_id, payload, version, attempts;`, now.Add(lease), now, dedupeKey)
+	return jobs, claimError
+}
+
+// Removes a finished job. If it was replaced while running, the replacement is left to run instead.
+func (store *PostgresStore) CompleteJob(ctx context.Context, job Job) error {
+	return store.completeJob(ctx, job, nil)
+}
+
+// Removes a finished status job and records the status as the last one we set, in one transaction
+func (store *PostgresStore) CompleteStatusJob(ctx context.Context, job Job, status string) error {
+	return store.completeJob(ctx, job, &status)
+}
+
+func (store *PostgresStore) completeJob(ctx context.Context, job Job, status *string) error {
+	// Open a transaction on the DB - roll it back if anything fails
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+
+	// Track the status change so sync can avoid unneccesary checks
+	if status != nil {
+		updateError := store.updateRow(ctx, transaction, false, "UPDATE slackaccounts SET status=$1 WHERE id=$2;", *status, job.User)
+		if updateError != nil {
+			return rollbackOnError(transaction, updateError)
+		}
+	}
+
+	// Delete the job if it is still the version we ran, otherwise just release it
+	_, deleteError := transaction.ExecContext(ctx, "DELETE FROM jobs WHERE id=$1 AND version=$2;", job.ID, job.Version)
+	if deleteError != nil {
+		return rollbackOnError(transaction, deleteError)
+	}
+	_, releaseError := transaction.ExecContext(ctx, "UPDATE jobs SET locked_until=null WHERE id=$1;", job.ID)
+	if releaseError != nil {
+		return rollbackOnError(transaction, releaseError)
+	}
+
+	// Commit the transaction to the DB
+	commitError := transaction.Commit()
+	if commitError != nil {
+		return rollbackOnError(transaction, commitError)
+	}
+	return nil
+}
+
+// Releases a failed job to be tried again at the given time. If it was replaced while running, the replacement runs straight away instead.
+func (store *PostgresStore) RetryJob(ctx context.Context, job Job, failure string, retryAt time.Time) error {
+	_, updateError := store.db.ExecContext(ctx, `UPDATE jobs SET locked_until=null, last_error=$1,
+		run_at=CASE WHEN version=$2 THEN $3 ELSE run_at END WHERE id=$4;`, failure, job.Version, retryAt, job.ID)
+	return updateError
+}
+
+// Gives up on a job that has failed too many times, and audits it. A replacement queued while it ran is kept.
+func (store *PostgresStore) AbandonJob(ctx context.Context, job Job, failure string) error {
+	_, deleteError := store.db.ExecContext(ctx, "DELETE FROM jobs WHERE id=$1 AND version=$2;", job.ID, job.Version)
+	if deleteError != nil {
+		return deleteError
+	}
+	_, releaseError := store.db.ExecContext(ctx, "UPDATE jobs SET locked_until=null WHERE id=$1;", job.ID)
+	if releaseError != nil {
+		return releaseError
+	}
+	return store.addAuditRecord(ctx, nil, "", job.User, "job_abandoned", job.Kind+" after "+strconv.Itoa(job.Attempts)+" attempts: "+failure)
+}
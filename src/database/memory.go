@@ -0,0 +1,780 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Storage kept in memory, with the same behaviour as the Postgres store. Meant for tests and local experiments -
+// nothing survives a restart.
+type MemoryStore struct {
+	lock    sync.Mutex
+	teams   map[string]*memoryTeam
+	users   map[string]*memoryUser
+	spotify map[string]*memorySpotifyAccount
+	jobs    map[int64]*memoryJob
+	nextJob int64
+	audit   []AuditRecord
+	oauth   map[string]memoryOAuthState
+	// When each processed event expires, by id
+	events map[string]time.Time
+}
+
+type memoryTeam struct {
+	token string
+}
+
+type memoryUser struct {
+	team              string
+	token             sql.NullString // null until one is saved, as the column is
+	status            string
+	spotifyID         string
+	profileText       string
+	profileEmoji      string
+	profileExpiration int
+	profileUpdatedAt  sql.NullTime
+	profileSource     string
+	manualOverride    bool
+	lastSync          LastResult
+	lastWrite         LastResult
+}
+
+type memorySpotifyAccount struct {
+	accessToken  string
+	refreshToken string
+	expiresAt    time.Time
+}
+
+type memoryJob struct {
+	job         Job
+	dedupeKey   string
+	lastError   string
+	runAt       time.Time
+	lockedUntil time.Time // zero when not leased
+}
+
+type memoryOAuthState struct {
+	provider  string
+	user      string
+	verifier  string
+	expiresAt time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		teams:   make(map[string]*memoryTeam),
+		users:   make(map[string]*memoryUser),
+		spotify: make(map[string]*memorySpotifyAccount),
+		jobs:    make(map[int64]*memoryJob),
+		oauth:   make(map[string]memoryOAuthState),
+		events:  make(map[string]time.Time),
+	}
+}
+
+// Users
+
+func (store *MemoryStore) EnsureUserExists(ctx context.Context, user string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, exists := store.users[user]; !exists {
+		store.users[user] = &memoryUser{}
+	}
+	return nil
+}
+
+func (store *MemoryStore) SetTeamForUser(ctx context.Context, user string, team string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	record, exists := store.users[user]
+	if !exists {
+		return errNoRowModified
+	}
+	// Same as the foreign key on slackaccounts
+	if _, teamExists := store.teams[team]; !teamExists {
+		return errors.New("Team " + team + " does not exist")
+	}
+	record.team = team
+	return nil
+}
+
+func (store *MemoryStore) SaveSlackTokenForUser(ctx context.Context, user string, token string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	record, exists := store.users[user]
+	if !exists {
+		return errNoRowModified
+	}
+	record.token = sql.NullString{String: token, Valid: true}
+	return nil
+}
+
+func (store *MemoryStore) GetSlackForUser(ctx context.Context, user string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if record, exists := store.users[user]; exists {
+		return record.token.String, nil
+	}
+	return "", nil
+}
+
+func (store *MemoryStore) GetTeamTokenForUser(ctx context.Context, user string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	record, exists := store.users[user]
+	if !exists {
+		return "", nil
+	}
+	if team, teamExists := store.teams[record.team]; teamExists {
+		return team.token, nil
+	}
+	return "", nil
+}
+
+func (store *MemoryStore) GetStatusForUser(ctx context.Context, user string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if record, exists := store.users[user]; exists {
+		return record.status, nil
+	}
+	return "", nil
+}
+
+func (store *MemoryStore) SetStatusForUser(ctx context.Context, user string, status string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	record, exists := store.users[user]
+	if !exists {
+		return errNoRowModified
+	}
+	record.status = status
+	return nil
+}
+
+func (store *MemoryStore) SetProfileForUser(ctx context.Context, user string, text string, emoji string, expiration int, source string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if record, exists := store.users[user]; exists {
+		record.profileText = text
+		record.profileEmoji = emoji
+		record.profileExpiration = expiration
+		record.profileUpdatedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		record.profileSource = source
+	}
+	return nil
+}
+
+func (store *MemoryStore) SetManualOverrideForUser(ctx context.Context, user string, overridden bool) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	record, exists := store.users[user]
+	if !exists || record.manualOverride == overridden {
+		return false, nil
+	}
+	record.manualOverride = overridden
+	if overridden {
+		record.status = ""
+	}
+	return true, nil
+}
+
+func (store *MemoryStore) GetManualOverrideForUser(ctx context.Context, user string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if record, exists := store.users[user]; exists {
+		return record.manualOverride, nil
+	}
+	return false, nil
+}
+
+func (store *MemoryStore) DeleteAllDataForUser(ctx context.Context, user string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.deletePendingForUser(user)
+	record, exists := store.users[user]
+	if !exists {
+		return nil
+	}
+	delete(store.users, user)
+	// The spotify account stays while another user is linked to it
+	if record.spotifyID != "" && !store.spotifyLinkedElsewhere(record.spotifyID, user) {
+		delete(store.spotify, record.spotifyID)
+	}
+	return nil
+}
+
+func (store *MemoryStore) GetUsersForTeam(ctx context.Context, team string) ([]string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	users := make([]string, 0)
+	for id, record := range store.users {
+		if record.team == team {
+			users = append(users, id)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (store *MemoryStore) GetSyncBatch(ctx context.Context, after string, limit int) ([]SyncUser, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// Walk the users in id order, the way the query does
+	ids := make([]string, 0, len(store.users))
+	for id := range store.users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	users := make([]SyncUser, 0)
+	for _, id := range ids {
+		if len(users) >= limit {
+			break
+		}
+		record := store.users[id]
+		account, linked := store.spotify[record.spotifyID]
+		if id <= after || !record.token.Valid || !linked {
+			continue
+		}
+		users = append(users, SyncUser{
+			ID:                      id,
+			Team:                    record.team,
+			SlackToken:              record.token.String,
+			Status:                  record.status,
+			SpotifyID:               record.spotifyID,
+			SpotifyAccessToken:      account.accessToken,
+			ProfileStatusText:       record.profileText,
+			ProfileStatusEmoji:      record.profileEmoji,
+			ProfileStatusExpiration: record.profileExpiration,
+			ProfileUpdatedAt:        record.profileUpdatedAt,
+			ProfileSource:           record.profileSource,
+			ManualOverride:          record.manualOverride,
+		})
+	}
+	return users, nil
+}
+
+func (store *MemoryStore) CountConnectedUsersByTeam(ctx context.Context) ([]TeamCount, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	byTeam := make(map[string]int)
+	for _, record := range store.users {
+		if record.token.Valid && record.spotifyID != "" && record.team != "" {
+			byTeam[record.team]++
+		}
+	}
+	counts := make([]TeamCount, 0, len(byTeam))
+	for team, count := range byTeam {
+		counts = append(counts, TeamCount{Team: team, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Team < counts[j].Team })
+	return counts, nil
+}
+
+func (store *MemoryStore) ListUsers(ctx context.Context) ([]UserSummary, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	users := make([]UserSummary, 0, len(store.users))
+	for id, record := range store.users {
+		summary := UserSummary{ID: id, Team: record.team, SlackConnected: record.token.Valid, SpotifyID: record.spotifyID,
+			Status: record.status, ManualOverride: record.manualOverride,
+			LastSyncAt: sql.NullTime{Time: record.lastSync.At, Valid: !record.lastSync.At.IsZero()}, LastSyncOutcome: record.lastSync.Outcome,
+			LastSyncError: record.lastSync.Error, LastWriteAt: sql.NullTime{Time: record.lastWrite.At, Valid: !record.lastWrite.At.IsZero()},
+			LastWriteOutcome: record.lastWrite.Outcome, LastWriteError: record.lastWrite.Error}
+		if account, linked := store.spotify[record.spotifyID]; linked {
+			summary.SpotifyExpiresAt = sql.NullTime{Time: account.expiresAt, Valid: true}
+		}
+		users = append(users, summary)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Team != users[j].Team {
+			return users[i].Team < users[j].Team
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+func (store *MemoryStore) RecordSyncResults(ctx context.Context, results []SyncResult) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	for _, result := range results {
+		if record, exists := store.users[result.User]; exists {
+			record.lastSync = LastResult{At: now, Outcome: result.Outcome, Error: result.Error}
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) RecordWriteResult(ctx context.Context, user string, outcome string, failure string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if record, exists := store.users[user]; exists {
+		record.lastWrite = LastResult{At: time.Now(), Outcome: outcome, Error: failure}
+	}
+	return nil
+}
+
+func (store *MemoryStore) ExportUser(ctx context.Context, user string) (*UserExport, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	export := &UserExport{AuditLog: make([]AuditRecord, 0), PendingJobs: make([]ExportedJob, 0), OAuthStates: make([]ExportedOAuthState, 0)}
+	redact := func(token string) string {
+		if token == "" {
+			return ""
+		}
+		return RedactedToken
+	}
+	if record, exists := store.users[user]; exists {
+		// Like the query, a saved token is redacted even if it's blank
+		slackToken := ""
+		if record.token.Valid {
+			slackToken = RedactedToken
+		}
+		account := &ExportedSlackAccount{ID: user, Team: record.team, SlackToken: slackToken, Status: record.status,
+			SpotifyID: record.spotifyID, ProfileStatusText: record.profileText, ProfileStatusEmoji: record.profileEmoji,
+			ProfileStatusExpiration: record.profileExpiration, ProfileSource: record.profileSource, ManualOverride: record.manualOverride,
+			LastSyncOutcome: record.lastSync.Outcome, LastSyncError: record.lastSync.Error,
+			LastWriteOutcome: record.lastWrite.Outcome, LastWriteError: record.lastWrite.Error}
+		if record.profileUpdatedAt.Valid {
+			updatedAt := record.profileUpdatedAt.Time
+			account.ProfileUpdatedAt = &updatedAt
+		}
+		if !record.lastSync.At.IsZero() {
+			syncedAt := record.lastSync.At
+			account.LastSyncAt = &syncedAt
+		}
+		if !record.lastWrite.At.IsZero() {
+			writtenAt := record.lastWrite.At
+			account.LastWriteAt = &writtenAt
+		}
+		export.SlackAccount = account
+		if spotifyAccount, linked := store.spotify[record.spotifyID]; linked {
+			expiresAt := spotifyAccount.expiresAt
+			export.SpotifyAccount = &ExportedSpotifyAccount{ID: record.spotifyID, AccessToken: redact(spotifyAccount.accessToken),
+				RefreshToken: redact(spotifyAccount.refreshToken), ExpiresAt: &expiresAt}
+		}
+	}
+	for _, record := range store.audit {
+		if record.User == user {
+			export.AuditLog = append(export.AuditLog, record)
+		}
+	}
+	// Jobs in the order they were queued, as ids are
+	ids := make([]int64, 0)
+	for id, existing := range store.jobs {
+		if existing.job.User == user {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		existing := store.jobs[id]
+		export.PendingJobs = append(export.PendingJobs, ExportedJob{Kind: existing.job.Kind, Payload: existing.job.Payload,
+			Attempts: existing.job.Attempts, LastError: existing.lastError, RunAt: existing.runAt})
+	}
+	for _, state := range store.oauth {
+		if state.user == user {
+			export.OAuthStates = append(export.OAuthStates, ExportedOAuthState{Provider: state.provider, ExpiresAt: state.expiresAt})
+		}
+	}
+	sort.Slice(export.OAuthStates, func(i, j int) bool { return export.OAuthStates[i].ExpiresAt.Before(export.OAuthStates[j].ExpiresAt) })
+	return export, nil
+}
+
+// Teams
+
+func (store *MemoryStore) EnsureTeamExists(ctx context.Context, team string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, exists := store.teams[team]; !exists {
+		store.teams[team] = &memoryTeam{}
+	}
+	return nil
+}
+
+func (store *MemoryStore) SetTokenForTeam(ctx context.Context, team string, token string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	record, exists := store.teams[team]
+	if !exists {
+		return errNoRowModified
+	}
+	record.token = token
+	return nil
+}
+
+func (store *MemoryStore) DeleteAllDataForTeam(ctx context.Context, team string, reason string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// Delete the users, their jobs and sign ins, and their spotify accounts unless a user in another team is linked to the same one
+	removed := 0
+	spotifyIDs := make([]string, 0)
+	for id, record := range store.users {
+		if record.team != team {
+			continue
+		}
+		store.deletePendingForUser(id)
+		delete(store.users, id)
+		if record.spotifyID != "" {
+			spotifyIDs = append(spotifyIDs, record.spotifyID)
+		}
+		removed++
+	}
+	for _, spotifyID := range spotifyIDs {
+		if !store.spotifyLinkedElsewhere(spotifyID, "") {
+			delete(store.spotify, spotifyID)
+		}
+	}
+	delete(store.teams, team)
+	store.addAuditRecord(team, "", "team_deleted", reason+", removed "+strconv.Itoa(removed)+" users")
+	return nil
+}
+
+func (store *MemoryStore) GetOwnedStatusesForTeam(ctx context.Context, team string) ([]OwnedStatus, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	statuses := make([]OwnedStatus, 0)
+	for id, record := range store.users {
+		if record.team == team && record.token.String != "" && record.status != "" {
+			statuses = append(statuses, OwnedStatus{User: id, Token: record.token.String, Status: record.status})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].User < statuses[j].User })
+	return statuses, nil
+}
+
+func (store *MemoryStore) ListTeams(ctx context.Context) ([]TeamSummary, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	teams := make([]TeamSummary, 0, len(store.teams))
+	for id, team := range store.teams {
+		summary := TeamSummary{ID: id, Installed: team.token != ""}
+		for _, record := range store.users {
+			if record.team == id {
+				summary.Users++
+			}
+		}
+		teams = append(teams, summary)
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].ID < teams[j].ID })
+	return teams, nil
+}
+
+// Spotify accounts
+
+func (store *MemoryStore) AddSpotifyToUser(ctx context.Context, user string, id string, accessToken string, refreshToken string, expiresIn int) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// Check the user first, so nothing is written if it fails - like the transaction rolling back
+	record, exists := store.users[user]
+	if !exists {
+		return errNoRowModified
+	}
+	store.spotify[id] = &memorySpotifyAccount{
+		accessToken:  accessToken,
+		refreshToken: refreshToken,
+		expiresAt:    time.Now().Add(time.Second * time.Duration(expiresIn)),
+	}
+	record.spotifyID = id
+	return nil
+}
+
+func (store *MemoryStore) GetSpotifyForUser(ctx context.Context, user string) (string, []string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	record, exists := store.users[user]
+	if !exists || record.spotifyID == "" {
+		return "", nil, nil
+	}
+	account, linked := store.spotify[record.spotifyID]
+	if !linked {
+		return "", nil, sql.ErrNoRows
+	}
+	return record.spotifyID, []string{account.accessToken, account.refreshToken}, nil
+}
+
+func (store *MemoryStore) DeleteSpotifyDataForUser(ctx context.Context, user string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	record, exists := store.users[user]
+	if !exists || record.spotifyID == "" {
+		return nil
+	}
+	spotifyID := record.spotifyID
+	record.spotifyID = ""
+	// The unlink is kept even if the delete fails, as it is in Postgres
+	if store.spotifyLinkedElsewhere(spotifyID, user) {
+		return errors.New("Spotify account " + spotifyID + " is linked to another user")
+	}
+	delete(store.spotify, spotifyID)
+	return nil
+}
+
+func (store *MemoryStore) GetAllUsersWhoExpireWithinXMinutes(ctx context.Context, minutes int) ([]string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	cutoff := time.Now().Add(time.Minute * time.Duration(minutes))
+	users := make([]string, 0)
+	for id, record := range store.users {
+		if account, linked := store.spotify[record.spotifyID]; linked && !account.expiresAt.After(cutoff) {
+			users = append(users, id)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// Whether any user other than the given one is linked to the spotify account
+func (store *MemoryStore) spotifyLinkedElsewhere(spotifyID string, user string) bool {
+	for id, record := range store.users {
+		if id != user && record.spotifyID == spotifyID {
+			return true
+		}
+	}
+	return false
+}
+
+// Jobs
+
+func (store *MemoryStore) EnqueueJob(ctx context.Context, kind string, user string, dedupeKey string, payload string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.enqueueJob(kind, user, dedupeKey, payload)
+	return nil
+}
+
+func (store *MemoryStore) EnqueueStatusJobs(ctx context.Context, statuses map[string]string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for user, status := range statuses {
+		kind := JobSetStatus
+		if status == "" {
+			kind = JobClearStatus
+		}
+		store.enqueueJob(kind, user, StatusJobKey(user), status)
+	}
+	return nil
+}
+
+func (store *MemoryStore) enqueueJob(kind string, user string, dedupeKey string, payload string) {
+	now := time.Now()
+	// A newer job replaces a waiting one with the same key, and resets its retries, but only if it actually differs
+	if dedupeKey != "" {
+		for _, existing := range store.jobs {
+			if existing.dedupeKey != dedupeKey {
+				continue
+			}
+			if existing.job.Kind != kind || existing.job.Payload != payload {
+				existing.job.Kind = kind
+				existing.job.Payload = payload
+				existing.job.Version++
+				existing.job.Attempts = 0
+				existing.lastError = ""
+				existing.runAt = now
+			}
+			return
+		}
+	}
+	store.nextJob++
+	store.jobs[store.nextJob] = &memoryJob{
+		job:       Job{ID: store.nextJob, Kind: kind, User: user, Payload: payload, Version: 1},
+		dedupeKey: dedupeKey,
+		runAt:     now,
+	}
+}
+
+func (store *MemoryStore) ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]Job, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	// Find the due jobs that nobody holds, oldest first
+	due := make([]*memoryJob, 0)
+	for _, queued := range store.jobs {
+		if !queued.runAt.After(now) && (queued.lockedUntil.IsZero() || queued.lockedUntil.Before(now)) {
+			due = append(due, queued)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].runAt.Equal(due[j].runAt) {
+			return due[i].job.ID < due[j].job.ID
+		}
+		return due[i].runAt.Before(due[j].runAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	// Lease them
+	jobs := make([]Job, 0, len(due))
+	for _, queued := range due {
+		queued.lockedUntil = now.Add(lease)
+		queued.job.Attempts++
+		jobs = append(jobs, queued.job)
+	}
+	return jobs, nil
+}
+
+func (store *MemoryStore) ClaimJobByKey(ctx context.Context, dedupeKey string, lease time.Duration) ([]Job, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	now := time.Now()
+	jobs := make([]Job, 0, 1)
+	for _, queued := range store.jobs {
+		if queued.dedupeKey == dedupeKey && !queued.runAt.After(now) && (queued.lockedUntil.IsZero() || queued.lockedUntil.Before(now)) {
+			queued.lockedUntil = now.Add(lease)
+			queued.job.Attempts++
+			jobs = append(jobs, queued.job)
+			break
+		}
+	}
+	return jobs, nil
+}
+
+func (store *MemoryStore) CompleteJob(ctx context.Context, job Job) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.finishJob(job)
+	return nil
+}
+
+func (store *MemoryStore) CompleteStatusJob(ctx context.Context, job Job, status string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if record, exists := store.users[job.User]; exists {
+		record.status = status
+	}
+	store.finishJob(job)
+	return nil
+}
+
+func (store *MemoryStore) RetryJob(ctx context.Context, job Job, failure string, retryAt time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	queued, exists := store.jobs[job.ID]
+	if !exists {
+		return nil
+	}
+	queued.lockedUntil = time.Time{}
+	queued.lastError = failure
+	if queued.job.Version == job.Version {
+		queued.runAt = retryAt
+	}
+	return nil
+}
+
+func (store *MemoryStore) AbandonJob(ctx context.Context, job Job, failure string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.finishJob(job)
+	store.addAuditRecord("", job.User, "job_abandoned", job.Kind+" after "+strconv.Itoa(job.Attempts)+" attempts: "+failure)
+	return nil
+}
+
+// Deletes the job if it is still the version that ran, otherwise just releases it
+func (store *MemoryStore) finishJob(job Job) {
+	queued, exists := store.jobs[job.ID]
+	if !exists {
+		return
+	}
+	if queued.job.Version == job.Version {
+		delete(store.jobs, job.ID)
+		return
+	}
+	queued.lockedUntil = time.Time{}
+}
+
+// Drops the user's queued jobs and any sign in they had started
+func (store *MemoryStore) deletePendingForUser(user string) {
+	for id, queued := range store.jobs {
+		if queued.job.User == user {
+			delete(store.jobs, id)
+		}
+	}
+	for nonce, state := range store.oauth {
+		if state.user == user {
+			delete(store.oauth, nonce)
+		}
+	}
+}
+
+// Audit log
+
+func (store *MemoryStore) AddAuditRecord(ctx context.Context, team string, user string, action string, detail string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.addAuditRecord(team, user, action, detail)
+	return nil
+}
+
+func (store *MemoryStore) addAuditRecord(team string, user string, action string, detail string) {
+	store.audit = append(store.audit, AuditRecord{At: time.Now(), Team: team, User: user, Action: action, Detail: detail})
+}
+
+func (store *MemoryStore) GetAuditRecords(ctx context.Context, limit int) ([]AuditRecord, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	records := make([]AuditRecord, 0, limit)
+	for index := len(store.audit) - 1; index >= 0 && len(records) < limit; index-- {
+		records = append(records, store.audit[index])
+	}
+	return records, nil
+}
+
+// OAuth states
+
+func (store *MemoryStore) SaveOAuthState(ctx context.Context, nonce string, provider string, user string, verifier string, expiresAt time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// Clear out states that were never used while we're here
+	now := time.Now()
+	for existing, state := range store.oauth {
+		if state.expiresAt.Before(now) {
+			delete(store.oauth, existing)
+		}
+	}
+	if _, exists := store.oauth[nonce]; exists {
+		return errors.New("OAuth state " + nonce + " already exists")
+	}
+	store.oauth[nonce] = memoryOAuthState{provider: provider, user: user, verifier: verifier, expiresAt: expiresAt}
+	return nil
+}
+
+func (store *MemoryStore) ConsumeOAuthState(ctx context.Context, nonce string, provider string) (string, string, bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	state, exists := store.oauth[nonce]
+	if !exists || state.provider != provider || state.expiresAt.Before(time.Now()) {
+		return "", "", false, nil
+	}
+	delete(store.oauth, nonce)
+	return state.user, state.verifier, true, nil
+}
+
+// Processed slack events
+
+func (store *MemoryStore) EventProcessed(ctx context.Context, id string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	expiresAt, exists := store.events[id]
+	return exists && !expiresAt.Before(time.Now()), nil
+}
+
+func (store *MemoryStore) RecordProcessedEvent(ctx context.Context, id string, expiresAt time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// Clear out expired events while we're here
+	now := time.Now()
+	for existing, existingExpiry := range store.events {
+		if existingExpiry.Before(now) {
+			delete(store.events, existing)
+		}
+	}
+	store.events[id] = expiresAt
+	return nil
+}
@@ -0,0 +1,241 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A numbered change to the schema. Down undoes Up. Migrations are applied in order and never edited once released -
+// changes to the schema go in a new migration at the end of the list.
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// The Postgres schema
+var migrations = []migration{
+	{
+		// Adopts databases created before migrations existed, which already have these tables
+		Version: 1,
+		Name:    "baseline",
+		Up: `
+			-- Stores information related to the bot user in each team - saved during callback
+			CREATE TABLE IF NOT EXISTS teams (id text CONSTRAINT team_pk PRIMARY KEY NOT null, accesstoken text);
+
+			-- Stores information for each connected spotify profile
+			CREATE TABLE IF NOT EXISTS spotifyaccounts (id text CONSTRAINT spotify_pk PRIMARY KEY NOT null,
+				accesstoken text, refreshtoken text, expirationat timestamp);
+
+			-- Stores information related to each slack user of the app
+			CREATE TABLE IF NOT EXISTS slackaccounts (id text CONSTRAINT slack_pk PRIMARY KEY NOT null,
+				status text, accesstoken text, spotify_id text, team_id text,
+				CONSTRAINT spotify_fk FOREIGN KEY(spotify_id) REFERENCES spotifyaccounts(id),
+				CONSTRAINT team_fk FOREIGN KEY(team_id) REFERENCES teams(id));`,
+		Down: `
+			DROP TABLE IF EXISTS slackaccounts;
+			DROP TABLE IF EXISTS spotifyaccounts;
+			DROP TABLE IF EXISTS teams;`,
+	},
+	{
+		// Record of destructive and security relevant actions
+		Version: 2,
+		Name:    "auditlog",
+		Up: `
+			CREATE TABLE IF NOT EXISTS auditlog (id bigserial CONSTRAINT audit_pk PRIMARY KEY,
+				at timestamp NOT null, team_id text, user_id text, action text NOT null, detail text);`,
+		Down: `DROP TABLE IF EXISTS auditlog;`,
+	},
+	{
+		// Cached copy of each user's slack status, kept current by profile events, and whether it pauses sync
+		Version: 3,
+		Name:    "slack_profile_cache",
+		Up: `
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS profile_status_text text;
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS profile_status_emoji text;
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS profile_status_expiration bigint;
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS profile_updated_at timestamp;
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS manual_override boolean NOT NULL DEFAULT false;`,
+		Down: `
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS manual_override;
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS profile_updated_at;
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS profile_status_expiration;
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS profile_status_emoji;
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS profile_status_text;`,
+	},
+	{
+		// Outbound slack writes waiting to be made. Jobs with the same dedupe key replace each other, so only the latest is sent.
+		Version: 4,
+		Name:    "jobs",
+		Up: `
+			CREATE TABLE IF NOT EXISTS jobs (id bigserial CONSTRAINT jobs_pk PRIMARY KEY,
+				kind text NOT null, user_id text NOT null, dedupe_key text CONSTRAINT jobs_dedupe_key UNIQUE, payload text NOT null,
+				version integer NOT null DEFAULT 1, attempts integer NOT null DEFAULT 0, last_error text,
+				run_at timestamp NOT null, locked_until timestamp, created_at timestamp NOT null);`,
+		Down: `DROP TABLE IF EXISTS jobs;`,
+	},
+	{
+		// Outstanding OAuth state tokens - each can be used once, before it expires. Verifier is set for PKCE flows.
+		Version: 5,
+		Name:    "oauthstates",
+		Up: `
+			CREATE TABLE IF NOT EXISTS oauthstates (nonce text CONSTRAINT oauthstate_pk PRIMARY KEY NOT null,
+				provider text NOT null, user_id text, expiresat timestamp NOT null);
+			ALTER TABLE oauthstates ADD COLUMN IF NOT EXISTS verifier text;`,
+		Down: `DROP TABLE IF EXISTS oauthstates;`,
+	},
+	{
+		// Slack events that have been processed, so any instance can spot a retried delivery until the row expires
+		Version: 6,
+		Name:    "slackevents",
+		Up: `
+			CREATE TABLE IF NOT EXISTS slackevents (event_id text CONSTRAINT slackevent_pk PRIMARY KEY NOT null,
+				expiresat timestamp NOT null);`,
+		Down: `DROP TABLE IF EXISTS slackevents;`,
+	},
+	{
+		// How each user's last sync and last status write went, shown on the admin dashboard
+		Version: 7,
+		Name:    "sync_results",
+		Up: `
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS lastsync_at timestamp;
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS lastsync_outcome text;
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS lastsync_error text;
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS lastwrite_at timestamp;
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS lastwrite_outcome text;
+			ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS lastwrite_error text;`,
+		Down: `
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS lastwrite_error;
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS lastwrite_outcome;
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS lastwrite_at;
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS lastsync_error;
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS lastsync_outcome;
+			ALTER TABLE slackaccounts DROP COLUMN IF EXISTS lastsync_at;`,
+	},
+	{
+		// Where the cached profile came from, since one read live goes stale sooner than one kept up to date by events
+		Version: 8,
+		Name:    "profile_source",
+		Up:      "ALTER TABLE slackaccounts ADD COLUMN IF NOT EXISTS profile_source text;",
+		Down:    "ALTER TABLE slackaccounts DROP COLUMN IF EXISTS profile_source;",
+	},
+}
+
+// Returns the newest migration applied to the database, and the newest of the steps this version of the app has
+func schemaVersion(ctx context.Context, database *sqlx.DB, steps []migration) (int, int, error) {
+	var current int
+	getError := database.GetContext(ctx, &current, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations;")
+	return current, steps[len(steps)-1].Version, getError
+}
+
+// What migrations are run on. On a connection each migration gets a transaction of its own; on a transaction they share it.
+type migrationTarget interface {
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Rebind(query string) string
+}
+
+// Applies the pending steps in order or, with down, undoes the applied ones newer than target, newest first. The caller
+// holds whatever lock stops others migrating at the same time. With dryRun, only logs what would be done and writes nothing.
+// The exists query reports whether schema_migrations has been created yet.
+func runMigrations(ctx context.Context, conn migrationTarget, steps []migration, existsQuery string, down bool, target int, dryRun bool) error {
+	// Find out which versions have been applied. A dry run leaves a database without the table untouched.
+	var tableExists bool
+	if existsError := conn.GetContext(ctx, &tableExists, existsQuery); existsError != nil {
+		return existsError
+	}
+	applied := make(map[int]bool)
+	if !tableExists && dryRun {
+		slog.Info("Dry run - Creating schema_migrations")
+	} else {
+		if !tableExists {
+			_, createError := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version integer CONSTRAINT schema_migrations_pk PRIMARY KEY,
+				name text NOT null, applied_at timestamp NOT null);`)
+			if createError != nil {
+				return createError
+			}
+		}
+		var versions []int
+		if selectError := conn.SelectContext(ctx, &versions, "SELECT version FROM schema_migrations;"); selectError != nil {
+			return selectError
+		}
+		for _, version := range versions {
+			applied[version] = true
+			// A newer release may have migrated further than this one knows about. Its migrations are left in place.
+			if version > steps[len(steps)-1].Version {
+				slog.Warn("Database has a migration which this version of the app doesn't know about", "version", version)
+			}
+		}
+	}
+
+	if !down {
+		for _, step := range steps {
+			if applied[step.Version] {
+				continue
+			}
+			if applyError := applyMigration(ctx, conn, step, true, dryRun); applyError != nil {
+				return applyError
+			}
+		}
+		return nil
+	}
+	for index := len(steps) - 1; index >= 0; index-- {
+		step := steps[index]
+		if step.Version <= target || !applied[step.Version] {
+			continue
+		}
+		if applyError := applyMigration(ctx, conn, step, false, dryRun); applyError != nil {
+			return applyError
+		}
+	}
+	return nil
+}
+
+// Applies or undoes a single migration along with its schema_migrations row, in one transaction
+func applyMigration(ctx context.Context, conn migrationTarget, step migration, up bool, dryRun bool) error {
+	statements := step.Up
+	direction := "Applying"
+	if !up {
+		statements = step.Down
+		direction = "Undoing"
+	}
+	if dryRun {
+		slog.Info("Dry run - "+direction+" migration", "version", step.Version, "name", step.Name, "statements", statements)
+		return nil
+	}
+	slog.Info(direction+" migration", "version", step.Version, "name", step.Name)
+
+	// Already in the caller's transaction
+	connection, ownTransaction := conn.(*sqlx.Conn)
+	if !ownTransaction {
+		return execMigration(ctx, conn, statements, step, up)
+	}
+	transaction, transactionError := connection.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+	if execError := execMigration(ctx, transaction, statements, step, up); execError != nil {
+		return rollbackOnError(transaction, execError)
+	}
+	return transaction.Commit()
+}
+
+// Runs a migration's statements and records or removes its schema_migrations row
+func execMigration(ctx context.Context, conn migrationTarget, statements string, step migration, up bool) error {
+	if _, execError := conn.ExecContext(ctx, statements); execError != nil {
+		return execError
+	}
+	var recordError error
+	if up {
+		_, recordError = conn.ExecContext(ctx, conn.Rebind("INSERT INTO schema_migrations VALUES (?, ?, ?);"), step.Version, step.Name, time.Now())
+	} else {
+		_, recordError = conn.ExecContext(ctx, conn.Rebind("DELETE FROM schema_migrations WHERE version=?;"), step.Version)
+	}
+	return recordError
+}
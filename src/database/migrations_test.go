@@ -0,0 +1,32 @@
+package database_test
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"rolflewis.com/spotify-status-sync/src/database"
+)
+
+func TestSQLiteMigratesOnceWhenStartedTogether(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		path := filepath.Join(t.TempDir(), "migrate.db")
+		var wait sync.WaitGroup
+		migrateErrors := make([]error, 4)
+		for index := range migrateErrors {
+			appDatabase := database.ConnectToDatabase("sqlite://"+path, "")
+			defer appDatabase.DisconnectDatabase()
+			wait.Add(1)
+			go func(index int) {
+				defer wait.Done()
+				migrateErrors[index] = appDatabase.MigrateUp(false)
+			}(index)
+		}
+		wait.Wait()
+		for _, migrateError := range migrateErrors {
+			if migrateError != nil {
+				t.Fatalf("migrating alongside others: %v", migrateError)
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Saves a newly issued state. User may be blank when the flow isn't started on behalf of a known user, and verifier when the flow doesn't use PKCE.
+func (store *PostgresStore) SaveOAuthState(ctx context.Context, nonce string, provider string, user string, verifier string, expiresAt time.Time) error {
+	// Clear out states that were never used while we're here
+	_, pruneError := store.db.ExecContext(ctx, "DELETE FROM oauthstates WHERE expiresat < $1;", time.Now())
+	if pruneError != nil {
+		return pruneError
+	}
+	_, insertError := store.db.ExecContext(ctx, "INSERT INTO oauthstates (nonce, provider, user_id, verifier, expiresat) VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5);",
+		nonce, provider, user, verifier, expiresAt)
+	return insertError
+}
+
+// Removes the state and returns the user and PKCE verifier it was issued with. Found is false if the state doesn't exist,
+// was for another provider, has expired or has already been used.
+func (store *PostgresStore) ConsumeOAuthState(ctx context.Context, nonce string, provider string) (string, string, bool, error) {
+	var state struct {
+		User     sql.NullString `db:"user_id"`
+		Verifier sql.NullString `db:"verifier"`
+	}
+	deleteError := store.db.GetContext(ctx, &state, "DELETE FROM oauthstates WHERE nonce=$1 AND provider=$2 AND expiresat >= $3 RETURNING user_id, verifier;", nonce, provider, time.Now())
+	if deleteError == sql.ErrNoRows {
+		return "", "", false, nil
+	} else if deleteError != nil {
+		return "", "", false, deleteError
+	}
+	return state.User.String, state.Verifier.String, true, nil
+}
@@ -1,62 +1,140 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"log"
-	"os"
+	"log/slog"
+	"strings"
 
+	"github.com/XSAM/otelsql"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"rolflewis.com/spotify-status-sync/src/tracing"
 )
 
-var appDatabase *sqlx.DB
+// Storage backed by Postgres
+type PostgresStore struct {
+	db   *sqlx.DB
+	keys *tokenKeyring
+}
+
+// Connects to the database at the url, encrypting tokens with the given keys. Urls starting sqlite:// open a SQLite
+// file at the path that follows, anything else is treated as Postgres.
+func ConnectToDatabase(url string, encryptionKeys string) Database {
+	// Tokens are encrypted at rest when keys are configured
+	keys, keyError := newTokenKeyring(encryptionKeys)
+	if keyError != nil {
+		log.Panic(keyError)
+	}
+	if keys.active == nil {
+		slog.Warn("$TOKEN_ENCRYPTION_KEYS is not set, so tokens will be stored unencrypted.")
+	}
+
+	if strings.HasPrefix(url, "sqlite://") {
+		store, sqliteError := openSQLite(sqlitePath(url), keys)
+		if sqliteError != nil {
+			log.Panic(sqliteError)
+		}
+		return store
+	}
 
-func ConnectToDatabase() {
-	database, dbError := sqlx.Connect("postgres", os.Getenv("DATABASE_URL"))
+	database, dbError := connectTraced("postgres", "postgresql", url)
 	if dbError != nil {
 		log.Panic(dbError)
 	}
 	// Performance Settings
 	database.SetConnMaxLifetime(0)
 	database.SetMaxOpenConns(10)
-	appDatabase = database
+	return &PostgresStore{db: database, keys: keys}
 }
 
-func DisconnectDatabase() {
-	dbError := appDatabase.Close()
-	if dbError != nil {
-		log.Println(dbError)
+// Opens and pings a database through the otelsql driver wrapper. Each query made with a context that carries a span
+// gets a span of its own, holding the statement but not its arguments.
+func connectTraced(driverName string, system string, dataSource string) (*sqlx.DB, error) {
+	wrapped, openError := otelsql.Open(driverName, dataSource,
+		otelsql.WithAttributes(attribute.String("db.system", system)),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitConnPrepare:      true,
+			OmitRows:             true,
+			OmitConnectorConnect: true,
+			SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+				return tracing.InSpan(ctx)
+			},
+		}))
+	if openError != nil {
+		return nil, openError
+	}
+	database := sqlx.NewDb(wrapped, driverName)
+	if pingError := database.Ping(); pingError != nil {
+		database.Close()
+		return nil, pingError
 	}
+	return database, nil
 }
 
-func ValidateSchema() {
-	createTableIfNotExists := func(tableParam string, createCmd string) {
-		// Check if the table exists
-		var tableName string
-		getError := appDatabase.Get(&tableName, "select table_name from information_schema.tables where table_name=$1", tableParam)
-		if getError != nil && getError != sql.ErrNoRows {
-			log.Panic(getError)
-		}
+func (store *PostgresStore) Ping(ctx context.Context) error {
+	return store.db.PingContext(ctx)
+}
 
-		if getError != nil {
-			_, tableCreateError := appDatabase.Exec(createCmd)
-			if tableCreateError != nil {
-				log.Println("Error when creating", tableParam, ":", createCmd)
-				log.Panic(tableCreateError)
-			}
-		}
+func (store *PostgresStore) Stats() sql.DBStats {
+	return store.db.Stats()
+}
+
+func (store *PostgresStore) DisconnectDatabase() {
+	dbError := store.db.Close()
+	if dbError != nil {
+		slog.Error("Could not close the database", "error", dbError)
 	}
+}
+
+// Deletes every row in every table. Only meant for databases used to test the store.
+func (store *PostgresStore) Reset() error {
+	_, truncateError := store.db.Exec("TRUNCATE jobs, auditlog, oauthstates, slackevents, slackaccounts, spotifyaccounts, teams RESTART IDENTITY;")
+	return truncateError
+}
+
+// Arbitrary key for the advisory lock that stops two processes migrating at once
+const migrationLockKey = 827361945
+
+// Applies every migration the database doesn't have yet, in order. With dryRun, only logs what would be applied.
+// Databases created before migrations existed are adopted by the baseline migration.
+func (store *PostgresStore) MigrateUp(dryRun bool) error {
+	return store.migrate(false, 0, dryRun)
+}
 
-	// Stores information related to the bot user in each team - saved during callback
-	createTableIfNotExists("teams", `CREATE TABLE teams (id text CONSTRAINT team_pk PRIMARY KEY NOT null, accesstoken text);`)
+// Undoes every applied migration newer than target, newest first. With dryRun, only logs what would be undone.
+func (store *PostgresStore) MigrateDown(target int, dryRun bool) error {
+	return store.migrate(true, target, dryRun)
+}
+
+// Returns the newest migration applied, and the newest this version of the app knows about
+func (store *PostgresStore) SchemaVersion(ctx context.Context) (int, int, error) {
+	return schemaVersion(ctx, store.db, migrations)
+}
 
-	// Stores information for each connected spotify profile
-	createTableIfNotExists("spotifyaccounts", `CREATE TABLE spotifyaccounts (id text CONSTRAINT spotify_pk PRIMARY KEY NOT null,
-		accesstoken text, refreshtoken text, expirationat timestamp);`)
+// Runs the migrations while holding the migration lock
+func (store *PostgresStore) migrate(down bool, target int, dryRun bool) error {
+	// Advisory locks belong to a session, so everything has to happen on one connection
+	ctx := context.Background()
+	conn, connError := store.db.Connx(ctx)
+	if connError != nil {
+		return connError
+	}
+	defer conn.Close()
+
+	// Wait for any other process that's migrating to finish
+	if _, lockError := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", migrationLockKey); lockError != nil {
+		return lockError
+	}
+	defer func() {
+		if _, unlockError := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1);", migrationLockKey); unlockError != nil {
+			slog.Error("Could not release migration lock", "error", unlockError)
+		}
+	}()
 
-	// Stores information related to each slack user of the app
-	createTableIfNotExists("slackaccounts", `CREATE TABLE slackaccounts (id text CONSTRAINT slack_pk PRIMARY KEY NOT null,
-		status text, accesstoken text, spotify_id text, team_id text,
-		CONSTRAINT spotify_fk FOREIGN KEY(spotify_id) REFERENCES spotifyaccounts(id),
-		CONSTRAINT team_fk FOREIGN KEY(team_id) REFERENCES teams(id));`)
+	return runMigrations(ctx, conn, migrations, "SELECT to_regclass('schema_migrations') IS NOT null;", down, target, dryRun)
 }
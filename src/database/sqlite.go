@@ -0,0 +1,785 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Storage backed by a SQLite file, for small installs that don't want to run Postgres
+type SQLiteStore struct {
+	db   *sqlx.DB
+	keys *tokenKeyring
+}
+
+var _ Database = (*SQLiteStore)(nil)
+
+// Opens the SQLite database at the path, creating it if needed. WAL mode lets the sync loops read while the workers write,
+// and immediate transactions take the write lock up front so concurrent writers wait for each other instead of deadlocking.
+// Tokens are encrypted with the keys.
+func openSQLite(path string, keys *tokenKeyring) (*SQLiteStore, error) {
+	database, dbError := connectTraced("sqlite3", "sqlite", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on&_txlock=immediate")
+	if dbError != nil {
+		return nil, dbError
+	}
+	return &SQLiteStore{db: database, keys: keys}, nil
+}
+
+func (store *SQLiteStore) Ping(ctx context.Context) error {
+	return store.db.PingContext(ctx)
+}
+
+func (store *SQLiteStore) Stats() sql.DBStats {
+	return store.db.Stats()
+}
+
+func (store *SQLiteStore) DisconnectDatabase() {
+	dbError := store.db.Close()
+	if dbError != nil {
+		slog.Error("Could not close the database", "error", dbError)
+	}
+}
+
+// Deletes every row in every table. Only meant for databases used to test the store.
+func (store *SQLiteStore) Reset() error {
+	_, deleteError := store.db.Exec(`DELETE FROM jobs; DELETE FROM auditlog; DELETE FROM oauthstates; DELETE FROM slackevents; DELETE FROM slackaccounts;
+		DELETE FROM spotifyaccounts; DELETE FROM teams; DELETE FROM sqlite_sequence;`)
+	return deleteError
+}
+
+// The SQLite schema. There are no SQLite databases from before migrations, so it starts from the schema as it is now.
+var sqliteMigrations = []migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: `
+			CREATE TABLE teams (id text PRIMARY KEY NOT null, accesstoken text);
+			CREATE TABLE spotifyaccounts (id text PRIMARY KEY NOT null, accesstoken text, refreshtoken text, expirationat timestamp);
+			CREATE TABLE slackaccounts (id text PRIMARY KEY NOT null,
+				status text, accesstoken text, spotify_id text REFERENCES spotifyaccounts(id), team_id text REFERENCES teams(id),
+				profile_status_text text, profile_status_emoji text, profile_status_expiration integer, profile_updated_at timestamp,
+				manual_override boolean NOT null DEFAULT false);
+			CREATE TABLE auditlog (id integer PRIMARY KEY AUTOINCREMENT,
+				at timestamp NOT null, team_id text, user_id text, action text NOT null, detail text);
+			CREATE TABLE jobs (id integer PRIMARY KEY AUTOINCREMENT,
+				kind text NOT null, user_id text NOT null, dedupe_key text UNIQUE, payload text NOT null,
+				version integer NOT null DEFAULT 1, attempts integer NOT null DEFAULT 0, last_error text,
+				run_at timestamp NOT null, locked_until timestamp, created_at timestamp NOT null);
+			CREATE TABLE oauthstates (nonce text PRIMARY KEY NOT null,
+				provider text NOT null, user_id text, verifier text, expiresat timestamp NOT null);`,
+		Down: `
+			DROP TABLE IF EXISTS oauthstates;
+			DROP TABLE IF EXISTS jobs;
+			DROP TABLE IF EXISTS auditlog;
+			DROP TABLE IF EXISTS slackaccounts;
+			DROP TABLE IF EXISTS spotifyaccounts;
+			DROP TABLE IF EXISTS teams;`,
+	},
+	{
+		Version: 2,
+		Name:    "slackevents",
+		Up:      `CREATE TABLE slackevents (event_id text PRIMARY KEY NOT null, expiresat timestamp NOT null);`,
+		Down:    `DROP TABLE IF EXISTS slackevents;`,
+	},
+	{
+		Version: 3,
+		Name:    "sync_results",
+		Up: `
+			ALTER TABLE slackaccounts ADD COLUMN lastsync_at timestamp;
+			ALTER TABLE slackaccounts ADD COLUMN lastsync_outcome text;
+			ALTER TABLE slackaccounts ADD COLUMN lastsync_error text;
+			ALTER TABLE slackaccounts ADD COLUMN lastwrite_at timestamp;
+			ALTER TABLE slackaccounts ADD COLUMN lastwrite_outcome text;
+			ALTER TABLE slackaccounts ADD COLUMN lastwrite_error text;`,
+		Down: `
+			ALTER TABLE slackaccounts DROP COLUMN lastwrite_error;
+			ALTER TABLE slackaccounts DROP COLUMN lastwrite_outcome;
+			ALTER TABLE slackaccounts DROP COLUMN lastwrite_at;
+			ALTER TABLE slackaccounts DROP COLUMN lastsync_error;
+			ALTER TABLE slackaccounts DROP COLUMN lastsync_outcome;
+			ALTER TABLE slackaccounts DROP COLUMN lastsync_at;`,
+	},
+	{
+		Version: 4,
+		Name:    "profile_source",
+		Up:      "ALTER TABLE slackaccounts ADD COLUMN profile_source text;",
+		Down:    "ALTER TABLE slackaccounts DROP COLUMN profile_source;",
+	},
+}
+
+// Applies every migration the database doesn't have yet, in order. With dryRun, only logs what would be applied.
+func (store *SQLiteStore) MigrateUp(dryRun bool) error {
+	return store.migrate(false, 0, dryRun)
+}
+
+// Undoes every applied migration newer than target, newest first. With dryRun, only logs what would be undone.
+func (store *SQLiteStore) MigrateDown(target int, dryRun bool) error {
+	return store.migrate(true, target, dryRun)
+}
+
+func (store *SQLiteStore) SchemaVersion(ctx context.Context) (int, int, error) {
+	return schemaVersion(ctx, store.db, sqliteMigrations)
+}
+
+// Runs the migrations in a single transaction. Transactions begin immediately (see openSQLite), so SQLite's write lock is
+// taken before the applied versions are read, and a process starting at the same time waits for it and then finds nothing
+// left to do. If any migration fails, none of them are applied.
+func (store *SQLiteStore) migrate(down bool, target int, dryRun bool) error {
+	ctx := context.Background()
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+	migrateError := runMigrations(ctx, transaction, sqliteMigrations, "SELECT count(*) > 0 FROM sqlite_master WHERE type='table' AND name='schema_migrations';", down, target, dryRun)
+	if migrateError != nil {
+		return rollbackOnError(transaction, migrateError)
+	}
+	return transaction.Commit()
+}
+
+func (store *SQLiteStore) EncryptPlaintextTokens() (int, error) {
+	if store.keys.active == nil {
+		return 0, nil
+	}
+	return reencryptTokens(store.db, store.keys, true)
+}
+
+func (store *SQLiteStore) ReencryptTokens(plaintextOnly bool) (int, error) {
+	return reencryptTokens(store.db, store.keys, plaintextOnly)
+}
+
+// Times are stored as UTC text, which sorts and compares in time order
+func sqliteNow() time.Time {
+	return time.Now().UTC()
+}
+
+func (store *SQLiteStore) getSingleString(ctx context.Context, query string, params ...interface{}) (string, error) {
+	var value sql.NullString
+	getError := store.db.GetContext(ctx, &value, query, params...)
+	if getError == sql.ErrNoRows {
+		return "", nil
+	}
+	return value.String, getError
+}
+
+func (store *SQLiteStore) updateRow(ctx context.Context, transaction *sqlx.Tx, mustEffect bool, query string, params ...interface{}) error {
+	return updateRowIn(ctx, store.db, transaction, mustEffect, query, params...)
+}
+
+// Users
+
+func (store *SQLiteStore) EnsureUserExists(ctx context.Context, user string) error {
+	_, insertError := store.db.ExecContext(ctx, "INSERT INTO slackaccounts (id) VALUES (?) ON CONFLICT (id) DO NOTHING;", user)
+	return insertError
+}
+
+func (store *SQLiteStore) SetTeamForUser(ctx context.Context, user string, team string) error {
+	return store.updateRow(ctx, nil, true, "UPDATE slackaccounts SET team_id=? WHERE id=?;", team, user)
+}
+
+func (store *SQLiteStore) SaveSlackTokenForUser(ctx context.Context, user string, token string) error {
+	encrypted, encryptError := store.keys.encryptToken(token, "slackaccounts", "accesstoken", user)
+	if encryptError != nil {
+		return encryptError
+	}
+	return store.updateRow(ctx, nil, true, "UPDATE slackaccounts SET accesstoken=? WHERE id=?;", encrypted, user)
+}
+
+func (store *SQLiteStore) GetSlackForUser(ctx context.Context, user string) (string, error) {
+	token, getError := store.getSingleString(ctx, "SELECT accesstoken FROM slackaccounts WHERE id=? AND accesstoken IS NOT null;", user)
+	if getError != nil {
+		return "", getError
+	}
+	return store.keys.decryptToken(token, "slackaccounts", "accesstoken", user)
+}
+
+func (store *SQLiteStore) GetTeamTokenForUser(ctx context.Context, user string) (string, error) {
+	// The team id is needed to decrypt the token
+	var stored struct {
+		Team  string `db:"id"`
+		Token string `db:"accesstoken"`
+	}
+	getError := store.db.GetContext(ctx, &stored, "SELECT teams.id, teams.accesstoken FROM slackaccounts INNER JOIN teams ON slackaccounts.team_id = teams.id WHERE slackaccounts.id=? AND teams.accesstoken IS NOT null;", user)
+	if getError == sql.ErrNoRows {
+		return "", nil
+	} else if getError != nil {
+		return "", getError
+	}
+	return store.keys.decryptToken(stored.Token, "teams", "accesstoken", stored.Team)
+}
+
+func (store *SQLiteStore) GetStatusForUser(ctx context.Context, user string) (string, error) {
+	return store.getSingleString(ctx, "SELECT status FROM slackaccounts WHERE id=? AND status IS NOT null;", user)
+}
+
+func (store *SQLiteStore) SetStatusForUser(ctx context.Context, user string, status string) error {
+	return store.updateRow(ctx, nil, true, "UPDATE slackaccounts SET status=? WHERE id=?;", status, user)
+}
+
+func (store *SQLiteStore) SetProfileForUser(ctx context.Context, user string, text string, emoji string, expiration int, source string) error {
+	return store.updateRow(ctx, nil, false, "UPDATE slackaccounts SET profile_status_text=?, profile_status_emoji=?, profile_status_expiration=?, profile_updated_at=?, profile_source=? WHERE id=?;",
+		text, emoji, expiration, sqliteNow(), source, user)
+}
+
+func (store *SQLiteStore) SetManualOverrideForUser(ctx context.Context, user string, overridden bool) (bool, error) {
+	query := "UPDATE slackaccounts SET manual_override=? WHERE id=? AND manual_override <> ?;"
+	if overridden {
+		query = "UPDATE slackaccounts SET manual_override=?, status='' WHERE id=? AND manual_override <> ?;"
+	}
+	results, updateError := store.db.ExecContext(ctx, query, overridden, user, overridden)
+	if updateError != nil {
+		return false, updateError
+	}
+	rowsAffected, affectedError := results.RowsAffected()
+	if affectedError != nil {
+		return false, affectedError
+	}
+	return rowsAffected > 0, nil
+}
+
+func (store *SQLiteStore) GetManualOverrideForUser(ctx context.Context, user string) (bool, error) {
+	var overridden bool
+	getError := store.db.GetContext(ctx, &overridden, "SELECT manual_override FROM slackaccounts WHERE id=?;", user)
+	if getError == sql.ErrNoRows {
+		return false, nil
+	}
+	return overridden, getError
+}
+
+// Deletes the user along with their spotify account, queued jobs and unfinished sign ins in a single transaction
+func (store *SQLiteStore) DeleteAllDataForUser(ctx context.Context, user string) error {
+	// Open a transaction on the DB - roll it back if anything fails
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+
+	// Drop anything still queued for the user
+	_, jobsDeleteError := transaction.ExecContext(ctx, "DELETE FROM jobs WHERE user_id=?;", user)
+	if jobsDeleteError != nil {
+		return rollbackOnError(transaction, jobsDeleteError)
+	}
+
+	// And any sign in they had started
+	_, statesDeleteError := transaction.ExecContext(ctx, "DELETE FROM oauthstates WHERE user_id=?;", user)
+	if statesDeleteError != nil {
+		return rollbackOnError(transaction, statesDeleteError)
+	}
+
+	// Delete the slack account record, keeping the spotify account id it linked to
+	var spotifyID string
+	slackDeleteError := transaction.GetContext(ctx, &spotifyID, "DELETE FROM slackaccounts WHERE id=? RETURNING COALESCE(spotify_id, '');", user)
+	if slackDeleteError != nil && slackDeleteError != sql.ErrNoRows {
+		return rollbackOnError(transaction, slackDeleteError)
+	}
+
+	// Delete the spotify record, unless another user is linked to the same account
+	if spotifyID != "" {
+		_, spotifyDeleteError := transaction.ExecContext(ctx, `DELETE FROM spotifyaccounts WHERE id=?
+			AND NOT EXISTS (SELECT 1 FROM slackaccounts WHERE slackaccounts.spotify_id = spotifyaccounts.id);`, spotifyID)
+		if spotifyDeleteError != nil {
+			return rollbackOnError(transaction, spotifyDeleteError)
+		}
+	}
+
+	// Commit the transaction to the DB
+	commitError := transaction.Commit()
+	if commitError != nil {
+		return rollbackOnError(transaction, commitError)
+	}
+
+	return nil
+}
+
+func (store *SQLiteStore) GetUsersForTeam(ctx context.Context, team string) ([]string, error) {
+	var users []string
+	selectError := store.db.SelectContext(ctx, &users, "SELECT id FROM slackaccounts WHERE team_id=? ORDER BY id;", team)
+	return users, selectError
+}
+
+func (store *SQLiteStore) GetSyncBatch(ctx context.Context, after string, limit int) ([]SyncUser, error) {
+	var users []SyncUser
+	selectError := store.db.SelectContext(ctx, &users, `SELECT slackaccounts.id, COALESCE(slackaccounts.team_id, '') AS team_id, slackaccounts.accesstoken AS slacktoken, COALESCE(slackaccounts.status, '') AS status,
+		spotifyaccounts.id AS spotifyid, spotifyaccounts.accesstoken AS spotifyaccesstoken,
+		COALESCE(slackaccounts.profile_status_text, '') AS profile_status_text, COALESCE(slackaccounts.profile_status_emoji, '') AS profile_status_emoji,
+		COALESCE(slackaccounts.profile_status_expiration, 0) AS profile_status_expiration, slackaccounts.profile_updated_at,
+		COALESCE(slackaccounts.profile_source, '') AS profile_source, slackaccounts.manual_override
+		FROM slackaccounts INNER JOIN spotifyaccounts ON slackaccounts.spotify_id = spotifyaccounts.id
+		WHERE slackaccounts.accesstoken IS NOT null AND slackaccounts.id > ?
+		ORDER BY slackaccounts.id LIMIT ?;`, after, limit)
+	if selectError != nil {
+		return nil, selectError
+	}
+	// Decrypt the tokens
+	for index := range users {
+		slackToken, slackError := store.keys.decryptToken(users[index].SlackToken, "slackaccounts", "accesstoken", users[index].ID)
+		if slackError != nil {
+			return nil, slackError
+		}
+		spotifyToken, spotifyError := store.keys.decryptToken(users[index].SpotifyAccessToken, "spotifyaccounts", "accesstoken", users[index].SpotifyID)
+		if spotifyError != nil {
+			return nil, spotifyError
+		}
+		users[index].SlackToken = slackToken
+		users[index].SpotifyAccessToken = spotifyToken
+	}
+	return users, nil
+}
+
+func (store *SQLiteStore) CountConnectedUsersByTeam(ctx context.Context) ([]TeamCount, error) {
+	counts := make([]TeamCount, 0)
+	selectError := store.db.SelectContext(ctx, &counts, `SELECT team_id, count(*) AS count FROM slackaccounts
+		WHERE accesstoken IS NOT null AND spotify_id IS NOT null AND team_id IS NOT null GROUP BY team_id ORDER BY team_id;`)
+	return counts, selectError
+}
+
+func (store *SQLiteStore) ListUsers(ctx context.Context) ([]UserSummary, error) {
+	users := make([]UserSummary, 0)
+	selectError := store.db.SelectContext(ctx, &users, "SELECT "+summaryColumns+`
+		FROM slackaccounts LEFT JOIN spotifyaccounts ON slackaccounts.spotify_id = spotifyaccounts.id
+		ORDER BY COALESCE(slackaccounts.team_id, ''), slackaccounts.id;`)
+	return users, selectError
+}
+
+func (store *SQLiteStore) RecordSyncResults(ctx context.Context, results []SyncResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+	now := sqliteNow()
+	for _, result := range results {
+		updateError := store.updateRow(ctx, transaction, false, "UPDATE slackaccounts SET lastsync_at=?, lastsync_outcome=?, lastsync_error=? WHERE id=?;",
+			now, result.Outcome, result.Error, result.User)
+		if updateError != nil {
+			return rollbackOnError(transaction, updateError)
+		}
+	}
+	commitError := transaction.Commit()
+	if commitError != nil {
+		return rollbackOnError(transaction, commitError)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) RecordWriteResult(ctx context.Context, user string, outcome string, failure string) error {
+	return store.updateRow(ctx, nil, false, "UPDATE slackaccounts SET lastwrite_at=?, lastwrite_outcome=?, lastwrite_error=? WHERE id=?;",
+		sqliteNow(), outcome, failure, user)
+}
+
+func (store *SQLiteStore) ExportUser(ctx context.Context, user string) (*UserExport, error) {
+	export := &UserExport{AuditLog: make([]AuditRecord, 0), PendingJobs: make([]ExportedJob, 0), OAuthStates: make([]ExportedOAuthState, 0)}
+	var account ExportedSlackAccount
+	accountError := store.db.GetContext(ctx, &account, "SELECT "+exportSlackColumns+" FROM slackaccounts WHERE id=?;", user)
+	if accountError != nil && accountError != sql.ErrNoRows {
+		return nil, accountError
+	}
+	if accountError == nil {
+		export.SlackAccount = &account
+		if account.SpotifyID != "" {
+			var spotifyAccount ExportedSpotifyAccount
+			spotifyError := store.db.GetContext(ctx, &spotifyAccount, "SELECT "+exportSpotifyColumns+" FROM spotifyaccounts WHERE id=?;", account.SpotifyID)
+			if spotifyError != nil {
+				return nil, spotifyError
+			}
+			export.SpotifyAccount = &spotifyAccount
+		}
+	}
+	auditError := store.db.SelectContext(ctx, &export.AuditLog, "SELECT "+exportAuditColumns+" FROM auditlog WHERE user_id=? ORDER BY id;", user)
+	if auditError != nil {
+		return nil, auditError
+	}
+	jobsError := store.db.SelectContext(ctx, &export.PendingJobs, "SELECT "+exportJobColumns+" FROM jobs WHERE user_id=? ORDER BY id;", user)
+	if jobsError != nil {
+		return nil, jobsError
+	}
+	statesError := store.db.SelectContext(ctx, &export.OAuthStates, "SELECT "+exportOAuthColumns+" FROM oauthstates WHERE user_id=? ORDER BY expiresat;", user)
+	if statesError != nil {
+		return nil, statesError
+	}
+	return export, nil
+}
+
+// Teams
+
+func (store *SQLiteStore) EnsureTeamExists(ctx context.Context, team string) error {
+	_, insertError := store.db.ExecContext(ctx, "INSERT INTO teams (id) VALUES (?) ON CONFLICT (id) DO NOTHING;", team)
+	return insertError
+}
+
+func (store *SQLiteStore) SetTokenForTeam(ctx context.Context, team string, token string) error {
+	encrypted, encryptError := store.keys.encryptToken(token, "teams", "accesstoken", team)
+	if encryptError != nil {
+		return encryptError
+	}
+	return store.updateRow(ctx, nil, true, "UPDATE teams SET accesstoken=? WHERE id=?;", encrypted, team)
+}
+
+func (store *SQLiteStore) DeleteAllDataForTeam(ctx context.Context, team string, reason string) error {
+	// Open a transaction on the DB - roll it back if anything fails
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+
+	// Drop anything still queued for the team's users, and any sign ins they had started
+	_, jobsDeleteError := transaction.ExecContext(ctx, "DELETE FROM jobs WHERE user_id IN (SELECT id FROM slackaccounts WHERE team_id=?);", team)
+	if jobsDeleteError != nil {
+		return rollbackOnError(transaction, jobsDeleteError)
+	}
+	_, statesDeleteError := transaction.ExecContext(ctx, "DELETE FROM oauthstates WHERE user_id IN (SELECT id FROM slackaccounts WHERE team_id=?);", team)
+	if statesDeleteError != nil {
+		return rollbackOnError(transaction, statesDeleteError)
+	}
+
+	// Delete the users so the team and spotify rows are no longer referenced. There's a spotify id for each, blank if they had none.
+	var spotifyIDs []string
+	usersDeleteError := transaction.SelectContext(ctx, &spotifyIDs, "DELETE FROM slackaccounts WHERE team_id=? RETURNING COALESCE(spotify_id, '');", team)
+	if usersDeleteError != nil {
+		return rollbackOnError(transaction, usersDeleteError)
+	}
+
+	// Delete their spotify accounts, unless a user in another team is linked to the same one
+	for _, spotifyID := range spotifyIDs {
+		if spotifyID == "" {
+			continue
+		}
+		_, spotifyDeleteError := transaction.ExecContext(ctx, `DELETE FROM spotifyaccounts WHERE id=?
+			AND NOT EXISTS (SELECT 1 FROM slackaccounts WHERE slackaccounts.spotify_id = spotifyaccounts.id);`, spotifyID)
+		if spotifyDeleteError != nil {
+			return rollbackOnError(transaction, spotifyDeleteError)
+		}
+	}
+
+	// Delete the team record
+	_, teamDeleteError := transaction.ExecContext(ctx, "DELETE FROM teams WHERE id=?;", team)
+	if teamDeleteError != nil {
+		return rollbackOnError(transaction, teamDeleteError)
+	}
+
+	// Audit the deletion
+	auditError := store.addAuditRecord(ctx, transaction, team, "", "team_deleted", reason+", removed "+strconv.Itoa(len(spotifyIDs))+" users")
+	if auditError != nil {
+		return rollbackOnError(transaction, auditError)
+	}
+
+	// Commit the transaction to the DB
+	commitError := transaction.Commit()
+	if commitError != nil {
+		return rollbackOnError(transaction, commitError)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) GetOwnedStatusesForTeam(ctx context.Context, team string) ([]OwnedStatus, error) {
+	var statuses []OwnedStatus
+	selectError := store.db.SelectContext(ctx, &statuses, "SELECT id, accesstoken, status FROM slackaccounts WHERE team_id=? AND accesstoken IS NOT null AND accesstoken <> '' AND status IS NOT null AND status <> '' ORDER BY id;", team)
+	if selectError != nil {
+		return nil, selectError
+	}
+	for index := range statuses {
+		token, decryptError := store.keys.decryptToken(statuses[index].Token, "slackaccounts", "accesstoken", statuses[index].User)
+		if decryptError != nil {
+			return nil, decryptError
+		}
+		statuses[index].Token = token
+	}
+	return statuses, nil
+}
+
+func (store *SQLiteStore) ListTeams(ctx context.Context) ([]TeamSummary, error) {
+	teams := make([]TeamSummary, 0)
+	selectError := store.db.SelectContext(ctx, &teams, `SELECT teams.id, teams.accesstoken IS NOT null AS installed, count(slackaccounts.id) AS users
+		FROM teams LEFT JOIN slackaccounts ON slackaccounts.team_id = teams.id
+		GROUP BY teams.id ORDER BY teams.id;`)
+	return teams, selectError
+}
+
+// Spotify accounts
+
+// Adds the spotify information to the DB using a transaction. Rolls back on any error.
+func (store *SQLiteStore) AddSpotifyToUser(ctx context.Context, user string, id string, accessToken string, refreshToken string, expiresIn int) error {
+	// Encrypt the tokens for storage
+	encryptedAccess, accessError := store.keys.encryptToken(accessToken, "spotifyaccounts", "accesstoken", id)
+	if accessError != nil {
+		return accessError
+	}
+	encryptedRefresh, refreshError := store.keys.encryptToken(refreshToken, "spotifyaccounts", "refreshtoken", id)
+	if refreshError != nil {
+		return refreshError
+	}
+
+	// Open a transaction on the DB - roll it back if anything fails
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+
+	// Insert the new spotify record
+	expirationTime := sqliteNow().Add(time.Second * time.Duration(expiresIn))
+	_, rowUpsertError := transaction.ExecContext(ctx, `INSERT INTO spotifyaccounts VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET accesstoken=excluded.accesstoken, refreshtoken=excluded.refreshtoken, expirationat=excluded.expirationat;`,
+		id, encryptedAccess, encryptedRefresh, expirationTime)
+	if rowUpsertError != nil {
+		return rollbackOnError(transaction, rowUpsertError)
+	}
+
+	// Tie the slack account to the spotify user
+	updateError := store.updateRow(ctx, transaction, true, "UPDATE slackaccounts SET spotify_id=? WHERE id=?;", id, user)
+	if updateError != nil {
+		return rollbackOnError(transaction, updateError)
+	}
+
+	// Commit the transaction to the DB
+	commitError := transaction.Commit()
+	if commitError != nil {
+		return rollbackOnError(transaction, commitError)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) GetSpotifyForUser(ctx context.Context, user string) (string, []string, error) {
+	// Get the spotify ID from the user
+	spotifyID, getError := store.getSingleString(ctx, "SELECT spotify_id FROM slackaccounts WHERE id=? AND spotify_id IS NOT null;", user)
+	if getError != nil || spotifyID == "" {
+		return "", nil, getError
+	}
+
+	// Get the spotify tokens
+	var stored struct {
+		AccessToken  string `db:"accesstoken"`
+		RefreshToken string `db:"refreshtoken"`
+	}
+	tokensError := store.db.GetContext(ctx, &stored, "SELECT accesstoken, refreshtoken FROM spotifyaccounts WHERE id=?;", spotifyID)
+	if tokensError != nil {
+		return "", nil, tokensError
+	}
+	accessToken, accessError := store.keys.decryptToken(stored.AccessToken, "spotifyaccounts", "accesstoken", spotifyID)
+	if accessError != nil {
+		return "", nil, accessError
+	}
+	refreshToken, refreshError := store.keys.decryptToken(stored.RefreshToken, "spotifyaccounts", "refreshtoken", spotifyID)
+	if refreshError != nil {
+		return "", nil, refreshError
+	}
+	return spotifyID, []string{accessToken, refreshToken}, nil
+}
+
+func (store *SQLiteStore) DeleteSpotifyDataForUser(ctx context.Context, user string) error {
+	// Get the spotify account id for the user
+	spotifyID, getError := store.getSingleString(ctx, "SELECT spotify_id FROM slackaccounts WHERE id=? AND spotify_id IS NOT null;", user)
+	if getError != nil {
+		return getError
+	}
+	// Remove the spotify record key from the slackaccount record first if exists
+	updateError := store.updateRow(ctx, nil, false, "UPDATE slackaccounts SET spotify_id=null WHERE id=?;", user)
+	if updateError != nil {
+		return updateError
+	}
+	// Delete the spotify record
+	if spotifyID != "" {
+		_, spotifyDeleteError := store.db.ExecContext(ctx, "DELETE FROM spotifyaccounts WHERE id=?;", spotifyID)
+		return spotifyDeleteError
+	}
+	return nil
+}
+
+func (store *SQLiteStore) GetAllUsersWhoExpireWithinXMinutes(ctx context.Context, minutes int) ([]string, error) {
+	cutoff := sqliteNow().Add(time.Minute * time.Duration(minutes))
+	var users []string
+	selectError := store.db.SelectContext(ctx, &users, "SELECT slackaccounts.id FROM slackaccounts INNER JOIN spotifyaccounts ON slackaccounts.spotify_id = spotifyaccounts.id WHERE spotifyaccounts.expirationat <= ? ORDER BY slackaccounts.id;", cutoff)
+	return users, selectError
+}
+
+// Jobs
+
+// Queues a job. If dedupe key is blank the job is always added, otherwise it replaces any waiting job with the same key.
+func (store *SQLiteStore) EnqueueJob(ctx context.Context, kind string, user string, dedupeKey string, payload string) error {
+	return store.enqueueJob(ctx, nil, kind, user, dedupeKey, payload)
+}
+
+// Queues status changes for many users in a single transaction
+func (store *SQLiteStore) EnqueueStatusJobs(ctx context.Context, statuses map[string]string) error {
+	if len(statuses) == 0 {
+		return nil
+	}
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+	for user, status := range statuses {
+		kind := JobSetStatus
+		if status == "" {
+			kind = JobClearStatus
+		}
+		if enqueueError := store.enqueueJob(ctx, transaction, kind, user, StatusJobKey(user), status); enqueueError != nil {
+			return rollbackOnError(transaction, enqueueError)
+		}
+	}
+	commitError := transaction.Commit()
+	if commitError != nil {
+		return rollbackOnError(transaction, commitError)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) enqueueJob(ctx context.Context, transaction *sqlx.Tx, kind string, user string, dedupeKey string, payload string) error {
+	now := sqliteNow()
+	return store.updateRow(ctx, transaction, false, "INSERT INTO jobs (kind, user_id, dedupe_key, payload, run_at, created_at) VALUES (?, ?, NULLIF(?, ''), ?, ?, ?)"+jobConflictClause,
+		kind, user, dedupeKey, payload, now, now)
+}
+
+// Leases up to limit due jobs. SQLite has a single writer, so the update can't race another worker's.
+func (store *SQLiteStore) ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]Job, error) {
+	now := sqliteNow()
+	var jobs []Job
+	claimError := store.db.SelectContext(ctx, &jobs, `UPDATE jobs SET locked_until=?, attempts=attempts+1
+		WHERE id IN (SELECT id FROM jobs WHERE run_at <= ? AND (locked_until IS null OR locked_until < ?) ORDER BY run_at, id LIMIT ?)
+		RETURNING id, kind, user_id, payload, version, attempts;`, now.Add(lease), now, now, limit)
+	return jobs, claimError
+}
+
+func (store *SQLiteStore) ClaimJobByKey(ctx context.Context, dedupeKey string, lease time.Duration) ([]Job, error) {
+	now := sqliteNow()
+	var jobs []Job
+	claimError := store.db.SelectContext(ctx, &jobs, `UPDATE jobs SET locked_until=?, attempts=attempts+1
+		WHERE dedupe_key=? AND run_at <= ? AND (locked_until IS null OR locked_until < ?)
+		RETURNING id, kind, user_id, payload, version, attempts;`, now.Add(lease), dedupeKey, now, now)
+	return jobs, claimError
+}
+
+func (store *SQLiteStore) CompleteJob(ctx context.Context, job Job) error {
+	return store.completeJob(ctx, job, nil)
+}
+
+func (store *SQLiteStore) CompleteStatusJob(ctx context.Context, job Job, status string) error {
+	return store.completeJob(ctx, job, &status)
+}
+
+func (store *SQLiteStore) completeJob(ctx context.Context, job Job, status *string) error {
+	// Open a transaction on the DB - roll it back if anything fails
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+
+	// Track the status change so sync can avoid unneccesary checks
+	if status != nil {
+		updateError := store.updateRow(ctx, transaction, false, "UPDATE slackaccounts SET status=? WHERE id=?;", *status, job.User)
+		if updateError != nil {
+			return rollbackOnError(transaction, updateError)
+		}
+	}
+
+	// Delete the job if it is still the version we ran, otherwise just release it
+	_, deleteError := transaction.ExecContext(ctx, "DELETE FROM jobs WHERE id=? AND version=?;", job.ID, job.Version)
+	if deleteError != nil {
+		return rollbackOnError(transaction, deleteError)
+	}
+	_, releaseError := transaction.ExecContext(ctx, "UPDATE jobs SET locked_until=null WHERE id=?;", job.ID)
+	if releaseError != nil {
+		return rollbackOnError(transaction, releaseError)
+	}
+
+	// Commit the transaction to the DB
+	commitError := transaction.Commit()
+	if commitError != nil {
+		return rollbackOnError(transaction, commitError)
+	}
+	return nil
+}
+
+func (store *SQLiteStore) RetryJob(ctx context.Context, job Job, failure string, retryAt time.Time) error {
+	_, updateError := store.db.ExecContext(ctx, `UPDATE jobs SET locked_until=null, last_error=?,
+		run_at=CASE WHEN version=? THEN ? ELSE run_at END WHERE id=?;`, failure, job.Version, retryAt.UTC(), job.ID)
+	return updateError
+}
+
+func (store *SQLiteStore) AbandonJob(ctx context.Context, job Job, failure string) error {
+	_, deleteError := store.db.ExecContext(ctx, "DELETE FROM jobs WHERE id=? AND version=?;", job.ID, job.Version)
+	if deleteError != nil {
+		return deleteError
+	}
+	_, releaseError := store.db.ExecContext(ctx, "UPDATE jobs SET locked_until=null WHERE id=?;", job.ID)
+	if releaseError != nil {
+		return releaseError
+	}
+	return store.addAuditRecord(ctx, nil, "", job.User, "job_abandoned", job.Kind+" after "+strconv.Itoa(job.Attempts)+" attempts: "+failure)
+}
+
+// Audit log
+
+func (store *SQLiteStore) addAuditRecord(ctx context.Context, transaction *sqlx.Tx, team string, user string, action string, detail string) error {
+	return store.updateRow(ctx, transaction, false, "INSERT INTO auditlog (at, team_id, user_id, action, detail) VALUES (?, NULLIF(?, ''), NULLIF(?, ''), ?, ?);",
+		sqliteNow(), team, user, action, detail)
+}
+
+func (store *SQLiteStore) AddAuditRecord(ctx context.Context, team string, user string, action string, detail string) error {
+	return store.addAuditRecord(ctx, nil, team, user, action, detail)
+}
+
+func (store *SQLiteStore) GetAuditRecords(ctx context.Context, limit int) ([]AuditRecord, error) {
+	var records []AuditRecord
+	selectError := store.db.SelectContext(ctx, &records, `SELECT at, COALESCE(team_id, '') AS team_id, COALESCE(user_id, '') AS user_id, action, COALESCE(detail, '') AS detail
+		FROM auditlog ORDER BY id DESC LIMIT ?;`, limit)
+	return records, selectError
+}
+
+// OAuth states
+
+func (store *SQLiteStore) SaveOAuthState(ctx context.Context, nonce string, provider string, user string, verifier string, expiresAt time.Time) error {
+	// Clear out states that were never used while we're here
+	_, pruneError := store.db.ExecContext(ctx, "DELETE FROM oauthstates WHERE expiresat < ?;", sqliteNow())
+	if pruneError != nil {
+		return pruneError
+	}
+	_, insertError := store.db.ExecContext(ctx, "INSERT INTO oauthstates (nonce, provider, user_id, verifier, expiresat) VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''), ?);",
+		nonce, provider, user, verifier, expiresAt.UTC())
+	return insertError
+}
+
+func (store *SQLiteStore) ConsumeOAuthState(ctx context.Context, nonce string, provider string) (string, string, bool, error) {
+	var state struct {
+		User     sql.NullString `db:"user_id"`
+		Verifier sql.NullString `db:"verifier"`
+	}
+	deleteError := store.db.GetContext(ctx, &state, "DELETE FROM oauthstates WHERE nonce=? AND provider=? AND expiresat >= ? RETURNING user_id, verifier;", nonce, provider, sqliteNow())
+	if deleteError == sql.ErrNoRows {
+		return "", "", false, nil
+	} else if deleteError != nil {
+		return "", "", false, deleteError
+	}
+	return state.User.String, state.Verifier.String, true, nil
+}
+
+// Processed slack events
+
+func (store *SQLiteStore) EventProcessed(ctx context.Context, id string) (bool, error) {
+	var processed bool
+	getError := store.db.GetContext(ctx, &processed, "SELECT EXISTS (SELECT 1 FROM slackevents WHERE event_id=? AND expiresat >= ?);", id, sqliteNow())
+	return processed, getError
+}
+
+func (store *SQLiteStore) RecordProcessedEvent(ctx context.Context, id string, expiresAt time.Time) error {
+	// Clear out expired events while we're here
+	_, pruneError := store.db.ExecContext(ctx, "DELETE FROM slackevents WHERE expiresat < ?;", sqliteNow())
+	if pruneError != nil {
+		return pruneError
+	}
+	_, insertError := store.db.ExecContext(ctx, `INSERT INTO slackevents (event_id, expiresat) VALUES (?, ?)
+		ON CONFLICT (event_id) DO UPDATE SET expiresat=excluded.expiresat;`, id, expiresAt.UTC())
+	return insertError
+}
+
+// Pulls the file path out of a sqlite:// url
+func sqlitePath(url string) string {
+	return strings.TrimPrefix(url, "sqlite://")
+}
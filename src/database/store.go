@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Slack users of the app, along with the status and profile state sync keeps for them
+type Users interface {
+	EnsureUserExists(ctx context.Context, user string) error
+	SetTeamForUser(ctx context.Context, user string, team string) error
+	SaveSlackTokenForUser(ctx context.Context, user string, token string) error
+	GetSlackForUser(ctx context.Context, user string) (string, error)
+	GetTeamTokenForUser(ctx context.Context, user string) (string, error)
+	GetStatusForUser(ctx context.Context, user string) (string, error)
+	SetStatusForUser(ctx context.Context, user string, status string) error
+	SetProfileForUser(ctx context.Context, user string, text string, emoji string, expiration int, source string) error
+	SetManualOverrideForUser(ctx context.Context, user string, overridden bool) (bool, error)
+	GetManualOverrideForUser(ctx context.Context, user string) (bool, error)
+	DeleteAllDataForUser(ctx context.Context, user string) error
+	GetUsersForTeam(ctx context.Context, team string) ([]string, error)
+	GetSyncBatch(ctx context.Context, after string, limit int) ([]SyncUser, error)
+	CountConnectedUsersByTeam(ctx context.Context) ([]TeamCount, error)
+	ListUsers(ctx context.Context) ([]UserSummary, error)
+	RecordSyncResults(ctx context.Context, results []SyncResult) error
+	RecordWriteResult(ctx context.Context, user string, outcome string, failure string) error
+	ExportUser(ctx context.Context, user string) (*UserExport, error)
+}
+
+// Slack workspaces the app is installed in
+type Teams interface {
+	EnsureTeamExists(ctx context.Context, team string) error
+	SetTokenForTeam(ctx context.Context, team string, token string) error
+	DeleteAllDataForTeam(ctx context.Context, team string, reason string) error
+	GetOwnedStatusesForTeam(ctx context.Context, team string) ([]OwnedStatus, error)
+	ListTeams(ctx context.Context) ([]TeamSummary, error)
+}
+
+// Spotify accounts linked to users
+type SpotifyAccounts interface {
+	AddSpotifyToUser(ctx context.Context, user string, id string, accessToken string, refreshToken string, expiresIn int) error
+	GetSpotifyForUser(ctx context.Context, user string) (string, []string, error)
+	DeleteSpotifyDataForUser(ctx context.Context, user string) error
+	GetAllUsersWhoExpireWithinXMinutes(ctx context.Context, minutes int) ([]string, error)
+}
+
+// Queued outbound slack writes
+type Jobs interface {
+	EnqueueJob(ctx context.Context, kind string, user string, dedupeKey string, payload string) error
+	EnqueueStatusJobs(ctx context.Context, statuses map[string]string) error
+	ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]Job, error)
+	ClaimJobByKey(ctx context.Context, dedupeKey string, lease time.Duration) ([]Job, error)
+	CompleteJob(ctx context.Context, job Job) error
+	CompleteStatusJob(ctx context.Context, job Job, status string) error
+	RetryJob(ctx context.Context, job Job, failure string, retryAt time.Time) error
+	AbandonJob(ctx context.Context, job Job, failure string) error
+}
+
+type AuditLog interface {
+	AddAuditRecord(ctx context.Context, team string, user string, action string, detail string) error
+	GetAuditRecords(ctx context.Context, limit int) ([]AuditRecord, error)
+}
+
+type OAuthStates interface {
+	SaveOAuthState(ctx context.Context, nonce string, provider string, user string, verifier string, expiresAt time.Time) error
+	ConsumeOAuthState(ctx context.Context, nonce string, provider string) (string, string, bool, error)
+}
+
+// Slack events that have been processed, so retried deliveries can be spotted by whichever instance they reach
+type ProcessedEvents interface {
+	EventProcessed(ctx context.Context, id string) (bool, error)
+	RecordProcessedEvent(ctx context.Context, id string, expiresAt time.Time) error
+}
+
+// Everything the app keeps. The slack, spotify, routes, jobs and oauthstate packages are handed one of these at startup.
+type Store interface {
+	Users
+	Teams
+	SpotifyAccounts
+	Jobs
+	AuditLog
+	OAuthStates
+	ProcessedEvents
+}
+
+// A Store backed by a real database, along with the upkeep run on it at startup and from the command line
+type Database interface {
+	Store
+	MigrateUp(dryRun bool) error
+	MigrateDown(target int, dryRun bool) error
+	// The newest migration applied, and the newest this version of the app knows about
+	SchemaVersion(ctx context.Context) (int, int, error)
+	EncryptPlaintextTokens() (int, error)
+	ReencryptTokens(plaintextOnly bool) (int, error)
+	// Deletes every row in every table. Only meant for databases used to test the store.
+	Reset() error
+	Ping(ctx context.Context) error
+	// Connection pool stats, for metrics
+	Stats() sql.DBStats
+	DisconnectDatabase()
+}
+
+var _ Database = (*PostgresStore)(nil)
@@ -0,0 +1,36 @@
+package database_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/database/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) database.Store {
+		return database.NewMemoryStore()
+	})
+}
+
+// Checks the database at $DATABASE_URL, encrypting tokens with $TOKEN_ENCRYPTION_KEYS. Every check deletes everything
+// in it, so only point it at a scratch database. Without it, a SQLite database in a temp dir is checked instead.
+func TestDatabaseStore(t *testing.T) {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		url = "sqlite://" + filepath.Join(t.TempDir(), "storetest.db")
+	}
+	appDatabase := database.ConnectToDatabase(url, os.Getenv("TOKEN_ENCRYPTION_KEYS"))
+	defer appDatabase.DisconnectDatabase()
+	if migrateError := appDatabase.MigrateUp(false); migrateError != nil {
+		t.Fatalf("migrating: %v", migrateError)
+	}
+	storetest.Run(t, func(t *testing.T) database.Store {
+		if resetError := appDatabase.Reset(); resetError != nil {
+			t.Fatalf("resetting: %v", resetError)
+		}
+		return appDatabase
+	})
+}
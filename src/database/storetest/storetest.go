@@ -0,0 +1,604 @@
+// Package storetest is the conformance suite every database.Store implementation has to pass, so the in-memory store
+// can stand in for the real ones.
+package storetest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rolflewis.com/spotify-status-sync/src/database"
+)
+
+// The checks don't exercise cancellation, so every call gets the same context
+var ctx = context.Background()
+
+// A named check run against a fresh, empty store
+type check struct {
+	name string
+	run  func(t *testing.T, store database.Store)
+}
+
+// Runs every check as a subtest, each against a new empty store from newStore
+func Run(t *testing.T, newStore func(t *testing.T) database.Store) {
+	for _, current := range checks {
+		current := current
+		t.Run(current.name, func(t *testing.T) {
+			current.run(t, newStore(t))
+		})
+	}
+}
+
+// Fails the check if err isn't nil
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Creates a team with a user in it who has a slack token
+func addUser(t *testing.T, store database.Store, team string, user string) {
+	t.Helper()
+	must(t, store.EnsureTeamExists(ctx, team))
+	must(t, store.SetTokenForTeam(ctx, team, "xoxb-"+team))
+	must(t, store.EnsureUserExists(ctx, user))
+	must(t, store.SetTeamForUser(ctx, user, team))
+	must(t, store.SaveSlackTokenForUser(ctx, user, "xoxp-"+user))
+}
+
+var checks = []check{
+	{"ensure user is idempotent", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.EnsureUserExists(ctx, "U1"))
+		token, tokenError := store.GetSlackForUser(ctx, "U1")
+		must(t, tokenError)
+		if token != "xoxp-U1" {
+			t.Errorf("ensuring an existing user replaced it, token is %q", token)
+		}
+	}},
+	{"updates that must effect a row fail for unknown users", func(t *testing.T, store database.Store) {
+		if store.SaveSlackTokenForUser(ctx, "nobody", "xoxp") == nil {
+			t.Errorf("saving a token for an unknown user succeeded")
+		}
+		if store.SetStatusForUser(ctx, "nobody", "status") == nil {
+			t.Errorf("setting a status for an unknown user succeeded")
+		}
+		if store.SetTokenForTeam(ctx, "nobody", "xoxb") == nil {
+			t.Errorf("setting a token for an unknown team succeeded")
+		}
+		if store.SetTeamForUser(ctx, "nobody", "T1") == nil {
+			t.Errorf("setting a team for an unknown user succeeded")
+		}
+		// Caching a profile isn't required to find anyone
+		must(t, store.SetProfileForUser(ctx, "nobody", "text", ":emoji:", 0, database.ProfileFromEvent))
+	}},
+	{"unknown users read as blank", func(t *testing.T, store database.Store) {
+		token, tokenError := store.GetSlackForUser(ctx, "nobody")
+		must(t, tokenError)
+		teamToken, teamError := store.GetTeamTokenForUser(ctx, "nobody")
+		must(t, teamError)
+		status, statusError := store.GetStatusForUser(ctx, "nobody")
+		must(t, statusError)
+		overridden, overrideError := store.GetManualOverrideForUser(ctx, "nobody")
+		must(t, overrideError)
+		spotifyID, tokens, spotifyError := store.GetSpotifyForUser(ctx, "nobody")
+		must(t, spotifyError)
+		if token != "" || teamToken != "" || status != "" || overridden || spotifyID != "" || tokens != nil {
+			t.Errorf("unknown user read as %q %q %q %v %q %v", token, teamToken, status, overridden, spotifyID, tokens)
+		}
+	}},
+	{"team token is read through the user", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		token, tokenError := store.GetTeamTokenForUser(ctx, "U1")
+		must(t, tokenError)
+		if token != "xoxb-T1" {
+			t.Errorf("team token is %q", token)
+		}
+	}},
+	{"spotify accounts are added and replaced", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access", "refresh", 3600))
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access2", "refresh2", 3600))
+		spotifyID, tokens, spotifyError := store.GetSpotifyForUser(ctx, "U1")
+		must(t, spotifyError)
+		if spotifyID != "S1" || len(tokens) != 2 || tokens[0] != "access2" || tokens[1] != "refresh2" {
+			t.Errorf("spotify account read as %q %v", spotifyID, tokens)
+		}
+	}},
+	{"adding spotify to an unknown user fails", func(t *testing.T, store database.Store) {
+		if store.AddSpotifyToUser(ctx, "nobody", "S1", "access", "refresh", 3600) == nil {
+			t.Errorf("adding spotify to an unknown user succeeded")
+		}
+	}},
+	{"expiring users are found by cutoff", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		addUser(t, store, "T1", "U2")
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access", "refresh", 600))
+		must(t, store.AddSpotifyToUser(ctx, "U2", "S2", "access", "refresh", 7200))
+		expiring, expiringError := store.GetAllUsersWhoExpireWithinXMinutes(ctx, 20)
+		must(t, expiringError)
+		if len(expiring) != 1 || expiring[0] != "U1" {
+			t.Errorf("expiring users are %v", expiring)
+		}
+	}},
+	{"disconnecting spotify keeps the user", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access", "refresh", 3600))
+		must(t, store.DeleteSpotifyDataForUser(ctx, "U1"))
+		spotifyID, _, spotifyError := store.GetSpotifyForUser(ctx, "U1")
+		must(t, spotifyError)
+		token, tokenError := store.GetSlackForUser(ctx, "U1")
+		must(t, tokenError)
+		if spotifyID != "" || token == "" {
+			t.Errorf("after disconnecting, spotify is %q and slack token is %q", spotifyID, token)
+		}
+		// Disconnecting again is fine
+		must(t, store.DeleteSpotifyDataForUser(ctx, "U1"))
+	}},
+	{"manual override reports changes and forgets our status", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.SetStatusForUser(ctx, "U1", "Listening"))
+		changed, overrideError := store.SetManualOverrideForUser(ctx, "U1", true)
+		must(t, overrideError)
+		if !changed {
+			t.Errorf("setting the override didn't report a change")
+		}
+		changed, overrideError = store.SetManualOverrideForUser(ctx, "U1", true)
+		must(t, overrideError)
+		if changed {
+			t.Errorf("setting the override twice reported a change")
+		}
+		status, statusError := store.GetStatusForUser(ctx, "U1")
+		must(t, statusError)
+		if status != "" {
+			t.Errorf("status is %q after the user set their own", status)
+		}
+		overridden, getError := store.GetManualOverrideForUser(ctx, "U1")
+		must(t, getError)
+		if !overridden {
+			t.Errorf("override didn't stick")
+		}
+		changed, overrideError = store.SetManualOverrideForUser(ctx, "U1", false)
+		must(t, overrideError)
+		if !changed {
+			t.Errorf("clearing the override didn't report a change")
+		}
+	}},
+	{"sync batches page through connected users", func(t *testing.T, store database.Store) {
+		for _, user := range []string{"U3", "U1", "U2", "U4"} {
+			addUser(t, store, "T1", user)
+		}
+		// U4 has no spotify, so isn't synced
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access1", "refresh", 3600))
+		must(t, store.AddSpotifyToUser(ctx, "U2", "S2", "access2", "refresh", 3600))
+		must(t, store.AddSpotifyToUser(ctx, "U3", "S3", "access3", "refresh", 3600))
+		must(t, store.SetProfileForUser(ctx, "U2", "In a meeting", ":calendar:", 0, database.ProfileFromRead))
+		first, firstError := store.GetSyncBatch(ctx, "", 2)
+		must(t, firstError)
+		if len(first) != 2 || first[0].ID != "U1" || first[1].ID != "U2" {
+			t.Fatalf("first batch is %+v", first)
+		}
+		if first[0].Team != "T1" || first[0].SlackToken != "xoxp-U1" || first[0].SpotifyID != "S1" || first[0].SpotifyAccessToken != "access1" || first[0].ProfileUpdatedAt.Valid {
+			t.Errorf("first user read as %+v", first[0])
+		}
+		if first[1].ProfileStatusText != "In a meeting" || first[1].ProfileStatusEmoji != ":calendar:" || !first[1].ProfileUpdatedAt.Valid ||
+			first[1].ProfileSource != database.ProfileFromRead {
+			t.Errorf("cached profile read as %+v", first[1])
+		}
+		second, secondError := store.GetSyncBatch(ctx, first[1].ID, 2)
+		must(t, secondError)
+		if len(second) != 1 || second[0].ID != "U3" {
+			t.Errorf("second batch is %+v", second)
+		}
+	}},
+	{"sync batches only skip users who never saved a slack token", func(t *testing.T, store database.Store) {
+		// U1 has never saved one, U2 saved a blank one, which is still a token as far as the query is concerned
+		for _, user := range []string{"U1", "U2"} {
+			must(t, store.EnsureUserExists(ctx, user))
+			must(t, store.AddSpotifyToUser(ctx, user, "S"+user, "access", "refresh", 3600))
+		}
+		must(t, store.SaveSlackTokenForUser(ctx, "U2", ""))
+		batch, batchError := store.GetSyncBatch(ctx, "", 10)
+		must(t, batchError)
+		if len(batch) != 1 || batch[0].ID != "U2" || batch[0].SlackToken != "" {
+			t.Errorf("batch is %+v", batch)
+		}
+	}},
+	{"connected users are counted by team", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		addUser(t, store, "T1", "U2")
+		addUser(t, store, "T2", "U3")
+		addUser(t, store, "T3", "U4")
+		// U2 and U4 have no spotify, so T3 has nobody connected
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access", "refresh", 3600))
+		must(t, store.AddSpotifyToUser(ctx, "U3", "S3", "access", "refresh", 3600))
+		counts, countError := store.CountConnectedUsersByTeam(ctx)
+		must(t, countError)
+		if len(counts) != 2 || counts[0] != (database.TeamCount{Team: "T1", Count: 1}) || counts[1] != (database.TeamCount{Team: "T2", Count: 1}) {
+			t.Errorf("counts are %+v", counts)
+		}
+	}},
+	{"users and teams are listed without tokens", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T2", "U3")
+		addUser(t, store, "T1", "U2")
+		addUser(t, store, "T1", "U1")
+		must(t, store.EnsureTeamExists(ctx, "T3"))
+		must(t, store.AddSpotifyToUser(ctx, "U2", "S2", "access", "refresh", 3600))
+		must(t, store.SetStatusForUser(ctx, "U2", "Song"))
+		users, usersError := store.ListUsers(ctx)
+		must(t, usersError)
+		if len(users) != 3 || users[0].ID != "U1" || users[1].ID != "U2" || users[2].ID != "U3" {
+			t.Fatalf("users are %+v", users)
+		}
+		if users[0].Team != "T1" || !users[0].SlackConnected || users[0].SpotifyID != "" || users[0].SpotifyExpiresAt.Valid {
+			t.Errorf("user without spotify read as %+v", users[0])
+		}
+		expiresIn := time.Until(users[1].SpotifyExpiresAt.Time)
+		if users[1].SpotifyID != "S2" || users[1].Status != "Song" || expiresIn < 55*time.Minute || expiresIn > 65*time.Minute {
+			t.Errorf("user with spotify read as %+v", users[1])
+		}
+		teams, teamsError := store.ListTeams(ctx)
+		must(t, teamsError)
+		expected := []database.TeamSummary{{ID: "T1", Installed: true, Users: 2}, {ID: "T2", Installed: true, Users: 1}, {ID: "T3"}}
+		if len(teams) != len(expected) {
+			t.Fatalf("teams are %+v", teams)
+		}
+		for index := range expected {
+			if teams[index] != expected[index] {
+				t.Errorf("teams are %+v", teams)
+				break
+			}
+		}
+	}},
+	{"last sync and write results are kept per user", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		addUser(t, store, "T1", "U2")
+		must(t, store.RecordSyncResults(ctx, []database.SyncResult{{User: "U1", Outcome: "queued"}, {User: "U2", Outcome: "error", Error: "Timed out"}}))
+		must(t, store.RecordSyncResults(ctx, nil))
+		must(t, store.RecordWriteResult(ctx, "U1", "set", ""))
+		// Results for users who have gone are dropped
+		must(t, store.RecordSyncResults(ctx, []database.SyncResult{{User: "U3", Outcome: "queued"}}))
+		must(t, store.RecordWriteResult(ctx, "U3", "skipped", ""))
+		users, usersError := store.ListUsers(ctx)
+		must(t, usersError)
+		if len(users) != 2 {
+			t.Fatalf("users are %+v", users)
+		}
+		sync, write := users[0].LastSync(), users[0].LastWrite()
+		if sync.Outcome != "queued" || sync.Error != "" || time.Since(sync.At) > time.Minute || write.Outcome != "set" || time.Since(write.At) > time.Minute {
+			t.Errorf("U1 results read as %+v, %+v", sync, write)
+		}
+		sync, write = users[1].LastSync(), users[1].LastWrite()
+		if sync.Outcome != "error" || sync.Error != "Timed out" || write.Outcome != "" || !write.At.IsZero() {
+			t.Errorf("U2 results read as %+v, %+v", sync, write)
+		}
+	}},
+	{"exports cover the user's rows without tokens", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		addUser(t, store, "T1", "U2")
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access", "refresh", 3600))
+		must(t, store.SetStatusForUser(ctx, "U1", "Song"))
+		must(t, store.SetProfileForUser(ctx, "U1", "Song", ":musical_note:", 0, database.ProfileFromEvent))
+		must(t, store.AddAuditRecord(ctx, "T1", "U1", "first", "detail"))
+		must(t, store.AddAuditRecord(ctx, "T1", "U2", "other", ""))
+		must(t, store.AddAuditRecord(ctx, "T1", "U1", "second", ""))
+		must(t, store.EnqueueJob(ctx, database.JobDirectMessage, "U1", "", "hello"))
+		must(t, store.EnqueueJob(ctx, database.JobPublishHome, "U2", "home:U2", ""))
+		must(t, store.SaveOAuthState(ctx, "nonce-U1", "spotify", "U1", "verifier", time.Now().Add(time.Minute)))
+		must(t, store.SaveOAuthState(ctx, "nonce-U2", "spotify", "U2", "", time.Now().Add(time.Minute)))
+		export, exportError := store.ExportUser(ctx, "U1")
+		must(t, exportError)
+		account := export.SlackAccount
+		if account == nil || account.ID != "U1" || account.Team != "T1" || account.Status != "Song" || account.SpotifyID != "S1" ||
+			account.ProfileStatusEmoji != ":musical_note:" || account.ProfileUpdatedAt == nil || account.ProfileSource != database.ProfileFromEvent || account.SlackToken != database.RedactedToken {
+			t.Errorf("slack account exported as %+v", account)
+		}
+		spotifyAccount := export.SpotifyAccount
+		if spotifyAccount == nil || spotifyAccount.ID != "S1" || spotifyAccount.AccessToken != database.RedactedToken ||
+			spotifyAccount.RefreshToken != database.RedactedToken || spotifyAccount.ExpiresAt == nil {
+			t.Errorf("spotify account exported as %+v", spotifyAccount)
+		}
+		if len(export.AuditLog) != 2 || export.AuditLog[0].Action != "first" || export.AuditLog[0].Detail != "detail" || export.AuditLog[1].Action != "second" {
+			t.Errorf("audit log exported as %+v", export.AuditLog)
+		}
+		if len(export.PendingJobs) != 1 || export.PendingJobs[0].Kind != database.JobDirectMessage || export.PendingJobs[0].Payload != "hello" {
+			t.Errorf("jobs exported as %+v", export.PendingJobs)
+		}
+		if len(export.OAuthStates) != 1 || export.OAuthStates[0].Provider != "spotify" || export.OAuthStates[0].ExpiresAt.IsZero() {
+			t.Errorf("oauth states exported as %+v", export.OAuthStates)
+		}
+		// Someone we know nothing about exports as empty
+		empty, emptyError := store.ExportUser(ctx, "nobody")
+		must(t, emptyError)
+		if empty.SlackAccount != nil || empty.SpotifyAccount != nil || len(empty.AuditLog) != 0 || len(empty.PendingJobs) != 0 ||
+			len(empty.OAuthStates) != 0 {
+			t.Errorf("unknown user exported as %+v", empty)
+		}
+	}},
+	{"deleting a user removes their data and jobs", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		addUser(t, store, "T1", "U2")
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access", "refresh", 3600))
+		must(t, store.EnqueueJob(ctx, database.JobPublishHome, "U1", "home:U1", ""))
+		must(t, store.EnqueueJob(ctx, database.JobPublishHome, "U2", "home:U2", ""))
+		must(t, store.SaveOAuthState(ctx, "nonce-U1", "spotify", "U1", "", time.Now().Add(time.Minute)))
+		must(t, store.SaveOAuthState(ctx, "nonce-U2", "spotify", "U2", "", time.Now().Add(time.Minute)))
+		must(t, store.DeleteAllDataForUser(ctx, "U1"))
+		must(t, store.DeleteAllDataForUser(ctx, "U1"))
+		users, usersError := store.GetUsersForTeam(ctx, "T1")
+		must(t, usersError)
+		if len(users) != 1 || users[0] != "U2" {
+			t.Errorf("users left in team are %v", users)
+		}
+		jobs, claimError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, claimError)
+		if len(jobs) != 1 || jobs[0].User != "U2" {
+			t.Errorf("jobs left are %+v", jobs)
+		}
+		_, _, found, consumeError := store.ConsumeOAuthState(ctx, "nonce-U1", "spotify")
+		must(t, consumeError)
+		if found {
+			t.Errorf("deleted user's oauth state was left behind")
+		}
+		_, _, found, consumeError = store.ConsumeOAuthState(ctx, "nonce-U2", "spotify")
+		must(t, consumeError)
+		if !found {
+			t.Errorf("another user's oauth state was deleted")
+		}
+	}},
+	{"deleting a user keeps a spotify account another user is linked to", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		addUser(t, store, "T1", "U2")
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access", "refresh", 3600))
+		must(t, store.AddSpotifyToUser(ctx, "U2", "S1", "access", "refresh", 3600))
+		must(t, store.EnqueueJob(ctx, database.JobPublishHome, "U1", "home:U1", ""))
+		must(t, store.DeleteAllDataForUser(ctx, "U1"))
+		users, usersError := store.GetUsersForTeam(ctx, "T1")
+		must(t, usersError)
+		if len(users) != 1 || users[0] != "U2" {
+			t.Errorf("users left in team are %v", users)
+		}
+		spotifyID, tokens, spotifyError := store.GetSpotifyForUser(ctx, "U2")
+		must(t, spotifyError)
+		if spotifyID != "S1" || len(tokens) != 2 || tokens[0] != "access" {
+			t.Errorf("other user's spotify account is %q %v", spotifyID, tokens)
+		}
+		jobs, claimError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, claimError)
+		if len(jobs) != 0 {
+			t.Errorf("jobs left for deleted user: %+v", jobs)
+		}
+		// Once the last user linked to it goes, so does the account, and it can be linked again from scratch
+		must(t, store.DeleteAllDataForUser(ctx, "U2"))
+		addUser(t, store, "T1", "U3")
+		must(t, store.AddSpotifyToUser(ctx, "U3", "S1", "access3", "refresh3", 3600))
+	}},
+	{"deleting a team removes everyone in it and audits it", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		addUser(t, store, "T1", "U2")
+		addUser(t, store, "T2", "U3")
+		must(t, store.AddSpotifyToUser(ctx, "U1", "S1", "access", "refresh", 3600))
+		must(t, store.AddSpotifyToUser(ctx, "U3", "S3", "access", "refresh", 3600))
+		must(t, store.EnqueueJob(ctx, database.JobPublishHome, "U1", "home:U1", ""))
+		must(t, store.SaveOAuthState(ctx, "nonce-U1", "spotify", "U1", "", time.Now().Add(time.Minute)))
+		must(t, store.DeleteAllDataForTeam(ctx, "T1", "app uninstalled"))
+		users, usersError := store.GetUsersForTeam(ctx, "T1")
+		must(t, usersError)
+		if len(users) != 0 {
+			t.Errorf("users left in deleted team: %v", users)
+		}
+		spotifyID, _, spotifyError := store.GetSpotifyForUser(ctx, "U3")
+		must(t, spotifyError)
+		if spotifyID != "S3" {
+			t.Errorf("user in another team lost their spotify account")
+		}
+		jobs, claimError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, claimError)
+		if len(jobs) != 0 {
+			t.Errorf("jobs left for deleted team: %+v", jobs)
+		}
+		_, _, found, consumeError := store.ConsumeOAuthState(ctx, "nonce-U1", "spotify")
+		must(t, consumeError)
+		if found {
+			t.Errorf("oauth state left for deleted team")
+		}
+		records, auditError := store.GetAuditRecords(ctx, 10)
+		must(t, auditError)
+		if len(records) != 1 || records[0].Action != "team_deleted" || records[0].Team != "T1" || records[0].Detail != "app uninstalled, removed 2 users" {
+			t.Errorf("audit records are %+v", records)
+		}
+		// The team can be installed again from scratch
+		addUser(t, store, "T1", "U1")
+	}},
+	{"owned statuses only include users we can clear", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		addUser(t, store, "T1", "U2")
+		must(t, store.SetStatusForUser(ctx, "U1", "Listening"))
+		statuses, statusError := store.GetOwnedStatusesForTeam(ctx, "T1")
+		must(t, statusError)
+		if len(statuses) != 1 || statuses[0].User != "U1" || statuses[0].Token != "xoxp-U1" || statuses[0].Status != "Listening" {
+			t.Errorf("owned statuses are %+v", statuses)
+		}
+	}},
+	{"jobs with the same key replace each other", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.EnqueueStatusJobs(ctx, map[string]string{"U1": "first"}))
+		must(t, store.EnqueueStatusJobs(ctx, map[string]string{"U1": "second"}))
+		must(t, store.EnqueueJob(ctx, database.JobDirectMessage, "U1", "", "hello"))
+		must(t, store.EnqueueJob(ctx, database.JobDirectMessage, "U1", "", "hello"))
+		jobs, claimError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, claimError)
+		statuses, messages := 0, 0
+		for _, job := range jobs {
+			if job.Kind == database.JobSetStatus {
+				statuses++
+				if job.Payload != "second" || job.Version != 2 || job.Attempts != 1 {
+					t.Errorf("status job is %+v", job)
+				}
+			} else if job.Kind == database.JobDirectMessage {
+				messages++
+			}
+		}
+		if statuses != 1 || messages != 2 {
+			t.Errorf("claimed %d status and %d message jobs", statuses, messages)
+		}
+	}},
+	{"leased jobs aren't claimed twice", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.EnqueueJob(ctx, database.JobPublishHome, "U1", "home:U1", ""))
+		first, firstError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, firstError)
+		second, secondError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, secondError)
+		if len(first) != 1 || len(second) != 0 {
+			t.Errorf("claimed %d then %d jobs", len(first), len(second))
+		}
+	}},
+	{"jobs can be claimed by key", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		addUser(t, store, "T1", "U2")
+		must(t, store.EnqueueStatusJobs(ctx, map[string]string{"U1": "first", "U2": "second"}))
+		must(t, store.EnqueueJob(ctx, database.JobPublishHome, "U2", "home:U2", ""))
+		claimed, claimError := store.ClaimJobByKey(ctx, database.StatusJobKey("U2"), time.Minute)
+		must(t, claimError)
+		if len(claimed) != 1 || claimed[0].User != "U2" || claimed[0].Payload != "second" || claimed[0].Attempts != 1 {
+			t.Fatalf("claimed %+v", claimed)
+		}
+		// It is leased like any other claim
+		again, againError := store.ClaimJobByKey(ctx, database.StatusJobKey("U2"), time.Minute)
+		must(t, againError)
+		rest, restError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, restError)
+		if len(again) != 0 || len(rest) != 2 {
+			t.Errorf("claimed %+v again and %+v after", again, rest)
+		}
+		missing, missingError := store.ClaimJobByKey(ctx, database.StatusJobKey("U3"), time.Minute)
+		must(t, missingError)
+		if len(missing) != 0 {
+			t.Errorf("claimed %+v for a user with nothing queued", missing)
+		}
+	}},
+	{"completing a status job records the status", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.EnqueueStatusJobs(ctx, map[string]string{"U1": "Listening"}))
+		jobs, claimError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, claimError)
+		if len(jobs) != 1 {
+			t.Fatalf("claimed %d jobs", len(jobs))
+		}
+		must(t, store.CompleteStatusJob(ctx, jobs[0], jobs[0].Payload))
+		status, statusError := store.GetStatusForUser(ctx, "U1")
+		must(t, statusError)
+		if status != "Listening" {
+			t.Errorf("status is %q", status)
+		}
+		// Clearing it is a new job, since the last one finished
+		must(t, store.EnqueueStatusJobs(ctx, map[string]string{"U1": ""}))
+		jobs, claimError = store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, claimError)
+		if len(jobs) != 1 || jobs[0].Kind != database.JobClearStatus {
+			t.Errorf("claimed %+v", jobs)
+		}
+	}},
+	{"a job replaced while running is kept", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.EnqueueStatusJobs(ctx, map[string]string{"U1": "first"}))
+		jobs, claimError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, claimError)
+		if len(jobs) != 1 {
+			t.Fatalf("claimed %d jobs", len(jobs))
+		}
+		must(t, store.EnqueueStatusJobs(ctx, map[string]string{"U1": "second"}))
+		must(t, store.CompleteStatusJob(ctx, jobs[0], jobs[0].Payload))
+		replacement, replacementError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, replacementError)
+		if len(replacement) != 1 || replacement[0].Payload != "second" {
+			t.Errorf("replacement is %+v", replacement)
+		}
+	}},
+	{"retried jobs wait until their retry time", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.EnqueueJob(ctx, database.JobPublishHome, "U1", "home:U1", ""))
+		jobs, claimError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, claimError)
+		if len(jobs) != 1 {
+			t.Fatalf("claimed %d jobs", len(jobs))
+		}
+		must(t, store.RetryJob(ctx, jobs[0], "slack is down", time.Now().Add(time.Hour)))
+		early, earlyError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, earlyError)
+		if len(early) != 0 {
+			t.Errorf("retried job was claimed before its retry time")
+		}
+	}},
+	{"abandoned jobs are removed and audited", func(t *testing.T, store database.Store) {
+		addUser(t, store, "T1", "U1")
+		must(t, store.EnqueueJob(ctx, database.JobDirectMessage, "U1", "", "hello"))
+		jobs, claimError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, claimError)
+		if len(jobs) != 1 {
+			t.Fatalf("claimed %d jobs", len(jobs))
+		}
+		must(t, store.AbandonJob(ctx, jobs[0], "channel_not_found"))
+		records, auditError := store.GetAuditRecords(ctx, 10)
+		must(t, auditError)
+		if len(records) != 1 || records[0].Action != "job_abandoned" || records[0].User != "U1" {
+			t.Errorf("audit records are %+v", records)
+		}
+		must(t, store.RetryJob(ctx, jobs[0], "late", time.Now()))
+		left, leftError := store.ClaimJobs(ctx, 10, time.Minute)
+		must(t, leftError)
+		if len(left) != 0 {
+			t.Errorf("abandoned job is still queued")
+		}
+	}},
+	{"audit records are read newest first", func(t *testing.T, store database.Store) {
+		must(t, store.AddAuditRecord(ctx, "T1", "", "first", ""))
+		must(t, store.AddAuditRecord(ctx, "", "U1", "second", "detail"))
+		records, auditError := store.GetAuditRecords(ctx, 1)
+		must(t, auditError)
+		if len(records) != 1 || records[0].Action != "second" || records[0].User != "U1" || records[0].Team != "" || records[0].Detail != "detail" {
+			t.Errorf("audit records are %+v", records)
+		}
+	}},
+	{"oauth states are single use and provider bound", func(t *testing.T, store database.Store) {
+		must(t, store.SaveOAuthState(ctx, "nonce", "spotify", "U1", "verifier", time.Now().Add(time.Hour)))
+		_, _, found, consumeError := store.ConsumeOAuthState(ctx, "nonce", "slack")
+		must(t, consumeError)
+		if found {
+			t.Errorf("state was consumed for the wrong provider")
+		}
+		user, verifier, found, consumeError := store.ConsumeOAuthState(ctx, "nonce", "spotify")
+		must(t, consumeError)
+		if !found || user != "U1" || verifier != "verifier" {
+			t.Errorf("state read as %q %q %v", user, verifier, found)
+		}
+		_, _, found, consumeError = store.ConsumeOAuthState(ctx, "nonce", "spotify")
+		must(t, consumeError)
+		if found {
+			t.Errorf("state was consumed twice")
+		}
+	}},
+	{"processed events are remembered until they expire", func(t *testing.T, store database.Store) {
+		must(t, store.RecordProcessedEvent(ctx, "Ev1", time.Now().Add(time.Hour)))
+		must(t, store.RecordProcessedEvent(ctx, "Ev2", time.Now().Add(-time.Minute)))
+		// Recording one again, such as from another instance, is fine
+		must(t, store.RecordProcessedEvent(ctx, "Ev1", time.Now().Add(time.Hour)))
+		for id, expected := range map[string]bool{"Ev1": true, "Ev2": false, "Ev3": false} {
+			processed, processedError := store.EventProcessed(ctx, id)
+			must(t, processedError)
+			if processed != expected {
+				t.Errorf("%s read as processed %v", id, processed)
+			}
+		}
+	}},
+	{"expired oauth states aren't accepted", func(t *testing.T, store database.Store) {
+		must(t, store.SaveOAuthState(ctx, "nonce", "slack", "", "", time.Now().Add(-time.Minute)))
+		_, _, found, consumeError := store.ConsumeOAuthState(ctx, "nonce", "slack")
+		must(t, consumeError)
+		if found {
+			t.Errorf("expired state was accepted")
+		}
+	}},
+}
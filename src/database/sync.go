@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Where a cached profile came from
+const (
+	// A user_change or user_status_changed event, which keeps it current
+	ProfileFromEvent = "event"
+	// A live read during a sync, which nothing updates until the next read
+	ProfileFromRead = "read"
+)
+
+// Everything the sync loop needs for a single user
+type SyncUser struct {
+	ID                 string `db:"id"`
+	Team               string `db:"team_id"`
+	SlackToken         string `db:"slacktoken"`
+	Status             string `db:"status"`
+	SpotifyID          string `db:"spotifyid"`
+	SpotifyAccessToken string `db:"spotifyaccesstoken"`
+	// Cached slack profile - ProfileUpdatedAt is null if nothing has been cached yet
+	ProfileStatusText       string       `db:"profile_status_text"`
+	ProfileStatusEmoji      string       `db:"profile_status_emoji"`
+	ProfileStatusExpiration int          `db:"profile_status_expiration"`
+	ProfileUpdatedAt        sql.NullTime `db:"profile_updated_at"`
+	// ProfileFromEvent or ProfileFromRead - blank for profiles cached before this was kept
+	ProfileSource  string `db:"profile_source"`
+	ManualOverride bool   `db:"manual_override"`
+}
+
+// Gets the next batch of connected users ordered by id, starting after the given id. Pass "" to start from the beginning.
+func (store *PostgresStore) GetSyncBatch(ctx context.Context, after string, limit int) ([]SyncUser, error) {
+	var users []SyncUser
+	selectError := store.db.SelectContext(ctx, &users, `SELECT slackaccounts.id, COALESCE(slackaccounts.team_id, '') AS team_id, slackaccounts.accesstoken AS slacktoken, COALESCE(slackaccounts.status, '') AS status,
+		spotifyaccounts.id AS spotifyid, spotifyaccounts.accesstoken AS spotifyaccesstoken,
+		COALESCE(slackaccounts.profile_status_text, '') AS profile_status_text, COALESCE(slackaccounts.profile_status_emoji, '') AS profile_status_emoji,
+		COALESCE(slackaccounts.profile_status_expiration, 0) AS profile_status_expiration, slackaccounts.profile_updated_at,
+		COALESCE(slackaccounts.profile_source, '') AS profile_source, slackaccounts.manual_override
+		FROM slackaccounts INNER JOIN spotifyaccounts ON slackaccounts.spotify_id = spotifyaccounts.id
+		WHERE slackaccounts.accesstoken IS NOT null AND slackaccounts.id > $1
+		ORDER BY slackaccounts.id LIMIT $2;`, after, limit)
+	if selectError != nil {
+		return nil, selectError
+	}
+	// Decrypt the tokens
+	for index := range users {
+		slackToken, slackError := store.keys.decryptToken(users[index].SlackToken, "slackaccounts", "accesstoken", users[index].ID)
+		if slackError != nil {
+			return nil, slackError
+		}
+		spotifyToken, spotifyError := store.keys.decryptToken(users[index].SpotifyAccessToken, "spotifyaccounts", "accesstoken", users[index].SpotifyID)
+		if spotifyError != nil {
+			return nil, spotifyError
+		}
+		users[index].SlackToken = slackToken
+		users[index].SpotifyAccessToken = spotifyToken
+	}
+	return users, nil
+}
+
+// How many users in a team are synced
+type TeamCount struct {
+	Team  string `db:"team_id"`
+	Count int    `db:"count"`
+}
+
+// Counts the users who have both slack and spotify connected, for each team that has any
+func (store *PostgresStore) CountConnectedUsersByTeam(ctx context.Context) ([]TeamCount, error) {
+	counts := make([]TeamCount, 0)
+	selectError := store.db.SelectContext(ctx, &counts, `SELECT team_id, count(*) AS count FROM slackaccounts
+		WHERE accesstoken IS NOT null AND spotify_id IS NOT null AND team_id IS NOT null GROUP BY team_id ORDER BY team_id;`)
+	return counts, selectError
+}
+
+// What the admin dashboard shows about a user. Tokens are left out - only whether they are connected.
+type UserSummary struct {
+	ID             string `db:"id"`
+	Team           string `db:"team_id"`
+	SlackConnected bool   `db:"slackconnected"`
+	SpotifyID      string `db:"spotifyid"`
+	// Null when spotify isn't connected
+	SpotifyExpiresAt sql.NullTime `db:"spotifyexpiresat"`
+	Status           string       `db:"status"`
+	ManualOverride   bool         `db:"manual_override"`
+	// How the last sync and last status write went. The times are null until there has been one.
+	LastSyncAt       sql.NullTime `db:"lastsync_at"`
+	LastSyncOutcome  string       `db:"lastsync_outcome"`
+	LastSyncError    string       `db:"lastsync_error"`
+	LastWriteAt      sql.NullTime `db:"lastwrite_at"`
+	LastWriteOutcome string       `db:"lastwrite_outcome"`
+	LastWriteError   string       `db:"lastwrite_error"`
+}
+
+// How a sync or status write went. Outcome is blank if there hasn't been one, and Error is blank unless it failed.
+type LastResult struct {
+	At      time.Time
+	Outcome string
+	Error   string
+}
+
+// How the user's last sync went
+func (summary UserSummary) LastSync() LastResult {
+	return LastResult{At: summary.LastSyncAt.Time, Outcome: summary.LastSyncOutcome, Error: summary.LastSyncError}
+}
+
+// How the user's last status write went
+func (summary UserSummary) LastWrite() LastResult {
+	return LastResult{At: summary.LastWriteAt.Time, Outcome: summary.LastWriteOutcome, Error: summary.LastWriteError}
+}
+
+// The columns of slackaccounts a UserSummary is read from
+const summaryColumns = `slackaccounts.id, COALESCE(slackaccounts.team_id, '') AS team_id,
+		slackaccounts.accesstoken IS NOT null AS slackconnected, COALESCE(slackaccounts.spotify_id, '') AS spotifyid,
+		spotifyaccounts.expirationat AS spotifyexpiresat, COALESCE(slackaccounts.status, '') AS status, slackaccounts.manual_override,
+		slackaccounts.lastsync_at, COALESCE(slackaccounts.lastsync_outcome, '') AS lastsync_outcome,
+		COALESCE(slackaccounts.lastsync_error, '') AS lastsync_error, slackaccounts.lastwrite_at,
+		COALESCE(slackaccounts.lastwrite_outcome, '') AS lastwrite_outcome, COALESCE(slackaccounts.lastwrite_error, '') AS lastwrite_error`
+
+// Lists every user, ordered by team and then id
+func (store *PostgresStore) ListUsers(ctx context.Context) ([]UserSummary, error) {
+	users := make([]UserSummary, 0)
+	selectError := store.db.SelectContext(ctx, &users, "SELECT "+summaryColumns+`
+		FROM slackaccounts LEFT JOIN spotifyaccounts ON slackaccounts.spotify_id = spotifyaccounts.id
+		ORDER BY COALESCE(slackaccounts.team_id, ''), slackaccounts.id;`)
+	return users, selectError
+}
+
+// How syncing a user went in a sync run. Error is blank unless it failed.
+type SyncResult struct {
+	User    string
+	Outcome string
+	Error   string
+}
+
+// Records how each user's sync went, in one statement for the whole run
+func (store *PostgresStore) RecordSyncResults(ctx context.Context, results []SyncResult) error {
+	// Nothing to write
+	if len(results) == 0 {
+		return nil
+	}
+	// Split the results into parallel arrays so they can be unnested into rows
+	users := make([]string, 0, len(results))
+	outcomes := make([]string, 0, len(results))
+	failures := make([]string, 0, len(results))
+	for _, result := range results {
+		users = append(users, result.User)
+		outcomes = append(outcomes, result.Outcome)
+		failures = append(failures, result.Error)
+	}
+	_, updateError := store.db.ExecContext(ctx, `UPDATE slackaccounts SET lastsync_at=$4, lastsync_outcome=results.outcome, lastsync_error=results.error
+		FROM unnest($1::text[], $2::text[], $3::text[]) AS results(id, outcome, error) WHERE slackaccounts.id = results.id;`,
+		pq.Array(users), pq.Array(outcomes), pq.Array(failures), time.Now())
+	return updateError
+}
+
+// Records how the user's last status write went. Users who have since been removed are skipped.
+func (store *PostgresStore) RecordWriteResult(ctx context.Context, user string, outcome string, failure string) error {
+	return store.updateRow(ctx, nil, false, "UPDATE slackaccounts SET lastwrite_at=$1, lastwrite_outcome=$2, lastwrite_error=$3 WHERE id=$4;",
+		time.Now(), outcome, failure, user)
+}
@@ -1,26 +1,33 @@
 package database
 
-func addNewTeam(team string) error {
-	_, rowInsertError := appDatabase.Exec("INSERT INTO teams VALUES ($1);", team)
+import (
+	"context"
+	"strconv"
+
+	"github.com/lib/pq"
+)
+
+func (store *PostgresStore) addNewTeam(ctx context.Context, team string) error {
+	_, rowInsertError := store.db.ExecContext(ctx, "INSERT INTO teams VALUES ($1);", team)
 	return rowInsertError
 }
 
-func teamExists(team string) (bool, error) {
+func (store *PostgresStore) teamExists(ctx context.Context, team string) (bool, error) {
 	// Get the team
-	result, getError := getSingleString("SELECT id FROM teams WHERE id=$1;", team)
+	result, getError := store.getSingleString(ctx, "SELECT id FROM teams WHERE id=$1;", team)
 	return (result != ""), getError
 }
 
-func EnsureTeamExists(team string) error {
+func (store *PostgresStore) EnsureTeamExists(ctx context.Context, team string) error {
 	// Make sure that a team record exists for the id
-	exists, existsError := teamExists(team)
+	exists, existsError := store.teamExists(ctx, team)
 	if existsError != nil {
 		return existsError
 	}
 
 	// Create a team record if needed
 	if !exists {
-		teamAddError := addNewTeam(team)
+		teamAddError := store.addNewTeam(ctx, team)
 		if teamAddError != nil {
 			return teamAddError
 		}
@@ -29,11 +36,113 @@ func EnsureTeamExists(team string) error {
 	return nil
 }
 
-func SetTokenForTeam(team string, token string) error {
-	return updateRow(nil, true, "UPDATE teams SET accesstoken=$1 WHERE id=$2;", token, team)
+func (store *PostgresStore) SetTokenForTeam(ctx context.Context, team string, token string) error {
+	encrypted, encryptError := store.keys.encryptToken(token, "teams", "accesstoken", team)
+	if encryptError != nil {
+		return encryptError
+	}
+	return store.updateRow(ctx, nil, true, "UPDATE teams SET accesstoken=$1 WHERE id=$2;", encrypted, team)
+}
+
+// Deletes the team along with every user in it and their spotify accounts in a single transaction, and audits why
+func (store *PostgresStore) DeleteAllDataForTeam(ctx context.Context, team string, reason string) error {
+	// Open a transaction on the DB - roll it back if anything fails
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+
+	// Delete the users first so the team and spotify rows are no longer referenced
+	var deleted []struct {
+		User      string `db:"id"`
+		SpotifyID string `db:"spotify_id"`
+	}
+	usersDeleteError := transaction.SelectContext(ctx, &deleted, "DELETE FROM slackaccounts WHERE team_id=$1 RETURNING id, COALESCE(spotify_id, '') AS spotify_id;", team)
+	if usersDeleteError != nil {
+		return rollbackOnError(transaction, usersDeleteError)
+	}
+	users := make([]string, 0, len(deleted))
+	spotifyIDs := make([]string, 0, len(deleted))
+	for _, row := range deleted {
+		users = append(users, row.User)
+		spotifyIDs = append(spotifyIDs, row.SpotifyID)
+	}
+
+	// Drop anything still queued for them, and any sign ins they had started
+	_, jobsDeleteError := transaction.ExecContext(ctx, "DELETE FROM jobs WHERE user_id = ANY($1);", pq.Array(users))
+	if jobsDeleteError != nil {
+		return rollbackOnError(transaction, jobsDeleteError)
+	}
+	_, statesDeleteError := transaction.ExecContext(ctx, "DELETE FROM oauthstates WHERE user_id = ANY($1);", pq.Array(users))
+	if statesDeleteError != nil {
+		return rollbackOnError(transaction, statesDeleteError)
+	}
+
+	// Delete their spotify accounts, unless a user in another team is linked to the same one
+	_, spotifyDeleteError := transaction.ExecContext(ctx, `DELETE FROM spotifyaccounts WHERE id = ANY($1)
+		AND NOT EXISTS (SELECT 1 FROM slackaccounts WHERE slackaccounts.spotify_id = spotifyaccounts.id);`, pq.Array(spotifyIDs))
+	if spotifyDeleteError != nil {
+		return rollbackOnError(transaction, spotifyDeleteError)
+	}
+
+	// Delete the team record
+	_, teamDeleteError := transaction.ExecContext(ctx, "DELETE FROM teams WHERE id=$1;", team)
+	if teamDeleteError != nil {
+		return rollbackOnError(transaction, teamDeleteError)
+	}
+
+	// Audit the deletion
+	auditError := store.addAuditRecord(ctx, transaction, team, "", "team_deleted", reason+", removed "+strconv.Itoa(len(users))+" users")
+	if auditError != nil {
+		return rollbackOnError(transaction, auditError)
+	}
+
+	// Commit the transaction to the DB
+	commitError := transaction.Commit()
+	if commitError != nil {
+		return rollbackOnError(transaction, commitError)
+	}
+
+	return nil
+}
+
+// A status we set for a user, along with the token needed to clear it
+type OwnedStatus struct {
+	User   string `db:"id"`
+	Token  string `db:"accesstoken"`
+	Status string `db:"status"`
+}
+
+// Gets every user in the team who has a status we set and a token that might still be able to clear it
+func (store *PostgresStore) GetOwnedStatusesForTeam(ctx context.Context, team string) ([]OwnedStatus, error) {
+	var statuses []OwnedStatus
+	selectError := store.db.SelectContext(ctx, &statuses, "SELECT id, accesstoken, status FROM slackaccounts WHERE team_id=$1 AND accesstoken IS NOT null AND accesstoken <> '' AND status IS NOT null AND status <> '';", team)
+	if selectError != nil {
+		return nil, selectError
+	}
+	for index := range statuses {
+		token, decryptError := store.keys.decryptToken(statuses[index].Token, "slackaccounts", "accesstoken", statuses[index].User)
+		if decryptError != nil {
+			return nil, decryptError
+		}
+		statuses[index].Token = token
+	}
+	return statuses, nil
+}
+
+// What the admin dashboard shows about a team
+type TeamSummary struct {
+	ID string `db:"id"`
+	// Whether the app still has a bot token for the team
+	Installed bool `db:"installed"`
+	Users     int  `db:"users"`
 }
 
-func DeleteAllDataForTeam(team string) error {
-	_, teamDeleteError := appDatabase.Exec("DELETE FROM teams WHERE id=$1;", team)
-	return teamDeleteError
+// Lists every team with how many users it has, ordered by id
+func (store *PostgresStore) ListTeams(ctx context.Context) ([]TeamSummary, error) {
+	teams := make([]TeamSummary, 0)
+	selectError := store.db.SelectContext(ctx, &teams, `SELECT teams.id, teams.accesstoken IS NOT null AS installed, count(slackaccounts.id) AS users
+		FROM teams LEFT JOIN slackaccounts ON slackaccounts.team_id = teams.id
+		GROUP BY teams.id, teams.accesstoken ORDER BY teams.id;`)
+	return teams, selectError
 }
@@ -0,0 +1,68 @@
+package database_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/tracing"
+)
+
+// Spans from every test. The query wrapper only ever follows the first provider installed, so there is one for the run.
+var exporter = tracetest.NewInMemoryExporter()
+
+func TestMain(m *testing.M) {
+	tracing.UseExporter(exporter)
+	m.Run()
+}
+
+func TestQueriesAreTracedInsideSpans(t *testing.T) {
+	appDatabase := database.ConnectToDatabase("sqlite://"+filepath.Join(t.TempDir(), "tracing.db"), "")
+	defer appDatabase.DisconnectDatabase()
+	if migrateError := appDatabase.MigrateUp(false); migrateError != nil {
+		t.Fatalf("migrating: %v", migrateError)
+	}
+
+	// Queries made outside of any span, such as the job workers polling, aren't traced
+	exporter.Reset()
+	if ensureError := appDatabase.EnsureUserExists(context.Background(), "U1"); ensureError != nil {
+		t.Fatal(ensureError)
+	}
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("a query outside of a span made %d spans", len(spans))
+	}
+
+	ctx, parent := tracing.Start(context.Background(), "job")
+	if _, tokenError := appDatabase.GetSlackForUser(ctx, "U1"); tokenError != nil {
+		t.Fatal(tokenError)
+	}
+	tracing.End(parent, nil)
+	var query *tracetest.SpanStub
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "sql.conn.query" {
+			query = &span
+		}
+	}
+	if query == nil {
+		t.Fatalf("no query span, got %v", exporter.GetSpans())
+	}
+	if query.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("query span isn't parented to the span it was made in")
+	}
+	var system, statement string
+	for _, kv := range query.Attributes {
+		switch kv.Key {
+		case attribute.Key("db.system"):
+			system = kv.Value.AsString()
+		case attribute.Key("db.statement"):
+			statement = kv.Value.AsString()
+		}
+	}
+	if system != "sqlite" || !strings.Contains(statement, "slackaccounts") {
+		t.Errorf("query span has attributes %v", query.Attributes)
+	}
+}
@@ -1,38 +1,32 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"time"
 )
 
-func addNewUser(user string) error {
-	_, rowInsertError := appDatabase.Exec("INSERT INTO slackaccounts VALUES ($1);", user)
+func (store *PostgresStore) addNewUser(ctx context.Context, user string) error {
+	_, rowInsertError := store.db.ExecContext(ctx, "INSERT INTO slackaccounts VALUES ($1);", user)
 	return rowInsertError
 }
 
-func userExists(user string) (bool, error) {
+func (store *PostgresStore) userExists(ctx context.Context, user string) (bool, error) {
 	// Get the user
-	result, getError := getSingleString("SELECT id FROM slackaccounts WHERE id=$1", user)
+	result, getError := store.getSingleString(ctx, "SELECT id FROM slackaccounts WHERE id=$1", user)
 	return (result != ""), getError
 }
 
-func GetAllConnectedUsers() ([]string, error) {
-	// Get all user ids where they have a connected spotify account
-	var users []string
-	selectError := appDatabase.Select(&users, "SELECT id FROM slackaccounts WHERE accesstoken IS NOT null AND spotify_id IS NOT null;")
-	return users, selectError
-}
-
-func EnsureUserExists(user string) error {
+func (store *PostgresStore) EnsureUserExists(ctx context.Context, user string) error {
 	// Make sure that a user record exists for the user
-	exists, existsError := userExists(user)
+	exists, existsError := store.userExists(ctx, user)
 	if existsError != nil {
 		return existsError
 	}
 
 	// Create a user record if needed
 	if !exists {
-		userAddError := addNewUser(user)
+		userAddError := store.addNewUser(ctx, user)
 		if userAddError != nil {
 			return userAddError
 		}
@@ -41,27 +35,37 @@ func EnsureUserExists(user string) error {
 	return nil
 }
 
-func SetTeamForUser(user string, team string) error {
-	return updateRow(nil, true, "UPDATE slackaccounts SET team_id=$1 WHERE id=$2;", team, user)
+func (store *PostgresStore) SetTeamForUser(ctx context.Context, user string, team string) error {
+	return store.updateRow(ctx, nil, true, "UPDATE slackaccounts SET team_id=$1 WHERE id=$2;", team, user)
 }
 
 // Adds the spotify information to the DB using a transaction. Rolls back on any error. Returns rollback error if one occurs.
-func AddSpotifyToUser(user string, id string, accessToken string, refreshToken string, expiresIn int) error {
+func (store *PostgresStore) AddSpotifyToUser(ctx context.Context, user string, id string, accessToken string, refreshToken string, expiresIn int) error {
+	// Encrypt the tokens for storage
+	encryptedAccess, accessError := store.keys.encryptToken(accessToken, "spotifyaccounts", "accesstoken", id)
+	if accessError != nil {
+		return accessError
+	}
+	encryptedRefresh, refreshError := store.keys.encryptToken(refreshToken, "spotifyaccounts", "refreshtoken", id)
+	if refreshError != nil {
+		return refreshError
+	}
+
 	// Open a transaction on the DB - roll it back if anything fails
-	transaction, transactionError := appDatabase.Beginx()
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
 	if transactionError != nil {
 		return rollbackOnError(transaction, transactionError)
 	}
 
 	// Insert the new spotify record
 	expirationTime := time.Now().Add(time.Second * time.Duration(expiresIn))
-	_, rowUpsertError := transaction.Exec("INSERT INTO spotifyaccounts VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET accessToken=$2, refreshToken=$3, expirationAt=$4;", id, accessToken, refreshToken, expirationTime)
+	_, rowUpsertError := transaction.ExecContext(ctx, "INSERT INTO spotifyaccounts VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO UPDATE SET accessToken=$2, refreshToken=$3, expirationAt=$4;", id, encryptedAccess, encryptedRefresh, expirationTime)
 	if rowUpsertError != nil {
 		return rollbackOnError(transaction, rowUpsertError)
 	}
 
 	// Tie the slack account to the spotify user
-	updateError := updateRow(transaction, true, "UPDATE slackaccounts SET spotify_id=$1 WHERE id=$2;", id, user)
+	updateError := store.updateRow(ctx, transaction, true, "UPDATE slackaccounts SET spotify_id=$1 WHERE id=$2;", id, user)
 	if updateError != nil {
 		return rollbackOnError(transaction, updateError)
 	}
@@ -76,14 +80,18 @@ func AddSpotifyToUser(user string, id string, accessToken string, refreshToken s
 	return nil
 }
 
-func SaveSlackTokenForUser(user string, token string) error {
+func (store *PostgresStore) SaveSlackTokenForUser(ctx context.Context, user string, token string) error {
+	encrypted, encryptError := store.keys.encryptToken(token, "slackaccounts", "accesstoken", user)
+	if encryptError != nil {
+		return encryptError
+	}
 	// Update this record
-	return updateRow(nil, true, "UPDATE slackaccounts SET accesstoken=$1 WHERE id=$2;", token, user)
+	return store.updateRow(ctx, nil, true, "UPDATE slackaccounts SET accesstoken=$1 WHERE id=$2;", encrypted, user)
 }
 
-func GetSpotifyForUser(user string) (string, []string, error) {
+func (store *PostgresStore) GetSpotifyForUser(ctx context.Context, user string) (string, []string, error) {
 	// Get the spotify ID from the user
-	spotifyID, getError := getSingleString("SELECT spotify_id FROM slackaccounts WHERE id=$1 AND spotify_id IS NOT null;", user)
+	spotifyID, getError := store.getSingleString(ctx, "SELECT spotify_id FROM slackaccounts WHERE id=$1 AND spotify_id IS NOT null;", user)
 	if getError != nil {
 		return "", nil, getError
 	}
@@ -94,64 +102,141 @@ func GetSpotifyForUser(user string) (string, []string, error) {
 	}
 
 	// Get the spotify tokens
-	fields, tokensScanError := appDatabase.QueryRowx("SELECT accessToken, refreshToken FROM spotifyaccounts WHERE id=$1;", spotifyID).SliceScan()
+	fields, tokensScanError := store.db.QueryRowxContext(ctx, "SELECT accessToken, refreshToken FROM spotifyaccounts WHERE id=$1;", spotifyID).SliceScan()
 	if tokensScanError != nil { // This row must exist because of the FK relationship so we don't need to test for row count
 		return "", nil, tokensScanError
 	}
 
-	// Convert interface array to strings array
-	tokens := []string{
-		fields[0].(string),
-		fields[1].(string),
+	// Convert interface array to strings array, decrypting as we go
+	columns := []string{"accesstoken", "refreshtoken"}
+	tokens := make([]string, len(fields))
+	for index, field := range fields {
+		token, decryptError := store.keys.decryptToken(field.(string), "spotifyaccounts", columns[index], spotifyID)
+		if decryptError != nil {
+			return "", nil, decryptError
+		}
+		tokens[index] = token
 	}
 
 	// Read the tokens into an object and return
 	return spotifyID, tokens, nil
 }
 
-func GetSlackForUser(user string) (string, error) {
+func (store *PostgresStore) GetSlackForUser(ctx context.Context, user string) (string, error) {
 	// Get the token for the user
-	return getSingleString("SELECT accessToken FROM slackaccounts WHERE id=$1 AND accessToken IS NOT null;", user)
+	token, getError := store.getSingleString(ctx, "SELECT accessToken FROM slackaccounts WHERE id=$1 AND accessToken IS NOT null;", user)
+	if getError != nil {
+		return "", getError
+	}
+	return store.keys.decryptToken(token, "slackaccounts", "accesstoken", user)
 }
 
-func GetStatusForUser(user string) (string, error) {
-	// Get the status string for the user
-	return getSingleString("SELECT status FROM slackaccounts WHERE id=$1 AND status IS NOT null;", user)
+func (store *PostgresStore) GetTeamTokenForUser(ctx context.Context, user string) (string, error) {
+	// The team id is needed to decrypt the token
+	var stored struct {
+		Team  string `db:"id"`
+		Token string `db:"accesstoken"`
+	}
+	getError := store.db.GetContext(ctx, &stored, "SELECT teams.id, teams.accesstoken FROM slackaccounts INNER JOIN teams ON slackaccounts.team_id = teams.id WHERE slackaccounts.id=$1 AND teams.accesstoken IS NOT null;", user)
+	if getError == sql.ErrNoRows {
+		return "", nil
+	} else if getError != nil {
+		return "", getError
+	}
+	return store.keys.decryptToken(stored.Token, "teams", "accesstoken", stored.Team)
 }
 
-func GetTeamTokenForUser(user string) (string, error) {
-	return getSingleString("SELECT teams.accesstoken FROM slackaccounts LEFT JOIN teams ON slackaccounts.team_id = teams.id WHERE slackaccounts.id=$1 AND teams.accesstoken IS NOT null;", user)
+func (store *PostgresStore) GetStatusForUser(ctx context.Context, user string) (string, error) {
+	// Get the status string for the user
+	return store.getSingleString(ctx, "SELECT status FROM slackaccounts WHERE id=$1 AND status IS NOT null;", user)
 }
 
-func SetStatusForUser(user string, status string) error {
+func (store *PostgresStore) SetStatusForUser(ctx context.Context, user string, status string) error {
 	// Update this record
-	return updateRow(nil, true, "UPDATE slackaccounts SET status=$1 WHERE id=$2;", status, user)
+	return store.updateRow(ctx, nil, true, "UPDATE slackaccounts SET status=$1 WHERE id=$2;", status, user)
 }
 
-func DeleteAllDataForUser(user string) error {
-	// Get the spotify account id for the user
-	var spotifyID string
-	scanError := appDatabase.QueryRowx("SELECT spotify_id FROM slackaccounts WHERE id=$1 AND spotify_id IS NOT null;", user).Scan(&spotifyID)
-	if scanError != nil && scanError != sql.ErrNoRows {
-		return scanError
+// Caches the user's current slack status, along with where it came from. Users we don't know about are ignored.
+func (store *PostgresStore) SetProfileForUser(ctx context.Context, user string, text string, emoji string, expiration int, source string) error {
+	return store.updateRow(ctx, nil, false, "UPDATE slackaccounts SET profile_status_text=$1, profile_status_emoji=$2, profile_status_expiration=$3, profile_updated_at=$4, profile_source=$5 WHERE id=$6;",
+		text, emoji, expiration, time.Now(), source, user)
+}
+
+// Marks or unmarks the user as having set their own status. Setting the mark also forgets the last status we set, since it is no longer showing.
+// Returns true if the mark changed.
+func (store *PostgresStore) SetManualOverrideForUser(ctx context.Context, user string, overridden bool) (bool, error) {
+	query := "UPDATE slackaccounts SET manual_override=$1 WHERE id=$2 AND manual_override <> $1;"
+	if overridden {
+		query = "UPDATE slackaccounts SET manual_override=$1, status='' WHERE id=$2 AND manual_override <> $1;"
+	}
+	results, updateError := store.db.ExecContext(ctx, query, overridden, user)
+	if updateError != nil {
+		return false, updateError
+	}
+	rowsAffected, affectedError := results.RowsAffected()
+	if affectedError != nil {
+		return false, affectedError
+	}
+	return rowsAffected > 0, nil
+}
+
+func (store *PostgresStore) GetManualOverrideForUser(ctx context.Context, user string) (bool, error) {
+	var overridden bool
+	getError := store.db.GetContext(ctx, &overridden, "SELECT manual_override FROM slackaccounts WHERE id=$1;", user)
+	if getError == sql.ErrNoRows {
+		return false, nil
+	}
+	return overridden, getError
+}
+
+// Deletes the user along with their spotify account, queued jobs and unfinished sign ins in a single transaction
+func (store *PostgresStore) DeleteAllDataForUser(ctx context.Context, user string) error {
+	// Open a transaction on the DB - roll it back if anything fails
+	transaction, transactionError := store.db.BeginTxx(ctx, nil)
+	if transactionError != nil {
+		return transactionError
+	}
+
+	// Drop anything still queued for the user
+	_, jobsDeleteError := transaction.ExecContext(ctx, "DELETE FROM jobs WHERE user_id=$1;", user)
+	if jobsDeleteError != nil {
+		return rollbackOnError(transaction, jobsDeleteError)
+	}
+
+	// And any sign in they had started
+	_, statesDeleteError := transaction.ExecContext(ctx, "DELETE FROM oauthstates WHERE user_id=$1;", user)
+	if statesDeleteError != nil {
+		return rollbackOnError(transaction, statesDeleteError)
 	}
-	// Delete the slack account record
-	_, slackDeleteError := appDatabase.Exec("DELETE FROM slackaccounts WHERE id=$1;", user)
-	if slackDeleteError != nil {
-		return slackDeleteError
+
+	// Delete the slack account record, keeping the spotify account id it linked to
+	var spotifyID string
+	slackDeleteError := transaction.GetContext(ctx, &spotifyID, "DELETE FROM slackaccounts WHERE id=$1 RETURNING COALESCE(spotify_id, '');", user)
+	if slackDeleteError != nil && slackDeleteError != sql.ErrNoRows {
+		return rollbackOnError(transaction, slackDeleteError)
 	}
-	// Delete the spotify record
+
+	// Delete the spotify record, unless another user is linked to the same account
 	if spotifyID != "" {
-		_, spotifyDeleteError := appDatabase.Exec("DELETE FROM spotifyaccounts WHERE id=$1;", spotifyID)
-		return spotifyDeleteError
+		_, spotifyDeleteError := transaction.ExecContext(ctx, `DELETE FROM spotifyaccounts WHERE id=$1
+			AND NOT EXISTS (SELECT 1 FROM slackaccounts WHERE slackaccounts.spotify_id = spotifyaccounts.id);`, spotifyID)
+		if spotifyDeleteError != nil {
+			return rollbackOnError(transaction, spotifyDeleteError)
+		}
 	}
-	// Delete spotify data
+
+	// Commit the transaction to the DB
+	commitError := transaction.Commit()
+	if commitError != nil {
+		return rollbackOnError(transaction, commitError)
+	}
+
 	return nil
 }
 
-func GetUsersForTeam(team string) ([]string, error) {
+func (store *PostgresStore) GetUsersForTeam(ctx context.Context, team string) ([]string, error) {
 	// Get all the user ids related to the given team id
 	var users []string
-	selectError := appDatabase.Select(&users, "SELECT id FROM slackaccounts WHERE team_id=$1;", team)
+	selectError := store.db.SelectContext(ctx, &users, "SELECT id FROM slackaccounts WHERE team_id=$1;", team)
 	return users, selectError
 }
@@ -1,12 +1,16 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 
 	"github.com/jmoiron/sqlx"
 )
 
+// Returned when an update that must change a row finds nothing to change
+var errNoRowModified = errors.New("No row was modified during update, and mustEffect is set to true.")
+
 // Rolls back the transaction and returns the causing error. If rollback fails, returns that error instead.
 func rollbackOnError(transaction *sqlx.Tx, err error) error {
 	rollbackError := transaction.Rollback()
@@ -16,9 +20,9 @@ func rollbackOnError(transaction *sqlx.Tx, err error) error {
 	return err
 }
 
-func getSingleString(query string, params ...interface{}) (string, error) {
+func (store *PostgresStore) getSingleString(ctx context.Context, query string, params ...interface{}) (string, error) {
 	var object interface{}
-	getError := appDatabase.Get(&object, query, params...)
+	getError := store.db.GetContext(ctx, &object, query, params...)
 	if getError == sql.ErrNoRows {
 		return "", nil
 	} else if getError != nil {
@@ -27,14 +31,18 @@ func getSingleString(query string, params ...interface{}) (string, error) {
 	return object.(string), nil
 }
 
-func updateRow(transaction *sqlx.Tx, mustEffect bool, query string, params ...interface{}) error {
+func (store *PostgresStore) updateRow(ctx context.Context, transaction *sqlx.Tx, mustEffect bool, query string, params ...interface{}) error {
+	return updateRowIn(ctx, store.db, transaction, mustEffect, query, params...)
+}
+
+func updateRowIn(ctx context.Context, database *sqlx.DB, transaction *sqlx.Tx, mustEffect bool, query string, params ...interface{}) error {
 	// If transaction is given, use it. If not, use the DB pool
 	var results sql.Result
 	var rowUpdateError error
 	if transaction != nil {
-		results, rowUpdateError = transaction.Exec(query, params...)
+		results, rowUpdateError = transaction.ExecContext(ctx, query, params...)
 	} else {
-		results, rowUpdateError = appDatabase.Exec(query, params...)
+		results, rowUpdateError = database.ExecContext(ctx, query, params...)
 	}
 
 	if rowUpdateError != nil {
@@ -49,7 +57,7 @@ func updateRow(transaction *sqlx.Tx, mustEffect bool, query string, params ...in
 		}
 		// If no rows were overwritten, then nothing had that ID
 		if rowsAffected == 0 {
-			return errors.New("No row was modified during update, and mustEffect is set to true.")
+			return errNoRowModified
 		}
 	}
 	// return success
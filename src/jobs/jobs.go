@@ -0,0 +1,274 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/logging"
+	"rolflewis.com/spotify-status-sync/src/slack"
+	"rolflewis.com/spotify-status-sync/src/tracing"
+)
+
+// Where the package keeps its data - set once at startup
+var store database.Store
+
+// Sets the storage the package uses
+func UseStore(newStore database.Store) {
+	store = newStore
+}
+
+const (
+	// How many jobs a worker leases at a time
+	claimBatchSize = 10
+	// How long a worker has to finish a job before another may pick it up
+	leaseDuration = 2 * time.Minute
+	// How long an idle worker waits before looking for jobs again
+	pollInterval = time.Second
+	// Jobs are dropped after this many tries
+	maxAttempts = 10
+)
+
+// Queues a status change for the user, replacing any change still waiting. A blank status clears it.
+func EnqueueStatus(ctx context.Context, user string, status string) error {
+	kind := database.JobSetStatus
+	if status == "" {
+		kind = database.JobClearStatus
+	}
+	return store.EnqueueJob(ctx, kind, user, database.StatusJobKey(user), status)
+}
+
+// Queues a republish of the user's home view. Only one is kept waiting per user, since each publishes the latest state.
+func EnqueuePublishHome(ctx context.Context, user string) error {
+	return store.EnqueueJob(ctx, database.JobPublishHome, user, "home:"+user, "")
+}
+
+// Queues a message to the user from the bot
+func EnqueueDirectMessage(ctx context.Context, user string, text string) error {
+	return store.EnqueueJob(ctx, database.JobDirectMessage, user, "", text)
+}
+
+// Queues a copy of everything stored about the user to be sent to them. Pressing the button again while one waits doesn't send two.
+func EnqueueDataExport(ctx context.Context, user string) error {
+	return store.EnqueueJob(ctx, database.JobExportData, user, "export:"+user, "")
+}
+
+// Starts the goroutines that work through the queue
+func StartWorkers(workers int, client *http.Client) {
+	for i := 0; i < workers; i++ {
+		go worker(client)
+	}
+}
+
+func worker(client *http.Client) {
+	for {
+		// Lease some jobs - skipping any another worker holds
+		jobs, claimError := store.ClaimJobs(context.Background(), claimBatchSize, leaseDuration)
+		if claimError != nil {
+			slog.Error("Could not claim jobs", "error", claimError)
+		}
+		// Nothing to do, so wait a bit
+		if len(jobs) == 0 {
+			time.Sleep(pollInterval)
+			continue
+		}
+		for _, job := range jobs {
+			process(job, client)
+		}
+	}
+}
+
+// Works through the queue until nothing is ready to run, for when there are no workers, such as from the command line.
+// Jobs that fail are scheduled for a retry as usual rather than run again. Returns how many jobs were run.
+func Drain(ctx context.Context, client *http.Client) (int, error) {
+	ran := 0
+	for {
+		jobs, claimError := store.ClaimJobs(ctx, claimBatchSize, leaseDuration)
+		if claimError != nil || len(jobs) == 0 {
+			return ran, claimError
+		}
+		for _, job := range jobs {
+			process(job, client)
+			ran++
+		}
+	}
+}
+
+// Runs the user's queued status change, if there is one ready, leaving the rest of the queue alone. Returns how many jobs
+// were run.
+func DrainStatus(ctx context.Context, user string, client *http.Client) (int, error) {
+	jobs, claimError := store.ClaimJobByKey(ctx, database.StatusJobKey(user), leaseDuration)
+	for _, job := range jobs {
+		process(job, client)
+	}
+	return len(jobs), claimError
+}
+
+// Runs a leased job, scheduling a retry if it fails
+func process(job database.Job, client *http.Client) {
+	// Give each job a bound well inside its lease. Everything logged or traced while it runs says which job it was for.
+	jobCtx, span := tracing.Start(context.Background(), "job "+job.Kind, attribute.Int64("job.id", job.ID),
+		attribute.Int("job.attempts", job.Attempts), attribute.String("user", logging.Hash(job.User)))
+	jobCtx = tracing.WithTraceID(logging.WithLogger(jobCtx, slog.Default().With("job", job.ID, "kind", job.Kind, "user", logging.Hash(job.User))))
+	ctx, cancel := context.WithTimeout(jobCtx, leaseDuration/2)
+	runError := run(ctx, job, client)
+	cancel()
+	// The run's deadline may have passed, so the retry is recorded without it
+	if runError != nil {
+		if job.Kind == database.JobSetStatus || job.Kind == database.JobClearStatus {
+			recordWrite(jobCtx, job.User, "failed", runError)
+		}
+		fail(jobCtx, job, runError)
+	}
+	tracing.End(span, runError)
+}
+
+// Saves how a status job went for the admin dashboard. Failing to save it doesn't fail the job.
+func recordWrite(ctx context.Context, user string, outcome string, writeError error) {
+	failure := ""
+	if writeError != nil {
+		failure = writeError.Error()
+	}
+	if recordError := store.RecordWriteResult(ctx, user, outcome, failure); recordError != nil {
+		logging.FromContext(ctx).Warn("Could not record status write", "error", recordError)
+	}
+}
+
+// Runs the job and marks it complete. Errors leave the job to be retried.
+func run(ctx context.Context, job database.Job, client *http.Client) error {
+	switch job.Kind {
+	case database.JobSetStatus, database.JobClearStatus:
+		// The user may have gone since this was queued
+		token, tokenError := store.GetSlackForUser(ctx, job.User)
+		if tokenError != nil {
+			return tokenError
+		}
+		if token == "" {
+			slack.StatusUpdates.WithLabelValues("skipped", "user_removed").Inc()
+			recordWrite(ctx, job.User, "skipped", nil)
+			return store.CompleteJob(ctx, job)
+		}
+		// Only clear the status if what's showing is still the last one we set
+		if job.Kind == database.JobClearStatus {
+			owned, ownedError := store.GetStatusForUser(ctx, job.User)
+			if ownedError != nil {
+				return ownedError
+			}
+			if owned != "" {
+				clearError := slack.ClearOwnedStatus(ctx, job.User, token, owned, client)
+				if clearError != nil {
+					return clearError
+				}
+				slack.StatusUpdates.WithLabelValues("written", "cleared").Inc()
+			}
+			recordWrite(ctx, job.User, "cleared", nil)
+			return store.CompleteStatusJob(ctx, job, "")
+		}
+		// Don't write over a status the user set after this was queued
+		overridden, overrideError := store.GetManualOverrideForUser(ctx, job.User)
+		if overrideError != nil {
+			return overrideError
+		}
+		if overridden {
+			slack.StatusUpdates.WithLabelValues("skipped", "user_status").Inc()
+			recordWrite(ctx, job.User, "skipped", nil)
+			return store.CompleteJob(ctx, job)
+		}
+		setError := slack.SetUserStatus(ctx, job.User, token, job.Payload, client)
+		if setError != nil {
+			return setError
+		}
+		slack.StatusUpdates.WithLabelValues("written", "set").Inc()
+		recordWrite(ctx, job.User, "set", nil)
+		return store.CompleteStatusJob(ctx, job, job.Payload)
+	case database.JobPublishHome:
+		publishError := slack.UpdateHome(ctx, job.User, client)
+		if publishError != nil {
+			return publishError
+		}
+		return store.CompleteJob(ctx, job)
+	case database.JobDirectMessage:
+		messageError := slack.SendDirectMessage(ctx, job.User, job.Payload, client)
+		if messageError != nil {
+			return messageError
+		}
+		return store.CompleteJob(ctx, job)
+	case database.JobExportData:
+		exportError := sendDataExport(ctx, job, client)
+		if exportError != nil {
+			return exportError
+		}
+		return store.CompleteJob(ctx, job)
+	}
+	return errors.New("Unknown job kind: " + job.Kind)
+}
+
+// Sends the user everything stored about them as a JSON file, with tokens redacted. The request was audited when it was
+// made; the export is only recorded as sent once slack has shared it, and a retry after that doesn't send it again.
+func sendDataExport(ctx context.Context, job database.Job, client *http.Client) error {
+	user := job.User
+	export, exportError := store.ExportUser(ctx, user)
+	if exportError != nil {
+		return exportError
+	}
+	// The user may have gone since this was queued
+	if export.SlackAccount == nil {
+		return nil
+	}
+	// An earlier attempt may have sent it but not finished the job
+	detail := "sent as a direct message by job " + strconv.FormatInt(job.ID, 10)
+	for _, record := range export.AuditLog {
+		if record.Action == "data_exported" && record.Detail == detail {
+			return nil
+		}
+	}
+	exportBytes, jsonError := json.MarshalIndent(export, "", "  ")
+	if jsonError != nil {
+		return jsonError
+	}
+	sendError := slack.SendFile(ctx, user, "spotify-status-sync-export.json", exportBytes,
+		"Here is everything Spotify Status Sync stores about you. Your tokens are left out.", client)
+	if errors.Is(sendError, slack.ErrMissingScope) {
+		// The job is given up on, so tell the user why nothing came
+		messageError := EnqueueDirectMessage(ctx, user, "Your data export couldn't be sent, since Spotify Status Sync doesn't have "+
+			"Slack's permission to send files. Ask an admin of your workspace to reinstall the app, then press Export my data again.")
+		if messageError != nil {
+			return messageError
+		}
+		return sendError
+	}
+	if sendError != nil {
+		return sendError
+	}
+	return store.AddAuditRecord(ctx, export.SlackAccount.Team, user, "data_exported", detail)
+}
+
+// Schedules a retry with exponential backoff, or gives up once the job has used all of its attempts or can't succeed
+func fail(ctx context.Context, job database.Job, runError error) {
+	logger := logging.FromContext(ctx)
+	// A missing scope needs the app reinstalling, so retries would fail the same way
+	if job.Attempts >= maxAttempts || errors.Is(runError, slack.ErrMissingScope) {
+		logger.Error("Giving up on job", "attempts", job.Attempts, "error", runError)
+		if abandonError := store.AbandonJob(ctx, job, runError.Error()); abandonError != nil {
+			logger.Error("Could not abandon job", "error", abandonError)
+		}
+		return
+	}
+	// 5s, 10s, 20s... capped at an hour, with some jitter so failed jobs don't all come back at once
+	delay := 5 * time.Second << uint(job.Attempts-1)
+	if delay > time.Hour || delay <= 0 {
+		delay = time.Hour
+	}
+	delay += time.Duration(rand.Int63n(int64(delay / 4)))
+	logger.Warn("Retrying job", "attempts", job.Attempts, "delay", delay.String(), "error", runError)
+	if retryError := store.RetryJob(ctx, job, runError.Error(), time.Now().Add(delay)); retryError != nil {
+		logger.Error("Could not schedule job retry", "error", retryError)
+	}
+}
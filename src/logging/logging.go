@@ -0,0 +1,139 @@
+// Package logging sets up structured logging and carries a logger tagged with request or run ids through contexts.
+package logging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Turns a LOG_LEVEL setting into a level. Blank is info.
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, errors.New("Unknown log level: " + level)
+}
+
+// Makes the default logger write to stderr at the level, as text or, with format "json", one JSON object per line.
+// Anything still written through the standard log package goes through it too.
+func Setup(level string, format string) error {
+	parsedLevel, levelError := ParseLevel(level)
+	if levelError != nil {
+		return levelError
+	}
+	options := &slog.HandlerOptions{Level: parsedLevel}
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return errors.New("Unknown log format: " + format)
+	}
+	slog.SetDefault(slog.New(handler))
+	// The handler adds its own timestamp
+	log.SetFlags(0)
+	return nil
+}
+
+// Logs at error level and exits
+func Fatal(message string, args ...interface{}) {
+	slog.Error(message, args...)
+	os.Exit(1)
+}
+
+// A short random id for a request, a loop run, or an error reference
+func NewID() string {
+	randomBytes := make([]byte, 8)
+	rand.Read(randomBytes)
+	return hex.EncodeToString(randomBytes)
+}
+
+// The key ids are hashed with. Until UseHashKey is called it is random, so hashes only match up within one process.
+var hashKey = randomHashKey()
+
+func randomHashKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
+
+// Keys Hash with one derived from LOG_HASH_KEY, so every instance gives the same hash for an id but nobody without the key
+// can work back from a hash by hashing known ids
+func UseHashKey(secret string) {
+	keyHasher := hmac.New(sha256.New, []byte(secret))
+	keyHasher.Write([]byte("log hashes"))
+	hashKey = keyHasher.Sum(nil)
+}
+
+// Stands in for a slack or spotify id in logs, so lines about the same user can be matched up without logging who they are
+func Hash(id string) string {
+	if id == "" {
+		return ""
+	}
+	hasher := hmac.New(sha256.New, hashKey)
+	hasher.Write([]byte(id))
+	return hex.EncodeToString(hasher.Sum(nil)[:8])
+}
+
+type loggerKey struct{}
+
+// Returns a context that carries the logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Returns the logger carried by the context, or the default one
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, exists := ctx.Value(loggerKey{}).(*slog.Logger); exists {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Request ids passed in by a proxy are only kept if they look like one
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Gin middleware that gives every request an id, returned in X-Request-ID, and a logger tagged with it, then logs the request
+// once it is done. The query string is left out, since OAuth callbacks carry codes in it.
+func Middleware() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		started := time.Now()
+		requestID := context.GetHeader("X-Request-ID")
+		if !requestIDPattern.MatchString(requestID) {
+			requestID = NewID()
+		}
+		context.Header("X-Request-ID", requestID)
+		logger := slog.Default().With("request_id", requestID)
+		context.Request = context.Request.WithContext(WithLogger(context.Request.Context(), logger))
+
+		context.Next()
+
+		// Later middleware may have tagged the logger further, such as with a trace id
+		FromContext(context.Request.Context()).Info("Request",
+			"method", context.Request.Method,
+			"path", context.Request.URL.Path,
+			"status", context.Writer.Status(),
+			"duration_ms", time.Since(started).Milliseconds())
+	}
+}
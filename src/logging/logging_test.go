@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestHashIsKeyed(t *testing.T) {
+	UseHashKey("first secret")
+	first := Hash("U123")
+	if Hash("U123") != first || Hash("U124") == first {
+		t.Errorf("hash isn't stable for an id, or is shared between ids")
+	}
+	if Hash("") != "" {
+		t.Errorf("blank id gave a hash")
+	}
+
+	// Without the secret, hashing the id doesn't give the logged hash
+	unkeyed := sha256.Sum256([]byte("U123"))
+	if strings.HasPrefix(hex.EncodeToString(unkeyed[:]), first) {
+		t.Errorf("hash is the plain sha-256 of the id")
+	}
+	UseHashKey("second secret")
+	if Hash("U123") == first {
+		t.Errorf("hash doesn't depend on the secret")
+	}
+}
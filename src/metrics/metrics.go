@@ -0,0 +1,42 @@
+// Package metrics holds the registry every metric is kept in, and serves it in the Prometheus text format.
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The app's metrics, along with the Go runtime's and the process's. The default registry isn't used, so nothing a library
+// registers there is served by accident.
+var Registry = prometheus.NewRegistry()
+
+// Makes metrics that are registered with Registry
+var Factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Buckets suited to timing calls to other services, in seconds
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Serves every metric, to requests that carry the token as a bearer token
+func Handler(token string) gin.HandlerFunc {
+	handler := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+	return func(context *gin.Context) {
+		provided := strings.TrimPrefix(context.GetHeader("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			context.Header("WWW-Authenticate", "Bearer")
+			context.String(http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		handler.ServeHTTP(context.Writer, context.Request)
+	}
+}
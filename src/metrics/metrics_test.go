@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+var testCalls = Factory.NewCounterVec(prometheus.CounterOpts{Name: "test_calls_total", Help: "Calls, by \"result\"."},
+	[]string{"result"})
+
+func scrape(t *testing.T, authorization string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/metrics", Handler("scrape-token"))
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestHandlerNeedsTheToken(t *testing.T) {
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		if recorder := scrape(t, authorization); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("scrape with %q answered %d", authorization, recorder.Code)
+		}
+	}
+}
+
+func TestHandlerServesParsableMetrics(t *testing.T) {
+	testCalls.WithLabelValues("ok").Add(2)
+	testCalls.WithLabelValues("say \"no\"\n").Inc()
+	recorder := scrape(t, "Bearer scrape-token")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("scrape answered %d", recorder.Code)
+	}
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, parseError := parser.TextToMetricFamilies(recorder.Body)
+	if parseError != nil {
+		t.Fatalf("metrics don't parse: %v", parseError)
+	}
+	calls := families["test_calls_total"]
+	if calls == nil || len(calls.Metric) != 2 {
+		t.Fatalf("expected both label values of test_calls_total, got %v", calls)
+	}
+	values := make(map[string]float64)
+	for _, metric := range calls.Metric {
+		values[metric.Label[0].GetValue()] = metric.Counter.GetValue()
+	}
+	if values["ok"] != 2 || values["say \"no\"\n"] != 1 {
+		t.Errorf("counter values are %v", values)
+	}
+	if families["go_goroutines"] == nil {
+		t.Errorf("runtime metrics aren't served")
+	}
+}
@@ -0,0 +1,139 @@
+package oauthstate
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"rolflewis.com/spotify-status-sync/src/database"
+)
+
+// Where the package keeps its data - set once at startup
+var store database.Store
+
+// Sets the storage the package uses
+func UseStore(newStore database.Store) {
+	store = newStore
+}
+
+// Signs issued states - set once at startup from OAUTH_STATE_SECRET
+var secret string
+
+// Sets the secret states are signed with
+func UseSecret(newSecret string) {
+	secret = newSecret
+}
+
+// How long an issued state can be used for. App Home links are reissued every time the home is opened, so this can be short.
+const Lifetime = time.Hour
+
+var ErrInvalidState = errors.New("OAuth state is invalid, expired or already used")
+
+// Creates a state token for an OAuth flow with the provider, bound server side to the user. User may be blank.
+// The token is signed so forged or altered tokens are rejected before touching the database.
+func Issue(ctx context.Context, provider string, user string) (string, error) {
+	return issue(ctx, provider, user, "")
+}
+
+// Like Issue, but also generates a PKCE code verifier bound to the state. Returns the state and the S256 code challenge to send
+// with the authorize request. The verifier is handed back by Consume for the token exchange.
+func IssueWithPKCE(ctx context.Context, provider string, user string) (string, string, error) {
+	// RFC 7636 verifiers are 43-128 characters - 32 random bytes encode to 43
+	verifier, verifierError := randomString(32)
+	if verifierError != nil {
+		return "", "", verifierError
+	}
+	state, stateError := issue(ctx, provider, user, verifier)
+	if stateError != nil {
+		return "", "", stateError
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	return state, base64.RawURLEncoding.EncodeToString(challenge[:]), nil
+}
+
+func issue(ctx context.Context, provider string, user string, verifier string) (string, error) {
+	key, keyError := signingKey()
+	if keyError != nil {
+		return "", keyError
+	}
+
+	// Random nonce identifies the stored state
+	nonce, nonceError := randomString(24)
+	if nonceError != nil {
+		return "", nonceError
+	}
+	expiresAt := time.Now().Add(Lifetime)
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+
+	// Save it so it can only be used once
+	saveError := store.SaveOAuthState(ctx, nonce, provider, user, verifier, expiresAt)
+	if saveError != nil {
+		return "", saveError
+	}
+
+	return nonce + "." + expiry + "." + sign(key, provider, nonce, expiry), nil
+}
+
+// Checks the state returned to a callback and uses it up. Returns the user it was issued for, which may be blank,
+// and the PKCE code verifier, which is blank unless the state came from IssueWithPKCE.
+func Consume(ctx context.Context, provider string, state string) (string, string, error) {
+	key, keyError := signingKey()
+	if keyError != nil {
+		return "", "", keyError
+	}
+
+	// Check the shape and signature
+	parts := strings.Split(state, ".")
+	if len(parts) != 3 {
+		return "", "", ErrInvalidState
+	}
+	nonce, expiry, signature := parts[0], parts[1], parts[2]
+	if !hmac.Equal([]byte(signature), []byte(sign(key, provider, nonce, expiry))) {
+		return "", "", ErrInvalidState
+	}
+
+	// Check the expiry without a database round trip
+	expiresAt, parseError := strconv.ParseInt(expiry, 10, 64)
+	if parseError != nil || time.Now().Unix() > expiresAt {
+		return "", "", ErrInvalidState
+	}
+
+	// Use it up - this is what makes it single use
+	user, verifier, found, consumeError := store.ConsumeOAuthState(ctx, nonce, provider)
+	if consumeError != nil {
+		return "", "", consumeError
+	}
+	if !found {
+		return "", "", ErrInvalidState
+	}
+	return user, verifier, nil
+}
+
+// Returns n random bytes, url-safe base64 encoded
+func randomString(n int) (string, error) {
+	randomBytes := make([]byte, n)
+	if _, randError := rand.Read(randomBytes); randError != nil {
+		return "", randError
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+func sign(key []byte, provider string, nonce string, expiry string) string {
+	hasher := hmac.New(sha256.New, key)
+	hasher.Write([]byte(provider + ":" + nonce + ":" + expiry))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func signingKey() ([]byte, error) {
+	if secret == "" {
+		return nil, errors.New("OAUTH_STATE_SECRET is not set")
+	}
+	return []byte(secret), nil
+}
@@ -0,0 +1,294 @@
+package routes
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"rolflewis.com/spotify-status-sync/src/config"
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/jobs"
+	"rolflewis.com/spotify-status-sync/src/logging"
+	"rolflewis.com/spotify-status-sync/src/oauthstate"
+	"rolflewis.com/spotify-status-sync/src/slack"
+	"rolflewis.com/spotify-status-sync/src/spotify"
+	"rolflewis.com/spotify-status-sync/src/util"
+)
+
+const (
+	// The cookie holding an admin's signed session
+	adminCookie = "admin_session"
+	// How long a sign in lasts
+	adminSessionLifetime = 12 * time.Hour
+	// Where the admin signed in is kept on the gin context
+	adminKey = "admin"
+)
+
+// A row of the dashboard's user table
+type adminUserRow struct {
+	database.UserSummary
+	TokenExpiry string
+}
+
+// Sends the admin off to Sign in with Slack
+func AdminSignIn(context *gin.Context) {
+	state, stateError := oauthstate.Issue(context.Request.Context(), "slack_admin", "")
+	if util.InternalError(stateError, context) {
+		return
+	}
+	context.Redirect(http.StatusFound, slack.SignInURL(state))
+}
+
+// Finishes Sign in with Slack, starting a session if the user is an admin
+func AdminCallbackFlow(context *gin.Context, settings *config.Config, client *http.Client) {
+	logger := logging.FromContext(context.Request.Context())
+	_, _, stateError := oauthstate.Consume(context.Request.Context(), "slack_admin", context.Query("state"))
+	if stateError == oauthstate.ErrInvalidState {
+		logger.Warn("Invalid state in admin sign in callback")
+		context.String(http.StatusBadRequest, "This link has expired or was already used. Try signing in again.")
+		return
+	}
+	if util.InternalError(stateError, context) {
+		return
+	}
+	if context.Query("error") != "" {
+		context.String(http.StatusBadRequest, "Sign in was cancelled.")
+		return
+	}
+
+	signedIn, signInError := slack.SignIn(context.Request.Context(), context.Query("code"), client)
+	if util.InternalError(signInError, context) {
+		return
+	}
+	// Admins are listed with their workspace, so the same user id in another one is refused
+	if !settings.IsAdmin(signedIn.Team, signedIn.ID) {
+		logger.Warn("Admin sign in refused", "user", logging.Hash(signedIn.ID), "team", logging.Hash(signedIn.Team))
+		context.String(http.StatusForbidden, "This Slack account is not an admin.")
+		return
+	}
+	// An admin's id is only theirs within their own workspace, so the sign in has to be from one the app is installed in
+	installed, installedError := isInstalledTeam(context.Request.Context(), signedIn.Team)
+	if util.InternalError(installedError, context) {
+		return
+	}
+	if !installed {
+		logger.Warn("Admin sign in from a workspace the app isn't installed in", "user", logging.Hash(signedIn.ID),
+			"team", logging.Hash(signedIn.Team))
+		context.String(http.StatusForbidden, "This Slack account is not an admin.")
+		return
+	}
+	logger.Info("Admin signed in", "user", logging.Hash(signedIn.ID))
+	setAdminCookie(context, settings, signAdminSession(settings, signedIn.Team+":"+signedIn.ID, time.Now().Add(adminSessionLifetime)), int(adminSessionLifetime.Seconds()))
+	context.Redirect(http.StatusFound, "/admin")
+}
+
+// Whether the team has the app installed
+func isInstalledTeam(ctx context.Context, team string) (bool, error) {
+	teams, teamsError := store.ListTeams(ctx)
+	if teamsError != nil {
+		return false, teamsError
+	}
+	for _, summary := range teams {
+		if summary.ID == team {
+			return summary.Installed, nil
+		}
+	}
+	return false, nil
+}
+
+// Gin middleware for the dashboard's pages. Requests without a session for a current admin are sent to sign in, or refused
+// if they change anything. Changes also have to carry the session's CSRF token.
+func AdminRequired(settings *config.Config) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		cookie, _ := context.Cookie(adminCookie)
+		// Sessions are for a TEAM:USER pair. Admins removed from ADMIN_USER_IDS lose access straight away, even with one.
+		admin := verifyAdminSession(settings, cookie, time.Now())
+		parts := strings.SplitN(admin, ":", 2)
+		if len(parts) != 2 || !settings.IsAdmin(parts[0], parts[1]) {
+			if context.Request.Method == http.MethodGet {
+				context.Redirect(http.StatusFound, "/admin/login")
+			} else {
+				context.String(http.StatusForbidden, "Sign in again to make changes.")
+			}
+			context.Abort()
+			return
+		}
+		if context.Request.Method != http.MethodGet && !hmac.Equal([]byte(context.PostForm("csrf")), []byte(csrfToken(settings, cookie))) {
+			logging.FromContext(context.Request.Context()).Warn("Admin request with a bad CSRF token", "admin", logging.Hash(admin))
+			context.String(http.StatusForbidden, "This form is out of date. Reload the page and try again.")
+			context.Abort()
+			return
+		}
+		context.Set(adminKey, admin)
+		context.Next()
+	}
+}
+
+// Ends the admin's session
+func AdminSignOut(context *gin.Context, settings *config.Config) {
+	setAdminCookie(context, settings, "", -1)
+	context.Redirect(http.StatusFound, "/")
+}
+
+// Shows every team and user, with how their syncs are going
+func AdminDashboard(context *gin.Context, settings *config.Config) {
+	teams, teamsError := store.ListTeams(context.Request.Context())
+	if util.InternalError(teamsError, context) {
+		return
+	}
+	users, usersError := store.ListUsers(context.Request.Context())
+	if util.InternalError(usersError, context) {
+		return
+	}
+	rows := make([]adminUserRow, 0, len(users))
+	for _, user := range users {
+		row := adminUserRow{UserSummary: user}
+		if user.SpotifyExpiresAt.Valid {
+			row.TokenExpiry = describeExpiry(user.SpotifyExpiresAt.Time, time.Now())
+		}
+		rows = append(rows, row)
+	}
+	cookie, _ := context.Cookie(adminCookie)
+	context.HTML(http.StatusOK, "admin.html", gin.H{
+		"Admin":  context.GetString(adminKey),
+		"CSRF":   csrfToken(settings, cookie),
+		"Teams":  teams,
+		"Users":  rows,
+		"Notice": context.Query("done"),
+	})
+}
+
+// Runs one of the dashboard's actions on a user: resync, disconnect or purge
+func AdminUserAction(context *gin.Context, client *http.Client) {
+	ctx := context.Request.Context()
+	admin := context.GetString(adminKey)
+	user := context.Param("user")
+	var notice string
+	var actionError error
+	switch context.Param("action") {
+	case "resync":
+		actionError = resyncUser(ctx, user)
+		notice = "Resync queued for " + user + "."
+	case "disconnect":
+		actionError = disconnectSpotify(ctx, user)
+		notice = "Disconnected Spotify for " + user + "."
+	case "purge":
+		actionError = PurgeUser(ctx, user, client)
+		notice = "Deleted everything stored for " + user + "."
+	default:
+		context.String(http.StatusNotFound, "Unknown action.")
+		return
+	}
+	if util.InternalError(actionError, context) {
+		return
+	}
+	logging.FromContext(ctx).Info("Admin action", "admin", logging.Hash(admin), "action", context.Param("action"), "user", logging.Hash(user))
+	if util.InternalError(store.AddAuditRecord(ctx, "", user, "admin_"+context.Param("action"), "by "+admin), context) {
+		return
+	}
+	context.Redirect(http.StatusSeeOther, "/admin?done="+url.QueryEscape(notice))
+}
+
+// Deletes a team and everyone in it
+func AdminPurgeTeam(context *gin.Context, client *http.Client) {
+	ctx := context.Request.Context()
+	admin := context.GetString(adminKey)
+	team := context.Param("team")
+	// Deleting the team audits it, with who asked as the reason
+	if util.InternalError(RemoveTeam(ctx, team, "purged by admin "+admin, client), context) {
+		return
+	}
+	logging.FromContext(ctx).Info("Admin action", "admin", logging.Hash(admin), "action", "purge_team", "team", logging.Hash(team))
+	context.Redirect(http.StatusSeeOther, "/admin?done="+url.QueryEscape("Deleted team "+team+"."))
+}
+
+// Has the next sync poll spotify afresh, and writes the last status we set again in case slack lost it
+func resyncUser(ctx context.Context, user string) error {
+	spotify.ForgetPlayback(user)
+	status, statusError := store.GetStatusForUser(ctx, user)
+	if statusError != nil {
+		return statusError
+	}
+	if enqueueError := jobs.EnqueueStatus(ctx, user, status); enqueueError != nil {
+		return enqueueError
+	}
+	return jobs.EnqueuePublishHome(ctx, user)
+}
+
+// Clears the status we set, if it is still showing, then deletes everything stored for the user
+func PurgeUser(ctx context.Context, user string, client *http.Client) error {
+	token, tokenError := store.GetSlackForUser(ctx, user)
+	if tokenError != nil {
+		return tokenError
+	}
+	owned, ownedError := store.GetStatusForUser(ctx, user)
+	if ownedError != nil {
+		return ownedError
+	}
+	// Best effort, as when a team is removed - the token may already be dead
+	if token != "" && owned != "" {
+		if clearError := slack.ClearOwnedStatus(ctx, user, token, owned, client); clearError != nil {
+			logging.FromContext(ctx).Warn("Could not clear status while purging user", "user", logging.Hash(user), "error", clearError)
+		}
+	}
+	spotify.ForgetPlayback(user)
+	return store.DeleteAllDataForUser(ctx, user)
+}
+
+// Describes when a token expires relative to now, such as "in 42m" or "expired 3m ago"
+func describeExpiry(expiresAt time.Time, now time.Time) string {
+	remaining := expiresAt.Sub(now).Round(time.Minute)
+	if remaining < 0 {
+		return "expired " + (-remaining).String() + " ago"
+	}
+	return "in " + remaining.String()
+}
+
+// Sessions are "user.expiry.signature", signed with a key derived from OAUTH_STATE_SECRET so it can't be mistaken for a state
+func signAdminSession(settings *config.Config, user string, expiresAt time.Time) string {
+	payload := user + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + adminMAC(settings, "session:"+payload)
+}
+
+// Returns the admin the session is for, or "" if it is forged, malformed or expired
+func verifyAdminSession(settings *config.Config, session string, now time.Time) string {
+	parts := strings.Split(session, ".")
+	if len(parts) != 3 || parts[0] == "" {
+		return ""
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(adminMAC(settings, "session:"+payload))) {
+		return ""
+	}
+	expiry, parseError := strconv.ParseInt(parts[1], 10, 64)
+	if parseError != nil || now.Unix() >= expiry {
+		return ""
+	}
+	return parts[0]
+}
+
+// The token the dashboard's forms carry, tied to the session so it can't be reused by another
+func csrfToken(settings *config.Config, session string) string {
+	return adminMAC(settings, "csrf:"+session)
+}
+
+func adminMAC(settings *config.Config, message string) string {
+	keyHasher := hmac.New(sha256.New, []byte(settings.OAuthStateSecret))
+	keyHasher.Write([]byte("admin dashboard"))
+	hasher := hmac.New(sha256.New, keyHasher.Sum(nil))
+	hasher.Write([]byte(message))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// Sets the session cookie, scoped to the dashboard. It is only sent over https when the app is served that way.
+func setAdminCookie(context *gin.Context, settings *config.Config, value string, maxAge int) {
+	context.SetSameSite(http.SameSiteLaxMode)
+	context.SetCookie(adminCookie, value, maxAge, "/admin", "", strings.HasPrefix(settings.AppURL, "https://"), true)
+}
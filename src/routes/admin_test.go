@@ -0,0 +1,90 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"rolflewis.com/spotify-status-sync/src/config"
+	"rolflewis.com/spotify-status-sync/src/oauthstate"
+	"rolflewis.com/spotify-status-sync/src/slack"
+	"rolflewis.com/spotify-status-sync/src/slack/slacktest"
+)
+
+// Signs in to the dashboard as the user through the fake slack, returning the callback's response
+func signInAsAdmin(t *testing.T, slackServer *slacktest.Server, settings *config.Config, user string) *httptest.ResponseRecorder {
+	t.Helper()
+	ctx := context.Background()
+	state, stateError := oauthstate.Issue(ctx, "slack_admin", "")
+	if stateError != nil {
+		t.Fatal(stateError)
+	}
+	slackServer.InstallAs = user
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	response, authorizeError := noFollow.Get(slack.SignInURL(state))
+	if authorizeError != nil {
+		t.Fatal(authorizeError)
+	}
+	response.Body.Close()
+	callback, parseError := url.Parse(response.Header.Get("Location"))
+	if parseError != nil {
+		t.Fatal(parseError)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/admin/callback", func(context *gin.Context) {
+		AdminCallbackFlow(context, settings, http.DefaultClient)
+	})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/callback?"+callback.RawQuery, nil))
+	return recorder
+}
+
+func TestAdminSignInNeedsAnInstalledWorkspace(t *testing.T) {
+	slackServer := slacktest.NewServer()
+	defer slackServer.Close()
+	// The store is shared with other tests, so the workspace is new to it
+	team := fmt.Sprintf("TA%d", atomic.AddInt64(&runs, 1))
+	slackServer.AddUser(team, "UA")
+	settings := &config.Config{AppURL: "http://app.test/", SlackAPIURL: slackServer.APIURL, SlackOpenIDURL: slackServer.OpenIDURL,
+		OAuthStateSecret: "state-secret", AdminUserIDs: team + ":UA"}
+	slack.UseConfig(settings)
+	oauthstate.UseSecret(settings.OAuthStateSecret)
+	// The event workers hold on to the package's store, so it is shared
+	memory := recorder.Store
+	oauthstate.UseStore(memory)
+
+	// UA is an admin's id, but in a workspace the app doesn't know
+	if recorder := signInAsAdmin(t, slackServer, settings, "UA"); recorder.Code != http.StatusForbidden || recorder.Header().Get("Set-Cookie") != "" {
+		t.Fatalf("sign in from an unknown workspace answered %d, setting %q", recorder.Code, recorder.Header().Get("Set-Cookie"))
+	}
+
+	// A workspace that uninstalled the app doesn't count either
+	ctx := context.Background()
+	if ensureError := memory.EnsureTeamExists(ctx, team); ensureError != nil {
+		t.Fatal(ensureError)
+	}
+	if recorder := signInAsAdmin(t, slackServer, settings, "UA"); recorder.Code != http.StatusForbidden {
+		t.Fatalf("sign in from a workspace without a bot token answered %d", recorder.Code)
+	}
+
+	if tokenError := memory.SetTokenForTeam(ctx, team, "xoxb-"+team); tokenError != nil {
+		t.Fatal(tokenError)
+	}
+	recorder := signInAsAdmin(t, slackServer, settings, "UA")
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "/admin" || recorder.Header().Get("Set-Cookie") == "" {
+		t.Errorf("admin in an installed workspace wasn't signed in: %d to %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	// The same user id is only an admin in the workspace it was listed with
+	settings.AdminUserIDs = "TOTHER:UA"
+	if recorder := signInAsAdmin(t, slackServer, settings, "UA"); recorder.Code != http.StatusForbidden || recorder.Header().Get("Set-Cookie") != "" {
+		t.Errorf("admin listed for another workspace answered %d, setting %q", recorder.Code, recorder.Header().Get("Set-Cookie"))
+	}
+}
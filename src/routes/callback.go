@@ -1,62 +1,101 @@
 package routes
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/jobs"
+	"rolflewis.com/spotify-status-sync/src/logging"
+	"rolflewis.com/spotify-status-sync/src/oauthstate"
 	"rolflewis.com/spotify-status-sync/src/slack"
 	"rolflewis.com/spotify-status-sync/src/spotify"
 	"rolflewis.com/spotify-status-sync/src/util"
 )
 
+// Where the package keeps its data - set once at startup
+var store database.Store
+
+// Sets the storage the package uses
+func UseStore(newStore database.Store) {
+	store = newStore
+}
+
 type SpotifyAuthResponse struct {
 	AccessToken  string
 	ExpiresIn    int
 	RefreshToken string
 }
 
+// Starts a slack install from outside of slack, such as the website's Add to Slack button
+func SlackInstallFlow(context *gin.Context) {
+	// Not on behalf of any particular user, but the state still stops forged callbacks
+	state, stateError := oauthstate.Issue(context.Request.Context(), "slack", "")
+	if util.InternalError(stateError, context) {
+		return
+	}
+	context.Redirect(http.StatusFound, slack.AuthorizeURL(state))
+}
+
 func SlackCallbackFlow(context *gin.Context, client *http.Client) {
+	// Check the state and look up the user it was issued for, if any
+	stateUser, _, stateError := oauthstate.Consume(context.Request.Context(), "slack", context.Query("state"))
+	if stateError == oauthstate.ErrInvalidState {
+		logging.FromContext(context.Request.Context()).Warn("Invalid state in slack callback request")
+		context.String(http.StatusBadRequest, "This link has expired or was already used. Try installing again.")
+		return
+	}
+	if util.InternalError(stateError, context) {
+		return
+	}
+
 	// Read the auth code
 	code := context.Query("code")
 
 	// Exchange code for token
-	authResponse, exchangeError := slack.ExchangeCodeForToken(code, client)
+	authResponse, exchangeError := slack.ExchangeCodeForToken(context.Request.Context(), code, client)
 	if util.InternalError(exchangeError, context) {
 		return
 	}
 
+	// If the flow was started for a user, it has to be finished by that same user
+	if stateUser != "" && stateUser != authResponse.AuthedUser.ID {
+		logging.FromContext(context.Request.Context()).Warn("Slack callback completed by a different user than it was started for",
+			"user", logging.Hash(authResponse.AuthedUser.ID), "team", logging.Hash(authResponse.Team.ID))
+		context.String(http.StatusForbidden, "This link was created for a different Slack user.")
+		return
+	}
+
 	// Make sure the team exists in DB
-	teamExistsError := database.EnsureTeamExists(authResponse.Team.ID)
+	teamExistsError := store.EnsureTeamExists(context.Request.Context(), authResponse.Team.ID)
 	if util.InternalError(teamExistsError, context) {
 		return
 	}
 
 	// Set token for team
-	teamUpdateError := database.SetTokenForTeam(authResponse.Team.ID, authResponse.AccessToken)
+	teamUpdateError := store.SetTokenForTeam(context.Request.Context(), authResponse.Team.ID, authResponse.AccessToken)
 	if util.InternalError(teamUpdateError, context) {
 		return
 	}
 
 	// Make sure we have a user record for the user
-	if util.InternalError(database.EnsureUserExists(authResponse.AuthedUser.ID), context) {
+	if util.InternalError(store.EnsureUserExists(context.Request.Context(), authResponse.AuthedUser.ID), context) {
 		return
 	}
 
 	// Set the user's team id
-	if util.InternalError(database.SetTeamForUser(authResponse.AuthedUser.ID, authResponse.Team.ID), context) {
+	if util.InternalError(store.SetTeamForUser(context.Request.Context(), authResponse.AuthedUser.ID, authResponse.Team.ID), context) {
 		return
 	}
 
 	// Save to user record
-	saveError := database.SaveSlackTokenForUser(authResponse.AuthedUser.ID, authResponse.AuthedUser.AccessToken)
+	saveError := store.SaveSlackTokenForUser(context.Request.Context(), authResponse.AuthedUser.ID, authResponse.AuthedUser.AccessToken)
 	if util.InternalError(saveError, context) {
 		return
 	}
 
 	// update the homepage view
-	viewError := slack.UpdateHome(authResponse.AuthedUser.ID, client)
+	viewError := jobs.EnqueuePublishHome(context.Request.Context(), authResponse.AuthedUser.ID)
 	if util.InternalError(viewError, context) {
 		return
 	}
@@ -68,30 +107,42 @@ func SpotifyCallbackFlow(context *gin.Context, client *http.Client) {
 	// Check for error from Spotify
 	errorMsg := context.Query("error")
 	if errorMsg != "" {
-		log.Println(errorMsg)
-		context.String(http.StatusInternalServerError, errorMsg)
+		// Only the reference goes back, the reason is in the log
+		reference := logging.NewID()
+		logging.FromContext(context.Request.Context()).Warn("Spotify reported an error in its callback", "reference", reference, "spotify_error", errorMsg)
+		context.String(http.StatusBadRequest, "Spotify was not connected. Open the app in Slack to try again. Reference: "+reference)
 		return
 	}
 
 	// Read auth code
 	code := context.Query("code")
 
-	// Read the user id (passed as state)
-	user := context.Query("state")
-
 	// if no state is somehow defined, bad request
-	if user == "" {
-		log.Println("No state/userid defined in callback request.")
-		context.String(http.StatusBadRequest, "No state/userid defined in callback request.")
+	state := context.Query("state")
+	if state == "" {
+		logging.FromContext(context.Request.Context()).Warn("No state defined in spotify callback request")
+		context.String(http.StatusBadRequest, "No state defined in callback request.")
+		return
+	}
+
+	// Check the state and look up the user and PKCE verifier it was issued with
+	user, verifier, stateError := oauthstate.Consume(context.Request.Context(), "spotify", state)
+	if stateError == oauthstate.ErrInvalidState || (stateError == nil && user == "") {
+		logging.FromContext(context.Request.Context()).Warn("Invalid state in spotify callback request")
+		context.String(http.StatusBadRequest, "This link has expired or was already used. Open the app in Slack to get a new one.")
+		return
+	}
+	if util.InternalError(stateError, context) {
+		return
 	}
 
 	// Make sure we have a user record for the user
-	if util.InternalError(database.EnsureUserExists(user), context) {
+	if util.InternalError(store.EnsureUserExists(context.Request.Context(), user), context) {
 		return
 	}
 
 	// Exchange code for tokens
-	tokensMap, exchangeError := spotify.ExchangeCodeForTokens(code, false, client)
+	tokensMap, exchangeError := spotify.ExchangeCodeForTokens(context.Request.Context(), code, verifier, false, client)
 	if util.InternalError(exchangeError, context) {
 		return
 	}
@@ -104,19 +155,19 @@ func SpotifyCallbackFlow(context *gin.Context, client *http.Client) {
 	}
 
 	// Get the user's profile information
-	profile, profileError := spotify.GetProfileForTokens(tokens.AccessToken, client)
+	profile, profileError := spotify.GetProfileForTokens(context.Request.Context(), tokens.AccessToken, client)
 	if util.InternalError(profileError, context) {
 		return
 	}
 
 	// Save the information to the DB
-	dbError := database.AddSpotifyToUser(user, *profile, tokens.AccessToken, tokens.RefreshToken, tokens.ExpiresIn)
+	dbError := store.AddSpotifyToUser(context.Request.Context(), user, *profile, tokens.AccessToken, tokens.RefreshToken, tokens.ExpiresIn)
 	if util.InternalError(dbError, context) {
 		return
 	}
 
 	// update the homepage view
-	viewError := slack.UpdateHome(user, client)
+	viewError := jobs.EnqueuePublishHome(context.Request.Context(), user)
 	if util.InternalError(viewError, context) {
 		return
 	}
@@ -1,12 +1,22 @@
 package routes
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/jobs"
+	"rolflewis.com/spotify-status-sync/src/logging"
 	"rolflewis.com/spotify-status-sync/src/slack"
+	"rolflewis.com/spotify-status-sync/src/spotify"
+	"rolflewis.com/spotify-status-sync/src/tracing"
 	"rolflewis.com/spotify-status-sync/src/util"
 )
 
@@ -16,25 +26,142 @@ type eventWrapper struct {
 	APIAppID  string `json:"api_app_id"`
 	Event     *event `json:"event"`
 	Type      string `json:"type"`
+	EventID   string `json:"event_id"`
 	Challenge string `json:"challenge"`
 }
 
 type event struct {
-	Type      string `json:"type"`
-	User      string `json:"user"`
-	Channel   string `json:"channel"`
-	Timestamp string `json:"event_ts"`
-	Tab       string `json:"tab"`
+	Type      string    `json:"type"`
+	User      eventUser `json:"user"`
+	Channel   string    `json:"channel"`
+	Timestamp string    `json:"event_ts"`
+	Tab       string    `json:"tab"`
 	Tokens    struct {
 		OAuth []string `json:"oauth"`
 		Bot   []string `json:"bot"`
 	} `json:"tokens"`
 }
 
-func EventsEndpoint(context *gin.Context, client *http.Client) {
+// Most events carry the user as a plain id, but profile events carry the whole user object
+type eventUser struct {
+	ID      string `json:"id"`
+	TeamID  string `json:"team_id"`
+	Profile *struct {
+		StatusText       string `json:"status_text"`
+		StatusEmoji      string `json:"status_emoji"`
+		StatusExpiration int    `json:"status_expiration"`
+	} `json:"profile"`
+}
+
+func (user *eventUser) UnmarshalJSON(data []byte) error {
+	// Plain id
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &user.ID)
+	}
+	// Full user object - alias the type so this method isn't called recursively
+	type plainUser eventUser
+	return json.Unmarshal(data, (*plainUser)(user))
+}
+
+// The event types we handle - anything else is rejected before it is queued
+var supportedEvents = map[string]bool{
+	"app_home_opened":     true,
+	"user_change":         true,
+	"user_status_changed": true,
+	"tokens_revoked":      true,
+	"app_uninstalled":     true,
+}
+
+// An acknowledged event waiting for a worker
+type queuedEvent struct {
+	wrapper eventWrapper
+	client  *http.Client
+}
+
+// How long a worker may spend on a single event
+const eventTimeout = 30 * time.Second
+
+// How many acknowledged events can wait, across every worker's queue
+const eventQueueSize = 1000
+
+// A queue for each worker. Events are sharded by user, so each user's events are handled in the order they arrived.
+var eventQueues []chan queuedEvent
+
+// Processed events are remembered for longer than slack keeps retrying them (roughly an hour and a half)
+const processedEventLifetime = 2 * time.Hour
+
+// Starts the goroutines that process acknowledged events. Must be called once, before events are accepted.
+func StartEventWorkers(workers int) {
+	eventQueues = make([]chan queuedEvent, workers)
+	for i := range eventQueues {
+		queue := make(chan queuedEvent, eventQueueSize/workers)
+		eventQueues[i] = queue
+		go func() {
+			for queued := range queue {
+				handleQueuedEvent(queued)
+			}
+		}()
+	}
+}
+
+// The queue for the event's user. Events without one, such as uninstalls, are sharded by team.
+func queueFor(wrapper eventWrapper) chan queuedEvent {
+	key := wrapper.Event.User.ID
+	if key == "" {
+		key = wrapper.TeamID
+	}
+	hasher := fnv.New32a()
+	hasher.Write([]byte(key))
+	return eventQueues[hasher.Sum32()%uint32(len(eventQueues))]
+}
+
+// Processes an event, unless a delivery of it has already been processed. It is only recorded once it has been, so a
+// retry of one that failed is processed again.
+func handleQueuedEvent(queued queuedEvent) {
+	// Everything logged while handling the event says which one it was
+	ctx, span := tracing.Start(context.Background(), "slack event "+queued.wrapper.Event.Type,
+		attribute.String("event", queued.wrapper.EventID), attribute.String("team", logging.Hash(queued.wrapper.TeamID)))
+	ctx = tracing.WithTraceID(logging.WithLogger(ctx, slog.Default().With("event", queued.wrapper.EventID,
+		"event_type", queued.wrapper.Event.Type, "team", logging.Hash(queued.wrapper.TeamID))))
+	logger := logging.FromContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, eventTimeout)
+	defer cancel()
+	// Deliveries of the same event are for the same user, so here they are in the same queue and the first has finished by
+	// now. Another instance may still be working on one.
+	processed, processedError := eventProcessed(ctx, queued.wrapper.EventID)
+	if processedError != nil {
+		tracing.End(span, processedError)
+		logger.Error("Could not check whether event was already processed", "error", processedError)
+		return
+	}
+	if processed {
+		logger.Info("Ignoring duplicate event")
+		tracing.End(span, nil)
+		return
+	}
+	processError := processEvent(ctx, queued.wrapper, queued.client)
+	if processError == nil && queued.wrapper.EventID != "" {
+		processError = store.RecordProcessedEvent(ctx, queued.wrapper.EventID, time.Now().Add(processedEventLifetime))
+	}
+	tracing.End(span, processError)
+	if processError != nil {
+		logger.Error("Could not process event", "error", processError)
+	}
+}
+
+// Reports whether the event was already processed. Events without an id can't be deduplicated, so they never were.
+func eventProcessed(ctx context.Context, id string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+	return store.EventProcessed(ctx, id)
+}
+
+// Handles a request from the Events API, which is checked against the app's signing key
+func EventsEndpoint(context *gin.Context, signingKey string, client *http.Client) {
 	// Ensure is from slack and is secure
-	if !util.IsSecureFromSlack(context) {
-		log.Println("Insecure request skipped.")
+	if !util.IsSecureFromSlack(context, signingKey) {
+		logging.FromContext(context.Request.Context()).Warn("Insecure request skipped")
 		return
 	}
 
@@ -49,65 +176,142 @@ func EventsEndpoint(context *gin.Context, client *http.Client) {
 	if wrapper.Type == "url_verification" {
 		context.String(http.StatusOK, wrapper.Challenge)
 		return
-	} else if wrapper.Type == "event_callback" {
-		// Extract the inner event
-		event := wrapper.Event
-
-		// If type is a app_home_opened, answer it
-		if event.Type == "app_home_opened" {
-			// Make sure that this user exists
-			if util.InternalError(database.EnsureUserExists(event.User), context) {
-				return
-			}
-			// Make sure the team exists in DB
-			teamExistsError := database.EnsureTeamExists(wrapper.TeamID)
-			if util.InternalError(teamExistsError, context) {
-				return
-			}
-			// Set the user's team id
-			if util.InternalError(database.SetTeamForUser(event.User, wrapper.TeamID), context) {
-				return
-			}
-			// Update the home page
-			updateError := slack.UpdateHome(event.User, client)
-			if util.InternalError(updateError, context) {
-				return
-			}
-			// Send an acknowledgment
-			context.String(http.StatusOK, "Ok")
-		} else if event.Type == "tokens_revoked" {
-			// Delete all of the users related to revoked user tokens
-			for _, user := range event.Tokens.OAuth {
-				// Clean out the spotify and slack authorization data so a page update is essentially like new
-				spotifyClearError := database.DeleteSpotifyDataForUser(user)
-				if util.InternalError(spotifyClearError, context) {
-					return
-				}
-				slackTokenClear := database.SaveSlackTokenForUser(user, "")
-				if util.InternalError(slackTokenClear, context) {
-					return
-				}
-				// Delete user data
-				log.Println("Cleaning up former user.")
-				cleanupError := database.DeleteAllDataForUser(user)
-				if util.InternalError(cleanupError, context) {
-					return
-				}
+	}
+
+	context.String(acceptEvent(wrapper, context.GetHeader("X-Slack-Retry-Num"), client))
+}
+
+// Delivers an Events API payload that arrived over something other than the HTTP endpoint, such as Socket Mode.
+// The payload must already be known to come from slack.
+func DeliverEvent(payload []byte, client *http.Client) error {
+	var wrapper eventWrapper
+	parseError := json.Unmarshal(payload, &wrapper)
+	if parseError != nil {
+		return parseError
+	}
+	status, message := acceptEvent(wrapper, "", client)
+	if status != http.StatusOK {
+		return errors.New("Event not accepted: " + message)
+	}
+	return nil
+}
+
+// Queues an event for the workers. Returns the status and message to acknowledge it with.
+func acceptEvent(wrapper eventWrapper, retry string, client *http.Client) (int, string) {
+	// Only accept events we know how to handle
+	if wrapper.Type != "event_callback" || wrapper.Event == nil || !supportedEvents[wrapper.Event.Type] {
+		slog.Warn("Not a supported event", "type", wrapper.Type, "event", wrapper.EventID)
+		return http.StatusBadRequest, "Not a supported event"
+	}
+
+	// Slack retries anything not acknowledged within 3 seconds, so ignore events we've already processed. Ones still
+	// waiting are queued again, and skipped by the worker if the first delivery works.
+	// If the check fails the event is queued anyway, and the worker checks again.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	processed, processedError := eventProcessed(ctx, wrapper.EventID)
+	cancel()
+	if processedError != nil {
+		slog.Warn("Could not check whether event was already processed", "event", wrapper.EventID, "error", processedError)
+	} else if processed {
+		slog.Info("Ignoring duplicate event", "event", wrapper.EventID, "event_type", wrapper.Event.Type, "retry", retry)
+		return http.StatusOK, "Ok"
+	}
+	if len(eventQueues) == 0 {
+		slog.Warn("Event workers aren't running, rejecting event", "event", wrapper.EventID, "event_type", wrapper.Event.Type)
+		return http.StatusServiceUnavailable, "Busy"
+	}
+
+	// Hand the event to the workers and acknowledge straight away. If the queue is full, let slack retry it later.
+	select {
+	case queueFor(wrapper) <- queuedEvent{wrapper: wrapper, client: client}:
+		return http.StatusOK, "Ok"
+	default:
+		slog.Warn("Event queue full, rejecting event", "event", wrapper.EventID, "event_type", wrapper.Event.Type)
+		return http.StatusServiceUnavailable, "Busy"
+	}
+}
+
+func processEvent(ctx context.Context, wrapper eventWrapper, client *http.Client) error {
+	// Extract the inner event
+	event := wrapper.Event
+
+	// If type is a app_home_opened, answer it
+	if event.Type == "app_home_opened" {
+		// Make sure that this user exists
+		if userExistsError := store.EnsureUserExists(ctx, event.User.ID); userExistsError != nil {
+			return userExistsError
+		}
+		// Make sure the team exists in DB
+		if teamExistsError := store.EnsureTeamExists(ctx, wrapper.TeamID); teamExistsError != nil {
+			return teamExistsError
+		}
+		// Set the user's team id
+		if teamSetError := store.SetTeamForUser(ctx, event.User.ID, wrapper.TeamID); teamSetError != nil {
+			return teamSetError
+		}
+		// Update the home page
+		return jobs.EnqueuePublishHome(ctx, event.User.ID)
+	} else if event.Type == "user_change" || event.Type == "user_status_changed" {
+		// Keep the cached profile current so sync doesn't have to read it from slack
+		if event.User.Profile == nil {
+			return nil
+		}
+		profile := event.User.Profile
+		cacheError := store.SetProfileForUser(ctx, event.User.ID, profile.StatusText, profile.StatusEmoji, profile.StatusExpiration, database.ProfileFromEvent)
+		if cacheError != nil {
+			return cacheError
+		}
+		// Pause sync while the user has a status of their own, and resume it once they clear it or it expires
+		overridden := slack.IsManualStatus(profile.StatusText, profile.StatusEmoji, profile.StatusExpiration)
+		changed, overrideError := store.SetManualOverrideForUser(ctx, event.User.ID, overridden)
+		if overrideError != nil || !changed {
+			return overrideError
+		}
+		// Make sure whatever is playing gets published again rather than skipped as unchanged
+		if !overridden {
+			spotify.ForgetPlayback(event.User.ID)
+		}
+		// Show the new state in the home page
+		return jobs.EnqueuePublishHome(ctx, event.User.ID)
+	} else if event.Type == "tokens_revoked" {
+		// Delete all of the users related to revoked user tokens. Their tokens no longer work, so their statuses can't be cleared.
+		// Users may already be gone if the app was uninstalled first, which deleting handles fine.
+		for _, user := range event.Tokens.OAuth {
+			logging.FromContext(ctx).Info("Cleaning up former user", "user", logging.Hash(user))
+			if cleanupError := store.DeleteAllDataForUser(ctx, user); cleanupError != nil {
+				return cleanupError
 			}
-			// Delete the team data and token of revoked bot tokens
-			if len(event.Tokens.Bot) > 0 {
-				// Delete the team record
-				teamDeleteError := database.DeleteAllDataForTeam(wrapper.TeamID)
-				if util.InternalError(teamDeleteError, context) {
-					return
-				}
+			spotify.ForgetPlayback(user)
+			if auditError := store.AddAuditRecord(ctx, wrapper.TeamID, user, "user_deleted", "user token revoked"); auditError != nil {
+				return auditError
 			}
-		} else {
-			context.String(http.StatusBadRequest, "Not a supported event")
-			log.Println("Not a supported event:", event)
 		}
-	} else {
-		context.String(http.StatusBadRequest, "Not a supported event")
-		log.Println("Not a supported event:", wrapper)
+		// Delete the team data and token of revoked bot tokens
+		if len(event.Tokens.Bot) > 0 {
+			return RemoveTeam(ctx, wrapper.TeamID, "bot token revoked", client)
+		}
+		return nil
+	} else if event.Type == "app_uninstalled" {
+		return RemoveTeam(ctx, wrapper.TeamID, "app uninstalled", client)
+	}
+	return errors.New("Not a supported event: " + event.Type)
+}
+
+// Removes a team and everyone in it. Statuses we set are cleared first where the users' tokens still allow it.
+func RemoveTeam(ctx context.Context, team string, reason string, client *http.Client) error {
+	// Clear out our statuses - this is best effort, since by the time slack tells us the tokens may already be dead
+	owned, ownedError := store.GetOwnedStatusesForTeam(ctx, team)
+	if ownedError != nil {
+		return ownedError
+	}
+	for _, status := range owned {
+		clearError := slack.ClearOwnedStatus(ctx, status.User, status.Token, status.Status, client)
+		if clearError != nil {
+			logging.FromContext(ctx).Warn("Could not clear status while removing team", "user", logging.Hash(status.User), "error", clearError)
+		}
+		spotify.ForgetPlayback(status.User)
 	}
+	// Delete everything for the team in one go
+	logging.FromContext(ctx).Info("Cleaning up former team")
+	return store.DeleteAllDataForTeam(ctx, team, reason)
 }
@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/jobs"
+)
+
+// A store that keeps the profiles cached by events in the order they were written, and fails them for users in failing
+type profileRecorder struct {
+	database.Store
+	lock     sync.Mutex
+	failing  map[string]bool
+	profiles map[string][]string
+}
+
+func (recorder *profileRecorder) SetProfileForUser(ctx context.Context, user string, text string, emoji string, expiration int, source string) error {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.profiles[user] = append(recorder.profiles[user], text)
+	if recorder.failing[user] {
+		return errors.New("database is down")
+	}
+	return nil
+}
+
+// The statuses written for the user so far
+func (recorder *profileRecorder) written(user string) []string {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	return append([]string(nil), recorder.profiles[user]...)
+}
+
+// Waits for the user to have count statuses written
+func (recorder *profileRecorder) waitFor(t *testing.T, user string, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.written(user)) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d statuses written for %s, got %v", count, user, recorder.written(user))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return recorder.written(user)
+}
+
+// Makes the user's profile writes fail, or work again
+func (recorder *profileRecorder) setFailing(user string, failing bool) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.failing[user] = failing
+}
+
+// Forgets what has been written
+func (recorder *profileRecorder) reset() {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	recorder.failing = make(map[string]bool)
+	recorder.profiles = make(map[string][]string)
+}
+
+// The workers keep running between tests, so they share a store, and the ids of events they have processed
+var recorder = &profileRecorder{Store: database.NewMemoryStore(), failing: make(map[string]bool), profiles: make(map[string][]string)}
+
+// Makes event ids unique to each run of a test
+var runs int64
+
+func newRun(t *testing.T) string {
+	recorder.reset()
+	return fmt.Sprintf("%s-%d-", t.Name(), atomic.AddInt64(&runs, 1))
+}
+
+func TestMain(m *testing.M) {
+	UseStore(recorder)
+	jobs.UseStore(recorder)
+	StartEventWorkers(4)
+	os.Exit(m.Run())
+}
+
+func deliverStatusChange(t *testing.T, id string, user string, text string) {
+	t.Helper()
+	payload := fmt.Sprintf(`{"type":"event_callback","team_id":"T1","event_id":%q,"event":{"type":"user_status_changed",`+
+		`"user":{"id":%q,"team_id":"T1","profile":{"status_text":%q}}}}`, id, user, text)
+	if deliverError := DeliverEvent([]byte(payload), http.DefaultClient); deliverError != nil {
+		t.Fatal(deliverError)
+	}
+}
+
+func TestEachUsersEventsAreProcessedInOrder(t *testing.T) {
+	run := newRun(t)
+	users := []string{"U1", "U2", "U3", "U4", "U5", "U6"}
+	for i := 0; i < 40; i++ {
+		for _, user := range users {
+			deliverStatusChange(t, fmt.Sprintf("%s%s-%d", run, user, i), user, fmt.Sprint(i))
+		}
+	}
+	for _, user := range users {
+		written := recorder.waitFor(t, user, 40)
+		for i, text := range written {
+			if text != fmt.Sprint(i) {
+				t.Fatalf("%s's events were processed out of order: %v", user, written)
+			}
+		}
+	}
+}
+
+func TestEventsAreOnlyRecordedOnceProcessed(t *testing.T) {
+	run := newRun(t)
+	recorder.setFailing("U1", true)
+	deliverStatusChange(t, run+"Ev1", "U1", "first try")
+	recorder.waitFor(t, "U1", 1)
+
+	// The first delivery failed, so slack's retry is processed
+	recorder.setFailing("U1", false)
+	deliverStatusChange(t, run+"Ev1", "U1", "retry")
+	recorder.waitFor(t, "U1", 2)
+
+	// That one worked, so the next retry is ignored. The user's events are handled in order, so once Ev2 is done Ev1 has
+	// been skipped.
+	deliverStatusChange(t, run+"Ev1", "U1", "second retry")
+	deliverStatusChange(t, run+"Ev2", "U1", "next event")
+	written := recorder.waitFor(t, "U1", 3)
+	if len(written) != 3 || written[2] != "next event" {
+		t.Errorf("expected the processed event's retry to be skipped, got %v", written)
+	}
+}
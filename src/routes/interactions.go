@@ -1,13 +1,14 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
-	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"rolflewis.com/spotify-status-sync/src/database"
-	"rolflewis.com/spotify-status-sync/src/slack"
+	"rolflewis.com/spotify-status-sync/src/jobs"
+	"rolflewis.com/spotify-status-sync/src/logging"
+	"rolflewis.com/spotify-status-sync/src/spotify"
 	"rolflewis.com/spotify-status-sync/src/util"
 )
 
@@ -63,10 +64,11 @@ type viewInteraction struct {
 	}
 }
 
-func InteractivityEndpoint(context *gin.Context, client *http.Client) {
+// Handles an interactivity request, which is checked against the app's signing key
+func InteractivityEndpoint(context *gin.Context, signingKey string, client *http.Client) {
 	// Ensure is from slack and is secure
-	if !util.IsSecureFromSlack(context) {
-		log.Println("Insecure request skipped.")
+	if !util.IsSecureFromSlack(context, signingKey) {
+		logging.FromContext(context.Request.Context()).Warn("Insecure request skipped")
 		return
 	}
 
@@ -77,51 +79,89 @@ func InteractivityEndpoint(context *gin.Context, client *http.Client) {
 		return
 	}
 
+	// Handle the interaction
+	message, interactionError := processInteraction(context.Request.Context(), []byte(jsonBody), client)
+	if util.InternalError(interactionError, context) {
+		return
+	}
+
+	context.String(http.StatusOK, message)
+}
+
+// Delivers an interaction payload that arrived over something other than the HTTP endpoint, such as Socket Mode.
+// The payload must already be known to come from slack.
+func DeliverInteraction(ctx context.Context, payload []byte, client *http.Client) error {
+	_, interactionError := processInteraction(ctx, payload, client)
+	return interactionError
+}
+
+// Handles an interaction payload. Returns the message to acknowledge it with.
+func processInteraction(ctx context.Context, jsonBody []byte, client *http.Client) (string, error) {
 	// Parse the interaction header data
 	var header interactionHeader
-	headerParseError := json.Unmarshal([]byte(jsonBody), &header)
-	if util.InternalError(headerParseError, context) {
-		log.Println("error while parsing header")
-		return
+	headerParseError := json.Unmarshal(jsonBody, &header)
+	if headerParseError != nil {
+		logging.FromContext(ctx).Warn("Could not parse interaction header", "error", headerParseError)
+		return "", headerParseError
 	}
 
 	// If this is not a view interaction, send an ack but ignore
 	if header.Type != "block_actions" || header.Container.Type != "view" {
-		context.String(http.StatusOK, "Ignored")
-		return
+		return "Ignored", nil
 	}
 
 	// unmarshal to a more specific viewInteraction
 	var interaction viewInteraction
-	interactionParseError := json.Unmarshal([]byte(jsonBody), &interaction)
-	if util.InternalError(interactionParseError, context) {
-		log.Println("error while parsing interaction")
-		return
+	interactionParseError := json.Unmarshal(jsonBody, &interaction)
+	if interactionParseError != nil {
+		logging.FromContext(ctx).Warn("Could not parse interaction", "error", interactionParseError)
+		return "", interactionParseError
 	}
 
 	// If the interaction was not with the app home view, ack and ignore
 	if interaction.View.Type != "home" {
-		context.String(http.StatusOK, "Ignored")
-		return
+		return "Ignored", nil
 	}
 
 	// Dispatch each button press to the correct helper function
 	for _, action := range interaction.Actions {
 		// Disconnect button
 		if action.Type == "button" && action.ActionID == "spotify_disconnect_button" {
-			// Delete spotify data
-			deleteError := database.DeleteSpotifyDataForUser(interaction.User.ID)
-			if util.InternalError(deleteError, context) {
-				return
+			disconnectError := disconnectSpotify(ctx, interaction.User.ID)
+			if disconnectError != nil {
+				return "", disconnectError
+			}
+		}
+		// Export button - the file takes a moment to put together, so it is sent from the queue
+		if action.Type == "button" && action.ActionID == "data_export_button" {
+			exportError := jobs.EnqueueDataExport(ctx, interaction.User.ID)
+			if exportError != nil {
+				return "", exportError
 			}
-			// After removing the data, reset the user's app home view back to the new user flow
-			viewError := slack.UpdateHome(interaction.User.ID, client)
-			if util.InternalError(viewError, context) {
-				return
+			auditError := store.AddAuditRecord(ctx, interaction.Team.ID, interaction.User.ID, "data_export_requested", "from the App Home")
+			if auditError != nil {
+				return "", auditError
 			}
 		}
 	}
 
 	// Return an interaction success
-	context.String(http.StatusOK, "Interaction Processed.")
+	return "Interaction Processed.", nil
+}
+
+// Unlinks the user's spotify account, clears the status we set and resets their home back to the new user flow
+func disconnectSpotify(ctx context.Context, user string) error {
+	// Delete spotify data
+	deleteError := store.DeleteSpotifyDataForUser(ctx, user)
+	if deleteError != nil {
+		return deleteError
+	}
+	spotify.ForgetPlayback(user)
+	// Clear the status we set, if it is still showing
+	clearError := jobs.EnqueueStatus(ctx, user, "")
+	if clearError != nil {
+		return clearError
+	}
+	// After removing the data, reset the user's app home view back to the new user flow
+	return jobs.EnqueuePublishHome(ctx, user)
 }
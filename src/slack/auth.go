@@ -1,13 +1,13 @@
 package slack
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 )
 
@@ -34,20 +34,32 @@ type slackAuthResponse struct {
 	} `json:"authed_user"`
 }
 
-func ExchangeCodeForToken(code string, client *http.Client) (*slackAuthResponse, error) {
+// Builds the link to slack's OAuth page. The state must come from oauthstate.Issue.
+func AuthorizeURL(state string) string {
+	// Set the query values
+	queryValues := url.Values{}
+	queryValues.Set("client_id", settings.SlackClientID)
+	queryValues.Set("redirect_uri", settings.AppURL+"slack/callback")
+	queryValues.Set("scope", "chat:write,files:write,im:write,users:read,users:write")
+	queryValues.Set("user_scope", "users.profile:read,users.profile:write")
+	queryValues.Set("state", state)
+	return settings.SlackAuthURL + "authorize?" + queryValues.Encode()
+}
+
+func ExchangeCodeForToken(ctx context.Context, code string, client *http.Client) (*slackAuthResponse, error) {
 	// Set the query values
 	queryValues := url.Values{}
 	queryValues.Set("code", code)
-	queryValues.Set("redirect_uri", os.Getenv("APP_URL")+"slack/callback")
+	queryValues.Set("redirect_uri", settings.AppURL+"slack/callback")
 
 	// Get the auth and refresh tokens
-	authReq, authReqError := http.NewRequest(http.MethodPost, os.Getenv("SLACK_API_URL")+"oauth.v2.access?"+queryValues.Encode(), nil)
+	authReq, authReqError := http.NewRequestWithContext(ctx, http.MethodPost, settings.SlackAPIURL+"oauth.v2.access?"+queryValues.Encode(), nil)
 	if authReqError != nil {
 		return nil, authReqError
 	}
 
 	// Encode the authorization header
-	bytes := []byte(os.Getenv("SLACK_CLIENT_ID") + ":" + os.Getenv("SLACK_CLIENT_SECRET"))
+	bytes := []byte(settings.SlackClientID + ":" + settings.SlackClientSecret)
 	authReq.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString(bytes))
 
 	// Send the request
@@ -86,7 +98,7 @@ func ExchangeCodeForToken(code string, client *http.Client) (*slackAuthResponse,
 // 	}
 
 // 	// Get the token for the user
-// 	token, tokenError := database.GetSlackForUser(user)
+// 	token, tokenError := database.GetSlackForUser(ctx, user)
 // 	if tokenError != nil {
 // 		return tokenError
 // 	}
@@ -0,0 +1,160 @@
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Reported when the app wasn't granted a scope the call needs. Retrying won't help until the app is reinstalled.
+var ErrMissingScope = errors.New("missing_scope")
+
+type botResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+type openConversationResponse struct {
+	botResponse
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+}
+
+type uploadURLResponse struct {
+	botResponse
+	UploadURL string `json:"upload_url"`
+	FileID    string `json:"file_id"`
+}
+
+type completeUploadFile struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// Sends a file to the user from the bot, in their direct messages with the app, along with a comment
+func SendFile(ctx context.Context, user string, filename string, content []byte, comment string, client *http.Client) error {
+	// Files are sent as the bot
+	token, tokenError := store.GetTeamTokenForUser(ctx, user)
+	if tokenError != nil {
+		return tokenError
+	}
+	if token == "" {
+		return errors.New("No team token found for user.")
+	}
+
+	// Unlike messages, files have to be shared to the DM's channel id rather than the user id
+	openValues := url.Values{}
+	openValues.Set("users", user)
+	var conversation openConversationResponse
+	openError := botFormCall(ctx, "conversations.open", token, openValues, &conversation, client)
+	if openError != nil {
+		return openError
+	}
+
+	// Ask where to upload the file
+	uploadValues := url.Values{}
+	uploadValues.Set("filename", filename)
+	uploadValues.Set("length", strconv.Itoa(len(content)))
+	var upload uploadURLResponse
+	uploadURLError := botFormCall(ctx, "files.getUploadURLExternal", token, uploadValues, &upload, client)
+	if uploadURLError != nil {
+		return uploadURLError
+	}
+
+	// Upload it
+	uploadError := uploadFile(ctx, upload.UploadURL, content, client)
+	if uploadError != nil {
+		return uploadError
+	}
+
+	// Then share it to the DM
+	filesBytes, jsonError := json.Marshal([]completeUploadFile{{ID: upload.FileID, Title: filename}})
+	if jsonError != nil {
+		return jsonError
+	}
+	completeValues := url.Values{}
+	completeValues.Set("files", string(filesBytes))
+	completeValues.Set("channel_id", conversation.Channel.ID)
+	completeValues.Set("initial_comment", comment)
+	var complete botResponse
+	return botFormCall(ctx, "files.completeUploadExternal", token, completeValues, &complete, client)
+}
+
+// Sends the file's bytes to the url files.getUploadURLExternal gave out
+func uploadFile(ctx context.Context, uploadURL string, content []byte, client *http.Client) error {
+	uploadReq, uploadReqError := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, bytes.NewReader(content))
+	if uploadReqError != nil {
+		return uploadReqError
+	}
+	uploadReq.Header.Add("Content-Type", "application/octet-stream")
+
+	// Send the request
+	uploadResp, uploadRespError := client.Do(uploadReq)
+	if uploadRespError != nil {
+		return uploadRespError
+	}
+	defer uploadResp.Body.Close()
+
+	// Check status codes
+	if uploadResp.StatusCode != http.StatusOK {
+		return errors.New("Non-200 status code from file upload: " + strconv.Itoa(uploadResp.StatusCode) + " / " + uploadResp.Status)
+	}
+	return nil
+}
+
+// Posts a form to a Web API method with the bot token, reading the JSON answer into response. Errors slack reports are returned.
+func botFormCall(ctx context.Context, method string, token string, form url.Values, response interface{ failure() string }, client *http.Client) error {
+	body := form.Encode()
+	botReq, botReqError := http.NewRequestWithContext(ctx, http.MethodPost, settings.SlackAPIURL+method, strings.NewReader(body))
+	if botReqError != nil {
+		return botReqError
+	}
+	botReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	botReq.Header.Add("Authorization", "Bearer "+token)
+
+	// Send the request
+	botResp, botRespError := client.Do(botReq)
+	if botRespError != nil {
+		return botRespError
+	}
+	defer botResp.Body.Close()
+
+	// Check status codes
+	if botResp.StatusCode != http.StatusOK {
+		return errors.New("Non-200 status code from " + method + " endpoint: " + strconv.Itoa(botResp.StatusCode) + " / " + botResp.Status)
+	}
+
+	jsonBytes, readError := ioutil.ReadAll(botResp.Body)
+	if readError != nil {
+		return readError
+	}
+	jsonError := json.Unmarshal(jsonBytes, response)
+	if jsonError != nil {
+		return jsonError
+	}
+	if failure := response.failure(); failure == ErrMissingScope.Error() {
+		return fmt.Errorf("Error reported from %s endpoint: %w", method, ErrMissingScope)
+	} else if failure != "" {
+		return errors.New("Error reported from " + method + " endpoint: " + failure)
+	}
+	return nil
+}
+
+// The error slack reported, or "" if the call worked
+func (response *botResponse) failure() string {
+	if response.OK {
+		return ""
+	}
+	if response.Error == "" {
+		return "unknown_error"
+	}
+	return response.Error
+}
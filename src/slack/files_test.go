@@ -0,0 +1,35 @@
+package slack
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"rolflewis.com/spotify-status-sync/src/config"
+)
+
+func TestMissingScopesCanBeToldApart(t *testing.T) {
+	slackServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		if request.URL.Path == "/api/files.completeUploadExternal" {
+			writer.Write([]byte(`{"ok":false,"error":"missing_scope"}`))
+			return
+		}
+		writer.Write([]byte(`{"ok":false,"error":"channel_not_found"}`))
+	}))
+	defer slackServer.Close()
+	settings = &config.Config{SlackAPIURL: slackServer.URL + "/api/"}
+
+	var response botResponse
+	scopeError := botFormCall(context.Background(), "files.completeUploadExternal", "xoxb", url.Values{}, &response, slackServer.Client())
+	if !errors.Is(scopeError, ErrMissingScope) || scopeError.Error() != "Error reported from files.completeUploadExternal endpoint: missing_scope" {
+		t.Errorf("missing scope reported as %v", scopeError)
+	}
+	otherError := botFormCall(context.Background(), "conversations.open", "xoxb", url.Values{}, &response, slackServer.Client())
+	if otherError == nil || errors.Is(otherError, ErrMissingScope) {
+		t.Errorf("other failure reported as %v", otherError)
+	}
+}
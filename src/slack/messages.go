@@ -0,0 +1,78 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type postMessageBody struct {
+	Channel string `json:"channel"`
+	Text    string `json:"text"`
+}
+
+type postMessageResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// Sends a message to the user from the bot, which shows up in the app's messages tab
+func SendDirectMessage(ctx context.Context, user string, text string, client *http.Client) error {
+	// Posting to a user id opens a DM with them
+	bodyBytes, jsonError := json.Marshal(postMessageBody{Channel: user, Text: text})
+	if jsonError != nil {
+		return jsonError
+	}
+	body := string(bodyBytes)
+
+	// Build request
+	messageReq, messageReqError := http.NewRequestWithContext(ctx, http.MethodPost, settings.SlackAPIURL+"chat.postMessage", strings.NewReader(body))
+	if messageReqError != nil {
+		return messageReqError
+	}
+
+	// Add the body headers
+	messageReq.Header.Add("Content-Type", "application/json")
+	messageReq.Header.Add("Content-Length", strconv.Itoa(len(body)))
+
+	// Messages are sent as the bot
+	token, tokenError := store.GetTeamTokenForUser(ctx, user)
+	if tokenError != nil {
+		return tokenError
+	}
+	if token == "" {
+		return errors.New("No team token found for user.")
+	}
+	messageReq.Header.Add("Authorization", "Bearer "+token)
+
+	// Send the request
+	messageResp, messageRespError := client.Do(messageReq)
+	if messageRespError != nil {
+		return messageRespError
+	}
+	defer messageResp.Body.Close()
+
+	// Check status codes
+	if messageResp.StatusCode != http.StatusOK {
+		return errors.New("Non-200 status code from chat.postMessage endpoint: " + strconv.Itoa(messageResp.StatusCode) + " / " + messageResp.Status)
+	}
+
+	// Read the response
+	jsonBytes, readError := ioutil.ReadAll(messageResp.Body)
+	if readError != nil {
+		return readError
+	}
+	var response postMessageResponse
+	jsonError = json.Unmarshal(jsonBytes, &response)
+	if jsonError != nil {
+		return jsonError
+	}
+	if !response.OK {
+		return errors.New("Error reported from chat.postMessage endpoint: " + response.Error)
+	}
+	return nil
+}
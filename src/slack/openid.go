@@ -0,0 +1,105 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type openIDTokenResponse struct {
+	OK          bool   `json:"ok"`
+	Error       string `json:"error"`
+	AccessToken string `json:"access_token"`
+}
+
+type openIDUserInfoResponse struct {
+	OK     bool   `json:"ok"`
+	Error  string `json:"error"`
+	UserID string `json:"https://slack.com/user_id"`
+	TeamID string `json:"https://slack.com/team_id"`
+}
+
+// Who signed in with Slack
+type SignedInUser struct {
+	ID   string
+	Team string
+}
+
+// Builds the Sign in with Slack link for the admin dashboard. The state must come from oauthstate.Issue.
+func SignInURL(state string) string {
+	queryValues := url.Values{}
+	queryValues.Set("response_type", "code")
+	queryValues.Set("scope", "openid")
+	queryValues.Set("client_id", settings.SlackClientID)
+	queryValues.Set("redirect_uri", settings.AppURL+"admin/callback")
+	queryValues.Set("state", state)
+	return settings.SlackOpenIDURL + "authorize?" + queryValues.Encode()
+}
+
+// Completes a Sign in with Slack, swapping the code for a token and reading who it belongs to
+func SignIn(ctx context.Context, code string, client *http.Client) (*SignedInUser, error) {
+	// Swap the code for a token
+	queryValues := url.Values{}
+	queryValues.Set("client_id", settings.SlackClientID)
+	queryValues.Set("client_secret", settings.SlackClientSecret)
+	queryValues.Set("code", code)
+	queryValues.Set("redirect_uri", settings.AppURL+"admin/callback")
+	var tokenResponse openIDTokenResponse
+	tokenError := openIDCall(ctx, "openid.connect.token", "", queryValues, &tokenResponse, client)
+	if tokenError != nil {
+		return nil, tokenError
+	}
+	if !tokenResponse.OK {
+		return nil, errors.New("Error reported from openid.connect.token endpoint: " + tokenResponse.Error)
+	}
+
+	// Ask who the token is for
+	var userInfo openIDUserInfoResponse
+	userInfoError := openIDCall(ctx, "openid.connect.userInfo", tokenResponse.AccessToken, url.Values{}, &userInfo, client)
+	if userInfoError != nil {
+		return nil, userInfoError
+	}
+	if !userInfo.OK {
+		return nil, errors.New("Error reported from openid.connect.userInfo endpoint: " + userInfo.Error)
+	}
+	if userInfo.UserID == "" {
+		return nil, errors.New("No user id in openid.connect.userInfo response.")
+	}
+	return &SignedInUser{ID: userInfo.UserID, Team: userInfo.TeamID}, nil
+}
+
+// Posts a form to one of the openid methods and reads the JSON answer into response
+func openIDCall(ctx context.Context, method string, token string, form url.Values, response interface{}, client *http.Client) error {
+	body := form.Encode()
+	openIDReq, openIDReqError := http.NewRequestWithContext(ctx, http.MethodPost, settings.SlackAPIURL+method, strings.NewReader(body))
+	if openIDReqError != nil {
+		return openIDReqError
+	}
+	openIDReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		openIDReq.Header.Add("Authorization", "Bearer "+token)
+	}
+
+	// Send the request
+	openIDResp, openIDRespError := client.Do(openIDReq)
+	if openIDRespError != nil {
+		return openIDRespError
+	}
+	defer openIDResp.Body.Close()
+
+	// Check status codes
+	if openIDResp.StatusCode != http.StatusOK {
+		return errors.New("Non-200 status code from " + method + " endpoint: " + strconv.Itoa(openIDResp.StatusCode) + " / " + openIDResp.Status)
+	}
+
+	jsonBytes, readError := ioutil.ReadAll(openIDResp.Body)
+	if readError != nil {
+		return readError
+	}
+	return json.Unmarshal(jsonBytes, response)
+}
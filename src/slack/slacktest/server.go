@@ -0,0 +1,721 @@
+// Package slacktest provides a local stand-in for the Slack Web API methods the app calls, and can play Slack's part in
+// sending signed Events API and interactivity payloads to the app. Together with spotifytest it lets the whole app run
+// without network access.
+package slacktest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A user's status as the emulator holds it
+type Profile struct {
+	StatusText       string `json:"status_text"`
+	StatusEmoji      string `json:"status_emoji"`
+	StatusExpiration int    `json:"status_expiration"`
+}
+
+// A Web API call the app made
+type Call struct {
+	Method string
+	// The user or team the call's token belongs to
+	User string
+	Team string
+	Body string
+}
+
+// A file the bot has shared with a user
+type File struct {
+	Name    string
+	Title   string
+	Comment string
+	Content []byte
+}
+
+type member struct {
+	team    string
+	profile Profile
+	home    string
+	// Messages and files the bot has sent the user
+	messages []string
+	files    []File
+}
+
+// A file waiting for files.completeUploadExternal
+type pendingUpload struct {
+	team     string
+	name     string
+	length   int
+	content  []byte
+	uploaded bool
+}
+
+type installCode struct {
+	user        string
+	redirectURI string
+	// Issued by Sign in with Slack rather than an install
+	openID bool
+}
+
+type Server struct {
+	// Base urls to hand the app in place of SLACK_API_URL, SLACK_AUTH_URL and SLACK_OPENID_URL
+	APIURL    string
+	AuthURL   string
+	OpenIDURL string
+	// If set, oauth.v2.access rejects other clients
+	ClientID     string
+	ClientSecret string
+	// Events and interactions are signed with this, as SLACK_SIGNING_KEY
+	SigningKey string
+	// Where the app is served, the same as its APP_URL. Events and interactions are sent here.
+	AppURL string
+	// Who the authorize page installs as when the request doesn't say with a user parameter
+	InstallAs string
+
+	server *httptest.Server
+	client *http.Client
+
+	lock       sync.Mutex
+	members    map[string]*member
+	codes      map[string]installCode
+	userTokens map[string]string
+	botTokens  map[string]string
+	// Sign in with Slack tokens, which only work for openid.connect.userInfo
+	openIDTokens map[string]string
+	// Files from files.getUploadURLExternal, by id, until they are shared
+	uploads   map[string]*pendingUpload
+	calls     []Call
+	nextEvent int
+}
+
+// Starts a server on a random local port
+func NewServer() *Server {
+	server := newServer()
+	server.server = httptest.NewServer(server.handler())
+	server.setURLs()
+	return server
+}
+
+// Starts a server listening on the address, such as ":8889"
+func NewServerAt(address string) (*Server, error) {
+	listener, listenError := net.Listen("tcp", address)
+	if listenError != nil {
+		return nil, listenError
+	}
+	server := newServer()
+	server.server = httptest.NewUnstartedServer(server.handler())
+	server.server.Listener.Close()
+	server.server.Listener = listener
+	server.server.Start()
+	server.setURLs()
+	return server, nil
+}
+
+func newServer() *Server {
+	return &Server{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		members:    make(map[string]*member),
+		codes:      make(map[string]installCode),
+		userTokens: make(map[string]string),
+		botTokens:  make(map[string]string),
+
+		openIDTokens: make(map[string]string),
+		uploads:      make(map[string]*pendingUpload),
+	}
+}
+
+func (server *Server) setURLs() {
+	server.APIURL = server.server.URL + "/api/"
+	server.AuthURL = server.server.URL + "/oauth/v2/"
+	server.OpenIDURL = server.server.URL + "/openid/connect/"
+}
+
+func (server *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/v2/authorize", server.handleAuthorize)
+	mux.HandleFunc("/api/oauth.v2.access", server.handleAccess)
+	mux.HandleFunc("/openid/connect/authorize", server.handleAuthorize)
+	mux.HandleFunc("/api/openid.connect.token", server.handleOpenIDToken)
+	mux.HandleFunc("/api/openid.connect.userInfo", server.handleOpenIDUserInfo)
+	mux.HandleFunc("/api/users.profile.get", server.handleProfileGet)
+	mux.HandleFunc("/api/users.profile.set", server.handleProfileSet)
+	mux.HandleFunc("/api/views.publish", server.handleViewsPublish)
+	mux.HandleFunc("/api/chat.postMessage", server.handlePostMessage)
+	mux.HandleFunc("/api/conversations.open", server.handleConversationsOpen)
+	mux.HandleFunc("/api/files.getUploadURLExternal", server.handleGetUploadURL)
+	mux.HandleFunc("/api/files.completeUploadExternal", server.handleCompleteUpload)
+	mux.HandleFunc("/upload/", server.handleUpload)
+	return mux
+}
+
+func (server *Server) Close() {
+	server.server.Close()
+}
+
+// Adds a user to a team with a blank status. Adding a user that exists moves them to the team.
+func (server *Server) AddUser(team string, user string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	existing, exists := server.members[user]
+	if !exists {
+		existing = &member{}
+		server.members[user] = existing
+	}
+	existing.team = team
+}
+
+// The user's current status
+func (server *Server) Profile(user string) Profile {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if existing, exists := server.members[user]; exists {
+		return existing.profile
+	}
+	return Profile{}
+}
+
+// Changes the user's status, as if they set it themselves. Doesn't tell the app - send a user_status_changed event for that.
+func (server *Server) SetProfile(user string, profile Profile) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if existing, exists := server.members[user]; exists {
+		existing.profile = profile
+	}
+}
+
+// The view last published to the user's App Home, as the JSON the app sent. Blank if nothing has been published.
+func (server *Server) HomeView(user string) string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if existing, exists := server.members[user]; exists {
+		return existing.home
+	}
+	return ""
+}
+
+// The messages the bot has sent the user, oldest first
+func (server *Server) Messages(user string) []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if existing, exists := server.members[user]; exists {
+		return append([]string(nil), existing.messages...)
+	}
+	return nil
+}
+
+// The files the bot has shared with the user, oldest first
+func (server *Server) Files(user string) []File {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if existing, exists := server.members[user]; exists {
+		return append([]File(nil), existing.files...)
+	}
+	return nil
+}
+
+// Every Web API call made so far, oldest first
+func (server *Server) Calls() []Call {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]Call(nil), server.calls...)
+}
+
+// Invalidates the user's tokens, so profile calls with them answer token_revoked
+func (server *Server) RevokeUserTokens(user string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for token, owner := range server.userTokens {
+		if owner == user {
+			server.userTokens[token] = ""
+		}
+	}
+}
+
+// Invalidates the team's bot tokens
+func (server *Server) RevokeBotTokens(team string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for token, owner := range server.botTokens {
+		if owner == team {
+			delete(server.botTokens, token)
+		}
+	}
+}
+
+// Approves the install or sign in straight away and redirects back with a code, skipping the consent screen
+func (server *Server) handleAuthorize(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	redirect, parseError := url.Parse(query.Get("redirect_uri"))
+	if parseError != nil || query.Get("redirect_uri") == "" {
+		http.Error(writer, "Invalid redirect uri", http.StatusBadRequest)
+		return
+	}
+	if server.ClientID != "" && query.Get("client_id") != server.ClientID {
+		http.Error(writer, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+	user := query.Get("user")
+	if user == "" {
+		user = server.InstallAs
+	}
+
+	server.lock.Lock()
+	_, known := server.members[user]
+	values := redirect.Query()
+	values.Set("state", query.Get("state"))
+	if !known {
+		values.Set("error", "access_denied")
+	} else {
+		code := randomToken("")
+		server.codes[code] = installCode{user: user, redirectURI: query.Get("redirect_uri"), openID: strings.HasPrefix(request.URL.Path, "/openid/")}
+		values.Set("code", code)
+	}
+	server.lock.Unlock()
+	redirect.RawQuery = values.Encode()
+	http.Redirect(writer, request, redirect.String(), http.StatusFound)
+}
+
+func (server *Server) handleAccess(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	clientID, clientSecret, _ := request.BasicAuth()
+	if (server.ClientID != "" && clientID != server.ClientID) || (server.ClientSecret != "" && clientSecret != server.ClientSecret) {
+		server.fail(writer, Call{Method: "oauth.v2.access"}, "invalid_client_id")
+		return
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	code, exists := server.codes[request.Form.Get("code")]
+	delete(server.codes, request.Form.Get("code"))
+	if !exists || code.openID || code.redirectURI != request.Form.Get("redirect_uri") {
+		server.record(Call{Method: "oauth.v2.access"})
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_code"})
+		return
+	}
+
+	// Issue a bot token for the team and a user token for the installer
+	team := server.members[code.user].team
+	botToken := randomToken("xoxb-")
+	userToken := randomToken("xoxp-")
+	server.botTokens[botToken] = team
+	server.userTokens[userToken] = code.user
+	server.record(Call{Method: "oauth.v2.access", User: code.user, Team: team})
+	writeJSON(writer, map[string]interface{}{
+		"ok":           true,
+		"access_token": botToken,
+		"token_type":   "bot",
+		"scope":        "chat:write,files:write,im:write,users:read,users:write",
+		"bot_user_id":  "B" + team,
+		"app_id":       "A0000000000",
+		"team":         map[string]string{"id": team, "name": team},
+		"authed_user": map[string]string{
+			"id":           code.user,
+			"scope":        "users.profile:read,users.profile:write",
+			"access_token": userToken,
+			"token_type":   "user",
+		},
+	})
+}
+
+// Swaps a Sign in with Slack code for a token that can read who signed in
+func (server *Server) handleOpenIDToken(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	if (server.ClientID != "" && request.Form.Get("client_id") != server.ClientID) ||
+		(server.ClientSecret != "" && request.Form.Get("client_secret") != server.ClientSecret) {
+		server.fail(writer, Call{Method: "openid.connect.token"}, "invalid_client_id")
+		return
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	code, exists := server.codes[request.Form.Get("code")]
+	delete(server.codes, request.Form.Get("code"))
+	if !exists || !code.openID || code.redirectURI != request.Form.Get("redirect_uri") {
+		server.record(Call{Method: "openid.connect.token"})
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_code"})
+		return
+	}
+	token := randomToken("xoxp-")
+	server.openIDTokens[token] = code.user
+	server.record(Call{Method: "openid.connect.token", User: code.user, Team: server.members[code.user].team})
+	writeJSON(writer, map[string]interface{}{"ok": true, "access_token": token, "token_type": "Bearer"})
+}
+
+func (server *Server) handleOpenIDUserInfo(writer http.ResponseWriter, request *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	user, exists := server.openIDTokens[bearer(request)]
+	if !exists {
+		server.record(Call{Method: "openid.connect.userInfo"})
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_auth"})
+		return
+	}
+	team := server.members[user].team
+	server.record(Call{Method: "openid.connect.userInfo", User: user, Team: team})
+	writeJSON(writer, map[string]interface{}{
+		"ok":                        true,
+		"sub":                       user,
+		"https://slack.com/user_id": user,
+		"https://slack.com/team_id": team,
+	})
+}
+
+func (server *Server) handleProfileGet(writer http.ResponseWriter, request *http.Request) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	user, tokenError := server.userFor(request)
+	if tokenError != "" {
+		server.record(Call{Method: "users.profile.get"})
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": tokenError})
+		return
+	}
+	server.record(Call{Method: "users.profile.get", User: user, Team: server.members[user].team})
+	writeJSON(writer, map[string]interface{}{"ok": true, "profile": server.members[user].profile})
+}
+
+func (server *Server) handleProfileSet(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	user, tokenError := server.userFor(request)
+	if tokenError != "" {
+		server.record(Call{Method: "users.profile.set", Body: string(body)})
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": tokenError})
+		return
+	}
+	server.record(Call{Method: "users.profile.set", User: user, Team: server.members[user].team, Body: string(body)})
+
+	var update struct {
+		Profile Profile `json:"profile"`
+	}
+	if jsonError := json.Unmarshal(body, &update); jsonError != nil {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_json"})
+		return
+	}
+	server.members[user].profile = update.Profile
+	writeJSON(writer, map[string]interface{}{"ok": true, "profile": update.Profile})
+}
+
+func (server *Server) handleViewsPublish(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	team, exists := server.botTokens[bearer(request)]
+	server.record(Call{Method: "views.publish", Team: team, Body: string(body)})
+	if !exists {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_auth"})
+		return
+	}
+
+	var publish struct {
+		UserID string          `json:"user_id"`
+		View   json.RawMessage `json:"view"`
+	}
+	if jsonError := json.Unmarshal(body, &publish); jsonError != nil || len(publish.View) == 0 {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_arguments"})
+		return
+	}
+	target, known := server.members[publish.UserID]
+	if !known || target.team != team {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "user_not_found"})
+		return
+	}
+	target.home = string(publish.View)
+	writeJSON(writer, map[string]interface{}{"ok": true})
+}
+
+func (server *Server) handlePostMessage(writer http.ResponseWriter, request *http.Request) {
+	body, _ := ioutil.ReadAll(request.Body)
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	team, exists := server.botTokens[bearer(request)]
+	server.record(Call{Method: "chat.postMessage", Team: team, Body: string(body)})
+	if !exists {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_auth"})
+		return
+	}
+
+	var message struct {
+		Channel string `json:"channel"`
+		Text    string `json:"text"`
+	}
+	if jsonError := json.Unmarshal(body, &message); jsonError != nil {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_json"})
+		return
+	}
+	// Only direct messages, which are posted to the user id
+	target, known := server.members[message.Channel]
+	if !known || target.team != team {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "channel_not_found"})
+		return
+	}
+	target.messages = append(target.messages, message.Text)
+	writeJSON(writer, map[string]interface{}{"ok": true, "channel": message.Channel})
+}
+
+// Opens the DM between the bot and a user. Each user's DM has the channel id "D" followed by their user id.
+func (server *Server) handleConversationsOpen(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	team, exists := server.botTokens[bearer(request)]
+	server.record(Call{Method: "conversations.open", Team: team, Body: request.Form.Encode()})
+	if !exists {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_auth"})
+		return
+	}
+	// Only DMs with one user
+	user := request.Form.Get("users")
+	target, known := server.members[user]
+	if !known || target.team != team {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "user_not_found"})
+		return
+	}
+	writeJSON(writer, map[string]interface{}{"ok": true, "channel": map[string]string{"id": "D" + user}})
+}
+
+// Hands out somewhere to upload a file to, which isn't shared anywhere until files.completeUploadExternal
+func (server *Server) handleGetUploadURL(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	team, exists := server.botTokens[bearer(request)]
+	server.record(Call{Method: "files.getUploadURLExternal", Team: team, Body: request.Form.Encode()})
+	if !exists {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_auth"})
+		return
+	}
+	length, lengthError := strconv.Atoi(request.Form.Get("length"))
+	if request.Form.Get("filename") == "" || lengthError != nil || length <= 0 {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_arguments"})
+		return
+	}
+	id := randomToken("F")
+	server.uploads[id] = &pendingUpload{team: team, name: request.Form.Get("filename"), length: length}
+	writeJSON(writer, map[string]interface{}{"ok": true, "upload_url": server.server.URL + "/upload/" + id, "file_id": id})
+}
+
+// Takes a file's contents. Like slack, the upload url needs no token, and the contents must be the length asked for.
+func (server *Server) handleUpload(writer http.ResponseWriter, request *http.Request) {
+	content, _ := ioutil.ReadAll(request.Body)
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	upload, exists := server.uploads[strings.TrimPrefix(request.URL.Path, "/upload/")]
+	if !exists || request.Method != http.MethodPost {
+		http.Error(writer, "Unknown upload", http.StatusNotFound)
+		return
+	}
+	if len(content) != upload.length {
+		http.Error(writer, "Length mismatch", http.StatusBadRequest)
+		return
+	}
+	upload.content = content
+	upload.uploaded = true
+	writer.Write([]byte("OK - " + strconv.Itoa(len(content))))
+}
+
+// Shares uploaded files to a DM opened with conversations.open
+func (server *Server) handleCompleteUpload(writer http.ResponseWriter, request *http.Request) {
+	request.ParseForm()
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	team, exists := server.botTokens[bearer(request)]
+	server.record(Call{Method: "files.completeUploadExternal", Team: team, Body: request.Form.Encode()})
+	if !exists {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_auth"})
+		return
+	}
+
+	var files []struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	}
+	if jsonError := json.Unmarshal([]byte(request.Form.Get("files")), &files); jsonError != nil || len(files) == 0 {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "invalid_arguments"})
+		return
+	}
+	channel := request.Form.Get("channel_id")
+	target, known := server.members[strings.TrimPrefix(channel, "D")]
+	if !strings.HasPrefix(channel, "D") || !known || target.team != team {
+		writeJSON(writer, map[string]interface{}{"ok": false, "error": "channel_not_found"})
+		return
+	}
+	for _, file := range files {
+		upload, uploadExists := server.uploads[file.ID]
+		if !uploadExists || upload.team != team || !upload.uploaded {
+			writeJSON(writer, map[string]interface{}{"ok": false, "error": "file_not_found"})
+			return
+		}
+	}
+	for _, file := range files {
+		upload := server.uploads[file.ID]
+		delete(server.uploads, file.ID)
+		target.files = append(target.files, File{Name: upload.name, Title: file.Title, Comment: request.Form.Get("initial_comment"), Content: upload.content})
+	}
+	writeJSON(writer, map[string]interface{}{"ok": true})
+}
+
+// Finds the user a request's user token belongs to. Returns the slack error code if the token is no good.
+// Must be called with the lock held.
+func (server *Server) userFor(request *http.Request) (string, string) {
+	user, exists := server.userTokens[bearer(request)]
+	if !exists {
+		return "", "invalid_auth"
+	}
+	if user == "" {
+		return "", "token_revoked"
+	}
+	return user, ""
+}
+
+// Must be called with the lock held
+func (server *Server) record(call Call) {
+	server.calls = append(server.calls, call)
+}
+
+func (server *Server) fail(writer http.ResponseWriter, call Call, code string) {
+	server.lock.Lock()
+	server.record(call)
+	server.lock.Unlock()
+	writeJSON(writer, map[string]interface{}{"ok": false, "error": code})
+}
+
+// Sends an event to the app's events endpoint, wrapped and signed the way slack does. Returns the status the app answered with.
+func (server *Server) SendEvent(team string, event interface{}) (int, error) {
+	server.lock.Lock()
+	server.nextEvent++
+	eventID := "Ev" + strconv.Itoa(server.nextEvent)
+	server.lock.Unlock()
+	body, jsonError := json.Marshal(map[string]interface{}{
+		"type":       "event_callback",
+		"team_id":    team,
+		"api_app_id": "A0000000000",
+		"event_id":   eventID,
+		"event_time": time.Now().Unix(),
+		"event":      event,
+	})
+	if jsonError != nil {
+		return 0, jsonError
+	}
+	return server.deliver("slack/events", "application/json", body)
+}
+
+// Sends an interaction payload to the app's interactivity endpoint, form encoded and signed the way slack does
+func (server *Server) SendInteraction(payload interface{}) (int, error) {
+	payloadBytes, jsonError := json.Marshal(payload)
+	if jsonError != nil {
+		return 0, jsonError
+	}
+	body := url.Values{"payload": {string(payloadBytes)}}.Encode()
+	return server.deliver("slack/interactivity", "application/x-www-form-urlencoded", []byte(body))
+}
+
+// Tells the app the user opened its App Home
+func (server *Server) OpenHome(user string) (int, error) {
+	return server.SendEvent(server.teamOf(user), map[string]interface{}{"type": "app_home_opened", "user": user, "tab": "home", "event_ts": eventTimestamp()})
+}
+
+// Presses a button in the user's App Home
+func (server *Server) PressHomeButton(user string, actionID string) (int, error) {
+	team := server.teamOf(user)
+	return server.SendInteraction(map[string]interface{}{
+		"type":      "block_actions",
+		"team":      map[string]string{"id": team},
+		"user":      map[string]string{"id": user, "team_id": team},
+		"container": map[string]string{"type": "view"},
+		"view":      map[string]string{"type": "home", "team_id": team},
+		"actions": []map[string]string{{
+			"type":      "button",
+			"action_id": actionID,
+			"value":     actionID,
+			"action_ts": eventTimestamp(),
+		}},
+	})
+}
+
+// Tells the app the user's status changed, sending the status the emulator holds for them
+func (server *Server) SendStatusChanged(user string) (int, error) {
+	team := server.teamOf(user)
+	return server.SendEvent(team, map[string]interface{}{
+		"type":     "user_status_changed",
+		"user":     map[string]interface{}{"id": user, "team_id": team, "profile": server.Profile(user)},
+		"event_ts": eventTimestamp(),
+	})
+}
+
+// Revokes the team's bot tokens and tells the app it was uninstalled
+func (server *Server) Uninstall(team string) (int, error) {
+	server.RevokeBotTokens(team)
+	return server.SendEvent(team, map[string]interface{}{"type": "app_uninstalled", "event_ts": eventTimestamp()})
+}
+
+// The team the user is in, or blank if they aren't known
+func (server *Server) teamOf(user string) string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if existing, exists := server.members[user]; exists {
+		return existing.team
+	}
+	return ""
+}
+
+func (server *Server) deliver(path string, contentType string, body []byte) (int, error) {
+	if server.AppURL == "" {
+		return 0, errors.New("AppURL must be set to send to the app")
+	}
+	request, requestError := http.NewRequest(http.MethodPost, server.AppURL+path, bytes.NewReader(body))
+	if requestError != nil {
+		return 0, requestError
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	request.Header.Set("X-Slack-Signature", Sign(server.SigningKey, timestamp, body))
+	response, responseError := server.client.Do(request)
+	if responseError != nil {
+		return 0, responseError
+	}
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+// Computes slack's request signature for a body sent at the timestamp
+func Sign(signingKey string, timestamp string, body []byte) string {
+	hasher := hmac.New(sha256.New, []byte(signingKey))
+	hasher.Write([]byte("v0:" + timestamp + ":" + string(body)))
+	return "v0=" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+func bearer(request *http.Request) string {
+	return strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+}
+
+func eventTimestamp() string {
+	return strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 6, 64)
+}
+
+func writeJSON(writer http.ResponseWriter, body interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(body)
+}
+
+func randomToken(prefix string) string {
+	randomBytes := make([]byte, 18)
+	rand.Read(randomBytes)
+	return prefix + base64.RawURLEncoding.EncodeToString(randomBytes)
+}
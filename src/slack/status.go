@@ -2,20 +2,41 @@ package slack
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"strconv"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"rolflewis.com/spotify-status-sync/src/config"
 	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/logging"
+	"rolflewis.com/spotify-status-sync/src/metrics"
+	"rolflewis.com/spotify-status-sync/src/upstream"
 )
 
+// Where the package keeps its data - set once at startup
+var store database.Store
+
+// Sets the storage the package uses
+func UseStore(newStore database.Store) {
+	store = newStore
+}
+
+// The app's configuration - set once at startup
+var settings *config.Config
+
+// Sets the configuration the package uses
+func UseConfig(newConfig *config.Config) {
+	settings = newConfig
+}
+
 type UserProfile struct {
 	IsOk    bool     `json:"ok"`
 	Profile *profile `json:"profile,omitempty"`
@@ -32,38 +53,92 @@ type profile struct {
 	StatusExpiration int    `json:"status_expiration"`
 }
 
-func UpdateUserStatus(user string, newStatus string, client *http.Client) error {
-	// Check if the last status we set is the same as this one
-	lastStatus, dbReadError := database.GetStatusForUser(user)
-	if dbReadError != nil {
-		return dbReadError
-	}
+// Statuses written to slack and sync results that didn't need one, and why
+var StatusUpdates = metrics.Factory.NewCounterVec(prometheus.CounterOpts{Name: "status_updates_total",
+	Help: "Statuses written to Slack and sync results skipped, by result and reason."}, []string{"result", "reason"})
+
+// How long a cached profile is trusted before it is read from slack again. One kept current by profile events is trusted
+// for longer than one read live, since nothing tells us when the user changes a status we read.
+const (
+	profileCacheLifetime     = 10 * time.Minute
+	readProfileCacheLifetime = time.Minute
+)
+
+// Decides whether the user's status in Slack should be changed to the new one. That is when it differs from the last one we set
+// and the user's current status can be overwritten. The caller is responsible for queueing the change.
+func ShouldSetStatus(ctx context.Context, user database.SyncUser, newStatus string, client *http.Client) (bool, error) {
 	// If this and last status match, return early
-	if lastStatus == newStatus {
-		return nil
-	}
-	// Read the status
-	profile, readError := getUserStatus(user, client)
-	if readError != nil {
-		return readError
+	if user.Status == newStatus {
+		StatusUpdates.WithLabelValues("skipped", "same_status").Inc()
+		return false, nil
 	}
-	// Check if we can overwrite, and do so if we can
-	if profile != nil && canOverwriteStatus(profile) {
-		// Set the status in slack
-		setError := setUserStatus(user, newStatus, client)
-		if setError != nil {
-			return setError
+	// Use the cached status if profile events have kept it fresh, otherwise read it live
+	profile := cachedProfile(user)
+	if profile == nil {
+		var readError error
+		profile, readError = getUserStatus(ctx, user.ID, user.SlackToken, client)
+		if readError != nil {
+			return false, readError
 		}
-		// Track the status change in the DB so we can avoid unneccesary checks
-		dbWriteError := database.SetStatusForUser(user, newStatus)
-		if dbWriteError != nil {
-			return dbWriteError
+		// Cache what we read for the next sync
+		if profile != nil {
+			cacheError := store.SetProfileForUser(ctx, user.ID, profile.StatusText, profile.StatusEmoji, profile.StatusExpiration, database.ProfileFromRead)
+			if cacheError != nil {
+				return false, cacheError
+			}
 		}
 	}
-	return nil
+	// if profile is nil, the user was cleaned up
+	if profile == nil {
+		StatusUpdates.WithLabelValues("skipped", "user_removed").Inc()
+		return false, nil
+	}
+	// Keep the manual override mark in line with what the user's status actually is
+	overridden := IsManualStatus(profile.StatusText, profile.StatusEmoji, profile.StatusExpiration)
+	if overridden != user.ManualOverride {
+		_, overrideError := store.SetManualOverrideForUser(ctx, user.ID, overridden)
+		if overrideError != nil {
+			return false, overrideError
+		}
+	}
+	// Check if we can overwrite
+	if overridden || !canOverwriteStatus(profile) {
+		StatusUpdates.WithLabelValues("skipped", "user_status").Inc()
+		return false, nil
+	}
+	return true, nil
+}
+
+// Returns the cached profile for the user, or nil if there isn't one or it is too old to trust
+func cachedProfile(user database.SyncUser) *profile {
+	lifetime := readProfileCacheLifetime
+	if user.ProfileSource == database.ProfileFromEvent {
+		lifetime = profileCacheLifetime
+	}
+	if !user.ProfileUpdatedAt.Valid || time.Since(user.ProfileUpdatedAt.Time) > lifetime {
+		return nil
+	}
+	return &profile{
+		StatusText:       user.ProfileStatusText,
+		StatusEmoji:      user.ProfileStatusEmoji,
+		StatusExpiration: user.ProfileStatusExpiration,
+	}
+}
+
+// Reports whether a status was set by the user rather than by us. Blank and expired statuses don't count.
+func IsManualStatus(text string, emoji string, expiration int) bool {
+	return !canOverwriteStatus(&profile{StatusText: text, StatusEmoji: emoji, StatusExpiration: expiration})
 }
 
 func canOverwriteStatus(profile *profile) bool {
+	// Nothing is set
+	if profile.StatusText == "" && profile.StatusEmoji == "" {
+		return true
+	}
+	// Slack clears expired statuses, but the news may not have reached us yet
+	if profile.StatusExpiration != 0 && int64(profile.StatusExpiration) <= time.Now().Unix() {
+		return true
+	}
 	// Don't overwrite if the status has an expiration
 	if profile.StatusExpiration != 0 {
 		return false
@@ -82,31 +157,27 @@ func canOverwriteStatus(profile *profile) bool {
 	return true
 }
 
-func getUserStatus(user string, client *http.Client) (*profile, error) {
+func getUserStatus(ctx context.Context, user string, token string, client *http.Client) (*profile, error) {
 	// Set the query values
 	queryValues := url.Values{}
 	queryValues.Set("user", user)
-	// Get the token for this user
-	token, tokenError := database.GetSlackForUser(user)
-	if tokenError != nil {
-		return nil, tokenError
-	}
 	authHeader := "Bearer " + token
 	// Run request
-	profile, requestError := profileRequestRunner(http.MethodGet, os.Getenv("SLACK_API_URL")+"users.profile.get?"+queryValues.Encode(), nil, authHeader, client)
+	profile, requestError := profileRequestRunner(ctx, http.MethodGet, settings.SlackAPIURL+"users.profile.get?"+queryValues.Encode(), nil, authHeader, client)
 	if requestError != nil {
 		return nil, requestError
 	}
 	// if profile is nil, the token was revoked. Cleanup and exit.
 	if profile == nil {
 		// clean the data from db
-		log.Println("Cleaning up former user.")
-		return nil, database.DeleteAllDataForUser(user)
+		logging.FromContext(ctx).Info("Cleaning up former user", "user", logging.Hash(user))
+		return nil, store.DeleteAllDataForUser(ctx, user)
 	}
 	return profile, nil
 }
 
-func setUserStatus(user string, newStatus string, client *http.Client) error {
+// Writes the status to slack. A blank status clears it.
+func SetUserStatus(ctx context.Context, user string, token string, newStatus string, client *http.Client) error {
 	// Select the emoji for the status - if the status is blank, clear the emoji
 	var emoji string
 	if newStatus != "" {
@@ -125,34 +196,29 @@ func setUserStatus(user string, newStatus string, client *http.Client) error {
 	if jsonError != nil {
 		return jsonError
 	}
-	// Get the token for this user
-	token, tokenError := database.GetSlackForUser(user)
-	if tokenError != nil {
-		return tokenError
-	}
 	authHeader := "Bearer " + token
-	// Run request
-	profile, requestError := profileRequestRunner(http.MethodPost, os.Getenv("SLACK_API_URL")+"users.profile.set", bodyBytes, authHeader, client)
+	// Run request - setting the same status twice is harmless, so this is safe to retry
+	profile, requestError := profileRequestRunner(upstream.Idempotent(ctx), http.MethodPost, settings.SlackAPIURL+"users.profile.set", bodyBytes, authHeader, client)
 	if requestError != nil {
 		return requestError
 	}
 	// if profile is nil, the token was revoked. Cleanup and exit.
 	if profile == nil {
 		// clean the data from db
-		log.Println("Cleaning up former user.")
-		return database.DeleteAllDataForUser(user)
+		logging.FromContext(ctx).Info("Cleaning up former user", "user", logging.Hash(user))
+		return store.DeleteAllDataForUser(ctx, user)
 	}
 	return nil
 }
 
-func profileRequestRunner(method string, url string, body []byte, auth string, client *http.Client) (*profile, error) {
+func profileRequestRunner(ctx context.Context, method string, url string, body []byte, auth string, client *http.Client) (*profile, error) {
 	// Convert the body
-	var bodyReader io.ReadCloser
+	var bodyReader io.Reader
 	if body != nil {
-		bodyReader = ioutil.NopCloser(bytes.NewBuffer(body))
+		bodyReader = bytes.NewReader(body)
 	}
 	// Get a new request
-	statusReq, statusReqError := http.NewRequest(method, url, bodyReader)
+	statusReq, statusReqError := http.NewRequestWithContext(ctx, method, url, bodyReader)
 	if statusReqError != nil {
 		return nil, statusReqError
 	}
@@ -191,3 +257,27 @@ func profileRequestRunner(method string, url string, body []byte, auth string, c
 	}
 	return profile.Profile, nil
 }
+
+// Clears the user's status if it is still the one we set. Unlike the sync path, a revoked token is not treated as an error
+// and does not trigger a cleanup, since this is used while the user is being removed anyway.
+func ClearOwnedStatus(ctx context.Context, user string, token string, ownedStatus string, client *http.Client) error {
+	authHeader := "Bearer " + token
+	// Read the current status
+	queryValues := url.Values{}
+	queryValues.Set("user", user)
+	current, readError := profileRequestRunner(ctx, http.MethodGet, settings.SlackAPIURL+"users.profile.get?"+queryValues.Encode(), nil, authHeader, client)
+	if readError != nil {
+		return readError
+	}
+	// Token already revoked, or the user has replaced our status since
+	if current == nil || current.StatusText != ownedStatus {
+		return nil
+	}
+	// Blank out the status
+	bodyBytes, jsonError := json.Marshal(statusSetBody{Profile: profile{}})
+	if jsonError != nil {
+		return jsonError
+	}
+	_, setError := profileRequestRunner(upstream.Idempotent(ctx), http.MethodPost, settings.SlackAPIURL+"users.profile.set", bodyBytes, authHeader, client)
+	return setError
+}
@@ -0,0 +1,50 @@
+package slack
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"rolflewis.com/spotify-status-sync/src/database"
+)
+
+func TestExpiredStatusesCanBeOverwritten(t *testing.T) {
+	now := time.Now().Unix()
+	overwritable := map[profile]bool{
+		{}: true,
+		{StatusText: "Listening to \"Song\" by Artist on Spotify", StatusEmoji: ":musical_note:"}: true,
+		// Slack hasn't told us it expired yet
+		{StatusText: "In a meeting", StatusEmoji: ":calendar:", StatusExpiration: int(now - 60)}:   true,
+		{StatusText: "In a meeting", StatusEmoji: ":calendar:", StatusExpiration: int(now + 3600)}: false,
+		{StatusText: "In a meeting", StatusEmoji: ":calendar:"}:                                    false,
+	}
+	for status, expected := range overwritable {
+		status := status
+		if canOverwriteStatus(&status) != expected {
+			t.Errorf("canOverwriteStatus(%+v) should be %v", status, expected)
+		}
+		if IsManualStatus(status.StatusText, status.StatusEmoji, status.StatusExpiration) == expected {
+			t.Errorf("IsManualStatus(%+v) should be %v", status, !expected)
+		}
+	}
+}
+
+func TestProfilesReadLiveGoStaleSooner(t *testing.T) {
+	cachedAt := func(age time.Duration) sql.NullTime {
+		return sql.NullTime{Time: time.Now().Add(-age), Valid: true}
+	}
+	trusted := map[database.SyncUser]bool{
+		{}: false,
+		{ProfileUpdatedAt: cachedAt(5 * time.Minute), ProfileSource: database.ProfileFromEvent}:  true,
+		{ProfileUpdatedAt: cachedAt(15 * time.Minute), ProfileSource: database.ProfileFromEvent}: false,
+		{ProfileUpdatedAt: cachedAt(30 * time.Second), ProfileSource: database.ProfileFromRead}:  true,
+		{ProfileUpdatedAt: cachedAt(5 * time.Minute), ProfileSource: database.ProfileFromRead}:   false,
+		// Cached before the source was kept
+		{ProfileUpdatedAt: cachedAt(5 * time.Minute)}: false,
+	}
+	for user, expected := range trusted {
+		if (cachedProfile(user) != nil) != expected {
+			t.Errorf("cached profile from %q, %v old, should be trusted: %v", user.ProfileSource, time.Since(user.ProfileUpdatedAt.Time).Round(time.Second), expected)
+		}
+	}
+}
@@ -1,16 +1,17 @@
 package slack
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
-	"net/url"
-	"os"
 	"strconv"
 	"strings"
 
-	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/oauthstate"
+	"rolflewis.com/spotify-status-sync/src/spotify"
+	"rolflewis.com/spotify-status-sync/src/upstream"
 )
 
 type viewPublishResponse struct {
@@ -18,19 +19,25 @@ type viewPublishResponse struct {
 	Error string `json:"error"`
 }
 
-func UpdateHome(user string, client *http.Client) error {
+func UpdateHome(ctx context.Context, user string, client *http.Client) error {
 	// Check if spotify has been connected yet for this user
-	profileID, _, dbError := database.GetSpotifyForUser(user)
+	profileID, _, dbError := store.GetSpotifyForUser(ctx, user)
 	if dbError != nil {
 		return dbError
 	}
 
 	// Check if the user has authorized slack
-	token, getError := database.GetSlackForUser(user)
+	token, getError := store.GetSlackForUser(ctx, user)
 	if getError != nil {
 		return getError
 	}
 
+	// Check if sync is paused because the user set their own status
+	overridden, overrideError := store.GetManualOverrideForUser(ctx, user)
+	if overrideError != nil {
+		return overrideError
+	}
+
 	// Control vars
 	spotifyConnected := (profileID != "")
 	slackConnected := (token != "")
@@ -110,6 +117,31 @@ func UpdateHome(user string, client *http.Client) error {
 		"type": "divider"
 	},`
 
+	if bothConnected {
+		syncState := ":musical_note: Active - your status will follow whatever you're playing on Spotify."
+		if overridden {
+			syncState = ":double_vertical_bar: Paused - you've set a status of your own, so syncing will pick back up once you clear it or it expires."
+		}
+
+		newView += `{
+			"type": "section",
+			"text": {
+				"type": "mrkdwn",
+				"text": "*Sync Status*"
+			}
+		},
+		{
+			"type": "section",
+			"text": {
+				"type": "mrkdwn",
+				"text": "` + syncState + `"
+			}
+		},
+		{
+			"type": "divider"
+		},`
+	}
+
 	if !bothConnected {
 		newView += `{
 			"type": "section",
@@ -128,16 +160,14 @@ func UpdateHome(user string, client *http.Client) error {
 				}
 			},`
 		} else {
-			// Set the query values
-			slackQueryValues := url.Values{}
-			slackQueryValues.Set("client_id", os.Getenv("SLACK_CLIENT_ID"))
-			slackQueryValues.Set("redirect_uri", os.Getenv("APP_URL")+"slack/callback")
-			slackQueryValues.Set("scope", "users:write")
-			slackQueryValues.Set("user_scope", "users.profile:read,users.profile:write")
-			slackQueryValues.Set("state", user)
+			// Bind the flow to this user with a signed, single use state
+			slackState, stateError := oauthstate.Issue(ctx, "slack", user)
+			if stateError != nil {
+				return stateError
+			}
 
-			// Link to spotify OAuth page
-			slackOAuthURL := os.Getenv("SLACK_AUTH_URL") + "authorize?" + slackQueryValues.Encode()
+			// Link to slack OAuth page
+			slackOAuthURL := AuthorizeURL(slackState)
 
 			newView += `{
 				"type": "section",
@@ -168,16 +198,14 @@ func UpdateHome(user string, client *http.Client) error {
 				}
 			}`
 		} else {
-			// Set the query values
-			spotifyQueryValues := url.Values{}
-			spotifyQueryValues.Set("client_id", os.Getenv("SPOTIFY_CLIENT_ID"))
-			spotifyQueryValues.Set("response_type", "code")
-			spotifyQueryValues.Set("redirect_uri", os.Getenv("APP_URL")+"spotify/callback")
-			spotifyQueryValues.Set("scope", "user-read-currently-playing")
-			spotifyQueryValues.Set("state", user)
+			// Bind the flow to this user with a signed, single use state, which also holds the PKCE verifier
+			spotifyState, spotifyChallenge, stateError := oauthstate.IssueWithPKCE(ctx, "spotify", user)
+			if stateError != nil {
+				return stateError
+			}
 
 			// Link to spotify OAuth page
-			spotifyOAuthURL := os.Getenv("SPOTIFY_AUTH_URL") + "authorize?" + spotifyQueryValues.Encode()
+			spotifyOAuthURL := spotify.AuthorizeURL(spotifyState, spotifyChallenge)
 
 			newView += `{
 				"type": "section",
@@ -233,13 +261,44 @@ func UpdateHome(user string, client *http.Client) error {
 		}`
 	}
 
+	// The export is sent as a bot DM, so it needs somewhere stored to send it from
+	if slackConnected {
+		newView += `,{
+			"type": "divider"
+		},
+		{
+			"type": "section",
+			"text": {
+				"type": "mrkdwn",
+				"text": "*Your Data*"
+			}
+		},
+		{
+			"type": "section",
+			"text": {
+				"type": "mrkdwn",
+				"text": "Click this button to be sent a file of everything the app stores about you, with your tokens left out:"
+			},
+			"accessory": {
+				"type": "button",
+				"text": {
+					"type": "plain_text",
+					"text": "Export my data",
+					"emoji": true
+				},
+				"value": "data_export_button",
+				"action_id": "data_export_button"
+			}
+		}`
+	}
+
 	newView += "]}}" // Close blocks array, view object, and then json
-	return updateHomeHelper(user, newView, client)
+	return updateHomeHelper(ctx, user, newView, client)
 }
 
-func updateHomeHelper(user string, view string, client *http.Client) error {
-	// Build request and send
-	viewReq, viewReqError := http.NewRequest(http.MethodPost, os.Getenv("SLACK_API_URL")+"views.publish", strings.NewReader(view))
+func updateHomeHelper(ctx context.Context, user string, view string, client *http.Client) error {
+	// Build request and send - publishing replaces the whole view, so this is safe to retry
+	viewReq, viewReqError := http.NewRequestWithContext(upstream.Idempotent(ctx), http.MethodPost, settings.SlackAPIURL+"views.publish", strings.NewReader(view))
 	if viewReqError != nil {
 		return viewReqError
 	}
@@ -249,7 +308,7 @@ func updateHomeHelper(user string, view string, client *http.Client) error {
 	viewReq.Header.Add("Content-Length", strconv.Itoa(len(view)))
 
 	// set the authorization header
-	token, tokenError := database.GetTeamTokenForUser(user)
+	token, tokenError := store.GetTeamTokenForUser(ctx, user)
 	if tokenError != nil {
 		return tokenError
 	}
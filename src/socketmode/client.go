@@ -0,0 +1,186 @@
+package socketmode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"rolflewis.com/spotify-status-sync/src/logging"
+)
+
+// A message from slack over the socket. Payload is the same json that would have been sent to the matching HTTP endpoint.
+type envelope struct {
+	EnvelopeID             string          `json:"envelope_id"`
+	Type                   string          `json:"type"`
+	Payload                json.RawMessage `json:"payload"`
+	AcceptsResponsePayload bool            `json:"accepts_response_payload"`
+	RetryAttempt           int             `json:"retry_attempt"`
+	Reason                 string          `json:"reason"`
+}
+
+type acknowledgement struct {
+	EnvelopeID string `json:"envelope_id"`
+}
+
+type connectionsOpenResponse struct {
+	OK    bool   `json:"ok"`
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// Receives events and interactions from slack over a websocket instead of public HTTP endpoints
+type Client struct {
+	AppToken   string // App-level token (xapp-) with the connections:write scope
+	APIURL     string // Base slack API url, such as https://slack.com/api/
+	HTTPClient *http.Client
+	Dialer     *websocket.Dialer
+
+	// Called with each Events API payload. The envelope is only acknowledged if this succeeds, so slack will redeliver it otherwise.
+	OnEvent func(payload []byte) error
+	// Called with each interaction payload. Slack needs interactions acknowledged quickly, so this runs after the acknowledgement.
+	OnInteraction func(ctx context.Context, payload []byte) error
+}
+
+// Connects and handles messages until the context is cancelled, reconnecting whenever the connection drops
+func (client *Client) Run(ctx context.Context) error {
+	backoff := time.Second
+	for {
+		connectionError := client.connectOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// A nil error means slack asked us to reconnect, so do so straight away
+		if connectionError == nil {
+			backoff = time.Second
+			continue
+		}
+		slog.Warn("Socket Mode connection lost, reconnecting", "backoff", backoff.String(), "error", connectionError)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// Asks slack for a websocket url to connect to
+func (client *Client) openConnection(ctx context.Context) (string, error) {
+	openReq, openReqError := http.NewRequestWithContext(ctx, http.MethodPost, client.APIURL+"apps.connections.open", nil)
+	if openReqError != nil {
+		return "", openReqError
+	}
+	openReq.Header.Add("Authorization", "Bearer "+client.AppToken)
+
+	// Send the request
+	openResp, openRespError := client.HTTPClient.Do(openReq)
+	if openRespError != nil {
+		return "", openRespError
+	}
+	defer openResp.Body.Close()
+
+	// Check status codes
+	if openResp.StatusCode != http.StatusOK {
+		return "", errors.New("Non-200 status code from apps.connections.open endpoint: " + strconv.Itoa(openResp.StatusCode) + " / " + openResp.Status)
+	}
+
+	// Read the url
+	jsonBytes, readError := ioutil.ReadAll(openResp.Body)
+	if readError != nil {
+		return "", readError
+	}
+	var response connectionsOpenResponse
+	jsonError := json.Unmarshal(jsonBytes, &response)
+	if jsonError != nil {
+		return "", jsonError
+	}
+	if !response.OK {
+		return "", errors.New("Error reported from apps.connections.open endpoint: " + response.Error)
+	}
+	return response.URL, nil
+}
+
+// Runs a single connection until it drops or slack asks us to disconnect. Returns nil only in the latter case.
+func (client *Client) connectOnce(ctx context.Context) error {
+	url, openError := client.openConnection(ctx)
+	if openError != nil {
+		return openError
+	}
+
+	// Connect the socket
+	dialer := client.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	connection, _, dialError := dialer.DialContext(ctx, url, nil)
+	if dialError != nil {
+		return dialError
+	}
+	defer connection.Close()
+
+	// Closing the socket is the only way to interrupt a blocked read, so do that when the context ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		var message envelope
+		readError := connection.ReadJSON(&message)
+		if readError != nil {
+			return readError
+		}
+
+		switch message.Type {
+		case "hello":
+			slog.Info("Socket Mode connected")
+		case "disconnect":
+			slog.Info("Socket Mode disconnect requested", "reason", message.Reason)
+			return nil
+		case "events_api":
+			// Leave the envelope unacknowledged if it couldn't be taken, so slack retries it
+			eventError := client.OnEvent(message.Payload)
+			if eventError != nil {
+				slog.Warn("Socket Mode event not accepted", "envelope", message.EnvelopeID, "error", eventError)
+				continue
+			}
+			if ackError := connection.WriteJSON(acknowledgement{EnvelopeID: message.EnvelopeID}); ackError != nil {
+				return ackError
+			}
+		case "interactive":
+			if ackError := connection.WriteJSON(acknowledgement{EnvelopeID: message.EnvelopeID}); ackError != nil {
+				return ackError
+			}
+			// The envelope id stands in for a request id
+			logger := slog.Default().With("envelope", message.EnvelopeID)
+			go func(payload []byte) {
+				interactionError := client.OnInteraction(logging.WithLogger(ctx, logger), payload)
+				if interactionError != nil {
+					logger.Error("Socket Mode interaction failed", "error", interactionError)
+				}
+			}(message.Payload)
+		default:
+			// Acknowledge anything else we don't handle, such as slash commands, so slack doesn't keep resending it
+			if message.EnvelopeID != "" {
+				if ackError := connection.WriteJSON(acknowledgement{EnvelopeID: message.EnvelopeID}); ackError != nil {
+					return ackError
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package socketmode_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"rolflewis.com/spotify-status-sync/src/socketmode"
+	"rolflewis.com/spotify-status-sync/src/socketmode/sockettest"
+)
+
+const wait = 5 * time.Second
+
+// Starts a client against a fresh fake, handing what it receives to the channels. Events fail while failEvents is set.
+// The client is stopped when the test ends.
+func startClient(t *testing.T, failEvents *atomic.Bool) (*sockettest.Server, chan string, chan string) {
+	t.Helper()
+	server := sockettest.NewServer()
+	server.AppToken = "xapp-test"
+	events, interactions := make(chan string, 10), make(chan string, 10)
+	client := &socketmode.Client{
+		AppToken:   "xapp-test",
+		APIURL:     server.URL,
+		HTTPClient: http.DefaultClient,
+		OnEvent: func(payload []byte) error {
+			if failEvents != nil && failEvents.Load() {
+				return errors.New("not now")
+			}
+			events <- string(payload)
+			return nil
+		},
+		OnInteraction: func(ctx context.Context, payload []byte) error {
+			interactions <- string(payload)
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- client.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case runError := <-stopped:
+			if runError != context.Canceled {
+				t.Errorf("Run stopped with %v, expected the context's error", runError)
+			}
+		case <-time.After(wait):
+			t.Errorf("Run didn't stop when its context was cancelled")
+		}
+		server.Close()
+	})
+	if connectError := server.WaitForConnection(wait); connectError != nil {
+		t.Fatal(connectError)
+	}
+	return server, events, interactions
+}
+
+func receive(t *testing.T, from chan string, what string) string {
+	t.Helper()
+	select {
+	case payload := <-from:
+		return payload
+	case <-time.After(wait):
+		t.Fatalf("no %s was received", what)
+		return ""
+	}
+}
+
+func TestHelloHandshake(t *testing.T) {
+	server, events, _ := startClient(t, nil)
+	if server.Connections() != 1 {
+		t.Fatalf("expected one connection, got %d", server.Connections())
+	}
+	// The hello doesn't count as an envelope, so the first event is handled as usual on the same connection
+	envelope, sendError := server.SendEvent([]byte(`{"type":"event_callback"}`))
+	if sendError != nil {
+		t.Fatal(sendError)
+	}
+	if payload := receive(t, events, "event"); payload != `{"type":"event_callback"}` {
+		t.Errorf("event payload was %s", payload)
+	}
+	if ackError := server.WaitForAck(envelope, wait); ackError != nil {
+		t.Error(ackError)
+	}
+	if server.Connections() != 1 {
+		t.Errorf("client reconnected after the hello, %d connections", server.Connections())
+	}
+}
+
+func TestEventsAreOnlyAcknowledgedOnceTaken(t *testing.T) {
+	var failEvents atomic.Bool
+	failEvents.Store(true)
+	server, events, _ := startClient(t, &failEvents)
+	// Left unacknowledged, so slack redelivers it
+	refused, sendError := server.SendEvent([]byte(`{"event_id":"Ev1"}`))
+	if sendError != nil {
+		t.Fatal(sendError)
+	}
+	if server.WaitForAck(refused, 200*time.Millisecond) == nil {
+		t.Errorf("an event that wasn't taken was acknowledged")
+	}
+
+	failEvents.Store(false)
+	accepted, sendError := server.SendEvent([]byte(`{"event_id":"Ev2"}`))
+	if sendError != nil {
+		t.Fatal(sendError)
+	}
+	if payload := receive(t, events, "event"); payload != `{"event_id":"Ev2"}` {
+		t.Errorf("event payload was %s", payload)
+	}
+	if ackError := server.WaitForAck(accepted, wait); ackError != nil {
+		t.Error(ackError)
+	}
+}
+
+func TestInteractionsAreAcknowledged(t *testing.T) {
+	server, _, interactions := startClient(t, nil)
+	envelope, sendError := server.SendInteraction([]byte(`{"type":"block_actions"}`))
+	if sendError != nil {
+		t.Fatal(sendError)
+	}
+	if ackError := server.WaitForAck(envelope, wait); ackError != nil {
+		t.Error(ackError)
+	}
+	if payload := receive(t, interactions, "interaction"); payload != `{"type":"block_actions"}` {
+		t.Errorf("interaction payload was %s", payload)
+	}
+}
+
+func TestReconnectsWhenAsked(t *testing.T) {
+	server, events, _ := startClient(t, nil)
+	if disconnectError := server.Disconnect("refresh_requested"); disconnectError != nil {
+		t.Fatal(disconnectError)
+	}
+	// Slack asking is not a failure, so there is no backoff
+	if connectError := server.WaitForConnections(2, 500*time.Millisecond); connectError != nil {
+		t.Fatal(connectError)
+	}
+	expectDelivered(t, server, events)
+}
+
+func TestReconnectsAfterDroppedSocket(t *testing.T) {
+	server, events, _ := startClient(t, nil)
+	server.Drop()
+	if connectError := server.WaitForConnections(2, wait); connectError != nil {
+		t.Fatal(connectError)
+	}
+	expectDelivered(t, server, events)
+}
+
+// Checks an event sent over the current connection is received and acknowledged
+func expectDelivered(t *testing.T, server *sockettest.Server, events chan string) {
+	t.Helper()
+	// The new connection's hello is written before the count goes up, so it is safe to send
+	envelope, sendError := server.SendEvent([]byte(`{"event_id":"Ev3"}`))
+	if sendError != nil {
+		t.Fatal(sendError)
+	}
+	receive(t, events, "event after reconnecting")
+	if ackError := server.WaitForAck(envelope, wait); ackError != nil {
+		t.Error(ackError)
+	}
+}
@@ -0,0 +1,208 @@
+// Package sockettest provides a local stand-in for slack's Socket Mode endpoints, so the socketmode client and the handlers
+// behind it can be exercised without network access.
+package sockettest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type Server struct {
+	// Base API url to hand the client in place of SLACK_API_URL
+	URL string
+	// If set, apps.connections.open rejects any other token
+	AppToken string
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	lock        sync.Mutex
+	connection  *websocket.Conn
+	connected   chan struct{}
+	connections int
+	nextID      int
+	acks        map[string]chan struct{}
+}
+
+func NewServer() *Server {
+	server := &Server{
+		connected: make(chan struct{}),
+		acks:      make(map[string]chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/apps.connections.open", server.handleOpen)
+	mux.HandleFunc("/link", server.handleLink)
+	server.server = httptest.NewServer(mux)
+	server.URL = server.server.URL + "/api/"
+	return server
+}
+
+func (server *Server) Close() {
+	server.lock.Lock()
+	if server.connection != nil {
+		server.connection.Close()
+	}
+	server.lock.Unlock()
+	server.server.Close()
+}
+
+// How many websocket connections the client has made so far
+func (server *Server) Connections() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.connections
+}
+
+// Blocks until a client is connected
+func (server *Server) WaitForConnection(timeout time.Duration) error {
+	server.lock.Lock()
+	connected := server.connected
+	server.lock.Unlock()
+	select {
+	case <-connected:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("no socket mode client connected")
+	}
+}
+
+// Sends an Events API payload to the connected client. Returns the envelope id to wait for an acknowledgement on.
+func (server *Server) SendEvent(payload []byte) (string, error) {
+	return server.send("events_api", payload, false)
+}
+
+// Sends an interaction payload to the connected client. Returns the envelope id to wait for an acknowledgement on.
+func (server *Server) SendInteraction(payload []byte) (string, error) {
+	return server.send("interactive", payload, true)
+}
+
+// Asks the client to reconnect, like slack does when it rotates connections
+func (server *Server) Disconnect(reason string) error {
+	return server.write(map[string]string{"type": "disconnect", "reason": reason})
+}
+
+// Closes the client's connection without a disconnect message, as a network failure would
+func (server *Server) Drop() {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.connection != nil {
+		server.connection.Close()
+		server.connection = nil
+	}
+}
+
+// Blocks until the client has made the given number of connections, such as 2 for the first reconnect
+func (server *Server) WaitForConnections(count int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for server.Connections() < count {
+		if time.Now().After(deadline) {
+			return errors.New("socket mode client made " + strconv.Itoa(server.Connections()) + " of " + strconv.Itoa(count) + " connections")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// Blocks until the client acknowledges the envelope
+func (server *Server) WaitForAck(envelopeID string, timeout time.Duration) error {
+	server.lock.Lock()
+	acked, exists := server.acks[envelopeID]
+	server.lock.Unlock()
+	if !exists {
+		return errors.New("unknown envelope " + envelopeID)
+	}
+	select {
+	case <-acked:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("envelope " + envelopeID + " was not acknowledged")
+	}
+}
+
+func (server *Server) send(messageType string, payload []byte, acceptsResponse bool) (string, error) {
+	server.lock.Lock()
+	server.nextID++
+	envelopeID := "envelope-" + strconv.Itoa(server.nextID)
+	server.acks[envelopeID] = make(chan struct{})
+	server.lock.Unlock()
+
+	message := map[string]interface{}{
+		"envelope_id":              envelopeID,
+		"type":                     messageType,
+		"payload":                  json.RawMessage(payload),
+		"accepts_response_payload": acceptsResponse,
+	}
+	return envelopeID, server.write(message)
+}
+
+func (server *Server) write(message interface{}) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.connection == nil {
+		return errors.New("no socket mode client connected")
+	}
+	return server.connection.WriteJSON(message)
+}
+
+func (server *Server) handleOpen(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if request.Method != http.MethodPost || (server.AppToken != "" && token != server.AppToken) {
+		json.NewEncoder(writer).Encode(map[string]interface{}{"ok": false, "error": "invalid_auth"})
+		return
+	}
+	url := "ws" + strings.TrimPrefix(server.server.URL, "http") + "/link"
+	json.NewEncoder(writer).Encode(map[string]interface{}{"ok": true, "url": url})
+}
+
+func (server *Server) handleLink(writer http.ResponseWriter, request *http.Request) {
+	connection, upgradeError := server.upgrader.Upgrade(writer, request, nil)
+	if upgradeError != nil {
+		return
+	}
+
+	// Replace any previous connection, the way slack moves a client over on reconnect
+	server.lock.Lock()
+	if server.connection != nil {
+		server.connection.Close()
+	}
+	server.connection = connection
+	server.connections++
+	helloError := connection.WriteJSON(map[string]interface{}{"type": "hello", "num_connections": 1})
+	select {
+	case <-server.connected:
+	default:
+		close(server.connected)
+	}
+	server.lock.Unlock()
+	if helloError != nil {
+		return
+	}
+
+	// Record acknowledgements until the client goes away
+	for {
+		var ack struct {
+			EnvelopeID string `json:"envelope_id"`
+		}
+		if readError := connection.ReadJSON(&ack); readError != nil {
+			return
+		}
+		server.lock.Lock()
+		if acked, exists := server.acks[ack.EnvelopeID]; exists {
+			select {
+			case <-acked:
+			default:
+				close(acked)
+			}
+		}
+		server.lock.Unlock()
+	}
+}
@@ -1,18 +1,34 @@
 package spotify
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 )
 
-func ExchangeCodeForTokens(code string, isRefresh bool, client *http.Client) (map[string]interface{}, error) {
+// Builds the link to spotify's OAuth page. The state and PKCE code challenge must come from oauthstate.IssueWithPKCE.
+func AuthorizeURL(state string, challenge string) string {
+	// Set the query values
+	queryValues := url.Values{}
+	queryValues.Set("client_id", settings.SpotifyClientID)
+	queryValues.Set("response_type", "code")
+	queryValues.Set("redirect_uri", settings.AppURL+"spotify/callback")
+	queryValues.Set("scope", "user-read-currently-playing")
+	queryValues.Set("state", state)
+	queryValues.Set("code_challenge_method", "S256")
+	queryValues.Set("code_challenge", challenge)
+	return settings.SpotifyAuthURL + "authorize?" + queryValues.Encode()
+}
+
+// Exchanges an auth code, or a refresh token if isRefresh is set, for new tokens. The verifier is the PKCE code verifier
+// bound to the flow's state, and is ignored for refreshes.
+func ExchangeCodeForTokens(ctx context.Context, code string, verifier string, isRefresh bool, client *http.Client) (map[string]interface{}, error) {
 	// Set the query values
 	queryValues := url.Values{}
 
@@ -23,12 +39,21 @@ func ExchangeCodeForTokens(code string, isRefresh bool, client *http.Client) (ma
 	} else {
 		queryValues.Set("grant_type", "authorization_code")
 		queryValues.Set("code", code)
-		queryValues.Set("redirect_uri", os.Getenv("APP_URL")+"spotify/callback")
+		queryValues.Set("redirect_uri", settings.AppURL+"spotify/callback")
+		if verifier != "" {
+			queryValues.Set("code_verifier", verifier)
+		}
+	}
+
+	// Without a client secret we are a public client, which identifies itself in the body instead
+	clientSecret := settings.SpotifyClientSecret
+	if clientSecret == "" {
+		queryValues.Set("client_id", settings.SpotifyClientID)
 	}
 	urlEncodedBody := queryValues.Encode()
 
 	// Get the auth and refresh tokens
-	authReq, authReqError := http.NewRequest(http.MethodPost, os.Getenv("SPOTIFY_AUTH_URL")+"api/token", strings.NewReader(urlEncodedBody))
+	authReq, authReqError := http.NewRequestWithContext(ctx, http.MethodPost, settings.SpotifyAuthURL+"api/token", strings.NewReader(urlEncodedBody))
 	if authReqError != nil {
 		return nil, authReqError
 	}
@@ -38,8 +63,10 @@ func ExchangeCodeForTokens(code string, isRefresh bool, client *http.Client) (ma
 	authReq.Header.Add("Content-Length", strconv.Itoa(len(urlEncodedBody)))
 
 	// Encode the authorization header
-	bytes := []byte(os.Getenv("SPOTIFY_CLIENT_ID") + ":" + os.Getenv("SPOTIFY_CLIENT_SECRET"))
-	authReq.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString(bytes))
+	if clientSecret != "" {
+		bytes := []byte(settings.SpotifyClientID + ":" + clientSecret)
+		authReq.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString(bytes))
+	}
 
 	// Send the request
 	authResp, authRespError := client.Do(authReq)
@@ -68,9 +95,9 @@ func ExchangeCodeForTokens(code string, isRefresh bool, client *http.Client) (ma
 	return tokens, nil
 }
 
-func GetProfileForTokens(accessToken string, client *http.Client) (*string, error) {
+func GetProfileForTokens(ctx context.Context, accessToken string, client *http.Client) (*string, error) {
 	// Build request
-	profReq, profReqError := http.NewRequest(http.MethodGet, os.Getenv("SPOTIFY_API_URL")+"me", nil)
+	profReq, profReqError := http.NewRequestWithContext(ctx, http.MethodGet, settings.SpotifyAPIURL+"me", nil)
 	if profReqError != nil {
 		return nil, profReqError
 	}
@@ -1,15 +1,15 @@
 package spotify
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
-
-	"rolflewis.com/spotify-status-sync/src/database"
+	"sync"
+	"sync/atomic"
 )
 
 type CurrentlyPlaying struct {
@@ -30,49 +30,104 @@ type CurrentlyPlaying struct {
 	} `json:"item"`
 }
 
+// What was last seen for a user, used to tell whether a poll changed anything
+type playbackCacheEntry struct {
+	etag        string
+	fingerprint string
+}
+
+var playbackCache = struct {
+	sync.Mutex
+	entries map[string]playbackCacheEntry
+}{entries: make(map[string]playbackCacheEntry)}
+
+// Counters for how many polls were made and how many of them were served unchanged
+var pollsTotal, pollsUnchanged uint64
+
 // Returns the currently playing song struct, or error if error occurs. If the user is not playing anything or is in private session, currently playing is nil.
-func GetCurrentlyPlayingForUser(user string, client *http.Client) (*CurrentlyPlaying, error) {
-	// Get the data for this user
-	_, tokens, tokensError := database.GetSpotifyForUser(user)
-	if tokensError != nil {
-		return nil, tokensError
-	}
+// Changed is false when Spotify answered 304 or the poll is the same as the last one for this user, in which case currently playing is also nil.
+func GetCurrentlyPlayingForUser(ctx context.Context, user string, accessToken string, client *http.Client) (*CurrentlyPlaying, bool, error) {
+	// Look up what we saw last time
+	playbackCache.Lock()
+	cached, hasCached := playbackCache.entries[user]
+	playbackCache.Unlock()
+	atomic.AddUint64(&pollsTotal, 1)
 	// Set the query values
 	queryValues := url.Values{}
 	queryValues.Set("market", "from_token")
 	queryValues.Set("additional_types", "episode")
 	// Get the auth and refresh tokens
-	songReq, songReqError := http.NewRequest(http.MethodGet, os.Getenv("SPOTIFY_API_URL")+"me/player/currently-playing?"+queryValues.Encode(), nil)
+	songReq, songReqError := http.NewRequestWithContext(ctx, http.MethodGet, settings.SpotifyAPIURL+"me/player/currently-playing?"+queryValues.Encode(), nil)
 	if songReqError != nil {
-		return nil, songReqError
+		return nil, false, songReqError
 	}
 	// Add auth
-	songReq.Header.Add("Authorization", "Bearer "+tokens[0])
+	songReq.Header.Add("Authorization", "Bearer "+accessToken)
+	// Let spotify skip the body if nothing changed since the last response
+	if hasCached && cached.etag != "" {
+		songReq.Header.Add("If-None-Match", cached.etag)
+	}
 	// Send the request
 	songResp, songRespError := client.Do(songReq)
 	if songRespError != nil {
-		return nil, songRespError
+		return nil, false, songRespError
 	}
 	defer songResp.Body.Close()
 	// Check status codes
-	if songResp.StatusCode != http.StatusOK && songResp.StatusCode != http.StatusNoContent {
-		return nil, errors.New("Non-200/204 status code from auth endpoint: " + strconv.Itoa(songResp.StatusCode) + " / " + songResp.Status)
+	if songResp.StatusCode != http.StatusOK && songResp.StatusCode != http.StatusNoContent && songResp.StatusCode != http.StatusNotModified {
+		return nil, false, errors.New("Non-200/204/304 status code from auth endpoint: " + strconv.Itoa(songResp.StatusCode) + " / " + songResp.Status)
 	}
-	// If status code is 204, the user is not playing anything or is in a private session
-	if songResp.StatusCode == http.StatusNoContent {
-		return nil, nil
+	// If status code is 304, nothing changed since the etag we sent
+	if songResp.StatusCode == http.StatusNotModified {
+		atomic.AddUint64(&pollsUnchanged, 1)
+		return nil, false, nil
 	}
-	// Read the tokens
-	jsonBytes, readError := ioutil.ReadAll(songResp.Body)
-	if readError != nil {
-		return nil, readError
+	// If status code is 204, the user is not playing anything or is in a private session
+	var current *CurrentlyPlaying
+	if songResp.StatusCode == http.StatusOK {
+		// Read the tokens
+		jsonBytes, readError := ioutil.ReadAll(songResp.Body)
+		if readError != nil {
+			return nil, false, readError
+		}
+		// unmarshal into struct
+		current = &CurrentlyPlaying{}
+		jsonError := json.Unmarshal(jsonBytes, current)
+		if jsonError != nil {
+			return nil, false, jsonError
+		}
 	}
-	// unmarshal into struct
-	var current CurrentlyPlaying
-	jsonError := json.Unmarshal(jsonBytes, &current)
-	if jsonError != nil {
-		return nil, jsonError
+	// Remember this poll for next time
+	entry := playbackCacheEntry{etag: songResp.Header.Get("ETag"), fingerprint: fingerprint(current)}
+	playbackCache.Lock()
+	playbackCache.entries[user] = entry
+	playbackCache.Unlock()
+	// Compare against the last poll
+	if hasCached && cached.fingerprint == entry.fingerprint {
+		atomic.AddUint64(&pollsUnchanged, 1)
+		return nil, false, nil
 	}
 	// Return success
-	return &current, nil
+	return current, true, nil
+}
+
+// Reduces a poll to just the fields the status is built from. Progress and timestamps change on every poll, so they are left out.
+func fingerprint(current *CurrentlyPlaying) string {
+	if current == nil {
+		return "nothing"
+	}
+	return strconv.FormatBool(current.IsPlaying) + "|" + current.CurrentlyPlayingType + "|" + current.Item.ID
+}
+
+// Drops what we remember about a user's playback so the next poll is treated as changed.
+// Used when acting on a poll failed, or when the user's connection changes.
+func ForgetPlayback(user string) {
+	playbackCache.Lock()
+	delete(playbackCache.entries, user)
+	playbackCache.Unlock()
+}
+
+// Returns how many polls have been made since startup, and how many of those were served unchanged
+func PollStats() (uint64, uint64) {
+	return atomic.LoadUint64(&pollsTotal), atomic.LoadUint64(&pollsUnchanged)
 }
@@ -1,37 +1,91 @@
 package spotify
 
 import (
+	"context"
+	"errors"
 	"net/http"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"rolflewis.com/spotify-status-sync/src/config"
 	"rolflewis.com/spotify-status-sync/src/database"
+	"rolflewis.com/spotify-status-sync/src/logging"
+	"rolflewis.com/spotify-status-sync/src/metrics"
 )
 
-func RefreshExpiringTokens(client *http.Client) (int, error) {
+// Where the package keeps its data - set once at startup
+var store database.Store
+
+// Sets the storage the package uses
+func UseStore(newStore database.Store) {
+	store = newStore
+}
+
+// The app's configuration - set once at startup
+var settings *config.Config
+
+// Sets the configuration the package uses
+func UseConfig(newConfig *config.Config) {
+	settings = newConfig
+}
+
+var tokenRefreshes = metrics.Factory.NewCounterVec(prometheus.CounterOpts{Name: "spotify_token_refreshes_total",
+	Help: "Spotify token refreshes, by result."}, []string{"result"})
+
+// Refreshes every token that expires soon, returning how many were refreshed. A user whose refresh fails is logged and
+// counted but doesn't stop the others - only reading the users, or running out of time, fails the sweep.
+func RefreshExpiringTokens(ctx context.Context, client *http.Client) (int, error) {
 	// Get the list of users who need to be refreshed
-	users, usersError := database.GetAllUsersWhoExpireWithinXMinutes(20)
+	users, usersError := store.GetAllUsersWhoExpireWithinXMinutes(ctx, 20)
 	if usersError != nil {
 		return 0, usersError
 	}
 	// Refresh each user
-	for index, user := range users {
-		refreshError := refreshTokenForUser(user, client)
+	refreshed := 0
+	for _, user := range users {
+		// Every user left would fail the same way
+		if ctx.Err() != nil {
+			return refreshed, ctx.Err()
+		}
+		refreshError := refreshTokenForUser(ctx, user, client)
 		if refreshError != nil {
-			return index, refreshError
+			tokenRefreshes.WithLabelValues("error").Inc()
+			logging.FromContext(ctx).Warn("Could not refresh spotify token", "user", logging.Hash(user), "error", refreshError)
+			continue
 		}
+		tokenRefreshes.WithLabelValues("ok").Inc()
+		refreshed++
 	}
 	// Return success
-	return len(users), nil
+	return refreshed, nil
+}
+
+// Refreshes the user's token now, whenever it expires
+func RefreshTokenForUser(ctx context.Context, user string, client *http.Client) error {
+	spotifyID, _, spotifyError := store.GetSpotifyForUser(ctx, user)
+	if spotifyError != nil {
+		return spotifyError
+	}
+	if spotifyID == "" {
+		return errors.New("User has no Spotify account connected.")
+	}
+	refreshError := refreshTokenForUser(ctx, user, client)
+	if refreshError != nil {
+		tokenRefreshes.WithLabelValues("error").Inc()
+		return refreshError
+	}
+	tokenRefreshes.WithLabelValues("ok").Inc()
+	return nil
 }
 
-func refreshTokenForUser(user string, client *http.Client) error {
+func refreshTokenForUser(ctx context.Context, user string, client *http.Client) error {
 	// Get the spotify token data for the user
-	spotifyID, oldTokens, spotifyError := database.GetSpotifyForUser(user)
+	spotifyID, oldTokens, spotifyError := store.GetSpotifyForUser(ctx, user)
 	if spotifyError != nil {
 		return spotifyError
 	}
 
 	// Exchange code for tokens
-	tokensMap, exchangeError := ExchangeCodeForTokens(oldTokens[1], true, client)
+	tokensMap, exchangeError := ExchangeCodeForTokens(ctx, oldTokens[1], "", true, client)
 	if exchangeError != nil {
 		return exchangeError
 	}
@@ -43,5 +97,5 @@ func refreshTokenForUser(user string, client *http.Client) error {
 	}
 
 	// Insert new tokens into databse
-	return database.AddSpotifyToUser(user, spotifyID, tokensMap["access_token"].(string), tokensMap["refresh_token"].(string), int(tokensMap["expires_in"].(float64)))
+	return store.AddSpotifyToUser(ctx, user, spotifyID, tokensMap["access_token"].(string), tokensMap["refresh_token"].(string), int(tokensMap["expires_in"].(float64)))
 }
@@ -0,0 +1,455 @@
+// Package spotifytest provides a local stand-in for the parts of the Spotify Web API the app uses, so the auth flow, token
+// refreshes and playback polling can be run without network access or a Spotify account.
+package spotifytest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Something that can be playing
+type Item struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Artists  []string `json:"artists"`
+	Explicit bool     `json:"explicit"`
+	// Set for podcast episodes, which have a show and publisher instead of artists
+	Show      string `json:"show"`
+	Publisher string `json:"publisher"`
+}
+
+// One step of a user's playback timeline
+type Step struct {
+	// When the step starts, measured from when the timeline was set
+	At time.Duration
+	// What is playing. Nil means nothing is, which is answered with a 204.
+	Item   *Item
+	Paused bool
+	// If set, currently-playing answers with this status instead, such as 204, 401 or 429
+	Status int
+}
+
+type user struct {
+	timeline      []Step
+	timelineStart time.Time
+}
+
+type authCode struct {
+	user        string
+	redirectURI string
+	challenge   string
+}
+
+type accessToken struct {
+	user      string
+	expiresAt time.Time
+}
+
+type Server struct {
+	// Base urls to hand the app in place of SPOTIFY_AUTH_URL and SPOTIFY_API_URL
+	AuthURL string
+	APIURL  string
+	// If set, the token endpoint rejects other clients. Leave the secret blank to accept public clients using PKCE.
+	ClientID     string
+	ClientSecret string
+	// How long access tokens last. Defaults to an hour, like Spotify's.
+	TokenLifetime time.Duration
+	// Who /authorize signs in when the request doesn't say with a user parameter
+	AuthorizeAs string
+
+	server *httptest.Server
+
+	lock          sync.Mutex
+	offset        time.Duration
+	users         map[string]*user
+	codes         map[string]authCode
+	accessTokens  map[string]accessToken
+	refreshTokens map[string]string
+	requests      map[string]int
+}
+
+// Starts a server on a random local port
+func NewServer() *Server {
+	server := newServer()
+	server.server = httptest.NewServer(server.handler())
+	server.setURLs()
+	return server
+}
+
+// Starts a server listening on the address, such as ":8888"
+func NewServerAt(address string) (*Server, error) {
+	listener, listenError := net.Listen("tcp", address)
+	if listenError != nil {
+		return nil, listenError
+	}
+	server := newServer()
+	server.server = httptest.NewUnstartedServer(server.handler())
+	server.server.Listener.Close()
+	server.server.Listener = listener
+	server.server.Start()
+	server.setURLs()
+	return server, nil
+}
+
+func newServer() *Server {
+	return &Server{
+		TokenLifetime: time.Hour,
+		users:         make(map[string]*user),
+		codes:         make(map[string]authCode),
+		accessTokens:  make(map[string]accessToken),
+		refreshTokens: make(map[string]string),
+		requests:      make(map[string]int),
+	}
+}
+
+func (server *Server) setURLs() {
+	server.AuthURL = server.server.URL + "/"
+	server.APIURL = server.server.URL + "/v1/"
+}
+
+func (server *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authorize", server.handleAuthorize)
+	mux.HandleFunc("/api/token", server.handleToken)
+	mux.HandleFunc("/v1/me", server.handleProfile)
+	mux.HandleFunc("/v1/me/player/currently-playing", server.handleCurrentlyPlaying)
+	return mux
+}
+
+func (server *Server) Close() {
+	server.server.Close()
+}
+
+// Adds a user with nothing playing. Adding a user that exists does nothing.
+func (server *Server) AddUser(id string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.addUser(id)
+}
+
+func (server *Server) addUser(id string) *user {
+	existing, exists := server.users[id]
+	if !exists {
+		existing = &user{timelineStart: server.now()}
+		server.users[id] = existing
+	}
+	return existing
+}
+
+// Replaces the user's playback with the steps, starting now. Each step lasts until the next one starts, and the last lasts
+// forever. Adds the user if needed.
+func (server *Server) SetTimeline(id string, steps ...Step) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	scripted := server.addUser(id)
+	scripted.timeline = steps
+	scripted.timelineStart = server.now()
+}
+
+// Moves the server's clock forward, which moves every timeline along and ages every token
+func (server *Server) Advance(duration time.Duration) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.offset += duration
+}
+
+// Expires every access token issued to the user, so their next API call gets a 401
+func (server *Server) ExpireTokens(id string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for token, issued := range server.accessTokens {
+		if issued.user == id {
+			issued.expiresAt = server.now().Add(-time.Second)
+			server.accessTokens[token] = issued
+		}
+	}
+}
+
+// Revokes the user's refresh tokens, like the user removing the app from their Spotify account. Refreshing with them
+// answers invalid_grant.
+func (server *Server) RevokeTokens(id string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for token, owner := range server.refreshTokens {
+		if owner == id {
+			delete(server.refreshTokens, token)
+		}
+	}
+	for token, issued := range server.accessTokens {
+		if issued.user == id {
+			delete(server.accessTokens, token)
+		}
+	}
+}
+
+// How many requests have been made to the path, such as "/api/token"
+func (server *Server) Requests(path string) int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.requests[path]
+}
+
+func (server *Server) now() time.Time {
+	return time.Now().Add(server.offset)
+}
+
+func (server *Server) count(request *http.Request) {
+	server.lock.Lock()
+	server.requests[request.URL.Path]++
+	server.lock.Unlock()
+}
+
+// Signs the user in straight away and redirects back with a code, skipping the consent screen
+func (server *Server) handleAuthorize(writer http.ResponseWriter, request *http.Request) {
+	server.count(request)
+	query := request.URL.Query()
+	redirectURI := query.Get("redirect_uri")
+	if request.Method != http.MethodGet || query.Get("response_type") != "code" || redirectURI == "" {
+		http.Error(writer, "Invalid authorize request", http.StatusBadRequest)
+		return
+	}
+	if server.ClientID != "" && query.Get("client_id") != server.ClientID {
+		http.Error(writer, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+	if query.Get("code_challenge") != "" && query.Get("code_challenge_method") != "S256" {
+		http.Error(writer, "Only S256 code challenges are supported", http.StatusBadRequest)
+		return
+	}
+
+	// Work out who is signing in
+	server.lock.Lock()
+	id := query.Get("user")
+	if id == "" {
+		id = server.AuthorizeAs
+	}
+	_, known := server.users[id]
+	server.lock.Unlock()
+	redirect, parseError := url.Parse(redirectURI)
+	if parseError != nil {
+		http.Error(writer, "Invalid redirect uri", http.StatusBadRequest)
+		return
+	}
+	values := redirect.Query()
+	values.Set("state", query.Get("state"))
+	if !known {
+		values.Set("error", "access_denied")
+	} else {
+		code := randomToken()
+		server.lock.Lock()
+		server.codes[code] = authCode{user: id, redirectURI: redirectURI, challenge: query.Get("code_challenge")}
+		server.lock.Unlock()
+		values.Set("code", code)
+	}
+	redirect.RawQuery = values.Encode()
+	http.Redirect(writer, request, redirect.String(), http.StatusFound)
+}
+
+func (server *Server) handleToken(writer http.ResponseWriter, request *http.Request) {
+	server.count(request)
+	if request.Method != http.MethodPost || request.ParseForm() != nil {
+		tokenError(writer, http.StatusBadRequest, "invalid_request", "Malformed token request")
+		return
+	}
+
+	// Check who is asking - confidential clients use basic auth, public ones put their id in the body
+	clientID, clientSecret, confidential := request.BasicAuth()
+	if !confidential {
+		clientID = request.PostForm.Get("client_id")
+	}
+	if server.ClientID != "" && clientID != server.ClientID {
+		tokenError(writer, http.StatusUnauthorized, "invalid_client", "Invalid client")
+		return
+	}
+	if server.ClientSecret != "" && confidential && clientSecret != server.ClientSecret {
+		tokenError(writer, http.StatusUnauthorized, "invalid_client", "Invalid client secret")
+		return
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	var id string
+	switch request.PostForm.Get("grant_type") {
+	case "authorization_code":
+		// Codes can only be used once
+		code, exists := server.codes[request.PostForm.Get("code")]
+		delete(server.codes, request.PostForm.Get("code"))
+		if !exists || code.redirectURI != request.PostForm.Get("redirect_uri") {
+			tokenError(writer, http.StatusBadRequest, "invalid_grant", "Invalid authorization code")
+			return
+		}
+		// Public clients must prove they started the flow
+		if code.challenge == "" && !confidential {
+			tokenError(writer, http.StatusBadRequest, "invalid_request", "code_verifier required")
+			return
+		}
+		if code.challenge != "" {
+			verifierHash := sha256.Sum256([]byte(request.PostForm.Get("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(verifierHash[:]) != code.challenge {
+				tokenError(writer, http.StatusBadRequest, "invalid_grant", "code_verifier was incorrect")
+				return
+			}
+		}
+		id = code.user
+	case "refresh_token":
+		owner, exists := server.refreshTokens[request.PostForm.Get("refresh_token")]
+		if !exists {
+			tokenError(writer, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+			return
+		}
+		id = owner
+	default:
+		tokenError(writer, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+		return
+	}
+
+	// Issue the tokens. Refreshes keep the same refresh token, which is what Spotify usually does.
+	access := randomToken()
+	server.accessTokens[access] = accessToken{user: id, expiresAt: server.now().Add(server.TokenLifetime)}
+	response := map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"scope":        "user-read-currently-playing",
+		"expires_in":   int(server.TokenLifetime.Seconds()),
+	}
+	if request.PostForm.Get("grant_type") == "authorization_code" {
+		refresh := randomToken()
+		server.refreshTokens[refresh] = id
+		response["refresh_token"] = refresh
+	}
+	writeJSON(writer, http.StatusOK, response)
+}
+
+func (server *Server) handleProfile(writer http.ResponseWriter, request *http.Request) {
+	server.count(request)
+	id, authorized := server.authorize(writer, request)
+	if !authorized {
+		return
+	}
+	writeJSON(writer, http.StatusOK, map[string]interface{}{"id": id, "display_name": id, "type": "user"})
+}
+
+func (server *Server) handleCurrentlyPlaying(writer http.ResponseWriter, request *http.Request) {
+	server.count(request)
+	id, authorized := server.authorize(writer, request)
+	if !authorized {
+		return
+	}
+
+	// Find where the user's timeline is up to
+	server.lock.Lock()
+	scripted := server.users[id]
+	var step Step
+	elapsed := server.now().Sub(scripted.timelineStart)
+	for _, candidate := range scripted.timeline {
+		if candidate.At > elapsed {
+			break
+		}
+		step = candidate
+	}
+	server.lock.Unlock()
+
+	if step.Status == http.StatusTooManyRequests {
+		writer.Header().Set("Retry-After", "1")
+	}
+	if step.Status != 0 && step.Status != http.StatusNoContent {
+		apiError(writer, step.Status, http.StatusText(step.Status))
+		return
+	}
+	if step.Item == nil || step.Status == http.StatusNoContent {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Build the response, with an etag so unchanged polls can be answered with a 304
+	body, marshalError := json.Marshal(currentlyPlaying(step))
+	if marshalError != nil {
+		apiError(writer, http.StatusInternalServerError, marshalError.Error())
+		return
+	}
+	bodyHash := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(bodyHash[:8]) + `"`
+	writer.Header().Set("ETag", etag)
+	if request.Header.Get("If-None-Match") == etag {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(body)
+}
+
+// Checks the bearer token, answering 401 if it is unknown or expired. Returns the user it was issued to.
+func (server *Server) authorize(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	server.lock.Lock()
+	issued, exists := server.accessTokens[token]
+	expired := exists && !server.now().Before(issued.expiresAt)
+	_, known := server.users[issued.user]
+	server.lock.Unlock()
+	if !exists || !known {
+		apiError(writer, http.StatusUnauthorized, "Invalid access token")
+		return "", false
+	}
+	if expired {
+		apiError(writer, http.StatusUnauthorized, "The access token expired")
+		return "", false
+	}
+	return issued.user, true
+}
+
+// The currently-playing body for a step, shaped like Spotify's
+func currentlyPlaying(step Step) map[string]interface{} {
+	item := map[string]interface{}{
+		"id":       step.Item.ID,
+		"name":     step.Item.Name,
+		"explicit": step.Item.Explicit,
+	}
+	playingType := "track"
+	if step.Item.Show != "" {
+		playingType = "episode"
+		item["show"] = map[string]string{"name": step.Item.Show, "publisher": step.Item.Publisher}
+	} else {
+		artists := []map[string]string{}
+		for _, artist := range step.Item.Artists {
+			artists = append(artists, map[string]string{"name": artist})
+		}
+		item["artists"] = artists
+	}
+	item["type"] = playingType
+	return map[string]interface{}{
+		"is_playing":             !step.Paused,
+		"currently_playing_type": playingType,
+		"item":                   item,
+	}
+}
+
+func tokenError(writer http.ResponseWriter, status int, code string, description string) {
+	writeJSON(writer, status, map[string]string{"error": code, "error_description": description})
+}
+
+func apiError(writer http.ResponseWriter, status int, message string) {
+	writeJSON(writer, status, map[string]interface{}{"error": map[string]interface{}{"status": status, "message": message}})
+}
+
+func writeJSON(writer http.ResponseWriter, status int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(body)
+}
+
+func randomToken() string {
+	randomBytes := make([]byte, 24)
+	rand.Read(randomBytes)
+	return base64.RawURLEncoding.EncodeToString(randomBytes)
+}
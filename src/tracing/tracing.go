@@ -0,0 +1,131 @@
+// Package tracing sets up OpenTelemetry tracing and holds the spans the app starts itself. Outbound calls are traced by the
+// upstream transport and database queries by the otelsql driver wrapper.
+package tracing
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"rolflewis.com/spotify-status-sync/src/config"
+	"rolflewis.com/spotify-status-sync/src/logging"
+)
+
+// The service name spans are reported under
+const serviceName = "spotify-status-sync"
+
+var tracer = otel.Tracer("rolflewis.com/spotify-status-sync")
+
+// Installs the tracer provider the settings ask for. With TRACE_EXPORTER=none spans are still created, so trace ids
+// show up in logs, but nothing is exported. The returned function flushes anything still buffered.
+func Setup(settings *config.Config) (func(context.Context) error, error) {
+	ratio, parseError := strconv.ParseFloat(settings.TraceSampleRatio, 64)
+	if parseError != nil {
+		return nil, parseError
+	}
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	}
+	if settings.TraceExporter == "otlp" {
+		exporter, exporterError := otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(settings.OTLPEndpoint),
+			otlptracehttp.WithHeaders(parseHeaders(settings.OTLPHeaders)))
+		if exporterError != nil {
+			return nil, exporterError
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+	return UseExporter(nil, options...), nil
+}
+
+// Installs a tracer provider that hands finished spans straight to the exporter, such as an in-memory one when checking
+// the spans the app makes. Any extra options are applied too. The returned function flushes and shuts the provider down.
+func UseExporter(exporter sdktrace.SpanExporter, options ...sdktrace.TracerProviderOption) func(context.Context) error {
+	if exporter != nil {
+		options = append(options, sdktrace.WithSyncer(exporter))
+	}
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown
+}
+
+// Turns "name=value,name2=value2" into a header map
+func parseHeaders(headers string) map[string]string {
+	parsed := make(map[string]string)
+	for _, header := range strings.Split(headers, ",") {
+		name, value, found := strings.Cut(header, "=")
+		if found {
+			parsed[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return parsed
+}
+
+// Starts a span as a child of whatever span the context carries
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Ends the span, marking it failed if there was an error
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Tags the context's logger with the id of the trace it is in, so log lines can be matched up with traces
+func WithTraceID(ctx context.Context) context.Context {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return ctx
+	}
+	return logging.WithLogger(ctx, logging.FromContext(ctx).With("trace_id", spanContext.TraceID().String()))
+}
+
+// Gin middleware that wraps every request in a server span, continuing the trace if the caller sent a traceparent header.
+// It also adds the trace id to the request's logger, so it has to come after logging.Middleware.
+func Middleware() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		// Name the span after the route, not the path, so ids in paths don't make every span unique
+		route := context.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx := otel.GetTextMapPropagator().Extract(context.Request.Context(), propagation.HeaderCarrier(context.Request.Header))
+		ctx, span := tracer.Start(ctx, context.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", context.Request.Method),
+				attribute.String("http.route", route),
+			))
+		defer span.End()
+		context.Request = context.Request.WithContext(WithTraceID(ctx))
+
+		context.Next()
+
+		status := context.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+	}
+}
+
+// Reports whether the context carries a span, which is when database queries made with it are traced. Queries made
+// outside of any request, loop run or job, such as the job workers polling for work, would otherwise each start a trace.
+func InSpan(ctx context.Context) bool {
+	return trace.SpanContextFromContext(ctx).IsValid()
+}
@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans from every test. The package's tracer only ever follows the first provider installed, so there is one for the run.
+var exporter = tracetest.NewInMemoryExporter()
+
+func TestMain(m *testing.M) {
+	UseExporter(exporter)
+	m.Run()
+}
+
+// The value of the attribute on the span, or an invalid value if it isn't set
+func attributeOf(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestMiddlewareNamesSpansByRoute(t *testing.T) {
+	exporter.Reset()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/teams/:team", func(context *gin.Context) {
+		if !InSpan(context.Request.Context()) {
+			t.Errorf("handler's context doesn't carry the request span")
+		}
+		context.String(http.StatusInternalServerError, "failed")
+	})
+
+	// Continue a trace the caller started
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	request := httptest.NewRequest(http.MethodGet, "/teams/T123", nil)
+	request.Header.Set("traceparent", parent)
+	router.ServeHTTP(httptest.NewRecorder(), request)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	route := spans[0]
+	if route.Name != "GET /teams/:team" || route.SpanKind != trace.SpanKindServer {
+		t.Errorf("route span is %q of kind %v", route.Name, route.SpanKind)
+	}
+	if attributeOf(route, "http.route").AsString() != "/teams/:team" || attributeOf(route, "http.request.method").AsString() != "GET" ||
+		attributeOf(route, "http.response.status_code").AsInt64() != 500 {
+		t.Errorf("route span has attributes %v", route.Attributes)
+	}
+	if route.Status.Code != codes.Error {
+		t.Errorf("a 500 didn't mark the span failed")
+	}
+	if route.Parent.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || route.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("route span didn't continue the caller's trace, parent is %v", route.Parent)
+	}
+	if spans[1].Name != "GET unmatched" || attributeOf(spans[1], "http.response.status_code").AsInt64() != 404 {
+		t.Errorf("unmatched request gave span %q with attributes %v", spans[1].Name, spans[1].Attributes)
+	}
+}
+
+func TestEndRecordsErrors(t *testing.T) {
+	exporter.Reset()
+	ctx, parent := Start(context.Background(), "parent", attribute.String("run", "1"))
+	_, child := Start(ctx, "child")
+	End(child, errors.New("it broke"))
+	End(parent, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 || spans[0].Name != "child" || spans[1].Name != "parent" {
+		t.Fatalf("expected child then parent spans, got %v", spans)
+	}
+	if spans[0].Parent.SpanID() != spans[1].SpanContext.SpanID() {
+		t.Errorf("child isn't parented to the span in its context")
+	}
+	if spans[0].Status.Code != codes.Error || spans[0].Status.Description != "it broke" || len(spans[0].Events) != 1 {
+		t.Errorf("failed span has status %v and events %v", spans[0].Status, spans[0].Events)
+	}
+	if spans[1].Status.Code != codes.Unset || attributeOf(spans[1], "run").AsString() != "1" {
+		t.Errorf("parent span has status %v and attributes %v", spans[1].Status, spans[1].Attributes)
+	}
+}
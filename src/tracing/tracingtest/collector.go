@@ -0,0 +1,152 @@
+// Package tracingtest provides a local OTLP/HTTP trace collector that keeps what it receives in memory, so the spans the
+// app exports can be checked without running a real collector.
+package tracingtest
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonv1 "go.opentelemetry.io/proto/otlp/common/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// A span as received, with ids hex encoded. ParentID is blank for a trace's root span.
+type Span struct {
+	Name       string
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Attributes map[string]string
+	Failed     bool
+}
+
+type Collector struct {
+	// The traces endpoint to hand the app as OTLP_ENDPOINT
+	URL string
+
+	server *httptest.Server
+
+	lock  sync.Mutex
+	spans []Span
+}
+
+func NewCollector() *Collector {
+	collector := &Collector{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/traces", collector.handleTraces)
+	collector.server = httptest.NewServer(mux)
+	collector.URL = collector.server.URL + "/v1/traces"
+	return collector
+}
+
+func (collector *Collector) Close() {
+	collector.server.Close()
+}
+
+// Every span received so far, in the order they arrived
+func (collector *Collector) Spans() []Span {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	return append([]Span(nil), collector.spans...)
+}
+
+// The received spans with the given name
+func (collector *Collector) Named(name string) []Span {
+	var named []Span
+	for _, span := range collector.Spans() {
+		if span.Name == name {
+			named = append(named, span)
+		}
+	}
+	return named
+}
+
+// The received spans whose parent is the given span
+func (collector *Collector) Children(parent Span) []Span {
+	var children []Span
+	for _, span := range collector.Spans() {
+		if span.TraceID == parent.TraceID && span.ParentID == parent.SpanID {
+			children = append(children, span)
+		}
+	}
+	return children
+}
+
+// Accepts an export request. Only the protobuf encoding is supported, which is what the Go exporter sends.
+func (collector *Collector) handleTraces(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(writer, "Expected a protobuf POST", http.StatusUnsupportedMediaType)
+		return
+	}
+	var body io.Reader = request.Body
+	if request.Header.Get("Content-Encoding") == "gzip" {
+		unzipped, zipError := gzip.NewReader(request.Body)
+		if zipError != nil {
+			http.Error(writer, zipError.Error(), http.StatusBadRequest)
+			return
+		}
+		body = unzipped
+	}
+	bodyBytes, readError := ioutil.ReadAll(body)
+	if readError != nil {
+		http.Error(writer, readError.Error(), http.StatusBadRequest)
+		return
+	}
+	var export collectortrace.ExportTraceServiceRequest
+	if parseError := proto.Unmarshal(bodyBytes, &export); parseError != nil {
+		http.Error(writer, parseError.Error(), http.StatusBadRequest)
+		return
+	}
+
+	collector.lock.Lock()
+	for _, resourceSpans := range export.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				collector.spans = append(collector.spans, convert(span))
+			}
+		}
+	}
+	collector.lock.Unlock()
+
+	response, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	writer.Header().Set("Content-Type", "application/x-protobuf")
+	writer.Write(response)
+}
+
+func convert(span *tracev1.Span) Span {
+	converted := Span{
+		Name:       span.Name,
+		TraceID:    hex.EncodeToString(span.TraceId),
+		SpanID:     hex.EncodeToString(span.SpanId),
+		ParentID:   hex.EncodeToString(span.ParentSpanId),
+		Attributes: make(map[string]string),
+		Failed:     span.Status != nil && span.Status.Code == tracev1.Status_STATUS_CODE_ERROR,
+	}
+	for _, attribute := range span.Attributes {
+		converted.Attributes[attribute.Key] = attributeString(attribute.Value)
+	}
+	return converted
+}
+
+// Flattens an attribute value to a string, which is all the checks need
+func attributeString(value *commonv1.AnyValue) string {
+	switch typed := value.GetValue().(type) {
+	case *commonv1.AnyValue_StringValue:
+		return typed.StringValue
+	case *commonv1.AnyValue_IntValue:
+		return fmt.Sprint(typed.IntValue)
+	case *commonv1.AnyValue_BoolValue:
+		return fmt.Sprint(typed.BoolValue)
+	case *commonv1.AnyValue_DoubleValue:
+		return fmt.Sprint(typed.DoubleValue)
+	}
+	return ""
+}
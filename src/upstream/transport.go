@@ -0,0 +1,289 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"rolflewis.com/spotify-status-sync/src/metrics"
+	"rolflewis.com/spotify-status-sync/src/tracing"
+)
+
+var requestsTotal = metrics.Factory.NewCounterVec(prometheus.CounterOpts{Name: "upstream_requests_total",
+	Help: "Calls made to Spotify and Slack, by upstream, endpoint and status code. Each retry is counted."},
+	[]string{"upstream", "endpoint", "code"})
+var requestDuration = metrics.Factory.NewHistogramVec(prometheus.HistogramOpts{Name: "upstream_request_duration_seconds",
+	Help: "How long Spotify and Slack took to answer, by upstream and endpoint.", Buckets: metrics.DurationBuckets},
+	[]string{"upstream", "endpoint"})
+
+// Returned (wrapped in a *url.Error by http.Client) when a call is refused because the upstream's breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open for upstream")
+
+// Describes how calls to a single upstream API are made
+type Policy struct {
+	Name             string
+	Prefixes         []string      // URL prefixes that belong to this upstream
+	Timeout          time.Duration // Per attempt, including reading the body
+	MaxRetries       int           // Only applied to idempotent requests
+	RetryBackoff     time.Duration // Base delay, doubled on each retry
+	FailureThreshold int           // Consecutive failures before the breaker opens, 0 disables the breaker
+	OpenDuration     time.Duration // How long the breaker stays open before a probe is let through
+}
+
+// An http.RoundTripper that applies a Policy to every request based on its URL
+type Transport struct {
+	Base     http.RoundTripper
+	Fallback Policy
+	breakers []*breaker
+}
+
+func New(policies ...Policy) *Transport {
+	transport := &Transport{
+		Base:     http.DefaultTransport,
+		Fallback: Policy{Name: "default", Timeout: 30 * time.Second},
+	}
+	for _, policy := range policies {
+		transport.breakers = append(transport.breakers, &breaker{policy: policy})
+	}
+	return transport
+}
+
+// Returns a client that sends every request through this transport
+func (transport *Transport) Client() *http.Client {
+	return &http.Client{Transport: transport}
+}
+
+// Reports whether the breaker for the named upstream is currently refusing calls
+func (transport *Transport) IsOpen(name string) bool {
+	for _, breaker := range transport.breakers {
+		if breaker.policy.Name == name {
+			return breaker.isOpen(time.Now())
+		}
+	}
+	return false
+}
+
+func (transport *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// Find the upstream this request is for
+	breaker := transport.breakerFor(request)
+	policy := transport.Fallback
+	if breaker != nil {
+		policy = breaker.policy
+	}
+	endpoint := endpointFor(request, policy)
+	// Only idempotent requests with a replayable body can be retried
+	retries := 0
+	if isIdempotent(request) && (request.Body == nil || request.GetBody != nil) {
+		retries = policy.MaxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Each attempt is its own span, so retries show up in the trace
+		ctx, span := tracing.Start(request.Context(), policy.Name+" "+endpoint, attribute.String("upstream", policy.Name),
+			attribute.String("http.request.method", request.Method), attribute.String("server.address", request.URL.Host),
+			attribute.String("url.path", request.URL.Path), attribute.Int("upstream.attempt", attempt))
+		// Refuse the call outright while the breaker is open
+		if breaker != nil && !breaker.allow(time.Now()) {
+			requestsTotal.WithLabelValues(policy.Name, endpoint, "circuit_open").Inc()
+			tracing.End(span, ErrCircuitOpen)
+			return nil, ErrCircuitOpen
+		}
+		// Rewind the body for retries
+		attemptRequest := request
+		if attempt > 0 && request.GetBody != nil {
+			body, bodyError := request.GetBody()
+			if bodyError != nil {
+				tracing.End(span, bodyError)
+				return nil, bodyError
+			}
+			attemptRequest = request.Clone(request.Context())
+			attemptRequest.Body = body
+		}
+
+		started := time.Now()
+		response, responseError := transport.attempt(attemptRequest.WithContext(ctx), policy.Timeout)
+		requestDuration.WithLabelValues(policy.Name, endpoint).Observe(time.Since(started).Seconds())
+		if responseError != nil {
+			requestsTotal.WithLabelValues(policy.Name, endpoint, "error").Inc()
+			tracing.End(span, responseError)
+		} else {
+			requestsTotal.WithLabelValues(policy.Name, endpoint, strconv.Itoa(response.StatusCode)).Inc()
+			span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+			if response.StatusCode >= http.StatusInternalServerError || response.StatusCode == http.StatusTooManyRequests {
+				span.SetStatus(codes.Error, response.Status)
+			}
+			span.End()
+		}
+
+		// A caller cancellation is not the upstream's fault, so don't count it or retry it
+		if responseError != nil && request.Context().Err() != nil {
+			if breaker != nil {
+				breaker.abandon()
+			}
+			return nil, responseError
+		}
+		failed := responseError != nil || response.StatusCode >= http.StatusInternalServerError
+		if breaker != nil {
+			breaker.record(failed, time.Now())
+		}
+		throttled := responseError == nil && response.StatusCode == http.StatusTooManyRequests
+
+		// Return anything that shouldn't or can't be retried
+		if (!failed && !throttled) || attempt >= retries {
+			return response, responseError
+		}
+
+		// Work out the delay before the next attempt, honouring Retry-After when given
+		delay := policy.RetryBackoff << uint(attempt)
+		delay += time.Duration(rand.Int63n(int64(delay/2) + 1))
+		if response != nil {
+			if seconds, parseError := strconv.Atoi(response.Header.Get("Retry-After")); parseError == nil {
+				delay = time.Duration(seconds) * time.Second
+			}
+			// Drain so the connection can be reused
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		// Wait, unless the caller gives up first
+		timer := time.NewTimer(delay)
+		select {
+		case <-request.Context().Done():
+			timer.Stop()
+			return nil, request.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Names the endpoint a request is for - the part of the url after the upstream's prefix, without the query
+func endpointFor(request *http.Request, policy Policy) string {
+	url := request.URL.Scheme + "://" + request.URL.Host + request.URL.Path
+	for _, prefix := range policy.Prefixes {
+		if prefix != "" && strings.HasPrefix(url, prefix) {
+			return strings.TrimPrefix(url, prefix)
+		}
+	}
+	return "other"
+}
+
+// Sends one attempt, bounding it (body included) by the timeout
+func (transport *Transport) attempt(request *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return transport.Base.RoundTrip(request)
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	response, responseError := transport.Base.RoundTrip(request.WithContext(ctx))
+	if responseError != nil {
+		cancel()
+		return nil, responseError
+	}
+	// The timeout has to keep running until the caller is done with the body
+	response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+func (transport *Transport) breakerFor(request *http.Request) *breaker {
+	url := request.URL.String()
+	for _, breaker := range transport.breakers {
+		for _, prefix := range breaker.policy.Prefixes {
+			if prefix != "" && strings.HasPrefix(url, prefix) {
+				return breaker
+			}
+		}
+	}
+	return nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	closeError := body.ReadCloser.Close()
+	body.cancel()
+	return closeError
+}
+
+type idempotentKey struct{}
+
+// Marks requests built with the returned context as safe to retry even though their method is not
+func Idempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+func isIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	marked, _ := request.Context().Value(idempotentKey{}).(bool)
+	return marked
+}
+
+type breaker struct {
+	policy    Policy
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (breaker *breaker) isOpen(now time.Time) bool {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	return now.Before(breaker.openUntil)
+}
+
+// Reports whether a call may go out. Once the open period has passed, a single probe is let through at a time.
+func (breaker *breaker) allow(now time.Time) bool {
+	if breaker.policy.FailureThreshold <= 0 {
+		return true
+	}
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	if now.Before(breaker.openUntil) {
+		return false
+	}
+	if breaker.failures >= breaker.policy.FailureThreshold {
+		if breaker.probing {
+			return false
+		}
+		breaker.probing = true
+	}
+	return true
+}
+
+// Frees up the probe slot without judging the upstream
+func (breaker *breaker) abandon() {
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.probing = false
+}
+
+func (breaker *breaker) record(failed bool, now time.Time) {
+	if breaker.policy.FailureThreshold <= 0 {
+		return
+	}
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+	breaker.probing = false
+	if !failed {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	if breaker.failures >= breaker.policy.FailureThreshold {
+		breaker.openUntil = now.Add(breaker.policy.OpenDuration)
+	}
+}
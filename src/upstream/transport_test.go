@@ -0,0 +1,108 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"rolflewis.com/spotify-status-sync/src/tracing"
+)
+
+// Spans from every test. The tracer only ever follows the first provider installed, so there is one for the run.
+var exporter = tracetest.NewInMemoryExporter()
+
+func TestMain(m *testing.M) {
+	tracing.UseExporter(exporter)
+	m.Run()
+}
+
+// The value of the attribute on the span, or an invalid value if it isn't set
+func attributeOf(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestEachAttemptIsTraced(t *testing.T) {
+	exporter.Reset()
+	// Fails once, then answers
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writer.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	client := New(Policy{Name: "widgets", Prefixes: []string{server.URL + "/api/"}, Timeout: time.Second, MaxRetries: 2,
+		RetryBackoff: time.Millisecond}).Client()
+
+	ctx, parent := tracing.Start(context.Background(), "caller")
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/things.list?page=2", nil)
+	response, responseError := client.Do(request)
+	if responseError != nil {
+		t.Fatal(responseError)
+	}
+	response.Body.Close()
+	tracing.End(parent, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("expected two attempt spans and the caller's, got %d", len(spans))
+	}
+	for attempt, span := range spans[:2] {
+		if span.Name != "widgets things.list" || span.Parent.SpanID() != spans[2].SpanContext.SpanID() {
+			t.Errorf("attempt %d span is %q, parented to %v", attempt, span.Name, span.Parent.SpanID())
+		}
+		if attributeOf(span, "upstream").AsString() != "widgets" || attributeOf(span, "http.request.method").AsString() != "GET" ||
+			attributeOf(span, "url.path").AsString() != "/api/things.list" || attributeOf(span, "upstream.attempt").AsInt64() != int64(attempt) {
+			t.Errorf("attempt %d span has attributes %v", attempt, span.Attributes)
+		}
+	}
+	if attributeOf(spans[0], "http.response.status_code").AsInt64() != 503 || spans[0].Status.Code != codes.Error {
+		t.Errorf("failed attempt span has status %v and attributes %v", spans[0].Status, spans[0].Attributes)
+	}
+	if attributeOf(spans[1], "http.response.status_code").AsInt64() != 200 || spans[1].Status.Code == codes.Error {
+		t.Errorf("successful attempt span has status %v and attributes %v", spans[1].Status, spans[1].Attributes)
+	}
+}
+
+func TestRefusedCallsAreTraced(t *testing.T) {
+	exporter.Reset()
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client := New(Policy{Name: "widgets", Prefixes: []string{server.URL + "/"}, Timeout: time.Second, FailureThreshold: 1,
+		OpenDuration: time.Minute}).Client()
+
+	// The first failure opens the breaker, so the second call is refused without being sent
+	for i := 0; i < 2; i++ {
+		response, responseError := client.Post(server.URL+"/things.add", "text/plain", nil)
+		if responseError == nil {
+			response.Body.Close()
+		}
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected a span for each call, got %d", len(spans))
+	}
+	refused := spans[1]
+	if refused.Name != "widgets things.add" || refused.Status.Code != codes.Error || refused.Status.Description != ErrCircuitOpen.Error() {
+		t.Errorf("refused call span is %q with status %v", refused.Name, refused.Status)
+	}
+	if attributeOf(refused, "http.response.status_code").Type() != attribute.INVALID {
+		t.Errorf("refused call span has a status code, but nothing was sent")
+	}
+}
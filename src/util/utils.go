@@ -6,28 +6,30 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io/ioutil"
-	"log"
 	"math"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"rolflewis.com/spotify-status-sync/src/logging"
 )
 
-// Takes an error and handles logging it and reporting a 500. Returns true if error was non-nil
+// Takes an error and handles logging it and reporting a 500. The caller only gets a reference to the log line, never the
+// error itself. Returns true if error was non-nil
 func InternalError(err error, context *gin.Context) bool {
 	if err != nil {
-		log.Println(err.Error())
-		context.String(http.StatusInternalServerError, err.Error())
+		reference := logging.NewID()
+		logging.FromContext(context.Request.Context()).Error("Internal error", "reference", reference, "error", err)
+		context.String(http.StatusInternalServerError, "Something went wrong. Reference: "+reference)
 		return true
 	}
 	return false
 }
 
-// Ensures that a payload / message is directly from Slack and enforces several of their security methods
-func IsSecureFromSlack(context *gin.Context) bool {
+// Ensures that a payload / message is directly from Slack and enforces several of their security methods.
+// The signing key is the one from the Slack app's settings.
+func IsSecureFromSlack(context *gin.Context, signingKey string) bool {
 	version := "v0" // This is a slack constant currently
 	timestampString := context.GetHeader("X-Slack-Request-Timestamp")
 
@@ -54,7 +56,7 @@ func IsSecureFromSlack(context *gin.Context) bool {
 
 	// Compute signature and compare
 	totalString := version + ":" + strconv.FormatInt(timestamp, 10) + ":" + string(bodyBytes)
-	hasher := hmac.New(sha256.New, []byte(os.Getenv("SLACK_SIGNING_KEY")))
+	hasher := hmac.New(sha256.New, []byte(signingKey))
 	hasher.Write([]byte(totalString))
 	mySignature := "v0=" + hex.EncodeToString(hasher.Sum(nil))
 	providedSignature := context.GetHeader("X-Slack-Signature")